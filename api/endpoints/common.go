@@ -1,6 +1,9 @@
 package endpoints
 
 import (
+	"net/http"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
@@ -18,3 +21,12 @@ func Logger(log *logrus.Logger) gin.HandlerFunc {
 		}).Debug("request processed")
 	}
 }
+
+// WriteTimeout extends the server write timeout for the requests listing and deleting backups on storages,
+// they take longer than the metrics scrape the server timeout is set for
+func WriteTimeout(d time.Duration) gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		_ = http.NewResponseController(gc.Writer).SetWriteDeadline(time.Now().Add(d))
+		gc.Next()
+	}
+}
@@ -0,0 +1,279 @@
+package endpoints
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backup"
+	"github.com/nixys/nxs-backup/modules/catalog"
+	"github.com/nixys/nxs-backup/modules/logger"
+	"github.com/nixys/nxs-backup/modules/scheduler"
+)
+
+type V1Opts struct {
+	Token     string
+	EvCh      chan logger.LogRecord
+	Scheduler *scheduler.Scheduler
+	Jobs      map[string]interfaces.Job
+	JobGroups map[string]interfaces.Jobs
+}
+
+// V1 implements handlers of the /api/v1 endpoints
+type V1 struct {
+	token     string
+	evCh      chan logger.LogRecord
+	scheduler *scheduler.Scheduler
+	jobs      map[string]interfaces.Job
+	jobTags   map[string][]string
+}
+
+type jobSummary struct {
+	Name           string           `json:"name"`
+	Type           misc.BackupType  `json:"type"`
+	Tags           []string         `json:"tags,omitempty"`
+	Targets        []string         `json:"targets"`
+	Storages       []string         `json:"storages"`
+	SafetyBackup   bool             `json:"safety_backup"`
+	Schedule       *scheduleSummary `json:"schedule,omitempty"`
+	RotateSchedule *scheduleSummary `json:"rotate_schedule,omitempty"`
+}
+
+type scheduleSummary struct {
+	Cron    string    `json:"cron"`
+	Jitter  string    `json:"jitter,omitempty"`
+	NextRun time.Time `json:"next_run"`
+}
+
+type storageBackups struct {
+	Files []string `json:"files"`
+	Error string   `json:"error,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func NewV1(o V1Opts) *V1 {
+	tags := make(map[string][]string)
+	for tag, jobs := range o.JobGroups {
+		for _, job := range jobs {
+			tags[job.GetName()] = append(tags[job.GetName()], tag)
+		}
+	}
+	for _, t := range tags {
+		sort.Strings(t)
+	}
+
+	return &V1{
+		token:     o.Token,
+		evCh:      o.EvCh,
+		scheduler: o.Scheduler,
+		jobs:      o.Jobs,
+		jobTags:   tags,
+	}
+}
+
+// Auth checks the bearer token set by config, the requests are never let through without the token
+func (v *V1) Auth(gc *gin.Context) {
+	if v.token == "" || subtle.ConstantTimeCompare([]byte(gc.GetHeader("Authorization")), []byte("Bearer "+v.token)) != 1 {
+		gc.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse{Error: "unauthorized"})
+	}
+}
+
+// JobsList returns summaries of all jobs
+func (v *V1) JobsList(gc *gin.Context) {
+	jobs := make([]jobSummary, 0, len(v.jobs))
+	for _, job := range v.jobs {
+		jobs = append(jobs, v.jobSummary(job))
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+
+	gc.JSON(http.StatusOK, jobs)
+}
+
+// JobGet returns the job summary
+func (v *V1) JobGet(gc *gin.Context) {
+	job, ok := v.jobs[gc.Param("name")]
+	if !ok {
+		gc.JSON(http.StatusNotFound, errorResponse{Error: "job not found"})
+		return
+	}
+
+	gc.JSON(http.StatusOK, v.jobSummary(job))
+}
+
+// JobRun triggers the run of the job or jobs group
+func (v *V1) JobRun(gc *gin.Context) {
+	r, err := v.scheduler.Trigger(gc.Param("name"))
+	if err != nil {
+		errorJSON(gc, err)
+		return
+	}
+
+	gc.JSON(http.StatusAccepted, r)
+}
+
+// JobRotate triggers the rotation of the job or jobs group backups
+func (v *V1) JobRotate(gc *gin.Context) {
+	r, err := v.scheduler.TriggerRotate(gc.Param("name"))
+	if err != nil {
+		errorJSON(gc, err)
+		return
+	}
+
+	gc.JSON(http.StatusAccepted, r)
+}
+
+// BackupsList returns backups of the job per target and storage
+func (v *V1) BackupsList(gc *gin.Context) {
+	job, ok := v.jobs[gc.Param("name")]
+	if !ok {
+		gc.JSON(http.StatusNotFound, errorResponse{Error: "job not found"})
+		return
+	}
+
+	res := make(map[string]map[string]storageBackups)
+	for target, storages := range job.ListBackups() {
+		res[target] = make(map[string]storageBackups)
+		for stName, tf := range storages {
+			sb := storageBackups{Files: tf.List}
+			if sb.Files == nil {
+				sb.Files = []string{}
+			}
+			if tf.ListErr != nil {
+				sb.Error = tf.ListErr.Error()
+			}
+			res[target][stName] = sb
+		}
+	}
+
+	gc.JSON(http.StatusOK, res)
+}
+
+// BackupDelete deletes the backup file defined by `storage` and `path` query params.
+// The path has to be the same as returned by the backups list.
+func (v *V1) BackupDelete(gc *gin.Context) {
+	job, ok := v.jobs[gc.Param("name")]
+	if !ok {
+		gc.JSON(http.StatusNotFound, errorResponse{Error: "job not found"})
+		return
+	}
+
+	stName, filePath := gc.Query("storage"), gc.Query("path")
+	if stName == "" || filePath == "" {
+		gc.JSON(http.StatusBadRequest, errorResponse{Error: "`storage` and `path` query params are required"})
+		return
+	}
+
+	if err := backup.DeleteBackup(v.evCh, job, stName, filePath); err != nil {
+		errorJSON(gc, err)
+		return
+	}
+
+	gc.Status(http.StatusNoContent)
+}
+
+// CatalogList returns the job backups recorded in the catalog.
+// The records can be filtered by `target`, `storage` and `success` query params.
+func (v *V1) CatalogList(gc *gin.Context) {
+	job, ok := v.jobs[gc.Param("name")]
+	if !ok {
+		gc.JSON(http.StatusNotFound, errorResponse{Error: "job not found"})
+		return
+	}
+	if job.GetCatalog() == nil {
+		gc.JSON(http.StatusNotFound, errorResponse{Error: "backups catalog is disabled"})
+		return
+	}
+
+	records, err := job.GetCatalog().Find(catalog.Query{
+		Job:         job.GetName(),
+		Ofs:         gc.Query("target"),
+		Storage:     gc.Query("storage"),
+		SuccessOnly: gc.Query("success") == "true",
+	})
+	if err != nil {
+		errorJSON(gc, err)
+		return
+	}
+	if records == nil {
+		records = []catalog.Record{}
+	}
+
+	gc.JSON(http.StatusOK, records)
+}
+
+// RunsList returns runs history without logs
+func (v *V1) RunsList(gc *gin.Context) {
+	gc.JSON(http.StatusOK, v.scheduler.GetRuns())
+}
+
+// RunGet returns the run status with logs
+func (v *V1) RunGet(gc *gin.Context) {
+	id, err := strconv.Atoi(gc.Param("id"))
+	if err != nil {
+		gc.JSON(http.StatusBadRequest, errorResponse{Error: "wrong run id"})
+		return
+	}
+
+	r, err := v.scheduler.GetRun(id)
+	if err != nil {
+		errorJSON(gc, err)
+		return
+	}
+
+	gc.JSON(http.StatusOK, r)
+}
+
+func (v *V1) jobSummary(job interfaces.Job) jobSummary {
+	js := jobSummary{
+		Name:         job.GetName(),
+		Type:         job.GetType(),
+		Tags:         v.jobTags[job.GetName()],
+		Targets:      job.GetTargetOfsList(),
+		Storages:     []string{},
+		SafetyBackup: job.IsBackupSafety(),
+	}
+	for _, st := range job.GetStorages() {
+		js.Storages = append(js.Storages, st.GetName())
+	}
+	if sch, next, ok := v.scheduler.GetSchedule(job.GetName()); ok {
+		js.Schedule = newScheduleSummary(sch, next)
+	}
+	if sch, next, ok := v.scheduler.GetRotateSchedule(job.GetName()); ok {
+		js.RotateSchedule = newScheduleSummary(sch, next)
+	}
+
+	return js
+}
+
+func newScheduleSummary(sch scheduler.Schedule, next time.Time) *scheduleSummary {
+	ss := &scheduleSummary{
+		Cron:    sch.Cron,
+		NextRun: next,
+	}
+	if sch.Jitter > 0 {
+		ss.Jitter = sch.Jitter.String()
+	}
+	return ss
+}
+
+func errorJSON(gc *gin.Context, err error) {
+	code := http.StatusInternalServerError
+	if errors.Is(err, misc.ErrNotFound) {
+		code = http.StatusNotFound
+	} else if errors.Is(err, misc.ErrPinned) {
+		code = http.StatusConflict
+	} else if errors.Is(err, misc.ErrNotSupported) {
+		code = http.StatusBadRequest
+	}
+	gc.JSON(code, errorResponse{Error: err.Error()})
+}
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -9,7 +11,10 @@ import (
 	"github.com/nixys/nxs-backup/api/endpoints"
 )
 
-func RoutesSet(log *logrus.Logger, reg *prometheus.Registry) *gin.Engine {
+// apiWriteTimeout is the time the API response may take, the storages are listed by the requests
+const apiWriteTimeout = 10 * time.Minute
+
+func RoutesSet(log *logrus.Logger, reg *prometheus.Registry, v1 *endpoints.V1) *gin.Engine {
 
 	gin.SetMode(gin.ReleaseMode)
 
@@ -26,5 +31,23 @@ func RoutesSet(log *logrus.Logger, reg *prometheus.Registry) *gin.Engine {
 		),
 	))
 
+	// the API runs and deletes backups, so it's mounted only with the token set
+	if v1 == nil {
+		return router
+	}
+
+	apiV1 := router.Group("/api/v1", endpoints.WriteTimeout(apiWriteTimeout), v1.Auth)
+	{
+		apiV1.GET("/jobs", v1.JobsList)
+		apiV1.GET("/jobs/:name", v1.JobGet)
+		apiV1.POST("/jobs/:name/run", v1.JobRun)
+		apiV1.POST("/jobs/:name/rotate", v1.JobRotate)
+		apiV1.GET("/jobs/:name/backups", v1.BackupsList)
+		apiV1.DELETE("/jobs/:name/backups", v1.BackupDelete)
+		apiV1.GET("/jobs/:name/catalog", v1.CatalogList)
+		apiV1.GET("/runs", v1.RunsList)
+		apiV1.GET("/runs/:id", v1.RunGet)
+	}
+
 	return router
 }
@@ -13,13 +13,21 @@ import (
 type command string
 
 const (
-	start     command = "start"
-	server    command = "server"
-	generate  command = "generate"
-	update    command = "update"
-	lsBackups command = "ls_backups"
-	testCfg   command = "test_cfg"
-	unknown   command = "unknown"
+	start      command = "start"
+	server     command = "server"
+	generate   command = "generate"
+	update     command = "update"
+	lsBackups  command = "ls_backups"
+	testCfg    command = "test_cfg"
+	restore    command = "restore"
+	verify     command = "verify"
+	syncBak    command = "sync"
+	catRebuild command = "catalog_rebuild"
+	rotate     command = "rotate"
+	pin        command = "pin"
+	unpin      command = "unpin"
+	lsPins     command = "ls_pins"
+	unknown    command = "unknown"
 )
 
 // ArgsParams contains parameters read from command line, command parameters and command handler
@@ -32,6 +40,8 @@ type ArgsParams struct {
 
 type StartCmd struct {
 	JobName string `arg:"positional" help:"Name of job or jobs group to run [default: all]" default:"all" placeholder:"JOB_NAME/GROUP_NAME"`
+	DryRun  bool   `arg:"--dry-run" help:"Print backups the rotation would delete without making backups and changing storages"`
+	JSON    bool   `arg:"--json" help:"Print the dry run rotation plan as JSON"`
 }
 
 // ServerCmd "Running the nxs-backup in server mode"
@@ -44,7 +54,65 @@ type GenerateCmd struct {
 }
 
 type ListCmd struct {
-	Backups *StartCmd `arg:"subcommand:backups"`
+	Backups *ListBackupsCmd `arg:"subcommand:backups"`
+	Pins    *ListPinsCmd    `arg:"subcommand:pins"`
+}
+
+type ListBackupsCmd struct {
+	JobName string `arg:"positional" help:"Name of job or jobs group to list backups of [default: all]" default:"all" placeholder:"JOB_NAME/GROUP_NAME"`
+	Catalog bool   `arg:"--catalog" help:"Read backups from the catalog instead of listing storages"`
+}
+
+type ListPinsCmd struct {
+	JobName string `arg:"positional" help:"Name of job or jobs group to list pinned backups of [default: all]" default:"all" placeholder:"JOB_NAME/GROUP_NAME"`
+}
+
+type RestoreCmd struct {
+	JobName    string `arg:"positional,required" help:"Name of job to restore" placeholder:"JOB_NAME"`
+	Target     string `arg:"positional,required" help:"Name of job target to restore (database, collection or files path as shown by 'ls backups')" placeholder:"TARGET"`
+	Storage    string `arg:"-s,--storage" help:"Name of storage to get backup from [default: local or first configured]" placeholder:"STORAGE_NAME"`
+	Date       string `arg:"-d,--date" help:"Restore the latest backup created before the date. Format: 2006-01-02 or 2006-01-02_15-04 [default: now]" placeholder:"DATE"`
+	Dst        string `arg:"-D,--dst" help:"Restore destination. Directory for files and physical backups, database name for logical backups, file for redis" placeholder:"DESTINATION"`
+	Catalog    bool   `arg:"--catalog" help:"Look up backups in the catalog instead of listing the storage"`
+	FullBackup string `arg:"--full-backup" help:"File name of the restored full backup the binlogs replay starts from, binlog jobs only [default: the only latest backup of the server before the date]" placeholder:"FILE_NAME"`
+}
+
+type VerifyCmd struct {
+	JobName string `arg:"positional" help:"Name of job or jobs group to verify backups of [default: all]" default:"all" placeholder:"JOB_NAME/GROUP_NAME"`
+}
+
+type SyncCmd struct {
+	JobName string `arg:"positional" help:"Name of job or jobs group to sync backups of [default: all]" default:"all" placeholder:"JOB_NAME/GROUP_NAME"`
+	From    string `arg:"--from,required" help:"Name of storage to copy backups from" placeholder:"STORAGE_NAME"`
+	To      string `arg:"--to,required" help:"Name of storage to copy backups to" placeholder:"STORAGE_NAME"`
+	Prune   bool   `arg:"--prune" help:"Delete backups missing on the source storage from the target one"`
+}
+
+type CatalogCmd struct {
+	Rebuild *CatalogRebuildCmd `arg:"subcommand:rebuild"`
+}
+
+type CatalogRebuildCmd struct {
+	JobName string `arg:"positional" help:"Name of job or jobs group to rebuild catalog records of [default: all]" default:"all" placeholder:"JOB_NAME/GROUP_NAME"`
+}
+
+type RotateCmd struct {
+	JobName string `arg:"positional" help:"Name of job or jobs group to rotate backups of [default: all]" default:"all" placeholder:"JOB_NAME/GROUP_NAME"`
+	DryRun  bool   `arg:"--dry-run" help:"Print backups the rotation would delete without changing storages"`
+	JSON    bool   `arg:"--json" help:"Print the dry run rotation plan as JSON"`
+}
+
+// PinCmd defines the backup pinned or unpinned, the pinned backups are never deleted by the rotation
+type PinCmd struct {
+	JobName string `arg:"positional,required" help:"Name of job the backup belongs to" placeholder:"JOB_NAME"`
+	Target  string `arg:"positional,required" help:"Name of job target the backup belongs to (as shown by 'ls backups')" placeholder:"TARGET"`
+	File    string `arg:"positional,required" help:"Name of backup file (as shown by 'ls backups')" placeholder:"BACKUP_FILE"`
+	Storage string `arg:"-s,--storage" help:"Name of storage the backup is pinned on [default: all storages of job]" placeholder:"STORAGE_NAME"`
+}
+
+// TestCfgCmd contains parameters of the configuration check
+type TestCfgCmd struct {
+	ProbeStorages bool
 }
 
 type UpdateCmd struct {
@@ -57,8 +125,16 @@ type args struct {
 	Generate *GenerateCmd `arg:"subcommand:generate"`
 	Update   *UpdateCmd   `arg:"subcommand:update"`
 	List     *ListCmd     `arg:"subcommand:ls"`
+	Restore  *RestoreCmd  `arg:"subcommand:restore"`
+	Verify   *VerifyCmd   `arg:"subcommand:verify"`
+	Sync     *SyncCmd     `arg:"subcommand:sync"`
+	Catalog  *CatalogCmd  `arg:"subcommand:catalog"`
+	Rotate   *RotateCmd   `arg:"subcommand:rotate"`
+	Pin      *PinCmd      `arg:"subcommand:pin"`
+	Unpin    *PinCmd      `arg:"subcommand:unpin"`
 	ConfPath string       `arg:"-c,--config" help:"Path to config file" default:"/etc/nxs-backup/nxs-backup.conf" placeholder:"PATH"`
 	TestConf bool         `arg:"-t,--test-config" help:"Check if configuration correct"`
+	Probe    bool         `arg:"--probe-storages" help:"Check connection to storages and access to backup paths in addition to the configuration check"`
 }
 
 // ReadArgs reads arguments from command line
@@ -72,8 +148,14 @@ func ReadArgs() (p ArgsParams, err error) {
 
 	if a.TestConf {
 		p.Cmd = testCfg
+		p.CmdParams = &TestCfgCmd{ProbeStorages: a.Probe}
 		return
 	}
+	if a.Probe {
+		_, _ = fmt.Fprintln(os.Stderr, "Option --probe-storages can be used only with --test-config")
+		curArgs.WriteHelp(os.Stderr)
+		return p, misc.ErrArg
+	}
 
 	subCmds := curArgs.SubcommandNames()
 	if len(subCmds) == 0 {
@@ -113,6 +195,22 @@ func getCmd(argCmd string) command {
 		return lsBackups
 	case testCfg:
 		return testCfg
+	case restore:
+		return restore
+	case verify:
+		return verify
+	case syncBak:
+		return syncBak
+	case catRebuild:
+		return catRebuild
+	case rotate:
+		return rotate
+	case pin:
+		return pin
+	case unpin:
+		return unpin
+	case lsPins:
+		return lsPins
 	default:
 		return unknown
 	}
@@ -24,8 +24,9 @@ type ConfOpts struct {
 	IncludeCfgs     []string             `conf:"include_jobs_configs"`
 	WaitingTimeout  time.Duration        `conf:"waiting_timeout"`
 
-	Server serverConf  `conf:"server"`
-	Limits *limitsConf `conf:"limits" conf_extraopts:"default={}"`
+	Server  serverConf  `conf:"server"`
+	Catalog catalogConf `conf:"catalog"`
+	Limits  *limitsConf `conf:"limits" conf_extraopts:"default={}"`
 
 	LogFile  string `conf:"logfile" conf_extraopts:"default=stdout"`
 	LogLevel string `conf:"loglevel" conf_extraopts:"default=info"`
@@ -33,14 +34,16 @@ type ConfOpts struct {
 }
 
 type limitsConf struct {
-	DiskRate *string `conf:"disk_rate"`
-	NetRate  *string `conf:"net_rate"`
-	CPUCount *int    `conf:"cpu_max_count"`
+	DiskRate        *string `conf:"disk_rate"`
+	NetRate         *string `conf:"net_rate"`
+	CPUCount        *int    `conf:"cpu_max_count"`
+	MaxParallelJobs *int    `conf:"max_parallel_jobs"`
 }
 
 type serverConf struct {
-	Bind    string      `conf:"bind" conf_extraopts:"default=:7979"`
-	Metrics metricsConf `conf:"metrics"`
+	Bind     string      `conf:"bind" conf_extraopts:"default=:7979"`
+	APIToken string      `conf:"api_token"`
+	Metrics  metricsConf `conf:"metrics"`
 }
 
 type metricsConf struct {
@@ -48,6 +51,11 @@ type metricsConf struct {
 	FilePath string `conf:"metrics_file_path" conf_extraopts:"default=/tmp/nxs-backup.metrics"`
 }
 
+type catalogConf struct {
+	Enabled  bool   `conf:"enabled" conf_extraopts:"default=true"`
+	FilePath string `conf:"file_path" conf_extraopts:"default=/var/lib/nxs-backup/catalog.db"`
+}
+
 type notificationsConf struct {
 	Mail     mailConf      `conf:"mail"`
 	Webhooks []webhookConf `conf:"webhooks"`
@@ -75,17 +83,42 @@ type webhookConf struct {
 }
 
 type jobConf struct {
-	SafetyBackup     bool            `conf:"safety_backup" conf_extraopts:"default=false"`
-	DeferredCopying  bool            `conf:"deferred_copying" conf_extraopts:"default=false"`
-	SkipBackupRotate bool            `conf:"skip_backup_rotate" conf_extraopts:"default=false"` // deprecated, used by external
-	Gzip             bool            `conf:"gzip" conf_extraopts:"default=false"`
-	Name             string          `conf:"job_name" conf_extraopts:"required"`
-	DumpCmd          string          `conf:"dump_cmd"` // used by external
-	TmpDir           string          `conf:"tmp_dir"`
-	Type             misc.BackupType `conf:"type" conf_extraopts:"required"`
-	Limits           *limitsConf     `conf:"limits"`
-	Sources          []sourceConf    `conf:"sources"`
-	StoragesOptions  []storageConf   `conf:"storages_options"`
+	SafetyBackup        bool             `conf:"safety_backup" conf_extraopts:"default=false"`
+	DeferredCopying     bool             `conf:"deferred_copying" conf_extraopts:"default=false"`
+	Streaming           bool             `conf:"streaming" conf_extraopts:"default=false"`
+	DeliveryConcurrency int              `conf:"delivery_concurrency" conf_extraopts:"default=1"`
+	SkipBackupRotate    bool             `conf:"skip_backup_rotate" conf_extraopts:"default=false"` // deprecated, used by external
+	Gzip                bool             `conf:"gzip" conf_extraopts:"default=false"`               // deprecated, use compression
+	Compression         *compressionConf `conf:"compression"`
+	Name                string           `conf:"job_name" conf_extraopts:"required"`
+	DumpCmd             string           `conf:"dump_cmd"` // used by external
+	TmpDir              string           `conf:"tmp_dir"`
+	Type                misc.BackupType  `conf:"type" conf_extraopts:"required"`
+	Tags                []string         `conf:"tags"`
+	Schedule            *scheduleConf    `conf:"schedule"`
+	RotateSchedule      *scheduleConf    `conf:"rotate_schedule"`
+	Limits              *limitsConf      `conf:"limits"`
+	Encryption          *encryptionConf  `conf:"encryption"`
+	Sources             []sourceConf     `conf:"sources"`
+	StoragesOptions     []storageConf    `conf:"storages_options"`
+}
+
+type scheduleConf struct {
+	Cron   string        `conf:"cron"`
+	Jitter time.Duration `conf:"jitter" conf_extraopts:"default=0"`
+}
+
+type compressionConf struct {
+	Algo    string `conf:"algo" conf_extraopts:"default=zstd"`
+	Level   int    `conf:"level" conf_extraopts:"default=0"`
+	Threads int    `conf:"threads" conf_extraopts:"default=0"`
+}
+
+type encryptionConf struct {
+	Algo         string   `conf:"algo" conf_extraopts:"default=age"`
+	Recipients   []string `conf:"recipients"`
+	IdentityFile string   `conf:"identity_file"`
+	KeyFile      string   `conf:"key_file"`
 }
 
 type sourceConf struct {
@@ -98,7 +131,8 @@ type sourceConf struct {
 	ExcludeDBs         []string          `conf:"exclude_dbs"`
 	ExcludeCollections []string          `conf:"exclude_collections"`
 	ExtraKeys          string            `conf:"db_extra_keys"`
-	Gzip               *bool             `conf:"gzip" conf_extraopts:"default=false"`
+	Gzip               *bool             `conf:"gzip" conf_extraopts:"default=false"` // deprecated, use compression
+	Compression        *compressionConf  `conf:"compression"`
 	IsSlave            bool              `conf:"is_slave" conf_extraopts:"default=false"`
 	SaveAbsPath        bool              `conf:"save_abs_path" conf_extraopts:"default=true"`
 	PrepareXtrabackup  bool              `conf:"prepare_xtrabackup" conf_extraopts:"default=false"`
@@ -131,15 +165,21 @@ type storageConf struct {
 }
 
 type retentionConf struct {
-	Days     int  `conf:"days" conf_extraopts:"default=7"`
-	Weeks    int  `conf:"weeks" conf_extraopts:"default=5"`
-	Months   int  `conf:"months" conf_extraopts:"default=12"`
-	UseCount bool `conf:"count_instead_of_period" conf_extraopts:"default=false"`
+	Days         int    `conf:"days" conf_extraopts:"default=7"`
+	Weeks        int    `conf:"weeks" conf_extraopts:"default=5"`
+	Months       int    `conf:"months" conf_extraopts:"default=12"`
+	Years        int    `conf:"years" conf_extraopts:"default=0"`
+	UseCount     bool   `conf:"count_instead_of_period" conf_extraopts:"default=false"`
+	WeeklyDay    int    `conf:"weekly_day" conf_extraopts:"default=0"`
+	MonthlyDay   int    `conf:"monthly_day" conf_extraopts:"default=1"`
+	YearlyDay    string `conf:"yearly_day" conf_extraopts:"default=01-01"`
+	MaxTotalSize string `conf:"max_total_size"`
 }
 
 type storageConnectConf struct {
 	Name         string          `conf:"name" conf_extraopts:"required"`
 	RateLimit    *string         `conf:"rate_limit"`
+	Retry        *retryConf      `conf:"retry"`
 	S3Params     *s3ConnConf     `conf:"s3_params"`
 	ScpParams    *sftpConnConf   `conf:"scp_params"`
 	SftpParams   *sftpConnConf   `conf:"sftp_params"`
@@ -147,6 +187,15 @@ type storageConnectConf struct {
 	NfsParams    *nfsConnConf    `conf:"nfs_params"`
 	WebDavParams *webDavConnConf `conf:"webdav_params"`
 	SmbParams    *smbConnConf    `conf:"smb_params"`
+	AzureParams  *azureConnConf  `conf:"azure_params"`
+	GcsParams    *gcsConnConf    `conf:"gcs_params"`
+	ExecParams   *execConnConf   `conf:"exec_params"`
+}
+
+type retryConf struct {
+	Attempts     int           `conf:"attempts" conf_extraopts:"default=3"`
+	InitialDelay time.Duration `conf:"initial_delay" conf_extraopts:"default=10"`
+	MaxDelay     time.Duration `conf:"max_delay" conf_extraopts:"default=300"`
 }
 
 type s3ConnConf struct {
@@ -157,6 +206,29 @@ type s3ConnConf struct {
 	Region        string `conf:"region" conf_extraopts:"required"`
 	BatchDeletion bool   `conf:"batch_deletion" conf_extraopts:"default=true"`
 	Secure        bool   `conf:"secure" conf_extraopts:"default=true"`
+
+	ServerSideEncryption *s3SSEConf           `conf:"server_side_encryption"`
+	StorageClass         string               `conf:"storage_class"`
+	PeriodStorageClasses *s3PeriodClassesConf `conf:"period_storage_classes"`
+	Tagging              bool                 `conf:"tagging" conf_extraopts:"default=false"`
+	ObjectLock           *s3ObjectLockConf    `conf:"object_lock"`
+}
+
+type s3SSEConf struct {
+	Type            string `conf:"type" conf_extraopts:"required"`
+	KmsKeyID        string `conf:"kms_key_id"`
+	CustomerKeyFile string `conf:"customer_key_file"`
+}
+
+type s3PeriodClassesConf struct {
+	Daily   string `conf:"daily"`
+	Weekly  string `conf:"weekly"`
+	Monthly string `conf:"monthly"`
+	Yearly  string `conf:"yearly"`
+}
+
+type s3ObjectLockConf struct {
+	Mode string `conf:"mode" conf_extraopts:"required"`
 }
 
 type sftpConnConf struct {
@@ -202,6 +274,30 @@ type smbConnConf struct {
 	ConnectionTimeout time.Duration `conf:"connection_timeout" conf_extraopts:"default=10"`
 }
 
+type azureConnConf struct {
+	AccountName             string `conf:"account_name" conf_extraopts:"required"`
+	Container               string `conf:"container" conf_extraopts:"required"`
+	AccountKey              string `conf:"account_key"`
+	SASToken                string `conf:"sas_token"`
+	Endpoint                string `conf:"endpoint"`
+	ManagedIdentity         bool   `conf:"managed_identity" conf_extraopts:"default=false"`
+	ManagedIdentityClientID string `conf:"managed_identity_client_id"`
+}
+
+type gcsConnConf struct {
+	BucketName      string `conf:"bucket_name" conf_extraopts:"required"`
+	CredentialsFile string `conf:"credentials_file"`
+	Endpoint        string `conf:"endpoint"`
+	BatchDeletion   bool   `conf:"batch_deletion" conf_extraopts:"default=true"`
+}
+
+type execConnConf struct {
+	Command        string        `conf:"command" conf_extraopts:"required"`
+	Args           []string      `conf:"args"`
+	Env            []string      `conf:"env"`
+	RequestTimeout time.Duration `conf:"request_timeout" conf_extraopts:"default=3600"`
+}
+
 func readConfig(confPath string) (ConfOpts, error) {
 
 	var c ConfOpts
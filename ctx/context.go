@@ -17,13 +17,23 @@ import (
 
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backup"
+	"github.com/nixys/nxs-backup/modules/catalog"
 	"github.com/nixys/nxs-backup/modules/cmd_handler/api_server"
 	"github.com/nixys/nxs-backup/modules/cmd_handler/generate_config"
+	"github.com/nixys/nxs-backup/modules/cmd_handler/list_pins"
+	"github.com/nixys/nxs-backup/modules/cmd_handler/pin_backup"
+	"github.com/nixys/nxs-backup/modules/cmd_handler/rebuild_catalog"
+	"github.com/nixys/nxs-backup/modules/cmd_handler/restore_backup"
+	"github.com/nixys/nxs-backup/modules/cmd_handler/rotate_backups"
 	"github.com/nixys/nxs-backup/modules/cmd_handler/self_update"
 	"github.com/nixys/nxs-backup/modules/cmd_handler/start_backup"
+	"github.com/nixys/nxs-backup/modules/cmd_handler/sync_backups"
 	"github.com/nixys/nxs-backup/modules/cmd_handler/test_config"
+	"github.com/nixys/nxs-backup/modules/cmd_handler/verify_backup"
 	"github.com/nixys/nxs-backup/modules/logger"
 	"github.com/nixys/nxs-backup/modules/metrics"
+	"github.com/nixys/nxs-backup/modules/scheduler"
 )
 
 // Ctx defines application custom context
@@ -37,14 +47,23 @@ type Ctx struct {
 }
 
 type app struct {
-	waitTimeout time.Duration
-	jobs        map[string]interfaces.Job
-	fileJobs    interfaces.Jobs
-	dbJobs      interfaces.Jobs
-	extJobs     interfaces.Jobs
-	initErrs    *multierror.Error
-	metricsData *metrics.Data
-	serverBind  string
+	waitTimeout     time.Duration
+	maxParallelJobs int
+	jobs            map[string]interfaces.Job
+	jobGroups       map[string]interfaces.Jobs
+	jobLocks        map[string][]string
+	schedules       []scheduler.Schedule
+	rotateSchedules []scheduler.Schedule
+	fileJobs        interfaces.Jobs
+	dbJobs          interfaces.Jobs
+	extJobs         interfaces.Jobs
+	initErrs        *multierror.Error
+	storageTargets  []test_config.StorageTarget
+	rawStorages     map[string]map[string]interfaces.Storage
+	metricsData     *metrics.Data
+	catalog         *catalog.Catalog
+	serverBind      string
+	apiToken        string
 }
 
 func AppCtxInit() (any, error) {
@@ -98,6 +117,9 @@ func AppCtxInit() (any, error) {
 				FileJobs: a.fileJobs,
 				DBJobs:   a.dbJobs,
 				ExtJobs:  a.extJobs,
+
+				ProbeStorages:  ra.CmdParams.(*TestCfgCmd).ProbeStorages,
+				StorageTargets: a.storageTargets,
 			},
 		)
 	case lsBackups:
@@ -105,15 +127,32 @@ func AppCtxInit() (any, error) {
 		if err != nil {
 			return nil, err
 		}
+		lc := ra.CmdParams.(*ListBackupsCmd)
 		c.Cmd = list_backups.Init(
 			list_backups.Opts{
-				InitErr:  a.initErrs.ErrorOrNil(),
-				Done:     c.Done,
-				JobName:  ra.CmdParams.(*StartCmd).JobName,
-				FileJobs: a.fileJobs,
-				DBJobs:   a.dbJobs,
-				ExtJobs:  a.extJobs,
-				Jobs:     a.jobs,
+				InitErr:     a.initErrs.ErrorOrNil(),
+				Done:        c.Done,
+				JobName:     lc.JobName,
+				FileJobs:    a.fileJobs,
+				DBJobs:      a.dbJobs,
+				ExtJobs:     a.extJobs,
+				Jobs:        a.jobs,
+				FromCatalog: lc.Catalog,
+			},
+		)
+	case lsPins:
+		a, err := appInit(c, ra.ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		c.Cmd = list_pins.Init(
+			list_pins.Opts{
+				InitErr:   a.initErrs.ErrorOrNil(),
+				Done:      c.Done,
+				JobName:   ra.CmdParams.(*ListPinsCmd).JobName,
+				Catalog:   a.catalog,
+				Jobs:      a.jobs,
+				JobGroups: a.jobGroups,
 			},
 		)
 	case start:
@@ -123,16 +162,147 @@ func AppCtxInit() (any, error) {
 		}
 		c.Cmd = start_backup.Init(
 			start_backup.Opts{
+				InitErr:         a.initErrs.ErrorOrNil(),
+				Done:            c.Done,
+				EvCh:            c.EventCh,
+				WaitPrev:        a.waitTimeout,
+				JobName:         ra.CmdParams.(*StartCmd).JobName,
+				MaxParallelJobs: a.maxParallelJobs,
+				Jobs:            a.jobs,
+				JobGroups:       a.jobGroups,
+				JobLocks:        a.jobLocks,
+				FileJobs:        a.fileJobs,
+				DBJobs:          a.dbJobs,
+				ExtJobs:         a.extJobs,
+				MetricsData:     a.metricsData,
+				DryRun:          ra.CmdParams.(*StartCmd).DryRun,
+				JSON:            ra.CmdParams.(*StartCmd).JSON,
+			},
+		)
+	case restore:
+		a, err := appInit(c, ra.ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		rc := ra.CmdParams.(*RestoreCmd)
+		c.Cmd = restore_backup.Init(
+			restore_backup.Opts{
+				InitErr:     a.initErrs.ErrorOrNil(),
+				Done:        c.Done,
+				EvCh:        c.EventCh,
+				JobName:     rc.JobName,
+				Target:      rc.Target,
+				Storage:     rc.Storage,
+				Date:        rc.Date,
+				Dst:         rc.Dst,
+				Jobs:        a.jobs,
+				FromCatalog: rc.Catalog,
+				FullBackup:  rc.FullBackup,
+			},
+		)
+	case verify:
+		a, err := appInit(c, ra.ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		c.Cmd = verify_backup.Init(
+			verify_backup.Opts{
+				InitErr:     a.initErrs.ErrorOrNil(),
+				Done:        c.Done,
+				EvCh:        c.EventCh,
+				JobName:     ra.CmdParams.(*VerifyCmd).JobName,
+				Jobs:        a.jobs,
+				FileJobs:    a.fileJobs,
+				DBJobs:      a.dbJobs,
+				ExtJobs:     a.extJobs,
+				JobStorages: a.rawStorages,
+			},
+		)
+	case syncBak:
+		a, err := appInit(c, ra.ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		sc := ra.CmdParams.(*SyncCmd)
+		c.Cmd = sync_backups.Init(
+			sync_backups.Opts{
 				InitErr:     a.initErrs.ErrorOrNil(),
 				Done:        c.Done,
 				EvCh:        c.EventCh,
 				WaitPrev:    a.waitTimeout,
-				JobName:     ra.CmdParams.(*StartCmd).JobName,
+				JobName:     sc.JobName,
+				From:        sc.From,
+				To:          sc.To,
+				Prune:       sc.Prune,
 				Jobs:        a.jobs,
 				FileJobs:    a.fileJobs,
 				DBJobs:      a.dbJobs,
 				ExtJobs:     a.extJobs,
-				MetricsData: a.metricsData,
+				JobStorages: a.rawStorages,
+			},
+		)
+	case catRebuild:
+		a, err := appInit(c, ra.ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		c.Cmd = rebuild_catalog.Init(
+			rebuild_catalog.Opts{
+				InitErr:  a.initErrs.ErrorOrNil(),
+				Done:     c.Done,
+				EvCh:     c.EventCh,
+				WaitPrev: a.waitTimeout,
+				JobName:  ra.CmdParams.(*CatalogRebuildCmd).JobName,
+				Catalog:  a.catalog,
+				Jobs:     a.jobs,
+				FileJobs: a.fileJobs,
+				DBJobs:   a.dbJobs,
+				ExtJobs:  a.extJobs,
+			},
+		)
+	case rotate:
+		a, err := appInit(c, ra.ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		rc := ra.CmdParams.(*RotateCmd)
+		c.Cmd = rotate_backups.Init(
+			rotate_backups.Opts{
+				InitErr:         a.initErrs.ErrorOrNil(),
+				Done:            c.Done,
+				EvCh:            c.EventCh,
+				WaitPrev:        a.waitTimeout,
+				JobName:         rc.JobName,
+				DryRun:          rc.DryRun,
+				JSON:            rc.JSON,
+				MaxParallelJobs: a.maxParallelJobs,
+				Jobs:            a.jobs,
+				JobGroups:       a.jobGroups,
+				JobLocks:        a.jobLocks,
+				FileJobs:        a.fileJobs,
+				DBJobs:          a.dbJobs,
+				ExtJobs:         a.extJobs,
+				MetricsData:     a.metricsData,
+			},
+		)
+	case pin, unpin:
+		a, err := appInit(c, ra.ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		pc := ra.CmdParams.(*PinCmd)
+		c.Cmd = pin_backup.Init(
+			pin_backup.Opts{
+				InitErr:  a.initErrs.ErrorOrNil(),
+				Done:     c.Done,
+				EvCh:     c.EventCh,
+				WaitPrev: a.waitTimeout,
+				JobName:  pc.JobName,
+				Target:   pc.Target,
+				File:     pc.File,
+				Storage:  pc.Storage,
+				Unpin:    ra.Cmd == unpin,
+				Jobs:     a.jobs,
 			},
 		)
 	case server:
@@ -145,11 +315,33 @@ func AppCtxInit() (any, error) {
 			printInitError("Init err:\n%s", err)
 			return nil, err
 		}
+		sched := scheduler.Init(
+			scheduler.Opts{
+				EvCh:            c.EventCh,
+				WaitPrev:        a.waitTimeout,
+				Runner:          backup.NewRunner(a.maxParallelJobs, a.jobLocks),
+				MetricsData:     a.metricsData,
+				Schedules:       a.schedules,
+				RotateSchedules: a.rotateSchedules,
+				Jobs:            a.jobs,
+				JobGroups:       a.jobGroups,
+				FileJobs:        a.fileJobs,
+				DBJobs:          a.dbJobs,
+				ExtJobs:         a.extJobs,
+			},
+		)
 		c.Cmd, err = api_server.Init(
 			api_server.Opts{
+				InitErr:        a.initErrs.ErrorOrNil(),
 				Bind:           a.serverBind,
+				APIToken:       a.apiToken,
 				MetricFilePath: a.metricsData.MetricFilePath(),
+				MetricsData:    a.metricsData,
+				Scheduler:      sched,
+				Jobs:           a.jobs,
+				JobGroups:      a.jobGroups,
 				Log:            c.Log,
+				EvCh:           c.EventCh,
 				Done:           c.Done,
 			},
 		)
@@ -172,7 +364,8 @@ func printInitError(ft string, err error) {
 func appInit(c *Ctx, cfgPath string) (app, error) {
 
 	a := app{
-		jobs: make(map[string]interfaces.Job),
+		jobs:            make(map[string]interfaces.Job),
+		maxParallelJobs: 1,
 	}
 
 	conf, err := readConfig(cfgPath)
@@ -183,6 +376,7 @@ func appInit(c *Ctx, cfgPath string) (app, error) {
 
 	a.waitTimeout = conf.WaitingTimeout
 	a.serverBind = conf.Server.Bind
+	a.apiToken = conf.Server.APIToken
 
 	a.metricsData = metrics.InitData(
 		metrics.DataOpts{
@@ -204,6 +398,10 @@ func appInit(c *Ctx, cfgPath string) (app, error) {
 		a.metricsData.Enabled = true
 	}
 
+	if conf.Catalog.Enabled {
+		a.catalog = catalog.Init(conf.Catalog.FilePath)
+	}
+
 	if err = logInit(c, conf.LogFile, conf.LogLevel); err != nil {
 		printInitError("Failed to init log file: %v\n", err)
 		return a, err
@@ -229,6 +427,13 @@ func appInit(c *Ctx, cfgPath string) (app, error) {
 		if conf.Limits.CPUCount != nil {
 			misc.CPULimit = *conf.Limits.CPUCount
 		}
+		if conf.Limits.MaxParallelJobs != nil {
+			if *conf.Limits.MaxParallelJobs < 1 {
+				a.initErrs = multierror.Append(a.initErrs, fmt.Errorf("Wrong `max_parallel_jobs` value %d, jobs will be run one by one ", *conf.Limits.MaxParallelJobs))
+			} else {
+				a.maxParallelJobs = *conf.Limits.MaxParallelJobs
+			}
+		}
 	}
 
 	// Init app
@@ -237,11 +442,14 @@ func appInit(c *Ctx, cfgPath string) (app, error) {
 		a.initErrs = multierror.Append(a.initErrs, err.(*multierror.Error).WrappedErrors()...)
 	}
 
+	a.storageTargets = storageTargetsInit(conf, storages)
+
 	jobs, err := jobsInit(
 		jobsOpts{
 			jobs:        conf.Jobs,
 			storages:    storages,
 			metricsData: a.metricsData,
+			catalog:     a.catalog,
 			mainLim:     lim,
 		},
 	)
@@ -253,7 +461,7 @@ func appInit(c *Ctx, cfgPath string) (app, error) {
 		switch job.GetType() {
 		case "desc_files", "inc_files":
 			a.fileJobs = append(a.fileJobs, job)
-		case "mysql", "mysql_xtrabackup", "mariadb_backup", "postgresql", "postgresql_basebackup", "mongodb", "redis":
+		case "mysql", "mysql_xtrabackup", "mariadb_backup", "mysql_binlog", "postgresql", "postgresql_basebackup", "mongodb", "redis":
 			a.dbJobs = append(a.dbJobs, job)
 		case "external":
 			a.extJobs = append(a.extJobs, job)
@@ -261,6 +469,18 @@ func appInit(c *Ctx, cfgPath string) (app, error) {
 		a.jobs[job.GetName()] = job
 	}
 
+	a.jobGroups, err = jobsGroupsInit(conf.Jobs, a.jobs)
+	if err != nil {
+		a.initErrs = multierror.Append(a.initErrs, err.(*multierror.Error).WrappedErrors()...)
+	}
+	a.jobLocks = jobsLocksInit(conf.Jobs, conf.StorageConnects)
+	a.rawStorages = jobsRawStoragesInit(conf.Jobs, storages, lim)
+
+	a.schedules, a.rotateSchedules, err = jobsSchedulesInit(conf.Jobs, a.jobs)
+	if err != nil {
+		a.initErrs = multierror.Append(a.initErrs, err.(*multierror.Error).WrappedErrors()...)
+	}
+
 	return a, nil
 }
 
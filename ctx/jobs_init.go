@@ -2,10 +2,15 @@ package ctx
 
 import (
 	"fmt"
+	"path"
+	"slices"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/docker/go-units"
 	"github.com/hashicorp/go-multierror"
+	"github.com/robfig/cron/v3"
 
 	"github.com/nixys/nxs-backup/ds/mongo_connect"
 	"github.com/nixys/nxs-backup/ds/mysql_connect"
@@ -13,21 +18,28 @@ import (
 	"github.com/nixys/nxs-backup/ds/redis_connect"
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/compression"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backup/desc_files"
 	"github.com/nixys/nxs-backup/modules/backup/external"
 	"github.com/nixys/nxs-backup/modules/backup/inc_files"
 	"github.com/nixys/nxs-backup/modules/backup/mongodump"
+	"github.com/nixys/nxs-backup/modules/backup/mysql_binlog"
 	"github.com/nixys/nxs-backup/modules/backup/mysql_logical"
 	"github.com/nixys/nxs-backup/modules/backup/mysql_physical"
 	"github.com/nixys/nxs-backup/modules/backup/psql_logical"
 	"github.com/nixys/nxs-backup/modules/backup/psql_physical"
 	"github.com/nixys/nxs-backup/modules/backup/redis"
+	"github.com/nixys/nxs-backup/modules/backup/rotation_only"
+	"github.com/nixys/nxs-backup/modules/catalog"
 	"github.com/nixys/nxs-backup/modules/metrics"
+	"github.com/nixys/nxs-backup/modules/scheduler"
 	"github.com/nixys/nxs-backup/modules/storage"
 )
 
 type jobsOpts struct {
 	metricsData *metrics.Data
+	catalog     *catalog.Catalog
 	mainLim     *limitsConf
 	jobs        []jobConf
 	storages    map[string]interfaces.Storage
@@ -49,6 +61,8 @@ func jobsInit(o jobsOpts) ([]interfaces.Job, error) {
 			stErrs           = 0
 			err              error
 			jobStorages      interfaces.Storages
+			cipher           *crypt.Cipher
+			compressor       *compression.Compressor
 		)
 
 		if len(j.Name) == 0 {
@@ -83,6 +97,40 @@ func jobsInit(o jobsOpts) ([]interfaces.Job, error) {
 			}
 		}
 
+		if j.Encryption != nil {
+			// the metadata of the previous incremental backup is read back from the storages on each run
+			if j.Type == misc.IncFiles && crypt.Algo(j.Encryption.Algo) == crypt.AgeAlgo && j.Encryption.IdentityFile == "" {
+				errs = multierror.Append(errs, fmt.Errorf("Failed to init encryption for job `%s`: `identity_file` is required by `%s` encryption of `%s` jobs to read the previous backups metadata ", j.Name, crypt.AgeAlgo, misc.IncFiles))
+				continue
+			}
+			cipher, err = crypt.Init(crypt.Params{
+				Algo:         crypt.Algo(j.Encryption.Algo),
+				Recipients:   j.Encryption.Recipients,
+				IdentityFile: j.Encryption.IdentityFile,
+				KeyFile:      j.Encryption.KeyFile,
+			})
+			if err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("Failed to init encryption for job `%s`: %s ", j.Name, err))
+				continue
+			}
+		}
+
+		compressor, err = getCompressor(j.Gzip, j.Compression)
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("Failed to init compression for job `%s`: %s ", j.Name, err))
+			continue
+		}
+		srcCompressors := make([]*compression.Compressor, len(j.Sources))
+		for i, src := range j.Sources {
+			if srcCompressors[i], err = getCompressor(isGzip(src.Gzip, j.Gzip), src.Compression, j.Compression); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("Failed to init compression for job `%s`: %s ", j.Name, err))
+			continue
+		}
+
 		for _, opt := range j.StoragesOptions {
 
 			// storages validation
@@ -93,17 +141,49 @@ func jobsInit(o jobsOpts) ([]interfaces.Job, error) {
 				continue
 			}
 
-			if opt.Retention.Days < 0 || opt.Retention.Weeks < 0 || opt.Retention.Months < 0 {
+			retention, err := getRetention(opt.Retention)
+			if err != nil {
 				stErrs++
-				errs = multierror.Append(errs, fmt.Errorf("Failed to set storage `%s` for job `%s`: retention period can't be negative ", opt.StorageName, j.Name))
+				errs = multierror.Append(errs, fmt.Errorf("Failed to set storage `%s` for job `%s`: %s ", opt.StorageName, j.Name, err))
 				continue
 			}
 
+			// the binlog segments are needed for the replay up to the oldest full backup only, the segments are
+			// kept for the days, the count of segments delivered per day isn't fixed
+			if j.Type == misc.MysqlBinlog {
+				if retention.UseCount {
+					stErrs++
+					errs = multierror.Append(errs, fmt.Errorf("Failed to set storage `%s` for job `%s`: `use_count` retention is not supported by `%s` jobs type ", opt.StorageName, j.Name, j.Type))
+					continue
+				}
+				if retention.Weeks > 0 || retention.Months > 0 || retention.Years > 0 {
+					errs = multierror.Append(errs, fmt.Errorf("Weekly, monthly and yearly retention is not supported by `%s` jobs type, storage `%s` of job `%s` keeps the daily binlogs only ", j.Type, opt.StorageName, j.Name))
+					retention.Weeks, retention.Months, retention.Years = 0, 0, 0
+				}
+			}
+
+			// the objects are locked until their retention period ends, the count of backups kept doesn't define it
+			if ls, ok := interfaces.WithoutRetry(s).(interfaces.LockStorage); ok && ls.ObjectLocked() && retention.UseCount {
+				stErrs++
+				errs = multierror.Append(errs, fmt.Errorf("Failed to set storage `%s` for job `%s`: `count_instead_of_period` retention is not supported by the storage with object lock ", opt.StorageName, j.Name))
+				continue
+			}
+
+			if retention.MaxTotalSize > 0 {
+				if _, ok = interfaces.WithoutRetry(s).(interfaces.SizeStorage); !ok || j.Type == misc.IncFiles {
+					stErrs++
+					errs = multierror.Append(errs, fmt.Errorf("Failed to set storage `%s` for job `%s`: `max_total_size` is not supported by the storage or the job type ", opt.StorageName, j.Name))
+					continue
+				}
+			}
+
 			st := s.Clone()
 			stParams := storage.Params{
 				BackupPath:    opt.BackupPath,
+				TmpDir:        j.TmpDir,
 				RotateEnabled: opt.EnableRotate,
-				Retention:     storage.Retention(opt.Retention),
+				Cipher:        cipher,
+				Retention:     retention,
 			}
 			if opt.StorageName == "local" {
 				stParams.RateLimit = diskRate
@@ -112,7 +192,7 @@ func jobsInit(o jobsOpts) ([]interfaces.Job, error) {
 			}
 			st.Configure(stParams)
 
-			if storage.IsNeedToBackup(opt.Retention.Days, opt.Retention.Weeks, opt.Retention.Months) {
+			if storage.IsNeedToBackup(retention) {
 				needToMakeBackup = true
 			}
 
@@ -124,60 +204,80 @@ func jobsInit(o jobsOpts) ([]interfaces.Job, error) {
 			sort.Sort(jobStorages)
 		}
 
+		if j.DeliveryConcurrency < 1 {
+			errs = multierror.Append(errs, fmt.Errorf("Wrong `delivery_concurrency` value %d for job `%s`, backups will be delivered to storages one by one ", j.DeliveryConcurrency, j.Name))
+			j.DeliveryConcurrency = 1
+		}
+
+		if j.Streaming && j.Type != misc.DescFiles && j.Type != misc.Mysql && j.Type != misc.Postgresql && j.Type != misc.MysqlBinlog {
+			errs = multierror.Append(errs, fmt.Errorf("Streaming is not supported by `%s` jobs type, job `%s` will use the temp file ", j.Type, j.Name))
+		}
+		if j.Streaming && j.Type == misc.MysqlBinlog && j.TmpDir == "" {
+			errs = multierror.Append(errs, fmt.Errorf("Streaming of binlogs requires `tmp_dir` to spool the segments, job `%s` will fetch the closed segments by its runs ", j.Name))
+			j.Streaming = false
+		}
+
 		switch j.Type {
 		case misc.DescFiles:
 			var sources []desc_files.SourceParams
 
-			for _, src := range j.Sources {
+			for i, src := range j.Sources {
 				sources = append(sources, desc_files.SourceParams{
 					Name:        src.Name,
 					Targets:     src.Targets,
 					Excludes:    src.Excludes,
 					SaveAbsPath: src.SaveAbsPath,
-					Gzip:        isGzip(src.Gzip, j.Gzip),
+					Compressor:  srcCompressors[i],
 				})
 			}
 
 			job, err = desc_files.Init(desc_files.JobParams{
-				Name:             j.Name,
-				TmpDir:           j.TmpDir,
-				NeedToMakeBackup: needToMakeBackup,
-				SafetyBackup:     j.SafetyBackup,
-				DeferredCopying:  j.DeferredCopying,
-				DiskRateLimit:    diskRate,
-				Storages:         jobStorages,
-				Sources:          sources,
-				Metrics:          o.metricsData,
+				Name:                j.Name,
+				TmpDir:              j.TmpDir,
+				NeedToMakeBackup:    needToMakeBackup,
+				SafetyBackup:        j.SafetyBackup,
+				DeliveryConcurrency: j.DeliveryConcurrency,
+				DeferredCopying:     j.DeferredCopying,
+				Streaming:           j.Streaming,
+				DiskRateLimit:       diskRate,
+				Storages:            jobStorages,
+				Cipher:              cipher,
+				Sources:             sources,
+				Metrics:             o.metricsData,
+				Catalog:             o.catalog,
 			})
 
 		case misc.IncFiles:
 			var sources []inc_files.SourceParams
 
-			for _, src := range j.Sources {
+			for i, src := range j.Sources {
 				sources = append(sources, inc_files.SourceParams{
 					Name:        src.Name,
 					Targets:     src.Targets,
 					Excludes:    src.Excludes,
 					SaveAbsPath: src.SaveAbsPath,
-					Gzip:        isGzip(src.Gzip, j.Gzip),
+					Compressor:  srcCompressors[i],
 				})
 			}
 
 			job, err = inc_files.Init(inc_files.JobParams{
-				Name:            j.Name,
-				TmpDir:          j.TmpDir,
-				SafetyBackup:    j.SafetyBackup,
-				DeferredCopying: j.DeferredCopying,
-				DiskRateLimit:   diskRate,
-				Storages:        jobStorages,
-				Sources:         sources,
-				Metrics:         o.metricsData,
+				Name:                j.Name,
+				TmpDir:              j.TmpDir,
+				SafetyBackup:        j.SafetyBackup,
+				DeliveryConcurrency: j.DeliveryConcurrency,
+				DeferredCopying:     j.DeferredCopying,
+				DiskRateLimit:       diskRate,
+				Storages:            jobStorages,
+				Cipher:              cipher,
+				Sources:             sources,
+				Metrics:             o.metricsData,
+				Catalog:             o.catalog,
 			})
 
 		case misc.Mysql:
 			var sources []mysql_logical.SourceParams
 
-			for _, src := range j.Sources {
+			for i, src := range j.Sources {
 				sources = append(sources, mysql_logical.SourceParams{
 					ConnectParams: mysql_connect.Params{
 						AuthFile: src.Connect.MySQLAuthFile,
@@ -190,31 +290,35 @@ func jobsInit(o jobsOpts) ([]interfaces.Job, error) {
 						SSLCert:  src.Connect.SSLCert,
 						SSLKey:   src.Connect.SSLKey,
 					},
-					Name:      src.Name,
-					TargetDBs: src.TargetDBs,
-					Excludes:  src.Excludes,
-					IsSlave:   src.IsSlave,
-					ExtraKeys: getExtraKeys(src.ExtraKeys),
-					Gzip:      isGzip(src.Gzip, j.Gzip),
+					Name:       src.Name,
+					TargetDBs:  src.TargetDBs,
+					Excludes:   src.Excludes,
+					IsSlave:    src.IsSlave,
+					ExtraKeys:  getExtraKeys(src.ExtraKeys),
+					Compressor: srcCompressors[i],
 				})
 			}
 
 			job, err = mysql_logical.Init(mysql_logical.JobParams{
-				Name:             j.Name,
-				TmpDir:           j.TmpDir,
-				NeedToMakeBackup: needToMakeBackup,
-				SafetyBackup:     j.SafetyBackup,
-				DeferredCopying:  j.DeferredCopying,
-				DiskRateLimit:    diskRate,
-				Storages:         jobStorages,
-				Sources:          sources,
-				Metrics:          o.metricsData,
+				Name:                j.Name,
+				TmpDir:              j.TmpDir,
+				NeedToMakeBackup:    needToMakeBackup,
+				SafetyBackup:        j.SafetyBackup,
+				DeliveryConcurrency: j.DeliveryConcurrency,
+				DeferredCopying:     j.DeferredCopying,
+				Streaming:           j.Streaming,
+				DiskRateLimit:       diskRate,
+				Storages:            jobStorages,
+				Cipher:              cipher,
+				Sources:             sources,
+				Metrics:             o.metricsData,
+				Catalog:             o.catalog,
 			})
 
 		case misc.MysqlXtrabackup, misc.MariadbBackup:
 			var sources []mysql_physical.SourceParams
 
-			for _, src := range j.Sources {
+			for i, src := range j.Sources {
 				sources = append(sources, mysql_physical.SourceParams{
 					ConnectParams: mysql_connect.Params{
 						AuthFile: src.Connect.MySQLAuthFile,
@@ -227,33 +331,72 @@ func jobsInit(o jobsOpts) ([]interfaces.Job, error) {
 						SSLCert:  src.Connect.SSLCert,
 						SSLKey:   src.Connect.SSLKey,
 					},
-					Name:      src.Name,
-					TargetDBs: src.TargetDBs,
-					Excludes:  src.Excludes,
-					IsSlave:   src.IsSlave,
-					Prepare:   src.PrepareXtrabackup,
-					ExtraKeys: getExtraKeys(src.ExtraKeys),
-					Gzip:      isGzip(src.Gzip, j.Gzip),
+					Name:       src.Name,
+					TargetDBs:  src.TargetDBs,
+					Excludes:   src.Excludes,
+					IsSlave:    src.IsSlave,
+					Prepare:    src.PrepareXtrabackup,
+					ExtraKeys:  getExtraKeys(src.ExtraKeys),
+					Compressor: srcCompressors[i],
 				})
 			}
 
 			job, err = mysql_physical.Init(mysql_physical.JobParams{
-				Name:             j.Name,
-				TmpDir:           j.TmpDir,
-				NeedToMakeBackup: needToMakeBackup,
-				SafetyBackup:     j.SafetyBackup,
-				DeferredCopying:  j.DeferredCopying,
-				DiskRateLimit:    diskRate,
-				BackupType:       j.Type,
-				Storages:         jobStorages,
-				Sources:          sources,
-				Metrics:          o.metricsData,
+				Name:                j.Name,
+				TmpDir:              j.TmpDir,
+				NeedToMakeBackup:    needToMakeBackup,
+				SafetyBackup:        j.SafetyBackup,
+				DeliveryConcurrency: j.DeliveryConcurrency,
+				DeferredCopying:     j.DeferredCopying,
+				DiskRateLimit:       diskRate,
+				BackupType:          j.Type,
+				Storages:            jobStorages,
+				Cipher:              cipher,
+				Sources:             sources,
+				Metrics:             o.metricsData,
+				Catalog:             o.catalog,
+			})
+
+		case misc.MysqlBinlog:
+			var sources []mysql_binlog.SourceParams
+
+			for i, src := range j.Sources {
+				sources = append(sources, mysql_binlog.SourceParams{
+					ConnectParams: mysql_connect.Params{
+						AuthFile: src.Connect.MySQLAuthFile,
+						User:     src.Connect.DBUser,
+						Passwd:   src.Connect.DBPassword,
+						Host:     src.Connect.DBHost,
+						Port:     src.Connect.DBPort,
+						Socket:   src.Connect.Socket,
+						SSLCA:    src.Connect.SSLCA,
+						SSLCert:  src.Connect.SSLCert,
+						SSLKey:   src.Connect.SSLKey,
+					},
+					Name:       src.Name,
+					ExtraKeys:  getExtraKeys(src.ExtraKeys),
+					Compressor: srcCompressors[i],
+				})
+			}
+
+			job, err = mysql_binlog.Init(mysql_binlog.JobParams{
+				Name:                j.Name,
+				TmpDir:              j.TmpDir,
+				NeedToMakeBackup:    needToMakeBackup,
+				DeliveryConcurrency: j.DeliveryConcurrency,
+				DiskRateLimit:       diskRate,
+				Storages:            jobStorages,
+				Cipher:              cipher,
+				Sources:             sources,
+				Metrics:             o.metricsData,
+				Catalog:             o.catalog,
+				Streaming:           j.Streaming,
 			})
 
 		case misc.Postgresql:
 			var sources []psql_logical.SourceParams
 
-			for _, src := range j.Sources {
+			for i, src := range j.Sources {
 				sources = append(sources, psql_logical.SourceParams{
 					ConnectParams: psql_connect.Params{
 						User:        src.Connect.DBUser,
@@ -265,31 +408,35 @@ func jobsInit(o jobsOpts) ([]interfaces.Job, error) {
 						SSLRootCert: src.Connect.PsqlSSlRootCert,
 						SSLCrl:      src.Connect.PsqlSSlCrl,
 					},
-					Name:      src.Name,
-					TargetDBs: src.TargetDBs,
-					Excludes:  src.Excludes,
-					IsSlave:   src.IsSlave,
-					ExtraKeys: getExtraKeys(src.ExtraKeys),
-					Gzip:      isGzip(src.Gzip, j.Gzip),
+					Name:       src.Name,
+					TargetDBs:  src.TargetDBs,
+					Excludes:   src.Excludes,
+					IsSlave:    src.IsSlave,
+					ExtraKeys:  getExtraKeys(src.ExtraKeys),
+					Compressor: srcCompressors[i],
 				})
 			}
 
 			job, err = psql_logical.Init(psql_logical.JobParams{
-				Name:             j.Name,
-				TmpDir:           j.TmpDir,
-				NeedToMakeBackup: needToMakeBackup,
-				SafetyBackup:     j.SafetyBackup,
-				DeferredCopying:  j.DeferredCopying,
-				DiskRateLimit:    diskRate,
-				Storages:         jobStorages,
-				Sources:          sources,
-				Metrics:          o.metricsData,
+				Name:                j.Name,
+				TmpDir:              j.TmpDir,
+				NeedToMakeBackup:    needToMakeBackup,
+				SafetyBackup:        j.SafetyBackup,
+				DeliveryConcurrency: j.DeliveryConcurrency,
+				DeferredCopying:     j.DeferredCopying,
+				Streaming:           j.Streaming,
+				DiskRateLimit:       diskRate,
+				Storages:            jobStorages,
+				Cipher:              cipher,
+				Sources:             sources,
+				Metrics:             o.metricsData,
+				Catalog:             o.catalog,
 			})
 
 		case misc.PostgresqlBasebackup:
 			var sources []psql_physical.SourceParams
 
-			for _, src := range j.Sources {
+			for i, src := range j.Sources {
 				sources = append(sources, psql_physical.SourceParams{
 					ConnectParams: psql_connect.Params{
 						User:        src.Connect.DBUser,
@@ -301,29 +448,32 @@ func jobsInit(o jobsOpts) ([]interfaces.Job, error) {
 						SSLRootCert: src.Connect.PsqlSSlRootCert,
 						SSLCrl:      src.Connect.PsqlSSlCrl,
 					},
-					Name:      src.Name,
-					IsSlave:   src.IsSlave,
-					ExtraKeys: getExtraKeys(src.ExtraKeys),
-					Gzip:      isGzip(src.Gzip, j.Gzip),
+					Name:       src.Name,
+					IsSlave:    src.IsSlave,
+					ExtraKeys:  getExtraKeys(src.ExtraKeys),
+					Compressor: srcCompressors[i],
 				})
 			}
 
 			job, err = psql_physical.Init(psql_physical.JobParams{
-				Name:             j.Name,
-				TmpDir:           j.TmpDir,
-				NeedToMakeBackup: needToMakeBackup,
-				SafetyBackup:     j.SafetyBackup,
-				DeferredCopying:  j.DeferredCopying,
-				DiskRateLimit:    diskRate,
-				Storages:         jobStorages,
-				Sources:          sources,
-				Metrics:          o.metricsData,
+				Name:                j.Name,
+				TmpDir:              j.TmpDir,
+				NeedToMakeBackup:    needToMakeBackup,
+				SafetyBackup:        j.SafetyBackup,
+				DeliveryConcurrency: j.DeliveryConcurrency,
+				DeferredCopying:     j.DeferredCopying,
+				DiskRateLimit:       diskRate,
+				Storages:            jobStorages,
+				Cipher:              cipher,
+				Sources:             sources,
+				Metrics:             o.metricsData,
+				Catalog:             o.catalog,
 			})
 
 		case misc.MongoDB:
 			var sources []mongodump.SourceParams
 
-			for _, src := range j.Sources {
+			for i, src := range j.Sources {
 				sources = append(sources, mongodump.SourceParams{
 					ConnectParams: mongo_connect.Params{
 						User:      src.Connect.DBUser,
@@ -341,26 +491,29 @@ func jobsInit(o jobsOpts) ([]interfaces.Job, error) {
 					TargetCollections:  src.TargetCollections,
 					ExcludeDBs:         src.ExcludeDBs,
 					ExcludeCollections: src.ExcludeCollections,
-					Gzip:               isGzip(src.Gzip, j.Gzip),
+					Compressor:         srcCompressors[i],
 				})
 			}
 
 			job, err = mongodump.Init(mongodump.JobParams{
-				Name:             j.Name,
-				TmpDir:           j.TmpDir,
-				NeedToMakeBackup: needToMakeBackup,
-				SafetyBackup:     j.SafetyBackup,
-				DeferredCopying:  j.DeferredCopying,
-				DiskRateLimit:    diskRate,
-				Storages:         jobStorages,
-				Sources:          sources,
-				Metrics:          o.metricsData,
+				Name:                j.Name,
+				TmpDir:              j.TmpDir,
+				NeedToMakeBackup:    needToMakeBackup,
+				SafetyBackup:        j.SafetyBackup,
+				DeliveryConcurrency: j.DeliveryConcurrency,
+				DeferredCopying:     j.DeferredCopying,
+				DiskRateLimit:       diskRate,
+				Storages:            jobStorages,
+				Cipher:              cipher,
+				Sources:             sources,
+				Metrics:             o.metricsData,
+				Catalog:             o.catalog,
 			})
 
 		case misc.Redis:
 			var sources []redis.SourceParams
 
-			for _, src := range j.Sources {
+			for i, src := range j.Sources {
 				sources = append(sources, redis.SourceParams{
 					ConnectParams: redis_connect.Params{
 						Passwd: src.Connect.DBPassword,
@@ -368,21 +521,24 @@ func jobsInit(o jobsOpts) ([]interfaces.Job, error) {
 						Port:   src.Connect.DBPort,
 						Socket: src.Connect.Socket,
 					},
-					Name: src.Name,
-					Gzip: isGzip(src.Gzip, j.Gzip),
+					Name:       src.Name,
+					Compressor: srcCompressors[i],
 				})
 			}
 
 			job, err = redis.Init(redis.JobParams{
-				Name:             j.Name,
-				TmpDir:           j.TmpDir,
-				NeedToMakeBackup: needToMakeBackup,
-				SafetyBackup:     j.SafetyBackup,
-				DeferredCopying:  j.DeferredCopying,
-				DiskRateLimit:    diskRate,
-				Storages:         jobStorages,
-				Sources:          sources,
-				Metrics:          o.metricsData,
+				Name:                j.Name,
+				TmpDir:              j.TmpDir,
+				NeedToMakeBackup:    needToMakeBackup,
+				SafetyBackup:        j.SafetyBackup,
+				DeliveryConcurrency: j.DeliveryConcurrency,
+				DeferredCopying:     j.DeferredCopying,
+				DiskRateLimit:       diskRate,
+				Storages:            jobStorages,
+				Cipher:              cipher,
+				Sources:             sources,
+				Metrics:             o.metricsData,
+				Catalog:             o.catalog,
 			})
 
 		case misc.External:
@@ -390,15 +546,18 @@ func jobsInit(o jobsOpts) ([]interfaces.Job, error) {
 				errs = multierror.Append(errs, fmt.Errorf("Used deprecated option `skip_backup_rotate` for job \"%s\". Use `storages_options[].enable_rotate` instead. ", j.Name))
 			}
 			job, err = external.Init(external.JobParams{
-				Name:             j.Name,
-				DumpCmd:          j.DumpCmd,
-				NeedToMakeBackup: needToMakeBackup,
-				SafetyBackup:     j.SafetyBackup,
-				SkipBackupRotate: j.SkipBackupRotate,
-				DiskRateLimit:    diskRate,
-				Storages:         jobStorages,
-				Metrics:          o.metricsData,
-				Gzip:             j.Gzip,
+				Name:                j.Name,
+				DumpCmd:             j.DumpCmd,
+				NeedToMakeBackup:    needToMakeBackup,
+				SafetyBackup:        j.SafetyBackup,
+				DeliveryConcurrency: j.DeliveryConcurrency,
+				SkipBackupRotate:    j.SkipBackupRotate,
+				DiskRateLimit:       diskRate,
+				Storages:            jobStorages,
+				Cipher:              cipher,
+				Metrics:             o.metricsData,
+				Catalog:             o.catalog,
+				Compressor:          compressor,
 			})
 
 		default:
@@ -408,6 +567,22 @@ func jobsInit(o jobsOpts) ([]interfaces.Job, error) {
 
 		if err != nil {
 			errs = multierror.Append(errs, fmt.Errorf("Failed to init job `%s` with error: %w ", j.Name, err))
+			// the job sources are connected by init, the backups of the unavailable sources are still rotated
+			if j.Type != misc.External && len(jobStorages) > 0 {
+				var sources []string
+				for _, src := range j.Sources {
+					sources = append(sources, src.Name)
+				}
+				jobs = append(jobs, rotation_only.Init(rotation_only.JobParams{
+					Name:     j.Name,
+					Type:     j.Type,
+					InitErr:  err,
+					Sources:  sources,
+					Storages: jobStorages,
+					Metrics:  o.metricsData,
+					Catalog:  o.catalog,
+				}))
+			}
 		} else {
 			jobs = append(jobs, job)
 		}
@@ -417,6 +592,232 @@ func jobsInit(o jobsOpts) ([]interfaces.Job, error) {
 	return jobs, errs.ErrorOrNil()
 }
 
+// jobsGroupsInit collects initialized jobs into the groups defined by jobs tags
+func jobsGroupsInit(confs []jobConf, jobs map[string]interfaces.Job) (map[string]interfaces.Jobs, error) {
+	var errs *multierror.Error
+
+	groups := make(map[string]interfaces.Jobs)
+
+	for _, j := range confs {
+		job, ok := jobs[j.Name]
+		if !ok {
+			continue
+		}
+
+		for _, tag := range j.Tags {
+			if misc.Contains([]string{"all", "files", "databases", "external"}, tag) {
+				errs = multierror.Append(errs, fmt.Errorf("A job `%s` cannot have the tag `%s` reserved ", j.Name, tag))
+				continue
+			}
+			if _, ok = jobs[tag]; ok {
+				errs = multierror.Append(errs, fmt.Errorf("A tag `%s` of job `%s` matches the name of another job ", tag, j.Name))
+				continue
+			}
+			if !slices.Contains(groups[tag], job) {
+				groups[tag] = append(groups[tag], job)
+			}
+		}
+	}
+
+	return groups, errs.ErrorOrNil()
+}
+
+// jobsSchedulesInit parses backup and rotation schedules of initialized jobs to run them in server mode
+func jobsSchedulesInit(confs []jobConf, jobs map[string]interfaces.Job) (schedules, rotateSchedules []scheduler.Schedule, err error) {
+	var errs *multierror.Error
+
+	for _, j := range confs {
+		job, ok := jobs[j.Name]
+		if !ok {
+			continue
+		}
+
+		if j.Schedule != nil {
+			if sch, err := scheduleInit(job, j.Schedule, "schedule"); err != nil {
+				errs = multierror.Append(errs, err)
+			} else {
+				schedules = append(schedules, sch)
+			}
+		}
+		if j.RotateSchedule != nil {
+			if sch, err := scheduleInit(job, j.RotateSchedule, "rotate_schedule"); err != nil {
+				errs = multierror.Append(errs, err)
+			} else {
+				rotateSchedules = append(rotateSchedules, sch)
+			}
+		}
+	}
+
+	return schedules, rotateSchedules, errs.ErrorOrNil()
+}
+
+func scheduleInit(job interfaces.Job, sc *scheduleConf, opt string) (scheduler.Schedule, error) {
+	spec, err := cron.ParseStandard(sc.Cron)
+	if err != nil {
+		return scheduler.Schedule{}, fmt.Errorf("Failed to parse %s of job `%s`: %s ", opt, job.GetName(), err)
+	}
+	if sc.Jitter < 0 {
+		return scheduler.Schedule{}, fmt.Errorf("Jitter of %s of job `%s` can't be negative ", opt, job.GetName())
+	}
+
+	return scheduler.Schedule{
+		Job:    job,
+		Cron:   sc.Cron,
+		Spec:   spec,
+		Jitter: sc.Jitter * time.Minute,
+	}, nil
+}
+
+// jobsLocksInit defines resources shared between jobs.
+// Jobs that hold the same lock are never run at the same time.
+func jobsLocksInit(confs []jobConf, connects []storageConnectConf) map[string][]string {
+	exclusive := make(map[string]bool)
+	for _, sc := range connects {
+		// FTP and NFS connections can't be used by several jobs simultaneously
+		if sc.FtpParams != nil || sc.NfsParams != nil {
+			exclusive[sc.Name] = true
+		}
+	}
+
+	locks := make(map[string][]string)
+	for _, j := range confs {
+		var keys []string
+
+		if j.TmpDir != "" {
+			keys = append(keys, "tmp_dir:"+path.Clean(j.TmpDir))
+		}
+		switch j.Type {
+		case misc.DescFiles, misc.IncFiles, misc.External:
+		default:
+			for _, src := range j.Sources {
+				keys = append(keys, "host:"+getSourceHost(src.Connect))
+			}
+		}
+		for _, opt := range j.StoragesOptions {
+			if exclusive[opt.StorageName] {
+				keys = append(keys, "storage:"+opt.StorageName)
+			}
+		}
+
+		locks[j.Name] = keys
+	}
+
+	return locks
+}
+
+// jobsRawStoragesInit configures the jobs storages reading files without decryption, so the backups can be copied between storages as is.
+// Errors of the jobs limits are reported by jobs init.
+func jobsRawStoragesInit(confs []jobConf, storages map[string]interfaces.Storage, mainLim *limitsConf) map[string]map[string]interfaces.Storage {
+	rawStorages := make(map[string]map[string]interfaces.Storage)
+	for _, j := range confs {
+		var netRate int64
+		diskRate, _ := getRateLimit(mainLim.DiskRate)
+		if j.Limits != nil {
+			if j.Limits.NetRate != nil {
+				netRate, _ = getRateLimit(j.Limits.NetRate)
+			}
+			if j.Limits.DiskRate != nil {
+				diskRate, _ = getRateLimit(j.Limits.DiskRate)
+			}
+		}
+
+		jobStorages := make(map[string]interfaces.Storage)
+		for _, opt := range j.StoragesOptions {
+			s, ok := storages[opt.StorageName]
+			if !ok {
+				continue
+			}
+			retention, err := getRetention(opt.Retention)
+			if err != nil {
+				continue
+			}
+			st := s.Clone()
+			stParams := storage.Params{
+				BackupPath:    opt.BackupPath,
+				TmpDir:        j.TmpDir,
+				RotateEnabled: opt.EnableRotate,
+				Cipher:        crypt.Raw(),
+				Retention:     retention,
+				RateLimit:     netRate,
+			}
+			if opt.StorageName == "local" {
+				stParams.RateLimit = diskRate
+			}
+			st.Configure(stParams)
+			jobStorages[opt.StorageName] = st
+		}
+		rawStorages[j.Name] = jobStorages
+	}
+
+	return rawStorages
+}
+
+// getRetention validates the retention settings of the storage and converts them to the storage ones
+func getRetention(c retentionConf) (r storage.Retention, err error) {
+	if c.Days < 0 || c.Weeks < 0 || c.Months < 0 || c.Years < 0 {
+		return r, fmt.Errorf("retention period can't be negative")
+	}
+	if c.WeeklyDay < 0 || c.WeeklyDay > 6 {
+		return r, fmt.Errorf("wrong `weekly_day` value %d, it must be from 0 (Sunday) to 6 (Saturday)", c.WeeklyDay)
+	}
+	if c.MonthlyDay < 1 || c.MonthlyDay > 31 {
+		return r, fmt.Errorf("wrong `monthly_day` value %d, it must be from 1 to 31", c.MonthlyDay)
+	}
+	// the leap year is used to allow Feb 29, it's kept on Feb 28 in other years
+	yearlyDay, err := time.Parse("2006-01-02", "2000-"+c.YearlyDay)
+	if err != nil {
+		return r, fmt.Errorf("wrong `yearly_day` value `%s`, it must be in MM-DD format", c.YearlyDay)
+	}
+
+	var maxTotalSize int64
+	if c.MaxTotalSize != "" {
+		if maxTotalSize, err = units.FromHumanSize(c.MaxTotalSize); err != nil || maxTotalSize <= 0 {
+			return r, fmt.Errorf("wrong `max_total_size` value `%s`", c.MaxTotalSize)
+		}
+	}
+
+	return storage.Retention{
+		Days:         c.Days,
+		Weeks:        c.Weeks,
+		Months:       c.Months,
+		Years:        c.Years,
+		UseCount:     c.UseCount,
+		WeeklyDay:    time.Weekday(c.WeeklyDay),
+		MonthlyDay:   c.MonthlyDay,
+		YearlyMonth:  yearlyDay.Month(),
+		YearlyDay:    yearlyDay.Day(),
+		MaxTotalSize: maxTotalSize,
+	}, nil
+}
+
+func getSourceHost(c sourceConnectConf) string {
+	switch c.DBHost {
+	case "", "localhost", "127.0.0.1", "::1":
+		return "localhost"
+	default:
+		return c.DBHost
+	}
+}
+
+// getCompressor inits the compressor by the first defined compression settings.
+// Deprecated `gzip` option is used if none of them defined.
+func getCompressor(gzip bool, confs ...*compressionConf) (*compression.Compressor, error) {
+	for _, c := range confs {
+		if c != nil {
+			return compression.Init(compression.Params{
+				Algo:    compression.Algo(c.Algo),
+				Level:   c.Level,
+				Threads: c.Threads,
+			})
+		}
+	}
+
+	if gzip {
+		return compression.Init(compression.Params{Algo: compression.GzipAlgo})
+	}
+	return nil, nil
+}
+
 func isGzip(sgz *bool, jgz bool) bool {
 	if sgz != nil {
 		return *sgz
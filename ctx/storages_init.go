@@ -3,11 +3,18 @@ package ctx
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 
 	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/cmd_handler/test_config"
+	"github.com/nixys/nxs-backup/modules/storage"
+	"github.com/nixys/nxs-backup/modules/storage/azure"
+	"github.com/nixys/nxs-backup/modules/storage/exec"
 	"github.com/nixys/nxs-backup/modules/storage/ftp"
+	"github.com/nixys/nxs-backup/modules/storage/gcs"
 	"github.com/nixys/nxs-backup/modules/storage/local"
 	"github.com/nixys/nxs-backup/modules/storage/nfs"
 	"github.com/nixys/nxs-backup/modules/storage/s3"
@@ -24,6 +31,9 @@ var allowedConnectParams = []string{
 	"smb_params",
 	"nfs_params",
 	"webdav_params",
+	"azure_params",
+	"gcs_params",
+	"exec_params",
 }
 
 func storagesInit(storageConnects []storageConnectConf, mainLim *limitsConf) (storagesMap map[string]interfaces.Storage, err error) {
@@ -58,7 +68,7 @@ func storagesInit(storageConnects []storageConnectConf, mainLim *limitsConf) (st
 
 		switch {
 		case st.S3Params != nil:
-			storage, err = s3.Init(st.Name, s3.Opts(*st.S3Params), rl)
+			storage, err = s3.Init(st.Name, getS3Opts(st.S3Params), rl)
 		case st.ScpParams != nil:
 			storage, err = sftp.Init(st.Name, sftp.Opts(*st.ScpParams), rl)
 		case st.SftpParams != nil:
@@ -71,6 +81,12 @@ func storagesInit(storageConnects []storageConnectConf, mainLim *limitsConf) (st
 			storage, err = webdav.Init(st.Name, webdav.Opts(*st.WebDavParams), rl)
 		case st.SmbParams != nil:
 			storage, err = smb.Init(st.Name, smb.Opts(*st.SmbParams), rl)
+		case st.AzureParams != nil:
+			storage, err = azure.Init(st.Name, azure.Opts(*st.AzureParams), rl)
+		case st.GcsParams != nil:
+			storage, err = gcs.Init(st.Name, gcs.Opts(*st.GcsParams), rl)
+		case st.ExecParams != nil:
+			storage, err = exec.Init(st.Name, exec.Opts(*st.ExecParams), rl)
 		default:
 			err = fmt.Errorf("unable to define `%s` storage connect type by its params. Allowed connect params: %s", st.Name, strings.Join(allowedConnectParams, ", "))
 		}
@@ -78,9 +94,88 @@ func storagesInit(storageConnects []storageConnectConf, mainLim *limitsConf) (st
 		if err != nil {
 			errs = multierror.Append(errs, fmt.Errorf("Failed to init storage `%s` with error: %w ", st.Name, err))
 		} else {
-			storagesMap[st.Name] = storage
+			storagesMap[st.Name] = interfaces.WithRetry(storage, getRetry(st.Retry))
 		}
 	}
 
 	return storagesMap, errs.ErrorOrNil()
 }
+
+// storageTargetsInit collects the backup paths of each storage used by jobs. Storages failed to init are
+// included without the storage, storages not used by jobs are included without the backup path.
+func storageTargetsInit(conf ConfOpts, storages map[string]interfaces.Storage) (targets []test_config.StorageTarget) {
+	paths := make(map[string][]string)
+	for _, j := range conf.Jobs {
+		for _, opt := range j.StoragesOptions {
+			if !misc.Contains(paths[opt.StorageName], opt.BackupPath) {
+				paths[opt.StorageName] = append(paths[opt.StorageName], opt.BackupPath)
+			}
+		}
+	}
+
+	names := []string{"local"}
+	for _, st := range conf.StorageConnects {
+		if !misc.Contains(names, st.Name) {
+			names = append(names, st.Name)
+		}
+	}
+
+	for _, name := range names {
+		if len(paths[name]) == 0 {
+			if name != "local" {
+				targets = append(targets, test_config.StorageTarget{Name: name, Storage: storages[name]})
+			}
+			continue
+		}
+		for _, p := range paths[name] {
+			targets = append(targets, test_config.StorageTarget{Name: name, BackupPath: p, Storage: storages[name]})
+		}
+	}
+	return
+}
+
+func getRetry(c *retryConf) storage.Retry {
+	if c == nil {
+		return storage.Retry{}
+	}
+	return storage.Retry{
+		Attempts:     c.Attempts,
+		InitialDelay: c.InitialDelay * time.Second,
+		MaxDelay:     c.MaxDelay * time.Second,
+	}
+}
+
+func getS3Opts(c *s3ConnConf) s3.Opts {
+	opts := s3.Opts{
+		BucketName:    c.BucketName,
+		AccessKeyID:   c.AccessKeyID,
+		SecretKey:     c.SecretKey,
+		Endpoint:      c.Endpoint,
+		Region:        c.Region,
+		BatchDeletion: c.BatchDeletion,
+		Secure:        c.Secure,
+		StorageClass:  c.StorageClass,
+		Tagging:       c.Tagging,
+	}
+
+	if c.ServerSideEncryption != nil {
+		opts.SSE = &s3.SSEOpts{
+			Type:            c.ServerSideEncryption.Type,
+			KmsKeyID:        c.ServerSideEncryption.KmsKeyID,
+			CustomerKeyFile: c.ServerSideEncryption.CustomerKeyFile,
+		}
+	}
+	if c.PeriodStorageClasses != nil {
+		opts.PeriodStorageClasses = map[string]string{
+			"daily":   c.PeriodStorageClasses.Daily,
+			"weekly":  c.PeriodStorageClasses.Weekly,
+			"monthly": c.PeriodStorageClasses.Monthly,
+			"yearly":  c.PeriodStorageClasses.Yearly,
+		}
+	}
+	if c.ObjectLock != nil {
+		opts.ObjectLockMode = c.ObjectLock.Mode
+	}
+
+	return opts
+}
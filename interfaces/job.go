@@ -1,7 +1,10 @@
 package interfaces
 
 import (
+	"time"
+
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/catalog"
 	"github.com/nixys/nxs-backup/modules/logger"
 )
 
@@ -9,11 +12,16 @@ type JobTargets map[string]TargetsOnStorages
 
 type Job interface {
 	SetOfsMetrics(ofs string, metrics map[string]float64)
+	GetOfsMetrics(ofs string) map[string]float64
+	SetOfsStorageMetrics(ofs, storage string, metrics map[string]float64)
+	GetCatalog() *catalog.Catalog
 	GetName() string
 	GetTempDir() string
 	GetType() misc.BackupType
 	GetTargetOfsList() []string
 	GetStoragesCount() int
+	GetStorages() Storages
+	GetDeliveryConcurrency() int
 	GetDumpObjects() map[string]DumpObject
 	SetDumpObjectDelivered(ofs string)
 	IsBackupSafety() bool
@@ -22,10 +30,17 @@ type Job interface {
 	NeedToUpdateIncMeta() bool
 	DoBackup(logCh chan logger.LogRecord, tmpDir string) error
 	DeleteOldBackups(logCh chan logger.LogRecord, ofsPath string) error
+	DoRestore(logCh chan logger.LogRecord, p RestoreParams) error
 	CleanupTmpData() error
 	Close() error
 }
 
+// StreamingJob fetches the source data continuously in server mode, the fetched data is delivered by the job runs
+type StreamingJob interface {
+	IsStreaming() bool
+	Stream(logCh chan logger.LogRecord, ofs string, ready func()) error
+}
+
 type Jobs []Job
 
 func (j Jobs) Close() error {
@@ -39,3 +54,16 @@ type DumpObject struct {
 	TmpFile   string
 	Delivered bool
 }
+
+// RestoreParams describes backup files that have to be restored for the job target.
+// Files are ordered chronologically and their paths are relative to the storage backup path.
+type RestoreParams struct {
+	Ofs     string
+	Storage string
+	Files   []string
+	Dst     string
+	// Time is the moment the state is restored at, the binlogs replay is stopped at it
+	Time time.Time
+	// FullBackup is the file name of the restored full backup the binlogs replay starts from
+	FullBackup string
+}
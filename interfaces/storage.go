@@ -1,14 +1,21 @@
 package interfaces
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path"
+	"sync"
 	"time"
 
+	"github.com/docker/go-units"
 	"github.com/hashicorp/go-multierror"
 
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/catalog"
 	"github.com/nixys/nxs-backup/modules/logger"
 	"github.com/nixys/nxs-backup/modules/metrics"
 	"github.com/nixys/nxs-backup/modules/storage"
@@ -26,13 +33,67 @@ type Storage interface {
 	Configure(storage.Params)
 	DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupPath, ofs, bakType string) error
 	DeleteOldBackups(logCh chan logger.LogRecord, ofsPart string, job Job, full bool) error
-	GetFileReader(string) (io.Reader, error)
+	GetFileReader(string) (io.ReadCloser, error)
+	DeleteFile(string) error
 	GetName() string
 	IsLocal() int
 	ListBackups(string) ([]string, error)
 	Close() error
 }
 
+// StreamStorage is implemented by storages able to receive a backup as a stream, without the temp file.
+// The tmpBackupFile defines the backup name, its checksum manifest is read from the temp dir after the end of the stream.
+// Incremental backups can't be streamed, since their metadata is delivered separately.
+type StreamStorage interface {
+	DeliveryBackupStream(logCh chan logger.LogRecord, jobName, tmpBackupFile, ofs, bakType string, src io.Reader) error
+}
+
+// ResumableStorage is implemented by storages able to continue an interrupted upload instead of starting it over.
+// Such storages keep the partial upload on failure, it's resumed by the next delivery if the resume is set.
+type ResumableStorage interface {
+	SetResume(resume bool)
+}
+
+// SpaceStorage is implemented by storages able to report the space available for new backups in the backup path
+type SpaceStorage interface {
+	FreeSpace() (uint64, error)
+}
+
+// SizeStorage is implemented by storages able to report the space taken by the backup files.
+// Links to the files stored in the longer retention periods take no space, their size is zero.
+type SizeStorage interface {
+	FileSize(ofsPath string) (int64, error)
+}
+
+// LockStorage is implemented by storages able to lock the backups against deletion for their retention period
+type LockStorage interface {
+	ObjectLocked() bool
+}
+
+// DryRunStorage is implemented by storages able to compute the rotation without deleting files.
+// The files the rotation would delete are added to the plan instead while it's set.
+type DryRunStorage interface {
+	SetDryRun(plan *storage.RotationPlan)
+	DryRunPlan() *storage.RotationPlan
+}
+
+// SyncStorage is implemented by storages able to receive backups files copied from another storage as is.
+// The ofsPath is relative to the backup path, the ofs and bakType are of the job target the file belongs to.
+type SyncStorage interface {
+	PutFile(logCh chan logger.LogRecord, jobName, ofs, bakType, ofsPath string, src io.Reader) error
+}
+
+// LinkStorage is implemented by the sync storages making the copies of the backup in the other retention periods dirs
+// without uploading it again, by symlinks or server side copies. The targetOfsPath is the backup already on the storage.
+type LinkStorage interface {
+	PutLink(logCh chan logger.LogRecord, jobName, ofs, bakType, ofsPath, targetOfsPath string) error
+}
+
+// DirStorage is implemented by storages keeping the directories, the object storages have no dirs to remove
+type DirStorage interface {
+	DeleteDir(ofsPath string) error
+}
+
 type Storages []Storage
 
 func (s Storages) Len() int           { return len(s) }
@@ -55,8 +116,112 @@ func (s Storages) DeleteOldBackups(logCh chan logger.LogRecord, j Job, ofsPath s
 					errs = multierror.Append(errs, err)
 				}
 			}
+			if err := fitSizeBudget(logCh, j, st); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// FitSizeBudget evicts the old backups of the job from the storages with the size budget until the job backups fit it
+func (s Storages) FitSizeBudget(logCh chan logger.LogRecord, j Job) error {
+	errs := new(multierror.Error)
+
+	for _, st := range s {
+		if err := fitSizeBudget(logCh, j, st); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// sizeBudgetStorage is implemented by storages able to tell the size budget of the job backups
+type sizeBudgetStorage interface {
+	SizeBudget() int64
+}
+
+func fitSizeBudget(logCh chan logger.LogRecord, j Job, st Storage) error {
+	bs, ok := WithoutRetry(st).(sizeBudgetStorage)
+	if !ok || bs.SizeBudget() <= 0 {
+		return nil
+	}
+	ss, ok := WithoutRetry(st).(SizeStorage)
+	if !ok {
+		logCh <- logger.Log(j.GetName(), st.GetName()).Warn("Size budget skipped. Storage can't report the size of backups.")
+		return nil
+	}
+	budget := bs.SizeBudget()
+
+	var plan *storage.RotationPlan
+	if ds, ok := WithoutRetry(st).(DryRunStorage); ok {
+		plan = ds.DryRunPlan()
+	}
+
+	var files []storage.SizedFile
+	for _, ofs := range j.GetTargetOfsList() {
+		pins, err := storage.LoadPins(j.GetCatalog(), j.GetName(), ofs, st.GetName())
+		if err != nil {
+			logCh <- logger.Log(j.GetName(), st.GetName()).Errorf("Size budget skipped. Failed to read pinned backups: %v", err)
+			return err
+		}
+		list, err := st.ListBackups(ofs)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			logCh <- logger.Log(j.GetName(), st.GetName()).Errorf("Failed to get backups list of `%s` to fit size budget. Error: %v", ofs, err)
+			return err
+		}
+		for _, f := range list {
+			ofsPath := storage.GetOfsRelPath(f, ofs)
+			// the files deleted by the rotation in the dry run are still listed
+			if plan != nil && plan.Deleted(j.GetName(), st.GetName(), ofs, ofsPath) {
+				continue
+			}
+			size, err := ss.FileSize(ofsPath)
+			if err != nil {
+				logCh <- logger.Log(j.GetName(), st.GetName()).Errorf("Failed to get size of `%s` to fit size budget. Error: %v", ofsPath, err)
+				return err
+			}
+			files = append(files, storage.SizedFile{Ofs: ofs, Path: ofsPath, Size: size, Pinned: pins.Pinned(ofsPath)})
+		}
+	}
+
+	evict, total := storage.SizeBudgetEvictions(files, budget)
+	if total <= budget && len(evict) == 0 {
+		logCh <- logger.Log(j.GetName(), st.GetName()).Debugf("Backups take %s of %s size budget.", units.HumanSize(float64(total)), units.HumanSize(float64(budget)))
+		return nil
+	}
+
+	if plan != nil {
+		for _, f := range evict {
+			plan.Add(storage.RotationAction{
+				Job:          j.GetName(),
+				Storage:      st.GetName(),
+				Target:       f.Ofs,
+				Path:         f.Path,
+				RotationRule: storage.RotationRule{Period: "size_budget", Budget: budget},
+			})
 		}
+		return nil
 	}
+
+	errs := new(multierror.Error)
+	for _, f := range evict {
+		if err := st.DeleteFile(f.Path); err != nil {
+			logCh <- logger.Log(j.GetName(), st.GetName()).Errorf("Failed to delete file '%s' to fit size budget. Error: %s", f.Path, err)
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		logCh <- logger.Log(j.GetName(), st.GetName()).Infof("Deleted backup file '%s' (%s) to fit size budget of %s", f.Path, units.HumanSize(float64(f.Size)), units.HumanSize(float64(budget)))
+	}
+	if total > budget {
+		logCh <- logger.Log(j.GetName(), st.GetName()).Warnf("Backups take %s exceeding size budget of %s, only the newest backups are left.", units.HumanSize(float64(total)), units.HumanSize(float64(budget)))
+	} else {
+		logCh <- logger.Log(j.GetName(), st.GetName()).Infof("Backups take %s of %s size budget.", units.HumanSize(float64(total)), units.HumanSize(float64(budget)))
+	}
+
 	return errs.ErrorOrNil()
 }
 
@@ -67,28 +232,215 @@ func (s Storages) Delivery(logCh chan logger.LogRecord, job Job) error {
 		if dumpObj.Delivered {
 			continue
 		}
-		deliveryErrs := new(multierror.Error)
 		startTime := time.Now()
-		ok := float64(0)
-		for _, st := range s {
-			if err := st.DeliveryBackup(logCh, job.GetName(), dumpObj.TmpFile, ofs, string(job.GetType())); err != nil {
-				deliveryErrs = multierror.Append(deliveryErrs, err)
+		// the temp backup is moved by the local storage, so it's described before the delivery
+		rec := newCatalogRecord(job, ofs, dumpObj.TmpFile, -1)
+		results := s.deliveryBackup(logCh, job, dumpObj.TmpFile, ofs)
+		deliveryErrs := setDeliveryMetrics(job, ofs, results, startTime)
+		catalogDelivery(logCh, job, rec, results, startTime)
+		if deliveryErrs.Len() < len(s) {
+			job.SetDumpObjectDelivered(ofs)
+		}
+		errs = multierror.Append(errs, deliveryErrs.ErrorOrNil())
+	}
+
+	return errs.ErrorOrNil()
+}
+
+type deliveryResult struct {
+	storage string
+	paths   []string
+	time    time.Duration
+	err     error
+}
+
+// relPathsStorage is implemented by storages able to tell the paths the backup is delivered to
+type relPathsStorage interface {
+	BackupRelPaths(tmpBackupFile, ofs, bakType string) []string
+}
+
+// deliveryBackup delivers the temp backup to the storages running up to the job delivery concurrency uploads at once.
+// Local storage is processed after the others, since it moves the temp backup.
+func (s Storages) deliveryBackup(logCh chan logger.LogRecord, job Job, tmpBackupFile, ofs string) []deliveryResult {
+	var wg sync.WaitGroup
+
+	results := make([]deliveryResult, len(s))
+	sem := make(chan struct{}, max(job.GetDeliveryConcurrency(), 1))
+
+	for _, isLocal := range []int{0, 1} {
+		for i, st := range s {
+			if st.IsLocal() != isLocal {
+				continue
 			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(i int, st Storage) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				startTime := time.Now()
+				paths := backupRelPaths(st, tmpBackupFile, ofs, string(job.GetType()))
+				err := st.DeliveryBackup(logCh, job.GetName(), tmpBackupFile, ofs, string(job.GetType()))
+				results[i] = deliveryResult{storage: st.GetName(), paths: paths, time: time.Since(startTime), err: err}
+			}(i, st)
 		}
-		if deliveryErrs.Len() == 0 {
-			ok = float64(1)
+		wg.Wait()
+	}
+
+	return results
+}
+
+// setDeliveryMetrics sets the delivery metrics of the job target for each storage and in total
+func setDeliveryMetrics(job Job, ofs string, results []deliveryResult, startTime time.Time) *multierror.Error {
+	errs := new(multierror.Error)
+
+	for _, r := range results {
+		ok := float64(1)
+		if r.err != nil {
+			ok = float64(0)
+			errs = multierror.Append(errs, fmt.Errorf("%s: %w", r.storage, r.err))
 		}
-		job.SetOfsMetrics(ofs, map[string]float64{
+		job.SetOfsStorageMetrics(ofs, r.storage, map[string]float64{
 			metrics.DeliveryOk:   ok,
-			metrics.DeliveryTime: float64(time.Since(startTime).Nanoseconds() / 1e6),
+			metrics.DeliveryTime: float64(r.time.Nanoseconds() / 1e6),
 		})
-		if deliveryErrs.Len() < len(s) {
-			job.SetDumpObjectDelivered(ofs)
+	}
+
+	ok := float64(0)
+	if errs.Len() == 0 {
+		ok = float64(1)
+	}
+	job.SetOfsMetrics(ofs, map[string]float64{
+		metrics.DeliveryOk:   ok,
+		metrics.DeliveryTime: float64(time.Since(startTime).Nanoseconds() / 1e6),
+	})
+
+	return errs
+}
+
+// DeliveryStream passes the backup written by dump directly to the storages able to receive streams.
+// If some of the storages can't stream, the backup is written to the temp file as well and delivered to them after the dump.
+// Partially streamed backups are discarded by storages if the dump fails.
+func (s Storages) DeliveryStream(logCh chan logger.LogRecord, job Job, ofs, tmpBackupFile string, dump func(w io.Writer) error) (size int64, dumpErr, deliveryErr error) {
+	var (
+		wg       sync.WaitGroup
+		fileSts  Storages
+		sw       streamWriter
+		startErr error
+	)
+	startTime := time.Now()
+
+	for _, st := range s {
+		if _, ok := st.(StreamStorage); !ok {
+			fileSts = append(fileSts, st)
 		}
-		errs = multierror.Append(errs, deliveryErrs.ErrorOrNil())
 	}
+	streamResults := make([]deliveryResult, len(s)-len(fileSts))
 
-	return errs.ErrorOrNil()
+	for _, st := range s {
+		ss, ok := st.(StreamStorage)
+		if !ok {
+			continue
+		}
+
+		pr, pw := io.Pipe()
+		sw.pipes = append(sw.pipes, pw)
+		wg.Add(1)
+		go func(i int, st Storage, ss StreamStorage) {
+			defer wg.Done()
+			paths := backupRelPaths(st, tmpBackupFile, ofs, string(job.GetType()))
+			err := ss.DeliveryBackupStream(logCh, job.GetName(), tmpBackupFile, ofs, string(job.GetType()), pr)
+			// unblock the writer if the storage failed before the end of the stream
+			_ = pr.CloseWithError(err)
+			streamResults[i] = deliveryResult{storage: st.GetName(), paths: paths, time: time.Since(startTime), err: err}
+		}(len(sw.pipes)-1, st, ss)
+	}
+
+	if len(fileSts) > 0 {
+		logCh <- logger.Log(job.GetName(), "").Debugf("Not all storages can receive streams, the temp backup %s will be created", tmpBackupFile)
+		sw.file, startErr = os.Create(tmpBackupFile)
+	}
+
+	if startErr == nil {
+		dumpErr = dump(&sw)
+	} else {
+		dumpErr = startErr
+	}
+	if sw.file != nil {
+		if err := sw.file.Close(); err != nil && dumpErr == nil {
+			dumpErr = err
+		}
+	}
+	for _, pw := range sw.pipes {
+		if dumpErr != nil {
+			_ = pw.CloseWithError(dumpErr)
+		} else {
+			_ = pw.Close()
+		}
+	}
+	wg.Wait()
+
+	if dumpErr != nil {
+		return sw.size, dumpErr, nil
+	}
+
+	rec := newCatalogRecord(job, ofs, tmpBackupFile, sw.size)
+	results := streamResults
+	if len(fileSts) > 0 {
+		results = append(results, fileSts.deliveryBackup(logCh, job, tmpBackupFile, ofs)...)
+	}
+	catalogDelivery(logCh, job, rec, results, startTime)
+
+	return sw.size, nil, setDeliveryMetrics(job, ofs, results, startTime).ErrorOrNil()
+}
+
+// backupRelPaths returns the paths relative to the backup path the temp backup is going to be delivered to by the storage
+func backupRelPaths(st Storage, tmpBackupFile, ofs, bakType string) []string {
+	if rs, ok := WithoutRetry(st).(relPathsStorage); ok {
+		return rs.BackupRelPaths(tmpBackupFile, ofs, bakType)
+	}
+	return nil
+}
+
+// newCatalogRecord describes the temp backup of the job target for the catalog, the size is read from the file if it's negative
+func newCatalogRecord(job Job, ofs, tmpBackupFile string, size int64) catalog.Record {
+	rec := catalog.NewRecord(job.GetName(), job.GetType(), ofs, "", path.Base(tmpBackupFile))
+
+	rec.Size = size
+	if size < 0 {
+		rec.Size = 0
+		if fi, err := os.Stat(tmpBackupFile); err == nil {
+			rec.Size = fi.Size()
+		}
+	}
+	if f, err := os.Open(tmpBackupFile + checksum.Ext); err == nil {
+		rec.Checksum, _ = checksum.ReadManifest(f)
+		_ = f.Close()
+	}
+
+	return rec
+}
+
+// catalogDelivery records the results of the backup delivery to the job storages in the catalog.
+// Failure to update the catalog doesn't fail the backup, the catalog can be rebuilt from storages.
+func catalogDelivery(logCh chan logger.LogRecord, job Job, rec catalog.Record, results []deliveryResult, startTime time.Time) {
+	records := make([]catalog.Record, 0, len(results))
+	for _, r := range results {
+		sr := rec
+		sr.Storage = r.storage
+		sr.Paths = r.paths
+		sr.DeliveredAt = startTime.Add(r.time)
+		sr.Success = r.err == nil
+		if r.err != nil {
+			sr.Error = r.err.Error()
+		}
+		records = append(records, sr)
+	}
+
+	if err := job.GetCatalog().Put(records...); err != nil {
+		logCh <- logger.Log(job.GetName(), "").Warnf("Failed to record backups to catalog: %s", err)
+	}
 }
 
 func (s Storages) ListBackups(ofs string) TargetsOnStorages {
@@ -104,6 +456,16 @@ func (s Storages) ListBackups(ofs string) TargetsOnStorages {
 	return result
 }
 
+func (s Storages) GetFileReader(stName, filePath string) (io.ReadCloser, error) {
+	for _, st := range s {
+		if st.GetName() == stName {
+			return st.GetFileReader(filePath)
+		}
+	}
+
+	return nil, fmt.Errorf("storage `%s` is not configured for the job", stName)
+}
+
 func (s Storages) CleanupTmpData(job Job) error {
 	errs := new(multierror.Error)
 
@@ -119,6 +481,9 @@ func (s Storages) CleanupTmpData(job Job) error {
 			}
 		}
 
+		// cleanup tmp checksum manifest
+		_ = os.Remove(tmpBakFile + checksum.Ext)
+
 		// cleanup tmp backup file
 		if err := os.Remove(tmpBakFile); err != nil {
 			errs = multierror.Append(errs, err)
@@ -127,9 +492,138 @@ func (s Storages) CleanupTmpData(job Job) error {
 	return errs.ErrorOrNil()
 }
 
+// streamWriter writes the backup to the storages pipes and to the temp file if it's set.
+// Pipes of the failed storages are skipped, so they don't break the delivery to the others.
+// The write fails once no pipes and no temp file are left, so the dump is aborted instead of being discarded.
+type streamWriter struct {
+	pipes []*io.PipeWriter
+	file  *os.File
+	size  int64
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if sw.file != nil {
+		if _, err := sw.file.Write(p); err != nil {
+			return 0, err
+		}
+	}
+
+	var pipeErr error
+	alive := sw.pipes[:0]
+	for _, pw := range sw.pipes {
+		if _, err := pw.Write(p); err == nil {
+			alive = append(alive, pw)
+		} else {
+			pipeErr = err
+		}
+	}
+	sw.pipes = alive
+
+	if sw.file == nil && len(sw.pipes) == 0 {
+		if pipeErr == nil {
+			pipeErr = errors.New("no storages to stream to")
+		}
+		return 0, fmt.Errorf("delivery to all storages failed: %w", pipeErr)
+	}
+	sw.size += int64(len(p))
+
+	return len(p), nil
+}
+
 func (s Storages) Close() error {
 	for _, st := range s {
 		_ = st.Close()
 	}
 	return nil
 }
+
+// WithRetry wraps the storage so its delivery, listing, reading and deletion are repeated on failure according to the policy.
+// Repeated deliveries resume the interrupted uploads if the storage supports it. Streams can't be read twice, so they aren't repeated.
+func WithRetry(st Storage, r storage.Retry) Storage {
+	if r.Attempts <= 1 {
+		return st
+	}
+
+	rs := &retryStorage{Storage: st, retry: r}
+	if _, ok := st.(StreamStorage); ok {
+		return &retryStreamStorage{rs}
+	}
+	return rs
+}
+
+// WithoutRetry returns the storage wrapped by WithRetry, so its failures are reported at once
+func WithoutRetry(st Storage) Storage {
+	switch s := st.(type) {
+	case *retryStorage:
+		return s.Storage
+	case *retryStreamStorage:
+		return s.Storage
+	}
+	return st
+}
+
+type retryStorage struct {
+	Storage
+	retry storage.Retry
+}
+
+type retryStreamStorage struct {
+	*retryStorage
+}
+
+func (s *retryStreamStorage) DeliveryBackupStream(logCh chan logger.LogRecord, jobName, tmpBackupFile, ofs, bakType string, src io.Reader) error {
+	return s.Storage.(StreamStorage).DeliveryBackupStream(logCh, jobName, tmpBackupFile, ofs, bakType, src)
+}
+
+func (s *retryStorage) Clone() Storage {
+	return WithRetry(s.Storage.Clone(), s.retry)
+}
+
+func (s *retryStorage) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupPath, ofs, bakType string) error {
+	rs, resumable := s.Storage.(ResumableStorage)
+	if resumable {
+		defer rs.SetResume(false)
+	}
+
+	return s.retry.Do(func(attempt int) error {
+		if resumable {
+			rs.SetResume(attempt > 1)
+		}
+		return s.Storage.DeliveryBackup(logCh, jobName, tmpBackupPath, ofs, bakType)
+	}, s.logFail(logCh, jobName, "delivery"))
+}
+
+func (s *retryStorage) DeleteOldBackups(logCh chan logger.LogRecord, ofsPart string, job Job, full bool) error {
+	return s.retry.Do(func(int) error {
+		return s.Storage.DeleteOldBackups(logCh, ofsPart, job, full)
+	}, s.logFail(logCh, job.GetName(), "rotation"))
+}
+
+func (s *retryStorage) GetFileReader(ofsPath string) (r io.ReadCloser, err error) {
+	err = s.retry.Do(func(int) error {
+		r, err = s.Storage.GetFileReader(ofsPath)
+		return err
+	}, nil)
+	return
+}
+
+func (s *retryStorage) DeleteFile(ofsPath string) error {
+	return s.retry.Do(func(int) error {
+		return s.Storage.DeleteFile(ofsPath)
+	}, nil)
+}
+
+func (s *retryStorage) ListBackups(ofsPath string) (list []string, err error) {
+	err = s.retry.Do(func(int) error {
+		list, err = s.Storage.ListBackups(ofsPath)
+		return err
+	}, nil)
+	return
+}
+
+func (s *retryStorage) logFail(logCh chan logger.LogRecord, jobName, op string) func(int, error, time.Duration) {
+	return func(attempt int, err error, delay time.Duration) {
+		logCh <- logger.Log(jobName, s.GetName()).Warnf("Backup %s failed (attempt %d of %d): %s. Retrying in %s",
+			op, attempt, s.retry.Attempts, err, delay)
+	}
+}
@@ -7,4 +7,7 @@ var (
 	ErrArgSuccessExit = errors.New("arg success exit")
 	ErrConfig         = errors.New("config incorrect")
 	ErrExecution      = errors.New("execution finished with errors")
+	ErrNotFound       = errors.New("not found")
+	ErrPinned         = errors.New("pinned")
+	ErrNotSupported   = errors.New("not supported")
 )
@@ -20,9 +20,10 @@ import (
 type BackupType string
 
 const (
+	// YearlyBackupDay and MonthlyBackupDay are the days of the full incremental backups
 	YearlyBackupDay  = "1"
 	MonthlyBackupDay = "1"
-	WeeklyBackupDay  = "0"
+	BackupTimeFormat = "2006-01-02_15-04"
 	LatestVersionURL = "https://github.com/nixys/nxs-backup/releases/latest/download/nxs-backup"
 	VersionURL       = "https://github.com/nixys/nxs-backup/releases/download/v"
 
@@ -30,6 +31,7 @@ const (
 	IncFiles             BackupType = "inc_files"
 	Mysql                BackupType = "mysql"
 	MysqlXtrabackup      BackupType = "mysql_xtrabackup"
+	MysqlBinlog          BackupType = "mysql_binlog"
 	MariadbBackup        BackupType = "mariadb_backup"
 	Postgresql           BackupType = "postgresql"
 	PostgresqlBasebackup BackupType = "postgresql_basebackup"
@@ -41,12 +43,15 @@ const (
 var DecadesBackupDays = []string{"1", "11", "21"}
 var CPULimit = 0
 
+var backupTimeRegexp = regexp.MustCompile(`_(\d{4}-\d{2}-\d{2}_\d{2}-\d{2})\.`)
+
 func AllowedBackupTypesList() []string {
 	return []string{
 		string(DescFiles),
 		string(IncFiles),
 		string(Mysql),
 		string(MysqlXtrabackup),
+		string(MysqlBinlog),
 		string(MariadbBackup),
 		string(Postgresql),
 		string(PostgresqlBasebackup),
@@ -93,7 +98,7 @@ func GetDateTimeNow(unit string) (res string) {
 	case "previous_year":
 		res = strconv.Itoa(currentTime.Year() - 1)
 	default:
-		res = currentTime.Format("2006-01-02_15-04")
+		res = currentTime.Format(BackupTimeFormat)
 	}
 
 	return res
@@ -111,7 +116,7 @@ func GetDecadeDaySubdir() (decadeDay string) {
 	return
 }
 
-func GetFileFullPath(dirPath, baseName, baseExtension, prefix string, gZip bool) (fullPath string) {
+func GetFileFullPath(dirPath, baseName, baseExtension, prefix, compressExt string) (fullPath string) {
 
 	fileName := fmt.Sprintf("%s_%s.%s", baseName, GetDateTimeNow(""), baseExtension)
 
@@ -119,15 +124,28 @@ func GetFileFullPath(dirPath, baseName, baseExtension, prefix string, gZip bool)
 		fileName = fmt.Sprintf("%s-%s", prefix, fileName)
 	}
 
-	if gZip {
-		fileName += ".gz"
-	}
+	fileName += compressExt
 
 	fullPath = filepath.Join(dirPath, fileName)
 
 	return fullPath
 }
 
+// GetBackupFileTime extracts the creation time from the backup file name
+func GetBackupFileTime(fileName string) (time.Time, bool) {
+	matches := backupTimeRegexp.FindStringSubmatch(filepath.Base(fileName))
+	if len(matches) < 2 {
+		return time.Time{}, false
+	}
+
+	t, err := time.ParseInLocation(BackupTimeFormat, matches[1], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
 // Contains checks if a string is present in a slice
 func Contains(s []string, str string) bool {
 	for _, v := range s {
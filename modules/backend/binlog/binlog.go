@@ -0,0 +1,169 @@
+package binlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/nixys/nxs-backup/modules/catalog"
+)
+
+// headLimit is the size of the dump beginning the binlog position is looked for in,
+// mysqldump writes it after the dump header and before the data
+const headLimit = 256 * 1024
+
+var (
+	dumpPosRegexp  = regexp.MustCompile(`CHANGE (?:MASTER|REPLICATION SOURCE) TO (?:MASTER|SOURCE)_LOG_FILE='([^']+)',\s*(?:MASTER|SOURCE)_LOG_POS=(\d+)`)
+	dumpGTIDRegexp = regexp.MustCompile(`SET (?:@@GLOBAL\.GTID_PURGED=(?:/\*!80000 '\+'\*/ )?|GLOBAL gtid_slave_pos=)'([^']*)'`)
+	// infoFiles are written to the backup dir by xtrabackup and mariabackup
+	infoFiles = []string{"xtrabackup_binlog_info", "mariadb_backup_binlog_info"}
+	// segmentRegexp extracts the binlog segment name from the name of its backup file
+	segmentRegexp = regexp.MustCompile(`^(.+)_\d{4}-\d{2}-\d{2}_\d{2}-\d{2}\.binlog`)
+)
+
+// the binlog file starts with the magic number followed by the events, the event header starts with
+// the timestamp and has the event size at the offset 9
+const (
+	magicSize       = 4
+	eventHeaderSize = 19
+)
+
+// Head keeps the beginning of the dump passing through it to find the binlog position in
+type Head struct {
+	buf bytes.Buffer
+}
+
+func (h *Head) Write(p []byte) (int, error) {
+	if n := headLimit - h.buf.Len(); n > 0 {
+		h.buf.Write(p[:min(n, len(p))])
+	}
+	return len(p), nil
+}
+
+// Position returns the binlog position written to the dump by mysqldump with `--source-data` or `--master-data` option
+func (h *Head) Position() (catalog.BinlogPosition, bool) {
+	m := dumpPosRegexp.FindSubmatch(h.buf.Bytes())
+	if m == nil {
+		return catalog.BinlogPosition{}, false
+	}
+	pos, err := strconv.ParseUint(string(m[2]), 10, 64)
+	if err != nil {
+		return catalog.BinlogPosition{}, false
+	}
+
+	p := catalog.BinlogPosition{File: string(m[1]), Pos: pos}
+	if g := dumpGTIDRegexp.FindSubmatch(h.buf.Bytes()); g != nil {
+		p.GTID = strings.ReplaceAll(string(g[1]), "\n", "")
+	}
+	return p, true
+}
+
+// ReadInfoFile reads the binlog position saved to the backup dir by xtrabackup or mariabackup
+func ReadInfoFile(backupDir string) (catalog.BinlogPosition, bool, error) {
+	for _, name := range infoFiles {
+		data, err := os.ReadFile(path.Join(backupDir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return catalog.BinlogPosition{}, false, err
+		}
+
+		// the file is `<file>\t<position>[\t<gtid set>]`, the gtid set may be split into lines
+		fields := strings.Fields(string(data))
+		if len(fields) < 2 {
+			return catalog.BinlogPosition{}, false, nil
+		}
+		pos, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return catalog.BinlogPosition{}, false, err
+		}
+		return catalog.BinlogPosition{
+			File: fields[0],
+			Pos:  pos,
+			GTID: strings.Join(fields[2:], ""),
+		}, true, nil
+	}
+	return catalog.BinlogPosition{}, false, nil
+}
+
+// ServerID returns the id of the MySQL server, the binlog positions are meaningful for the server they are taken on only
+func ServerID(db *sqlx.DB) (uint32, error) {
+	var id uint32
+	err := db.Get(&id, "SELECT @@server_id")
+	return id, err
+}
+
+// SegmentName returns the name of the binlog segment stored in the backup file
+func SegmentName(file string) string {
+	m := segmentRegexp.FindStringSubmatch(path.Base(file))
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// splitSegment splits the segment name into the binlog base name and the sequence number
+func splitSegment(seg string) (string, int) {
+	i := strings.LastIndex(seg, ".")
+	if i < 0 {
+		return seg, 0
+	}
+	n, _ := strconv.Atoi(seg[i+1:])
+	return seg[:i], n
+}
+
+// SegmentLess reports whether the segment a is written before b, the sequence numbers may exceed their zero padding
+func SegmentLess(a, b string) bool {
+	aBase, aNum := splitSegment(a)
+	bBase, bNum := splitSegment(b)
+	if aBase != bBase {
+		return aBase < bBase
+	}
+	return aNum < bNum
+}
+
+// IsNextSegment reports whether the segment seg is written right after prev
+func IsNextSegment(prev, seg string) bool {
+	pBase, pNum := splitSegment(prev)
+	sBase, sNum := splitSegment(seg)
+	return pBase == sBase && sNum == pNum+1
+}
+
+// FirstEventTime returns the time of the first event of the raw binlog segment file, the time the segment is opened at.
+// The events with zero timestamp are skipped, they are added by the server to the binlogs sent to the replicas.
+func FirstEventTime(file string) (time.Time, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer func() { _ = f.Close() }()
+
+	header := make([]byte, eventHeaderSize)
+	for offset := int64(magicSize); ; {
+		if _, err = f.ReadAt(header, offset); err != nil {
+			if errors.Is(err, io.EOF) {
+				return time.Time{}, fmt.Errorf("no events with timestamp found in binlog segment `%s`", path.Base(file))
+			}
+			return time.Time{}, err
+		}
+		if ts := binary.LittleEndian.Uint32(header[0:4]); ts != 0 {
+			return time.Unix(int64(ts), 0), nil
+		}
+		size := binary.LittleEndian.Uint32(header[9:13])
+		if size < eventHeaderSize {
+			return time.Time{}, fmt.Errorf("wrong event size %d in binlog segment `%s`", size, path.Base(file))
+		}
+		offset += int64(size)
+	}
+}
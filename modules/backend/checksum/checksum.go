@@ -0,0 +1,94 @@
+package checksum
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Ext is the extension of the checksum manifest stored next to the backup
+const Ext = ".sha256"
+
+// Writer calculates the checksum of data passing through it and writes the manifest on Close.
+// Close does not close the underlying writer.
+type Writer struct {
+	w        io.Writer
+	h        hash.Hash
+	filePath string
+}
+
+func NewWriter(filePath string, w io.Writer) *Writer {
+	return &Writer{
+		w:        w,
+		h:        sha256.New(),
+		filePath: filePath,
+	}
+}
+
+func (cw *Writer) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.h.Write(p[:n])
+	return n, err
+}
+
+func (cw *Writer) Close() error {
+	return WriteManifest(cw.filePath, hex.EncodeToString(cw.h.Sum(nil)))
+}
+
+// IsManifest checks if the file is a checksum manifest
+func IsManifest(fileName string) bool {
+	return strings.HasSuffix(fileName, Ext)
+}
+
+// Sum calculates the checksum of the data read from r
+func Sum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CreateManifest calculates the checksum of the file and writes the manifest next to it
+func CreateManifest(filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	sum, err := Sum(f)
+	if err != nil {
+		return err
+	}
+	return WriteManifest(filePath, sum)
+}
+
+// WriteManifest writes the manifest of the file in the `sha256sum` compatible format
+func WriteManifest(filePath, sum string) error {
+	return os.WriteFile(filePath+Ext, []byte(fmt.Sprintf("%s  %s\n", sum, path.Base(filePath))), 0644)
+}
+
+// ReadManifest returns the checksum stored in the manifest
+func ReadManifest(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum manifest")
+	}
+	if _, err = hex.DecodeString(fields[0]); err != nil || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("wrong checksum format in manifest")
+	}
+
+	return fields[0], nil
+}
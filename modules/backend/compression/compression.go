@@ -0,0 +1,204 @@
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz"
+
+	"github.com/nixys/nxs-backup/misc"
+)
+
+type Algo string
+
+const (
+	NoneAlgo Algo = "none"
+	GzipAlgo Algo = "gzip"
+	ZstdAlgo Algo = "zstd"
+	XzAlgo   Algo = "xz"
+)
+
+const (
+	gzipExt = ".gz"
+	zstdExt = ".zst"
+	xzExt   = ".xz"
+
+	defaultBlockSize = 1 << 20
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+
+	// xzDictCaps maps xz compression presets to the dictionary sizes
+	xzDictCaps = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+)
+
+// Params defines the compression settings of a job target
+type Params struct {
+	Algo    Algo
+	Level   int // compression level, the algorithm default is used if 0
+	Threads int // number of compression threads, depends on CPU limit if 0
+}
+
+// Compressor compresses backups before they are encrypted and written to the tmp dir.
+// A nil *Compressor is valid and means compression is disabled.
+type Compressor struct {
+	algo    Algo
+	level   int
+	threads int
+}
+
+func Init(p Params) (*Compressor, error) {
+	c := &Compressor{
+		algo:    p.Algo,
+		level:   p.Level,
+		threads: p.Threads,
+	}
+
+	if p.Threads < 0 {
+		return nil, fmt.Errorf("number of compression threads can't be negative")
+	}
+
+	switch p.Algo {
+	case NoneAlgo, "":
+		return nil, nil
+	case GzipAlgo:
+		if p.Level == 0 {
+			c.level = pgzip.BestCompression
+		}
+		if c.level < pgzip.BestSpeed || c.level > pgzip.BestCompression {
+			return nil, fmt.Errorf("wrong `%s` compression level %d, allowed levels: %d-%d", p.Algo, p.Level, pgzip.BestSpeed, pgzip.BestCompression)
+		}
+	case ZstdAlgo:
+		if p.Level == 0 {
+			c.level = 3
+		}
+		if c.level < 1 || c.level > 22 {
+			return nil, fmt.Errorf("wrong `%s` compression level %d, allowed levels: 1-22", p.Algo, p.Level)
+		}
+	case XzAlgo:
+		if p.Level == 0 {
+			c.level = 6
+		}
+		if c.level < 1 || c.level > 9 {
+			return nil, fmt.Errorf("wrong `%s` compression level %d, allowed levels: 1-9", p.Algo, p.Level)
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm `%s`, allowed: %s, %s, %s, %s", p.Algo, ZstdAlgo, GzipAlgo, XzAlgo, NoneAlgo)
+	}
+
+	return c, nil
+}
+
+// Ext returns the extension to be appended to the compressed backup file name
+func (c *Compressor) Ext() string {
+	if c == nil {
+		return ""
+	}
+	switch c.algo {
+	case GzipAlgo:
+		return gzipExt
+	case ZstdAlgo:
+		return zstdExt
+	case XzAlgo:
+		return xzExt
+	}
+	return ""
+}
+
+// Compress returns a writer that compresses data written to it. Close does not close the underlying writer.
+func (c *Compressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	if c == nil {
+		return nopWriteCloser{w}, nil
+	}
+
+	threads := c.threads
+	if threads == 0 {
+		threads = runtime.GOMAXPROCS(misc.CPULimit)
+	}
+
+	switch c.algo {
+	case GzipAlgo:
+		gzw, err := pgzip.NewWriterLevel(w, c.level)
+		if err != nil {
+			return nil, err
+		}
+		if err = gzw.SetConcurrency(defaultBlockSize, threads); err != nil {
+			return nil, err
+		}
+		return gzw, nil
+	case ZstdAlgo:
+		return zstd.NewWriter(w,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)),
+			zstd.WithEncoderConcurrency(threads),
+		)
+	case XzAlgo:
+		// xz compression is single-threaded
+		return xz.WriterConfig{DictCap: xzDictCaps[c.level]}.NewWriter(w)
+	}
+
+	return nopWriteCloser{w}, nil
+}
+
+// Decompress returns a reader with decompressed data. The compression algorithm is detected by the data header,
+// not compressed data returned as is.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReaderSize(r, defaultBlockSize)
+	header, _ := br.Peek(len(xzMagic))
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return pgzip.NewReaderN(br, defaultBlockSize, runtime.GOMAXPROCS(misc.CPULimit))
+	case bytes.HasPrefix(header, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case bytes.HasPrefix(header, xzMagic):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	}
+
+	return io.NopCloser(br), nil
+}
+
+// AlgoOf returns the compression algorithm of the not encrypted backup file by its extension
+func AlgoOf(fileName string) Algo {
+	switch {
+	case strings.HasSuffix(fileName, gzipExt):
+		return GzipAlgo
+	case strings.HasSuffix(fileName, zstdExt):
+		return ZstdAlgo
+	case strings.HasSuffix(fileName, xzExt):
+		return XzAlgo
+	}
+	return NoneAlgo
+}
+
+// TrimExt removes the compression extension from the file name
+func TrimExt(fileName string) string {
+	for _, ext := range []string{gzipExt, zstdExt, xzExt} {
+		if strings.HasSuffix(fileName, ext) {
+			return strings.TrimSuffix(fileName, ext)
+		}
+	}
+	return fileName
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
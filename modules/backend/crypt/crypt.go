@@ -0,0 +1,433 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/hkdf"
+)
+
+type Algo string
+
+const (
+	AgeAlgo       Algo = "age"
+	AES256GCMAlgo Algo = "aes256gcm"
+
+	rawAlgo Algo = "raw"
+)
+
+const (
+	ageExt = ".age"
+	aesExt = ".enc"
+
+	ageMagic = "age-encryption.org/v1\n"
+	aesMagic = "nxs-backup/aes256gcm/v1\n"
+
+	aesKeySize   = 32
+	aesSaltSize  = 32
+	aesChunkSize = 64 * 1024
+	aesInfo      = "nxs-backup aes256gcm payload key"
+)
+
+// Params defines the encryption settings of a job
+type Params struct {
+	Algo         Algo
+	Recipients   []string // age recipients used to encrypt backups
+	IdentityFile string   // age identities file used to decrypt backups
+	KeyFile      string   // file with AES-256 key
+}
+
+// Cipher encrypts backups before they are written to the tmp dir and decrypts them on read.
+// A nil *Cipher is valid and means encryption is disabled.
+type Cipher struct {
+	algo       Algo
+	recipients []age.Recipient
+	identities []age.Identity
+	key        []byte
+}
+
+type readCloser struct {
+	io.Reader
+	c io.Closer
+}
+
+func (rc *readCloser) Close() error {
+	return rc.c.Close()
+}
+
+func Init(p Params) (*Cipher, error) {
+	c := &Cipher{algo: p.Algo}
+
+	switch p.Algo {
+	case AgeAlgo:
+		if len(p.Recipients) == 0 {
+			return nil, fmt.Errorf("at least one recipient required for `%s` encryption", p.Algo)
+		}
+		for _, r := range p.Recipients {
+			rcp, err := age.ParseX25519Recipient(strings.TrimSpace(r))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse recipient `%s`: %w", r, err)
+			}
+			c.recipients = append(c.recipients, rcp)
+		}
+		if p.IdentityFile != "" {
+			f, err := os.Open(p.IdentityFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open identity file: %w", err)
+			}
+			defer func() { _ = f.Close() }()
+			if c.identities, err = age.ParseIdentities(f); err != nil {
+				return nil, fmt.Errorf("failed to parse identity file: %w", err)
+			}
+		}
+	case AES256GCMAlgo:
+		if p.KeyFile == "" {
+			return nil, fmt.Errorf("key file required for `%s` encryption", p.Algo)
+		}
+		key, err := ReadKeyFile(p.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.key = key
+	default:
+		return nil, fmt.Errorf("unknown encryption algo `%s`. Allowed algos: %s, %s", p.Algo, AgeAlgo, AES256GCMAlgo)
+	}
+
+	return c, nil
+}
+
+// Raw returns the cipher passing the data as is in both directions. It's used to copy encrypted backups between storages
+// without the keys.
+func Raw() *Cipher {
+	return &Cipher{algo: rawAlgo}
+}
+
+// Ext returns the extension to be appended to the encrypted backup file name
+func (c *Cipher) Ext() string {
+	if c == nil || c.algo == rawAlgo {
+		return ""
+	}
+	if c.algo == AgeAlgo {
+		return ageExt
+	}
+	return aesExt
+}
+
+// Encrypt returns a writer that encrypts data written to it. Close does not close the underlying writer.
+func (c *Cipher) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	if c == nil || c.algo == rawAlgo {
+		return nopWriteCloser{w}, nil
+	}
+
+	if c.algo == AgeAlgo {
+		return age.Encrypt(w, c.recipients...)
+	}
+
+	salt := make([]byte, aesSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.newAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(append([]byte(aesMagic), salt...)); err != nil {
+		return nil, err
+	}
+
+	return &aesWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, aesChunkSize),
+	}, nil
+}
+
+// Decrypt returns a reader with decrypted data if the source is encrypted, otherwise the source data returned as is.
+// The returned reader keeps the io.Closer of the source, if any.
+func (c *Cipher) Decrypt(r io.Reader) (io.Reader, error) {
+	if c != nil && c.algo == rawAlgo {
+		return r, nil
+	}
+
+	br := bufio.NewReaderSize(r, aesChunkSize)
+
+	var (
+		dr  io.Reader
+		err error
+	)
+
+	header, _ := br.Peek(len(aesMagic))
+	switch {
+	case bytes.HasPrefix(header, []byte(ageMagic)):
+		if c == nil || c.algo != AgeAlgo {
+			return nil, fmt.Errorf("file encrypted with `%s`, but the job encryption is not configured accordingly", AgeAlgo)
+		}
+		if len(c.identities) == 0 {
+			return nil, fmt.Errorf("identity file required to decrypt `%s` encrypted files", AgeAlgo)
+		}
+		dr, err = age.Decrypt(br, c.identities...)
+	case bytes.Equal(header, []byte(aesMagic)):
+		if c == nil || c.algo != AES256GCMAlgo {
+			return nil, fmt.Errorf("file encrypted with `%s`, but the job encryption is not configured accordingly", AES256GCMAlgo)
+		}
+		dr, err = c.newAESReader(br)
+	default:
+		dr = br
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cl, ok := r.(io.Closer); ok {
+		return &readCloser{Reader: dr, c: cl}, nil
+	}
+	return dr, nil
+}
+
+// DecryptReadCloser decrypts the source on the fly like Decrypt, closing the returned reader closes the source.
+// The source is closed if it can't be decrypted.
+func (c *Cipher) DecryptReadCloser(rc io.ReadCloser) (io.ReadCloser, error) {
+	r, err := c.Decrypt(rc)
+	if err != nil {
+		_ = rc.Close()
+		return nil, err
+	}
+	if drc, ok := r.(io.ReadCloser); ok {
+		return drc, nil
+	}
+	return &readCloser{Reader: r, c: rc}, nil
+}
+
+// EncryptFile encrypts the file in place
+func (c *Cipher) EncryptFile(filePath string) error {
+	if c == nil || c.algo == rawAlgo {
+		return nil
+	}
+
+	src, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	tmpFile := path.Join(path.Dir(filePath), "."+path.Base(filePath)+".tmp")
+	dst, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dst.Close()
+		_ = os.Remove(tmpFile)
+	}()
+
+	w, err := c.Encrypt(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, src); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, filePath)
+}
+
+// AlgoOf returns the encryption algorithm of the backup file by its extension, empty if the file isn't encrypted
+func AlgoOf(fileName string) Algo {
+	switch {
+	case strings.HasSuffix(fileName, ageExt):
+		return AgeAlgo
+	case strings.HasSuffix(fileName, aesExt):
+		return AES256GCMAlgo
+	}
+	return ""
+}
+
+// TrimExt removes the encryption extension from the file name
+func TrimExt(fileName string) string {
+	for _, ext := range []string{ageExt, aesExt} {
+		if strings.HasSuffix(fileName, ext) {
+			return strings.TrimSuffix(fileName, ext)
+		}
+	}
+	return fileName
+}
+
+// ReadKeyFile reads a 32 bytes key stored in hex, base64 or raw form
+func ReadKeyFile(keyFile string) ([]byte, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	if len(data) == aesKeySize {
+		return data, nil
+	}
+
+	s := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == aesKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == aesKeySize {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("key file must contain %d bytes key (raw, hex or base64 encoded)", aesKeySize)
+}
+
+// newAEAD derives a per-file key from the job key and the random salt
+func (c *Cipher) newAEAD(salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, aesKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.key, salt, []byte(aesInfo)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *Cipher) newAESReader(br *bufio.Reader) (io.Reader, error) {
+	header := make([]byte, len(aesMagic)+aesSaltSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	aead, err := c.newAEAD(header[len(aesMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return &aesReader{
+		r:    br,
+		aead: aead,
+		buf:  make([]byte, aesChunkSize+aead.Overhead()),
+	}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// aesWriter encrypts data by chunks, each chunk has its own nonce made of the chunk counter and the last chunk flag
+type aesWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+func (aw *aesWriter) Write(p []byte) (n int, err error) {
+	if aw.closed {
+		return 0, fmt.Errorf("write to closed encryption writer")
+	}
+	for len(p) > 0 {
+		if len(aw.buf) == aesChunkSize {
+			if err = aw.flush(false); err != nil {
+				return
+			}
+		}
+		c := copy(aw.buf[len(aw.buf):aesChunkSize], p)
+		aw.buf = aw.buf[:len(aw.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return
+}
+
+func (aw *aesWriter) Close() error {
+	if aw.closed {
+		return nil
+	}
+	aw.closed = true
+	return aw.flush(true)
+}
+
+func (aw *aesWriter) flush(last bool) error {
+	out := aw.aead.Seal(nil, chunkNonce(aw.counter, last), aw.buf, nil)
+	if _, err := aw.w.Write(out); err != nil {
+		return err
+	}
+	aw.counter++
+	aw.buf = aw.buf[:0]
+	return nil
+}
+
+type aesReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	plain   []byte
+	counter uint64
+	last    bool
+}
+
+func (ar *aesReader) Read(p []byte) (int, error) {
+	for len(ar.plain) == 0 {
+		if ar.last {
+			return 0, io.EOF
+		}
+		if err := ar.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, ar.plain)
+	ar.plain = ar.plain[n:]
+	return n, nil
+}
+
+func (ar *aesReader) readChunk() error {
+	n, err := io.ReadFull(ar.r, ar.buf)
+	switch err {
+	case nil:
+		// the full chunk is the last one if nothing follows it
+		if _, perr := ar.r.Peek(1); perr == io.EOF {
+			ar.last = true
+		}
+	case io.ErrUnexpectedEOF:
+		ar.last = true
+	case io.EOF:
+		return io.ErrUnexpectedEOF
+	default:
+		return err
+	}
+
+	plain, err := ar.aead.Open(ar.buf[:0], chunkNonce(ar.counter, ar.last), ar.buf[:n], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt data: %w", err)
+	}
+	ar.counter++
+	ar.plain = plain
+	return nil
+}
+
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	for i := 10; i >= 3; i-- {
+		nonce[i] = byte(counter)
+		counter >>= 8
+	}
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
@@ -4,6 +4,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/juju/ratelimit"
 	"gopkg.in/ini.v1"
@@ -98,3 +99,21 @@ func GetLimitedFileReader(filePath string, rateLim int64) (*LimitedReadCloser, e
 
 	return lrc, err
 }
+
+func GetLimitedReader(r io.Reader, rateLim int64) io.Reader {
+	if rateLim == 0 {
+		return r
+	}
+
+	bucket := ratelimit.NewBucketWithRate(float64(rateLim), rateLim*2)
+	return ratelimit.Reader(r, bucket)
+}
+
+// FreeSpace returns the space available for unprivileged users on the file system of the path
+func FreeSpace(p string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
@@ -7,16 +7,14 @@ import (
 	"os/exec"
 	"path"
 	"regexp"
-	"runtime"
 
-	"github.com/klauspost/pgzip"
-
-	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backend/compression"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backend/files"
 )
 
 const (
-	defaultBlockSize = 1 << 20
 	regexToIgnoreErr = "^tar:.*(Removing leading|socket ignored|file changed as we read it|Удаляется начальный|сокет проигнорирован|файл изменился во время чтения)"
 )
 
@@ -25,62 +23,130 @@ type Error struct {
 	Stderr string
 }
 
+type UntarOpts struct {
+	Src         io.Reader
+	Dst         string
+	Incremental bool
+}
+
 type TarOpts struct {
 	Src         string
 	Dst         string
 	Incremental bool
-	Gzip        bool
+	Compressor  *compression.Compressor
 	SaveAbsPath bool
 	RateLim     int64
 	Excludes    []string
+	Cipher      *crypt.Cipher
+	Stream      io.Writer // if set, the archive is written to it instead of the Dst file
 }
 
 func (e Error) Error() string {
 	return e.Err.Error()
 }
 
-func GetGZipFileWriter(filePath string, gZip bool, rateLim int64) (io.WriteCloser, error) {
-	var gzw *pgzip.Writer
+type writeCloserChain struct {
+	io.Writer
+	closers []io.Closer
+}
 
+// Close closes the chain of writers starting from the top one. Repeated calls do nothing.
+func (wc *writeCloserChain) Close() (err error) {
+	for _, c := range wc.closers {
+		if cErr := c.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+	wc.closers = nil
+	return
+}
+
+// GetFileWriter returns a writer that compresses (if compressor is set) and encrypts (if cipher is set) data before writing it to the file.
+// The checksum manifest of the written data is created next to the file on Close.
+func GetFileWriter(filePath string, cmp *compression.Compressor, rateLim int64, c *crypt.Cipher) (io.WriteCloser, error) {
 	lwc, err := files.GetLimitedFileWriter(filePath, rateLim)
 	if err != nil {
 		return nil, err
 	}
 
-	if gZip {
-		if gzw, err = pgzip.NewWriterLevel(lwc, pgzip.BestCompression); err != nil {
+	wc, err := GetWriter(lwc, filePath, cmp, c)
+	if err != nil {
+		_ = lwc.Close()
+		return nil, err
+	}
+
+	return &writeCloserChain{
+		Writer:  wc,
+		closers: []io.Closer{wc, lwc},
+	}, nil
+}
+
+// GetWriter returns a writer that compresses (if compressor is set) and encrypts (if cipher is set) data before writing it to w.
+// The checksum manifest of the written data is created next to the file path on Close. Close does not close w.
+func GetWriter(w io.Writer, filePath string, cmp *compression.Compressor, c *crypt.Cipher) (io.WriteCloser, error) {
+	// checksum is calculated of the data written to the storage, so it's verified without the decryption key
+	cw := checksum.NewWriter(filePath, w)
+	wc := &writeCloserChain{Writer: cw, closers: []io.Closer{cw}}
+
+	if c != nil {
+		ew, err := c.Encrypt(wc.Writer)
+		if err != nil {
 			return nil, err
 		}
-		err = gzw.SetConcurrency(defaultBlockSize, runtime.GOMAXPROCS(misc.CPULimit))
-		lwc = gzw
+		wc.Writer = ew
+		wc.closers = append([]io.Closer{ew}, wc.closers...)
 	}
 
-	return lwc, err
+	if cmp != nil {
+		cw, err := cmp.Compress(wc.Writer)
+		if err != nil {
+			return nil, err
+		}
+		wc.Writer = cw
+		wc.closers = append([]io.Closer{cw}, wc.closers...)
+	}
+
+	return wc, nil
 }
 
-func GZip(src, dst string, rateLim int64) error {
-	fileWriter, err := GetGZipFileWriter(dst, true, rateLim)
+// Pack copies the file through the compression and encryption writer chain
+func Pack(src, dst string, cmp *compression.Compressor, rateLim int64, c *crypt.Cipher) error {
+	fileWriter, err := GetFileWriter(dst, cmp, rateLim, c)
 	if err != nil {
 		return err
 	}
-	defer func() { _ = fileWriter.Close() }()
 
 	file, err := os.Open(src)
 	if err != nil {
+		_ = fileWriter.Close()
 		return err
 	}
 	defer func() { _ = file.Close() }()
 
-	_, err = io.Copy(fileWriter, file)
-	return err
+	if _, err = io.Copy(fileWriter, file); err != nil {
+		_ = fileWriter.Close()
+		return err
+	}
+	return fileWriter.Close()
 }
 
 func Tar(o TarOpts) error {
-	tarWriter, err := GetGZipFileWriter(o.Dst, o.Gzip, o.RateLim)
+	var (
+		tarWriter io.WriteCloser
+		err       error
+	)
+
+	// the stream write errors are kept, since tar killed by the closed pipe isn't treated as failed
+	var sw *streamErrWriter
+	if o.Stream != nil {
+		sw = &streamErrWriter{w: o.Stream}
+		tarWriter, err = GetWriter(sw, o.Dst, o.Compressor, o.Cipher)
+	} else {
+		tarWriter, err = GetFileWriter(o.Dst, o.Compressor, o.RateLim, o.Cipher)
+	}
 	if err != nil {
 		return err
 	}
-	defer func() { _ = tarWriter.Close() }()
 
 	var stderr bytes.Buffer
 	var args []string
@@ -110,6 +176,7 @@ func Tar(o TarOpts) error {
 
 	if err = cmd.Run(); err != nil {
 		if cmd.ProcessState.ExitCode() == 2 || checkIsRealError(stderr.String()) {
+			_ = tarWriter.Close()
 			return Error{
 				Err:    err,
 				Stderr: stderr.String(),
@@ -117,6 +184,59 @@ func Tar(o TarOpts) error {
 		}
 	}
 
+	err = tarWriter.Close()
+	if sw != nil && sw.err != nil {
+		return sw.err
+	}
+	return err
+}
+
+// streamErrWriter keeps the first error of the writes to the stream
+type streamErrWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (sw *streamErrWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	if err != nil && sw.err == nil {
+		sw.err = err
+	}
+	return n, err
+}
+
+func Untar(o UntarOpts) error {
+	tarReader, err := compression.Decompress(o.Src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tarReader.Close() }()
+
+	if err = os.MkdirAll(o.Dst, os.ModePerm); err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	var args []string
+
+	if o.Incremental {
+		args = append(args, "--listed-incremental=/dev/null")
+	}
+	args = append(args, "--extract")
+	args = append(args, "--file=-")
+	args = append(args, "--directory="+o.Dst)
+
+	cmd := exec.Command("tar", args...)
+	cmd.Stdin = tarReader
+	cmd.Stderr = &stderr
+
+	if err = cmd.Run(); err != nil {
+		return Error{
+			Err:    err,
+			Stderr: stderr.String(),
+		}
+	}
+
 	return nil
 }
 
@@ -142,7 +142,7 @@ func (w *Client) Ls(path string) ([]os.FileInfo, error) {
 	defer func() { _ = res.Body.Close() }()
 	if res.StatusCode >= 400 {
 		if res.StatusCode == 404 {
-			return nil, fmt.Errorf("%s: %v", path, fs.ErrNotExist)
+			return nil, fmt.Errorf("%s: %w", path, fs.ErrNotExist)
 		}
 		return nil, fmt.Errorf("%s(%d): can't get things in %s", httpFriendlyStatus(res.StatusCode), res.StatusCode, filepath.Base(path))
 	}
@@ -230,12 +230,31 @@ func (w *Client) Copy(src, dst string) error {
 	return nil
 }
 
+func (w *Client) Move(src, dst string) error {
+	res, err := w.request("MOVE", src, nil, func(req *http.Request) {
+		req.Header.Add("Destination", w.URL+encodeURL(dst))
+		req.Header.Add("Overwrite", "T")
+	})
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("%s(%d): can't move %s to %s", httpFriendlyStatus(res.StatusCode), res.StatusCode, src, dst)
+	}
+	return nil
+}
+
 func (w *Client) Read(path string) (io.ReadCloser, error) {
 	res, err := w.request("GET", path, nil, nil)
 	if err != nil {
 		return nil, err
 	}
 	if res.StatusCode >= 400 {
+		_ = res.Body.Close()
+		if res.StatusCode == 404 {
+			return nil, fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+		}
 		return nil, fmt.Errorf("%s(%d): can't read %s", httpFriendlyStatus(res.StatusCode), res.StatusCode, path)
 	}
 	return res.Body, nil
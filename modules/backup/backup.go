@@ -1,16 +1,24 @@
 package backup
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/hashicorp/go-multierror"
 
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backend/files"
 	"github.com/nixys/nxs-backup/modules/logger"
+	"github.com/nixys/nxs-backup/modules/metrics"
+	"github.com/nixys/nxs-backup/modules/storage"
 )
 
 func Perform(logCh chan logger.LogRecord, job interfaces.Job) error {
@@ -33,6 +41,12 @@ func Perform(logCh chan logger.LogRecord, job interfaces.Job) error {
 		}
 	}
 
+	if err := checkFreeSpace(logCh, job); err != nil {
+		logCh <- logger.Log(job.GetName(), "").Errorf("Job `%s` skipped. %s", job.GetName(), err)
+		errs = multierror.Append(errs, err)
+		return errs.ErrorOrNil()
+	}
+
 	logCh <- logger.Log(job.GetName(), "").Info("Starting")
 
 	if jobTmpDir := job.GetTempDir(); jobTmpDir != "" {
@@ -69,9 +83,176 @@ func Perform(logCh chan logger.LogRecord, job interfaces.Job) error {
 		if err := job.DeleteOldBackups(logCh, ""); err != nil {
 			errs = multierror.Append(errs, err)
 		}
+	} else if err := job.GetStorages().FitSizeBudget(logCh, job); err != nil {
+		// the rotation is done before the backup, the size budget has to count the new one
+		errs = multierror.Append(errs, err)
 	}
+	PruneCatalog(logCh, job)
 
 	logCh <- logger.Log(job.GetName(), "").Info("Finished")
 
 	return errs.ErrorOrNil()
 }
+
+// checkFreeSpace compares the space available in the temp dir and on the job storages with the size of the previous backups.
+// With disabled safety backup it's called after the rotation, so the space freed by the old backups is taken into account.
+// The check is skipped if the size is unknown, e.g. on the first run or with disabled metrics.
+func checkFreeSpace(logCh chan logger.LogRecord, job interfaces.Job) error {
+	var (
+		size  uint64
+		short []string
+	)
+
+	for _, ofs := range job.GetTargetOfsList() {
+		size += uint64(job.GetOfsMetrics(ofs)[metrics.BackupSize])
+	}
+	if size == 0 {
+		logCh <- logger.Log(job.GetName(), "").Debug("Size of previous backups is unknown, free space check skipped")
+		return nil
+	}
+
+	if tmpDir := job.GetTempDir(); tmpDir != "" {
+		free, err := storage.NearestFreeSpace(tmpDir, files.FreeSpace)
+		if err != nil {
+			logCh <- logger.Log(job.GetName(), "").Warnf("Unable to get free space of temp dir: %s", err)
+		} else if free < size {
+			short = append(short, fmt.Sprintf("temp dir `%s` has %s available", tmpDir, formatSize(free)))
+		}
+	}
+
+	for _, st := range job.GetStorages() {
+		ss, ok := interfaces.WithoutRetry(st).(interfaces.SpaceStorage)
+		if !ok {
+			continue
+		}
+		free, err := ss.FreeSpace()
+		if err != nil {
+			logCh <- logger.Log(job.GetName(), st.GetName()).Warnf("Unable to get free space of storage: %s", err)
+		} else if free < size {
+			short = append(short, fmt.Sprintf("storage `%s` has %s available", st.GetName(), formatSize(free)))
+		}
+	}
+
+	if len(short) > 0 {
+		msg := fmt.Sprintf("Not enough free space for backups of %s expected by the previous run: %s", formatSize(size), strings.Join(short, ", "))
+		if job.IsBackupSafety() {
+			msg += ". Old backups are rotated after the new ones due to `safety_backup`"
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+func formatSize(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// PruneCatalog removes the job backups deleted from storages by the rotation from the catalog.
+// The storages are listed once per run, so the catalog queries don't have to.
+func PruneCatalog(logCh chan logger.LogRecord, job interfaces.Job) {
+	cat := job.GetCatalog()
+	if cat == nil {
+		return
+	}
+
+	for _, st := range job.GetStorages() {
+		for _, ofs := range job.GetTargetOfsList() {
+			list, err := st.ListBackups(ofs)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				logCh <- logger.Log(job.GetName(), st.GetName()).Warnf("Unable to list backups of `%s` to update catalog: %s", ofs, err)
+				continue
+			}
+			exists := make(map[string]bool, len(list))
+			for _, f := range list {
+				exists[storage.GetOfsRelPath(f, ofs)] = true
+			}
+			deleted, err := cat.Prune(job.GetName(), ofs, st.GetName(), exists)
+			if err != nil {
+				logCh <- logger.Log(job.GetName(), st.GetName()).Warnf("Failed to update catalog: %s", err)
+				return
+			}
+			if deleted > 0 {
+				logCh <- logger.Log(job.GetName(), st.GetName()).Debugf("Removed %d backups of `%s` missing on storage from catalog", deleted, ofs)
+			}
+		}
+	}
+}
+
+// DeleteBackup deletes the backup file listed on the job storage along with its checksum manifest, pinned backups can't be deleted.
+// The backup is stored in several retention period dirs as the links or copies with the same name, all of them are deleted,
+// so no link to the deleted file is left. The incremental backups can't be deleted one by one, since the later backups
+// of the month are restored on top of them.
+func DeleteBackup(logCh chan logger.LogRecord, job interfaces.Job, storageName, filePath string) error {
+	if job.GetType() == misc.IncFiles {
+		return fmt.Errorf("deleting single backups of `%s` jobs is %w, they are deleted by the rotation along with the backups depending on them", misc.IncFiles, misc.ErrNotSupported)
+	}
+
+	var st interfaces.Storage
+	for _, s := range job.GetStorages() {
+		if s.GetName() == storageName {
+			st = s
+			break
+		}
+	}
+	if st == nil {
+		return fmt.Errorf("storage `%s` of job `%s` %w", storageName, job.GetName(), misc.ErrNotFound)
+	}
+
+	for _, ofs := range job.GetTargetOfsList() {
+		list, err := st.ListBackups(ofs)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(list, filePath) || checksum.IsManifest(filePath) {
+			continue
+		}
+
+		pins, err := storage.LoadPins(job.GetCatalog(), job.GetName(), ofs, st.GetName())
+		if err != nil {
+			return err
+		}
+
+		var copies []string
+		files := make(map[string]bool, len(list))
+		for _, f := range list {
+			relPath := storage.GetOfsRelPath(f, ofs)
+			files[relPath] = true
+			if path.Base(f) == path.Base(filePath) {
+				if pins.Pinned(relPath) {
+					return fmt.Errorf("backup `%s` is %w, unpin it first", f, misc.ErrPinned)
+				}
+				copies = append(copies, relPath)
+			}
+		}
+
+		var errs *multierror.Error
+		for _, relPath := range copies {
+			if err = st.DeleteFile(relPath); err != nil {
+				logCh <- logger.Log(job.GetName(), st.GetName()).Errorf("Failed to delete backup `%s`: %v", relPath, err)
+				errs = multierror.Append(errs, err)
+				continue
+			}
+			if files[relPath+checksum.Ext] {
+				if err = st.DeleteFile(relPath + checksum.Ext); err != nil {
+					logCh <- logger.Log(job.GetName(), st.GetName()).Warnf("Failed to delete checksum manifest of backup `%s`: %v", relPath, err)
+				}
+			}
+			logCh <- logger.Log(job.GetName(), st.GetName()).Infof("Backup `%s` deleted", relPath)
+			if err = job.GetCatalog().DeletePath(job.GetName(), ofs, st.GetName(), relPath); err != nil {
+				logCh <- logger.Log(job.GetName(), st.GetName()).Warnf("Failed to update catalog: %s", err)
+			}
+		}
+		return errs.ErrorOrNil()
+	}
+
+	return fmt.Errorf("backup `%s` %w", filePath, misc.ErrNotFound)
+}
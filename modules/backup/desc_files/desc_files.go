@@ -3,6 +3,7 @@ package desc_files
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
@@ -14,49 +15,60 @@ import (
 
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/compression"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backend/exec_cmd"
 	"github.com/nixys/nxs-backup/modules/backend/targz"
+	"github.com/nixys/nxs-backup/modules/catalog"
 	"github.com/nixys/nxs-backup/modules/logger"
 	"github.com/nixys/nxs-backup/modules/metrics"
 )
 
 type job struct {
-	name             string
-	tmpDir           string
-	needToMakeBackup bool
-	safetyBackup     bool
-	deferredCopying  bool
-	diskRateLimit    int64
-	storages         interfaces.Storages
-	targets          map[string]target
-	dumpedObjects    map[string]interfaces.DumpObject
-	appMetrics       *metrics.Data
+	name                string
+	tmpDir              string
+	needToMakeBackup    bool
+	safetyBackup        bool
+	deferredCopying     bool
+	deliveryConcurrency int
+	streaming           bool
+	diskRateLimit       int64
+	storages            interfaces.Storages
+	cipher              *crypt.Cipher
+	targets             map[string]target
+	dumpedObjects       map[string]interfaces.DumpObject
+	appMetrics          *metrics.Data
+	catalog             *catalog.Catalog
 }
 
 type target struct {
 	path        string
-	gzip        bool
+	compressor  *compression.Compressor
 	saveAbsPath bool
 	excludes    []string
 }
 
 type JobParams struct {
-	Name             string
-	TmpDir           string
-	NeedToMakeBackup bool
-	SafetyBackup     bool
-	DeferredCopying  bool
-	DiskRateLimit    int64
-	Storages         interfaces.Storages
-	Sources          []SourceParams
-	Metrics          *metrics.Data
+	Name                string
+	TmpDir              string
+	NeedToMakeBackup    bool
+	SafetyBackup        bool
+	DeferredCopying     bool
+	DeliveryConcurrency int
+	Streaming           bool
+	DiskRateLimit       int64
+	Storages            interfaces.Storages
+	Cipher              *crypt.Cipher
+	Sources             []SourceParams
+	Metrics             *metrics.Data
+	Catalog             *catalog.Catalog
 }
 
 type SourceParams struct {
 	Name        string
 	Targets     []string
 	Excludes    []string
-	Gzip        bool
+	Compressor  *compression.Compressor
 	SaveAbsPath bool
 }
 
@@ -68,15 +80,19 @@ func Init(jp JobParams) (interfaces.Job, error) {
 	}
 
 	j := job{
-		name:             jp.Name,
-		tmpDir:           jp.TmpDir,
-		needToMakeBackup: jp.NeedToMakeBackup,
-		safetyBackup:     jp.SafetyBackup,
-		deferredCopying:  jp.DeferredCopying,
-		diskRateLimit:    jp.DiskRateLimit,
-		storages:         jp.Storages,
-		targets:          make(map[string]target),
-		dumpedObjects:    make(map[string]interfaces.DumpObject),
+		name:                jp.Name,
+		tmpDir:              jp.TmpDir,
+		needToMakeBackup:    jp.NeedToMakeBackup,
+		safetyBackup:        jp.SafetyBackup,
+		deferredCopying:     jp.DeferredCopying,
+		deliveryConcurrency: jp.DeliveryConcurrency,
+		streaming:           jp.Streaming,
+		diskRateLimit:       jp.DiskRateLimit,
+		storages:            jp.Storages,
+		cipher:              jp.Cipher,
+		targets:             make(map[string]target),
+		dumpedObjects:       make(map[string]interfaces.DumpObject),
+		catalog:             jp.Catalog,
 		appMetrics: jp.Metrics.RegisterJob(
 			metrics.JobData{
 				JobName:       jp.Name,
@@ -121,7 +137,7 @@ func Init(jp JobParams) (interfaces.Job, error) {
 
 					j.targets[ofs] = target{
 						path:        ofsFullPath,
-						gzip:        src.Gzip,
+						compressor:  src.Compressor,
 						saveAbsPath: src.SaveAbsPath,
 						excludes:    excludes,
 					}
@@ -139,9 +155,19 @@ func Init(jp JobParams) (interfaces.Job, error) {
 }
 
 func (j *job) SetOfsMetrics(ofs string, metricsMap map[string]float64) {
-	for m, v := range metricsMap {
-		j.appMetrics.Job[j.name].TargetMetrics[ofs].Values[m] = v
-	}
+	j.appMetrics.SetValues(j.name, ofs, metricsMap)
+}
+
+func (j *job) GetOfsMetrics(ofs string) map[string]float64 {
+	return j.appMetrics.GetValues(j.name, ofs)
+}
+
+func (j *job) GetCatalog() *catalog.Catalog {
+	return j.catalog
+}
+
+func (j *job) SetOfsStorageMetrics(ofs, storage string, metricsMap map[string]float64) {
+	j.appMetrics.SetStorageValues(j.name, ofs, storage, metricsMap)
 }
 
 func (j *job) GetName() string {
@@ -167,6 +193,14 @@ func (j *job) GetStoragesCount() int {
 	return len(j.storages)
 }
 
+func (j *job) GetStorages() interfaces.Storages {
+	return j.storages
+}
+
+func (j *job) GetDeliveryConcurrency() int {
+	return j.deliveryConcurrency
+}
+
 func (j *job) GetDumpObjects() map[string]interfaces.DumpObject {
 	return j.dumpedObjects
 }
@@ -224,7 +258,7 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 			metrics.BackupTimestamp: float64(startTime.Unix()),
 		})
 
-		tmpBackupFile := misc.GetFileFullPath(tmpDir, ofsPart, "tar", "", tgt.gzip)
+		tmpBackupFile := misc.GetFileFullPath(tmpDir, ofsPart, "tar", "", tgt.compressor.Ext()) + j.cipher.Ext()
 		err := os.MkdirAll(path.Dir(tmpBackupFile), os.ModePerm)
 		if err != nil {
 			logCh <- logger.Log(j.name, "").Errorf("Unable to create tmp dir with next error: %s", err)
@@ -232,14 +266,22 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 			continue
 		}
 
+		if j.streaming {
+			if err = j.streamBackup(logCh, ofsPart, tmpBackupFile, tgt, startTime); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+			continue
+		}
+
 		if err = targz.Tar(targz.TarOpts{
 			Src:         tgt.path,
 			Dst:         tmpBackupFile,
 			Incremental: false,
-			Gzip:        tgt.gzip,
+			Compressor:  tgt.compressor,
 			SaveAbsPath: tgt.saveAbsPath,
 			RateLim:     j.diskRateLimit,
 			Excludes:    tgt.excludes,
+			Cipher:      j.cipher,
 		}); err != nil {
 			j.SetOfsMetrics(ofsPart, map[string]float64{
 				metrics.BackupTime: float64(time.Since(startTime).Nanoseconds() / 1e6),
@@ -278,6 +320,96 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 	return errs.ErrorOrNil()
 }
 
+// streamBackup makes the archive and passes it to the storages without the temp file
+func (j *job) streamBackup(logCh chan logger.LogRecord, ofsPart, tmpBackupFile string, tgt target, startTime time.Time) error {
+	size, dumpErr, deliveryErr := j.storages.DeliveryStream(logCh, j, ofsPart, tmpBackupFile, func(w io.Writer) error {
+		return targz.Tar(targz.TarOpts{
+			Src:         tgt.path,
+			Dst:         tmpBackupFile,
+			Incremental: false,
+			Compressor:  tgt.compressor,
+			SaveAbsPath: tgt.saveAbsPath,
+			Excludes:    tgt.excludes,
+			Cipher:      j.cipher,
+			Stream:      w,
+		})
+	})
+	// the stream can't be delivered again, the dump object is kept only to cleanup tmp data
+	j.dumpedObjects[ofsPart] = interfaces.DumpObject{TmpFile: tmpBackupFile, Delivered: true}
+
+	if dumpErr != nil {
+		j.SetOfsMetrics(ofsPart, map[string]float64{
+			metrics.BackupTime: float64(time.Since(startTime).Nanoseconds() / 1e6),
+		})
+		logCh <- logger.Log(j.name, "").Errorf("Failed to stream backup \"%s\". Error: %v", tmpBackupFile, dumpErr)
+		var serr targz.Error
+		if errors.As(dumpErr, &serr) {
+			logCh <- logger.Log(j.name, "").Debugf("STDERR: %s", serr.Stderr)
+		}
+		return dumpErr
+	}
+	j.SetOfsMetrics(ofsPart, map[string]float64{
+		metrics.BackupOk:   float64(1),
+		metrics.BackupTime: float64(time.Since(startTime).Nanoseconds() / 1e6),
+		metrics.BackupSize: float64(size),
+	})
+
+	logCh <- logger.Log(j.name, "").Debugf("Streamed backup %s", tmpBackupFile)
+
+	if deliveryErr != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Failed to delivery backup. Errors: %v", deliveryErr)
+	}
+	return deliveryErr
+}
+
+func (j *job) DoRestore(logCh chan logger.LogRecord, p interfaces.RestoreParams) error {
+	tgt, ok := j.targets[p.Ofs]
+	if !ok {
+		return fmt.Errorf("Target `%s` not found in job `%s` ", p.Ofs, j.name)
+	}
+
+	dst := p.Dst
+	if dst == "" {
+		if tgt.saveAbsPath {
+			dst = "/"
+		} else {
+			dst = path.Dir(tgt.path)
+		}
+	}
+
+	for _, file := range p.Files {
+		if err := func() error {
+			src, err := j.storages.GetFileReader(p.Storage, file)
+			if err != nil {
+				logCh <- logger.Log(j.name, p.Storage).Errorf("Unable to get backup `%s` from storage. Error: %s", file, err)
+				return err
+			}
+			defer func() { _ = src.Close() }()
+
+			logCh <- logger.Log(j.name, p.Storage).Infof("Starting to restore `%s` to `%s`", file, dst)
+			if err = targz.Untar(targz.UntarOpts{
+				Src:         src,
+				Dst:         dst,
+				Incremental: false,
+			}); err != nil {
+				logCh <- logger.Log(j.name, p.Storage).Errorf("Failed to restore backup `%s`. Error: %v", file, err)
+				var serr targz.Error
+				if errors.As(err, &serr) {
+					logCh <- logger.Log(j.name, p.Storage).Debugf("STDERR: %s", serr.Stderr)
+				}
+				return err
+			}
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+
+	logCh <- logger.Log(j.name, p.Storage).Infof("Restore of `%s` completed", p.Ofs)
+
+	return nil
+}
+
 func (j *job) Close() error {
 	for _, st := range j.storages {
 		_ = st.Close()
@@ -11,53 +11,66 @@ import (
 
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backend/compression"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
+	"github.com/nixys/nxs-backup/modules/catalog"
 	"github.com/nixys/nxs-backup/modules/logger"
 	"github.com/nixys/nxs-backup/modules/metrics"
 )
 
 type job struct {
-	needToMakeBackup bool
-	gzip             bool
-	safetyBackup     bool
-	skipBackupRotate bool // deprecated
-	diskRateLimit    int64
-	name             string
-	appMetrics       *metrics.Data
-	dumpCmd          string
-	args             []string
-	envs             map[string]string
-	storages         interfaces.Storages
-	dumpedObjects    map[string]interfaces.DumpObject
+	needToMakeBackup    bool
+	compressor          *compression.Compressor
+	safetyBackup        bool
+	deliveryConcurrency int
+	skipBackupRotate    bool // deprecated
+	diskRateLimit       int64
+	name                string
+	appMetrics          *metrics.Data
+	catalog             *catalog.Catalog
+	dumpCmd             string
+	args                []string
+	envs                map[string]string
+	storages            interfaces.Storages
+	cipher              *crypt.Cipher
+	dumpedObjects       map[string]interfaces.DumpObject
 }
 
 type JobParams struct {
-	NeedToMakeBackup bool
-	Gzip             bool
-	SafetyBackup     bool
-	SkipBackupRotate bool // deprecated
-	DiskRateLimit    int64
-	Name             string
-	Metrics          *metrics.Data
-	DumpCmd          string
-	Args             []string
-	Envs             map[string]string
-	Storages         interfaces.Storages
+	NeedToMakeBackup    bool
+	Compressor          *compression.Compressor
+	SafetyBackup        bool
+	DeliveryConcurrency int
+	SkipBackupRotate    bool // deprecated
+	DiskRateLimit       int64
+	Name                string
+	Metrics             *metrics.Data
+	Catalog             *catalog.Catalog
+	DumpCmd             string
+	Args                []string
+	Envs                map[string]string
+	Storages            interfaces.Storages
+	Cipher              *crypt.Cipher
 }
 
 func Init(jp JobParams) (interfaces.Job, error) {
 
 	j := job{
-		name:             jp.Name,
-		dumpCmd:          jp.DumpCmd,
-		args:             jp.Args,
-		envs:             jp.Envs,
-		needToMakeBackup: jp.NeedToMakeBackup,
-		gzip:             jp.Gzip,
-		safetyBackup:     jp.SafetyBackup,
-		skipBackupRotate: jp.SkipBackupRotate,
-		diskRateLimit:    jp.DiskRateLimit,
-		storages:         jp.Storages,
-		dumpedObjects:    make(map[string]interfaces.DumpObject),
+		name:                jp.Name,
+		dumpCmd:             jp.DumpCmd,
+		args:                jp.Args,
+		envs:                jp.Envs,
+		needToMakeBackup:    jp.NeedToMakeBackup,
+		compressor:          jp.Compressor,
+		safetyBackup:        jp.SafetyBackup,
+		deliveryConcurrency: jp.DeliveryConcurrency,
+		skipBackupRotate:    jp.SkipBackupRotate,
+		diskRateLimit:       jp.DiskRateLimit,
+		storages:            jp.Storages,
+		cipher:              jp.Cipher,
+		dumpedObjects:       make(map[string]interfaces.DumpObject),
+		catalog:             jp.Catalog,
 		appMetrics: jp.Metrics.RegisterJob(
 			metrics.JobData{
 				JobName:       jp.Name,
@@ -77,9 +90,19 @@ func Init(jp JobParams) (interfaces.Job, error) {
 }
 
 func (j *job) SetOfsMetrics(_ string, metrics map[string]float64) {
-	for m, v := range metrics {
-		j.appMetrics.Job[j.name].TargetMetrics[j.name].Values[m] = v
-	}
+	j.appMetrics.SetValues(j.name, j.name, metrics)
+}
+
+func (j *job) GetOfsMetrics(_ string) map[string]float64 {
+	return j.appMetrics.GetValues(j.name, j.name)
+}
+
+func (j *job) GetCatalog() *catalog.Catalog {
+	return j.catalog
+}
+
+func (j *job) SetOfsStorageMetrics(_, storage string, metrics map[string]float64) {
+	j.appMetrics.SetStorageValues(j.name, j.name, storage, metrics)
 }
 
 func (j *job) GetName() string {
@@ -102,6 +125,14 @@ func (j *job) GetStoragesCount() int {
 	return len(j.storages)
 }
 
+func (j *job) GetStorages() interfaces.Storages {
+	return j.storages
+}
+
+func (j *job) GetDeliveryConcurrency() int {
+	return j.deliveryConcurrency
+}
+
 func (j *job) GetDumpObjects() map[string]interfaces.DumpObject {
 	return j.dumpedObjects
 }
@@ -213,14 +244,17 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, _ string) (err error) {
 		return err
 	}
 	tmpBackupPath := out.FullPath
-	if j.gzip {
-		newTmpBackup := tmpBackupPath + ".gz"
-		if err = targz.GZip(tmpBackupPath, newTmpBackup, j.diskRateLimit); err != nil {
-			logCh <- logger.Log(j.name, "").Errorf("Unable to gzip tmp backup: %s", err)
+	if j.compressor != nil || j.cipher != nil {
+		newTmpBackup := tmpBackupPath + j.compressor.Ext() + j.cipher.Ext()
+		if err = targz.Pack(tmpBackupPath, newTmpBackup, j.compressor, j.diskRateLimit, j.cipher); err != nil {
+			logCh <- logger.Log(j.name, "").Errorf("Unable to pack tmp backup: %s", err)
 			return err
 		}
 		_ = os.RemoveAll(tmpBackupPath)
 		tmpBackupPath = newTmpBackup
+	} else if err = checksum.CreateManifest(tmpBackupPath); err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to create checksum manifest: %s", err)
+		return err
 	}
 
 	logCh <- logger.Log(j.name, "").Debugf("Created temp backup %s.", tmpBackupPath)
@@ -234,6 +268,10 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, _ string) (err error) {
 	return j.storages.Delivery(logCh, j)
 }
 
+func (j *job) DoRestore(_ chan logger.LogRecord, _ interfaces.RestoreParams) error {
+	return fmt.Errorf("Restore is not supported for `%s` job type ", misc.External)
+}
+
 func (j *job) Close() error {
 	for _, st := range j.storages {
 		_ = st.Close()
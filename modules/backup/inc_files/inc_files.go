@@ -1,6 +1,7 @@
 package inc_files
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -16,47 +17,56 @@ import (
 
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/compression"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backend/exec_cmd"
 	"github.com/nixys/nxs-backup/modules/backend/targz"
+	"github.com/nixys/nxs-backup/modules/catalog"
 	"github.com/nixys/nxs-backup/modules/logger"
 	"github.com/nixys/nxs-backup/modules/metrics"
 )
 
 type job struct {
-	name            string
-	tmpDir          string
-	safetyBackup    bool
-	deferredCopying bool
-	diskRateLimit   int64
-	storages        interfaces.Storages
-	targets         map[string]target
-	dumpedObjects   map[string]interfaces.DumpObject
-	appMetrics      *metrics.Data
+	name                string
+	tmpDir              string
+	safetyBackup        bool
+	deferredCopying     bool
+	deliveryConcurrency int
+	diskRateLimit       int64
+	storages            interfaces.Storages
+	cipher              *crypt.Cipher
+	targets             map[string]target
+	dumpedObjects       map[string]interfaces.DumpObject
+	appMetrics          *metrics.Data
+	catalog             *catalog.Catalog
 }
 
 type target struct {
 	path        string
-	gzip        bool
+	compressor  *compression.Compressor
 	saveAbsPath bool
 	excludes    []string
 }
 
 type JobParams struct {
-	Name            string
-	TmpDir          string
-	SafetyBackup    bool
-	DeferredCopying bool
-	DiskRateLimit   int64
-	Storages        interfaces.Storages
-	Sources         []SourceParams
-	Metrics         *metrics.Data
+	Name                string
+	TmpDir              string
+	SafetyBackup        bool
+	DeferredCopying     bool
+	DeliveryConcurrency int
+	DiskRateLimit       int64
+	Storages            interfaces.Storages
+	Cipher              *crypt.Cipher
+	Sources             []SourceParams
+	Metrics             *metrics.Data
+	Catalog             *catalog.Catalog
 }
 
 type SourceParams struct {
 	Name        string
 	Targets     []string
 	Excludes    []string
-	Gzip        bool
+	Compressor  *compression.Compressor
 	SaveAbsPath bool
 }
 
@@ -67,14 +77,17 @@ func Init(jp JobParams) (interfaces.Job, error) {
 	}
 
 	j := job{
-		name:            jp.Name,
-		tmpDir:          jp.TmpDir,
-		safetyBackup:    jp.SafetyBackup,
-		deferredCopying: jp.DeferredCopying,
-		diskRateLimit:   jp.DiskRateLimit,
-		storages:        jp.Storages,
-		dumpedObjects:   make(map[string]interfaces.DumpObject),
-		targets:         make(map[string]target),
+		name:                jp.Name,
+		tmpDir:              jp.TmpDir,
+		safetyBackup:        jp.SafetyBackup,
+		deferredCopying:     jp.DeferredCopying,
+		deliveryConcurrency: jp.DeliveryConcurrency,
+		diskRateLimit:       jp.DiskRateLimit,
+		storages:            jp.Storages,
+		cipher:              jp.Cipher,
+		dumpedObjects:       make(map[string]interfaces.DumpObject),
+		targets:             make(map[string]target),
+		catalog:             jp.Catalog,
 		appMetrics: jp.Metrics.RegisterJob(
 			metrics.JobData{
 				JobName:       jp.Name,
@@ -119,7 +132,7 @@ func Init(jp JobParams) (interfaces.Job, error) {
 
 					j.targets[ofs] = target{
 						path:        ofsFullPath,
-						gzip:        src.Gzip,
+						compressor:  src.Compressor,
 						saveAbsPath: src.SaveAbsPath,
 						excludes:    excludes,
 					}
@@ -137,9 +150,19 @@ func Init(jp JobParams) (interfaces.Job, error) {
 }
 
 func (j *job) SetOfsMetrics(ofs string, metricsMap map[string]float64) {
-	for m, v := range metricsMap {
-		j.appMetrics.Job[j.name].TargetMetrics[ofs].Values[m] = v
-	}
+	j.appMetrics.SetValues(j.name, ofs, metricsMap)
+}
+
+func (j *job) GetOfsMetrics(ofs string) map[string]float64 {
+	return j.appMetrics.GetValues(j.name, ofs)
+}
+
+func (j *job) GetCatalog() *catalog.Catalog {
+	return j.catalog
+}
+
+func (j *job) SetOfsStorageMetrics(ofs, storage string, metricsMap map[string]float64) {
+	j.appMetrics.SetStorageValues(j.name, ofs, storage, metricsMap)
 }
 
 func (j *job) GetName() string {
@@ -165,6 +188,14 @@ func (j *job) GetStoragesCount() int {
 	return len(j.storages)
 }
 
+func (j *job) GetStorages() interfaces.Storages {
+	return j.storages
+}
+
+func (j *job) GetDeliveryConcurrency() int {
+	return j.deliveryConcurrency
+}
+
 func (j *job) GetDumpObjects() map[string]interfaces.DumpObject {
 	return j.dumpedObjects
 }
@@ -222,7 +253,7 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 			metrics.BackupTimestamp: float64(startTime.Unix()),
 		})
 
-		tmpBackupFile := misc.GetFileFullPath(tmpDir, ofsPart, "tar", "", tgt.gzip)
+		tmpBackupFile := misc.GetFileFullPath(tmpDir, ofsPart, "tar", "", tgt.compressor.Ext()) + j.cipher.Ext()
 		err := os.MkdirAll(path.Dir(tmpBackupFile), os.ModePerm)
 		if err != nil {
 			logCh <- logger.Log(j.name, "").Errorf("Unable to create tmp dir with next error: %s", err)
@@ -251,10 +282,11 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 			Src:         tgt.path,
 			Dst:         tmpBackupFile,
 			Incremental: true,
-			Gzip:        tgt.gzip,
+			Compressor:  tgt.compressor,
 			SaveAbsPath: tgt.saveAbsPath,
 			RateLim:     j.diskRateLimit,
 			Excludes:    tgt.excludes,
+			Cipher:      j.cipher,
 		}); err != nil {
 			j.SetOfsMetrics(ofsPart, map[string]float64{
 				metrics.BackupTime: float64(time.Since(startTime).Nanoseconds() / 1e6),
@@ -267,6 +299,12 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 			errs = multierror.Append(errs, err)
 			continue
 		}
+		// metadata is delivered to the storages as well, so it has to be encrypted too
+		if err = j.cipher.EncryptFile(tmpBackupFile + ".inc"); err != nil {
+			logCh <- logger.Log(j.name, "").Errorf("Failed to encrypt backup metadata. Error: %v", err)
+			errs = multierror.Append(errs, err)
+			continue
+		}
 		fileInfo, _ := os.Stat(tmpBackupFile)
 		j.SetOfsMetrics(ofsPart, map[string]float64{
 			metrics.BackupOk:   float64(1),
@@ -361,11 +399,13 @@ func (j *job) getMetadataFile(logCh chan logger.LogRecord, ofsPart, metadata str
 	for i := len(j.storages) - 1; i >= 0; i-- {
 		st := j.storages[i]
 
-		reader, err = st.GetFileReader(path.Join(ofsPart, year, "inc_meta_info", metadata))
+		var buf []byte
+		buf, err = readMetadataFile(st, path.Join(ofsPart, year, "inc_meta_info", metadata))
 		if err != nil {
 			logCh <- logger.Log(j.name, st.GetName()).Warnf("Unable to get previous metadata '%s' from storage. Error: %s ", metadata, err)
 			continue
 		}
+		reader = bytes.NewReader(buf)
 		break
 	}
 
@@ -376,6 +416,65 @@ func (j *job) getMetadataFile(logCh chan logger.LogRecord, ofsPart, metadata str
 	return
 }
 
+// readMetadataFile reads the small metadata file at once, so the storage connection is released for the next files
+func readMetadataFile(st interfaces.Storage, ofsPath string) ([]byte, error) {
+	r, err := st.GetFileReader(ofsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+
+	return io.ReadAll(r)
+}
+
+func (j *job) DoRestore(logCh chan logger.LogRecord, p interfaces.RestoreParams) error {
+	tgt, ok := j.targets[p.Ofs]
+	if !ok {
+		return fmt.Errorf("Target `%s` not found in job `%s` ", p.Ofs, j.name)
+	}
+
+	dst := p.Dst
+	if dst == "" {
+		if tgt.saveAbsPath {
+			dst = "/"
+		} else {
+			dst = path.Dir(tgt.path)
+		}
+	}
+
+	for _, file := range p.Files {
+		if err := func() error {
+			src, err := j.storages.GetFileReader(p.Storage, file)
+			if err != nil {
+				logCh <- logger.Log(j.name, p.Storage).Errorf("Unable to get backup `%s` from storage. Error: %s", file, err)
+				return err
+			}
+			defer func() { _ = src.Close() }()
+
+			logCh <- logger.Log(j.name, p.Storage).Infof("Starting to restore `%s` to `%s`", file, dst)
+			if err = targz.Untar(targz.UntarOpts{
+				Src:         src,
+				Dst:         dst,
+				Incremental: true,
+			}); err != nil {
+				logCh <- logger.Log(j.name, p.Storage).Errorf("Failed to restore backup `%s`. Error: %v", file, err)
+				var serr targz.Error
+				if errors.As(err, &serr) {
+					logCh <- logger.Log(j.name, p.Storage).Debugf("STDERR: %s", serr.Stderr)
+				}
+				return err
+			}
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+
+	logCh <- logger.Log(j.name, p.Storage).Infof("Restore of `%s` completed", p.Ofs)
+
+	return nil
+}
+
 func (j *job) Close() error {
 	for _, st := range j.storages {
 		_ = st.Close()
@@ -17,23 +17,29 @@ import (
 	"github.com/nixys/nxs-backup/ds/mongo_connect"
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/compression"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backend/exec_cmd"
 	"github.com/nixys/nxs-backup/modules/backend/targz"
+	"github.com/nixys/nxs-backup/modules/catalog"
 	"github.com/nixys/nxs-backup/modules/logger"
 	"github.com/nixys/nxs-backup/modules/metrics"
 )
 
 type job struct {
-	name             string
-	tmpDir           string
-	needToMakeBackup bool
-	safetyBackup     bool
-	deferredCopying  bool
-	diskRateLimit    int64
-	storages         interfaces.Storages
-	targets          map[string]target
-	dumpedObjects    map[string]interfaces.DumpObject
-	appMetrics       *metrics.Data
+	name                string
+	tmpDir              string
+	needToMakeBackup    bool
+	safetyBackup        bool
+	deferredCopying     bool
+	deliveryConcurrency int
+	diskRateLimit       int64
+	storages            interfaces.Storages
+	cipher              *crypt.Cipher
+	targets             map[string]target
+	dumpedObjects       map[string]interfaces.DumpObject
+	appMetrics          *metrics.Data
+	catalog             *catalog.Catalog
 }
 
 type target struct {
@@ -42,19 +48,22 @@ type target struct {
 	dbName      string
 	collections []string
 	extraKeys   []string
-	gzip        bool
+	compressor  *compression.Compressor
 }
 
 type JobParams struct {
-	Name             string
-	TmpDir           string
-	NeedToMakeBackup bool
-	SafetyBackup     bool
-	DeferredCopying  bool
-	DiskRateLimit    int64
-	Storages         interfaces.Storages
-	Sources          []SourceParams
-	Metrics          *metrics.Data
+	Name                string
+	TmpDir              string
+	NeedToMakeBackup    bool
+	SafetyBackup        bool
+	DeferredCopying     bool
+	DeliveryConcurrency int
+	DiskRateLimit       int64
+	Storages            interfaces.Storages
+	Cipher              *crypt.Cipher
+	Sources             []SourceParams
+	Metrics             *metrics.Data
+	Catalog             *catalog.Catalog
 }
 
 type SourceParams struct {
@@ -65,7 +74,7 @@ type SourceParams struct {
 	ExcludeDBs         []string
 	ExcludeCollections []string
 	ExtraKeys          []string
-	Gzip               bool
+	Compressor         *compression.Compressor
 }
 
 func Init(jp JobParams) (interfaces.Job, error) {
@@ -80,15 +89,18 @@ func Init(jp JobParams) (interfaces.Job, error) {
 	}
 
 	j := job{
-		name:             jp.Name,
-		tmpDir:           jp.TmpDir,
-		needToMakeBackup: jp.NeedToMakeBackup,
-		safetyBackup:     jp.SafetyBackup,
-		deferredCopying:  jp.DeferredCopying,
-		diskRateLimit:    jp.DiskRateLimit,
-		storages:         jp.Storages,
-		targets:          make(map[string]target),
-		dumpedObjects:    make(map[string]interfaces.DumpObject),
+		name:                jp.Name,
+		tmpDir:              jp.TmpDir,
+		needToMakeBackup:    jp.NeedToMakeBackup,
+		safetyBackup:        jp.SafetyBackup,
+		deferredCopying:     jp.DeferredCopying,
+		deliveryConcurrency: jp.DeliveryConcurrency,
+		diskRateLimit:       jp.DiskRateLimit,
+		storages:            jp.Storages,
+		cipher:              jp.Cipher,
+		targets:             make(map[string]target),
+		dumpedObjects:       make(map[string]interfaces.DumpObject),
+		catalog:             jp.Catalog,
 		appMetrics: jp.Metrics.RegisterJob(
 			metrics.JobData{
 				JobName:       jp.Name,
@@ -157,7 +169,7 @@ func Init(jp JobParams) (interfaces.Job, error) {
 				collections: tc,
 				host:        host,
 				extraKeys:   src.ExtraKeys,
-				gzip:        src.Gzip,
+				compressor:  src.Compressor,
 				connOpts:    src.ConnectParams,
 			}
 			j.appMetrics.Job[j.name].TargetMetrics[ofs] = metrics.TargetData{
@@ -172,9 +184,19 @@ func Init(jp JobParams) (interfaces.Job, error) {
 }
 
 func (j *job) SetOfsMetrics(ofs string, metricsMap map[string]float64) {
-	for m, v := range metricsMap {
-		j.appMetrics.Job[j.name].TargetMetrics[ofs].Values[m] = v
-	}
+	j.appMetrics.SetValues(j.name, ofs, metricsMap)
+}
+
+func (j *job) GetOfsMetrics(ofs string) map[string]float64 {
+	return j.appMetrics.GetValues(j.name, ofs)
+}
+
+func (j *job) GetCatalog() *catalog.Catalog {
+	return j.catalog
+}
+
+func (j *job) SetOfsStorageMetrics(ofs, storage string, metricsMap map[string]float64) {
+	j.appMetrics.SetStorageValues(j.name, ofs, storage, metricsMap)
 }
 
 func (j *job) GetName() string {
@@ -200,6 +222,14 @@ func (j *job) GetStoragesCount() int {
 	return len(j.storages)
 }
 
+func (j *job) GetStorages() interfaces.Storages {
+	return j.storages
+}
+
+func (j *job) GetDeliveryConcurrency() int {
+	return j.deliveryConcurrency
+}
+
 func (j *job) GetDumpObjects() map[string]interfaces.DumpObject {
 	return j.dumpedObjects
 }
@@ -257,7 +287,7 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 			metrics.BackupTimestamp: float64(startTime.Unix()),
 		})
 
-		tmpBackupFile := misc.GetFileFullPath(tmpDir, ofsPart, "tar", "", tgt.gzip)
+		tmpBackupFile := misc.GetFileFullPath(tmpDir, ofsPart, "tar", "", tgt.compressor.Ext()) + j.cipher.Ext()
 
 		if err := os.MkdirAll(path.Dir(tmpBackupFile), os.ModePerm); err != nil {
 			logCh <- logger.Log(j.name, "").Errorf("Unable to create tmp dir with next error: %s", err)
@@ -352,10 +382,11 @@ func (j *job) createTmpBackup(logCh chan logger.LogRecord, tmpBackupFile string,
 		Src:         tmpMongodumpPath,
 		Dst:         tmpBackupFile,
 		Incremental: false,
-		Gzip:        target.gzip,
+		Compressor:  target.compressor,
 		SaveAbsPath: false,
 		RateLim:     j.diskRateLimit,
 		Excludes:    nil,
+		Cipher:      j.cipher,
 	}); err != nil {
 		logCh <- logger.Log(j.name, "").Errorf("Unable to make tar: %s", err)
 		var serr targz.Error
@@ -370,6 +401,84 @@ func (j *job) createTmpBackup(logCh chan logger.LogRecord, tmpBackupFile string,
 	return nil
 }
 
+func (j *job) DoRestore(logCh chan logger.LogRecord, p interfaces.RestoreParams) error {
+	tgt, ok := j.targets[p.Ofs]
+	if !ok {
+		return fmt.Errorf("Target `%s` not found in job `%s` ", p.Ofs, j.name)
+	}
+	if len(p.Files) == 0 {
+		return fmt.Errorf("No backups to restore for target `%s` ", p.Ofs)
+	}
+	file := p.Files[len(p.Files)-1]
+
+	tmpDir := j.tmpDir
+	if tmpDir == "" {
+		tmpDir = os.TempDir()
+	}
+	tmpRestorePath := path.Join(tmpDir, "mongorestore_"+misc.GetDateTimeNow(""))
+	defer func() { _ = os.RemoveAll(tmpRestorePath) }()
+
+	src, err := j.storages.GetFileReader(p.Storage, file)
+	if err != nil {
+		logCh <- logger.Log(j.name, p.Storage).Errorf("Unable to get backup `%s` from storage. Error: %s", file, err)
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	if err = targz.Untar(targz.UntarOpts{
+		Src:         src,
+		Dst:         tmpRestorePath,
+		Incremental: false,
+	}); err != nil {
+		logCh <- logger.Log(j.name, p.Storage).Errorf("Unable to unpack backup `%s`. Error: %v", file, err)
+		var serr targz.Error
+		if errors.As(err, &serr) {
+			logCh <- logger.Log(j.name, "").Debugf("STDERR: %s", serr.Stderr)
+		}
+		return err
+	}
+
+	var args []string
+	// define command args
+	// auth url
+	args = append(args, "--host="+tgt.host)
+	if tgt.connOpts.AuthDB != "" {
+		args = append(args, "--authenticationDatabase="+tgt.connOpts.AuthDB)
+	} else {
+		args = append(args, "--authenticationDatabase=admin")
+	}
+	args = append(args, "--username="+tgt.connOpts.User)
+	args = append(args, "--password="+tgt.connOpts.Passwd)
+	if tgt.connOpts.TLSCAFile != "" {
+		args = append(args, "--ssl")
+		args = append(args, "--sslCAFile="+tgt.connOpts.TLSCAFile)
+	}
+	// namespaces to restore
+	args = append(args, "--nsInclude="+tgt.dbName+".*")
+	if p.Dst != "" {
+		args = append(args, "--nsFrom="+tgt.dbName+".*", "--nsTo="+p.Dst+".*")
+	}
+	args = append(args, "--dir="+path.Join(tmpRestorePath, "dump"))
+
+	var stderr, stdout bytes.Buffer
+	cmd := exec.Command("mongorestore", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	logCh <- logger.Log(j.name, p.Storage).Infof("Starting to restore `%s` into `%s` database", file, tgt.dbName)
+
+	if err = cmd.Run(); err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to restore `%s`. Error: %s", tgt.dbName, err)
+		logCh <- logger.Log(j.name, "").Debugf("STDOUT: %s", stdout.String())
+		logCh <- logger.Log(j.name, "").Debugf("STDERR: %s", stderr.String())
+		return err
+	}
+
+	logCh <- logger.Log(j.name, "").Infof("Restore of `%s` completed", tgt.dbName)
+
+	return nil
+}
+
 func (j *job) Close() error {
 	for _, st := range j.storages {
 		_ = st.Close()
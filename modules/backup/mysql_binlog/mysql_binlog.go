@@ -0,0 +1,847 @@
+package mysql_binlog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/ini.v1"
+
+	"github.com/nixys/nxs-backup/ds/mysql_connect"
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/binlog"
+	"github.com/nixys/nxs-backup/modules/backend/compression"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
+	"github.com/nixys/nxs-backup/modules/backend/exec_cmd"
+	"github.com/nixys/nxs-backup/modules/backend/files"
+	"github.com/nixys/nxs-backup/modules/backend/targz"
+	"github.com/nixys/nxs-backup/modules/catalog"
+	"github.com/nixys/nxs-backup/modules/logger"
+	"github.com/nixys/nxs-backup/modules/metrics"
+)
+
+// streamPollInterval is the interval the spool dir of the streamed binlogs is checked for the closed segments
+const streamPollInterval = 10 * time.Second
+
+type job struct {
+	name                string
+	tmpDir              string
+	needToMakeBackup    bool
+	deliveryConcurrency int
+	diskRateLimit       int64
+	storages            interfaces.Storages
+	cipher              *crypt.Cipher
+	targets             map[string]target
+	dumpedObjects       map[string]interfaces.DumpObject
+	appMetrics          *metrics.Data
+	catalog             *catalog.Catalog
+	streaming           bool
+}
+
+type target struct {
+	connect    *sqlx.DB
+	authFile   *ini.File
+	extraKeys  []string
+	compressor *compression.Compressor
+	// streamed is set while the binlogs of the target are streamed to the spool dir
+	streamed *atomic.Bool
+}
+
+type JobParams struct {
+	Name                string
+	TmpDir              string
+	NeedToMakeBackup    bool
+	DeliveryConcurrency int
+	DiskRateLimit       int64
+	Storages            interfaces.Storages
+	Cipher              *crypt.Cipher
+	Sources             []SourceParams
+	Metrics             *metrics.Data
+	Catalog             *catalog.Catalog
+	// Streaming makes the binlogs to be streamed continuously in server mode
+	Streaming bool
+}
+
+type SourceParams struct {
+	Name          string
+	ConnectParams mysql_connect.Params
+	ExtraKeys     []string
+	Compressor    *compression.Compressor
+}
+
+func Init(jp JobParams) (interfaces.Job, error) {
+
+	// check if mysqlbinlog available
+	if _, err := exec_cmd.Exec("mysqlbinlog", "--version"); err != nil {
+		return nil, fmt.Errorf("Job `%s` init failed. Can't to check `mysqlbinlog` version. Please install `mysqlbinlog`. Error: %s ", jp.Name, err)
+	}
+
+	j := job{
+		name:                jp.Name,
+		tmpDir:              jp.TmpDir,
+		needToMakeBackup:    jp.NeedToMakeBackup,
+		deliveryConcurrency: jp.DeliveryConcurrency,
+		diskRateLimit:       jp.DiskRateLimit,
+		storages:            jp.Storages,
+		cipher:              jp.Cipher,
+		targets:             make(map[string]target),
+		dumpedObjects:       make(map[string]interfaces.DumpObject),
+		catalog:             jp.Catalog,
+		streaming:           jp.Streaming,
+		appMetrics: jp.Metrics.RegisterJob(
+			metrics.JobData{
+				JobName:       jp.Name,
+				JobType:       misc.MysqlBinlog,
+				TargetMetrics: make(map[string]metrics.TargetData),
+			},
+		),
+	}
+
+	for _, src := range jp.Sources {
+
+		dbConn, authFile, err := mysql_connect.GetConnectAndCnfFile(src.ConnectParams, "mysqlbinlog")
+		if err != nil {
+			return nil, fmt.Errorf("Job `%s` init failed. MySQL connect error: %s ", jp.Name, err)
+		}
+
+		var logBin bool
+		if err = dbConn.Get(&logBin, "SELECT @@log_bin"); err != nil {
+			return nil, fmt.Errorf("Job `%s` init failed. Unable to check binary logging. Error: %s ", jp.Name, err)
+		}
+		if !logBin {
+			return nil, fmt.Errorf("Job `%s` init failed. Binary logging is disabled on the `%s` source server ", jp.Name, src.Name)
+		}
+
+		ofs := src.Name + "/binlog"
+		j.targets[ofs] = target{
+			connect:    dbConn,
+			authFile:   authFile,
+			extraKeys:  src.ExtraKeys,
+			compressor: src.Compressor,
+			streamed:   new(atomic.Bool),
+		}
+		j.appMetrics.Job[j.name].TargetMetrics[ofs] = metrics.TargetData{
+			Source: src.Name,
+			Target: "binlog",
+			Values: make(map[string]float64),
+		}
+	}
+
+	return &j, nil
+}
+
+func (j *job) SetOfsMetrics(ofs string, metricsMap map[string]float64) {
+	j.appMetrics.SetValues(j.name, ofs, metricsMap)
+}
+
+func (j *job) GetOfsMetrics(ofs string) map[string]float64 {
+	return j.appMetrics.GetValues(j.name, ofs)
+}
+
+func (j *job) GetCatalog() *catalog.Catalog {
+	return j.catalog
+}
+
+func (j *job) SetOfsStorageMetrics(ofs, storage string, metricsMap map[string]float64) {
+	j.appMetrics.SetStorageValues(j.name, ofs, storage, metricsMap)
+}
+
+func (j *job) GetName() string {
+	return j.name
+}
+
+func (j *job) GetTempDir() string {
+	return j.tmpDir
+}
+
+func (j *job) GetType() misc.BackupType {
+	return misc.MysqlBinlog
+}
+
+func (j *job) GetTargetOfsList() (ofsList []string) {
+	for ofs := range j.targets {
+		ofsList = append(ofsList, ofs)
+	}
+	return
+}
+
+func (j *job) GetStoragesCount() int {
+	return len(j.storages)
+}
+
+func (j *job) GetStorages() interfaces.Storages {
+	return j.storages
+}
+
+func (j *job) GetDeliveryConcurrency() int {
+	return j.deliveryConcurrency
+}
+
+func (j *job) GetDumpObjects() map[string]interfaces.DumpObject {
+	return j.dumpedObjects
+}
+
+func (j *job) ListBackups() interfaces.JobTargets {
+	jt := make(interfaces.JobTargets)
+
+	for tn := range j.targets {
+		jt[tn] = make(interfaces.TargetsOnStorages)
+		jt[tn] = j.storages.ListBackups(tn)
+	}
+
+	return jt
+}
+
+func (j *job) SetDumpObjectDelivered(ofs string) {
+	dumpObj := j.dumpedObjects[ofs]
+	dumpObj.Delivered = true
+	j.dumpedObjects[ofs] = dumpObj
+}
+
+// IsBackupSafety is always true, since the binlog segments are rotated after the new ones are delivered.
+// Each run delivers several segments, so they can't be counted in advance.
+func (j *job) IsBackupSafety() bool {
+	return true
+}
+
+func (j *job) NeedToMakeBackup() bool {
+	return j.needToMakeBackup
+}
+
+func (j *job) NeedToUpdateIncMeta() bool {
+	return false
+}
+
+// IsStreaming reports whether the binlogs are streamed continuously by the server mode
+func (j *job) IsStreaming() bool {
+	return j.streaming
+}
+
+func (j *job) DeleteOldBackups(logCh chan logger.LogRecord, ofsPath string) error {
+	logCh <- logger.Log(j.name, "").Debugf("Starting rotate outdated backups.")
+	return j.storages.DeleteOldBackups(logCh, j, ofsPath)
+}
+
+func (j *job) CleanupTmpData() error {
+	return j.storages.CleanupTmpData(j)
+}
+
+// DoBackup delivers the binlog segments closed since the previous run to the storages one by one in their order
+func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
+	var errs *multierror.Error
+
+	for ofsPart, tgt := range j.targets {
+		startTime := time.Now()
+
+		j.SetOfsMetrics(ofsPart, map[string]float64{
+			metrics.BackupOk:        float64(0),
+			metrics.BackupTime:      float64(0),
+			metrics.DeliveryOk:      float64(0),
+			metrics.DeliveryTime:    float64(0),
+			metrics.BackupSize:      float64(0),
+			metrics.BackupTimestamp: float64(startTime.Unix()),
+		})
+
+		size, err := j.backupSegments(logCh, tmpDir, ofsPart, tgt)
+		j.SetOfsMetrics(ofsPart, map[string]float64{
+			metrics.BackupTime: float64(time.Since(startTime).Nanoseconds() / 1e6),
+			metrics.BackupSize: float64(size),
+		})
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		j.SetOfsMetrics(ofsPart, map[string]float64{
+			metrics.BackupOk: float64(1),
+		})
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// backupSegments fetches the new closed binlog segments of the target and delivers them, it returns the size of the delivered segments
+func (j *job) backupSegments(logCh chan logger.LogRecord, tmpDir, ofsPart string, tgt target) (size int64, err error) {
+	var segments []string
+
+	// the streamed segments are closed by the server on its binlog rotation, the newest one is still written
+	streamed := tgt.streamed.Load()
+	rawDir := path.Join(tmpDir, ofsPart, "raw")
+	if streamed {
+		rawDir = j.spoolDir(ofsPart)
+		if segments, err = spooledSegments(rawDir); len(segments) > 0 {
+			segments = segments[:len(segments)-1]
+		}
+	} else {
+		segments, err = closedSegments(tgt.connect)
+	}
+	if err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to get binlog segments of `%s`. Error: %s", ofsPart, err)
+		return 0, err
+	}
+
+	last, err := j.lastDeliveredSegment(ofsPart)
+	if err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to get delivered binlog segments of `%s`. Error: %s", ofsPart, err)
+		return 0, err
+	}
+	for len(segments) > 0 && last != "" && !binlog.SegmentLess(last, segments[0]) {
+		if streamed {
+			_ = os.Remove(path.Join(rawDir, segments[0]))
+		}
+		segments = segments[1:]
+	}
+	if len(segments) == 0 {
+		logCh <- logger.Log(j.name, "").Infof("No new binlog segments of `%s` to deliver", ofsPart)
+		return 0, nil
+	}
+
+	if !streamed {
+		if err = os.MkdirAll(rawDir, os.ModePerm); err != nil {
+			logCh <- logger.Log(j.name, "").Errorf("Unable to create tmp dir with next error: %s", err)
+			return 0, err
+		}
+		defer func() { _ = os.RemoveAll(rawDir) }()
+
+		if err = j.fetchSegments(logCh, rawDir, segments, tgt); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, seg := range segments {
+		tmpBackupFile := misc.GetFileFullPath(tmpDir, path.Join(ofsPart, seg), "binlog", "", tgt.compressor.Ext()) + j.cipher.Ext()
+		if err = targz.Pack(path.Join(rawDir, seg), tmpBackupFile, tgt.compressor, j.diskRateLimit, j.cipher); err != nil {
+			logCh <- logger.Log(j.name, "").Errorf("Unable to create temp backup of binlog segment `%s`. Error: %s", seg, err)
+			return size, err
+		}
+		if fileInfo, err := os.Stat(tmpBackupFile); err == nil {
+			size += fileInfo.Size()
+		}
+
+		j.dumpedObjects[ofsPart] = interfaces.DumpObject{TmpFile: tmpBackupFile}
+		err = j.storages.Delivery(logCh, j)
+		_ = j.CleanupTmpData()
+		// the segment failed to deliver must not be delivered again along with the segments of other targets
+		delete(j.dumpedObjects, ofsPart)
+		if err != nil {
+			// the segments are delivered in order, the rest of them are delivered by the next run
+			logCh <- logger.Log(j.name, "").Errorf("Failed to delivery binlog segment `%s`. Errors: %v", seg, err)
+			return size, err
+		}
+		// the streamed segment is kept in the spool dir until it's delivered
+		_ = os.Remove(path.Join(rawDir, seg))
+	}
+
+	logCh <- logger.Log(j.name, "").Infof("Delivered %d binlog segments of `%s`, the last is `%s`", len(segments), ofsPart, segments[len(segments)-1])
+
+	return size, nil
+}
+
+// closedSegments flushes the binary log of the server and returns the segments closed by now,
+// the segment the server writes to is excluded. The flush is used when the binlogs aren't streamed,
+// it closes the segment for each run.
+func closedSegments(db *sqlx.DB) ([]string, error) {
+	if _, err := db.Exec("FLUSH BINARY LOGS"); err != nil {
+		return nil, err
+	}
+
+	segments, err := binaryLogs(db)
+	if err != nil || len(segments) == 0 {
+		return nil, err
+	}
+	return segments[:len(segments)-1], nil
+}
+
+// binaryLogs returns the binlog segments kept by the server in their order
+func binaryLogs(db *sqlx.DB) ([]string, error) {
+	rows, err := db.Queryx("SHOW BINARY LOGS")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var segments []string
+	for rows.Next() {
+		cols, err := rows.SliceScan()
+		if err != nil {
+			return nil, err
+		}
+		switch name := cols[0].(type) {
+		case []byte:
+			segments = append(segments, string(name))
+		case string:
+			segments = append(segments, name)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return segments, nil
+}
+
+// lastDeliveredSegment returns the latest binlog segment delivered to all storages. The segments missing
+// on some storage due to the failed delivery are delivered again, so the storages have no gaps in binlogs.
+func (j *job) lastDeliveredSegment(ofsPart string) (string, error) {
+	var last string
+
+	for i, st := range j.storages {
+		list, err := st.ListBackups(ofsPart)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("storage `%s`: %w", st.GetName(), err)
+		}
+
+		var stLast string
+		for _, f := range list {
+			if seg := binlog.SegmentName(f); seg != "" && (stLast == "" || binlog.SegmentLess(stLast, seg)) {
+				stLast = seg
+			}
+		}
+		if i == 0 || stLast == "" || binlog.SegmentLess(stLast, last) {
+			last = stLast
+		}
+		if last == "" {
+			break
+		}
+	}
+
+	return last, nil
+}
+
+// fetchSegments reads the binlog segments from the server to the dir as is
+func (j *job) fetchSegments(logCh chan logger.LogRecord, rawDir string, segments []string, tgt target) error {
+	authFile, err := files.CreateTmpMysqlAuthFile(tgt.authFile)
+	if err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Failed to create tmp auth file. Error: %s", err)
+		return err
+	}
+	defer func() {
+		if err = files.DeleteTmpMysqlAuthFile(authFile); err != nil {
+			logCh <- logger.Log(j.name, "").Errorf("Failed to delete tmp auth file. Error: %s", err)
+		}
+	}()
+
+	args := []string{
+		"--defaults-file=" + authFile,
+		"--read-from-remote-server",
+		"--raw",
+		"--result-file=" + rawDir + "/",
+	}
+	args = append(args, tgt.extraKeys...)
+	args = append(args, segments...)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("mysqlbinlog", args...)
+	cmd.Stderr = &stderr
+
+	logCh <- logger.Log(j.name, "").Debugf("Fetch cmd: %s", cmd.String())
+	logCh <- logger.Log(j.name, "").Infof("Fetching binlog segments from `%s` to `%s`", segments[0], segments[len(segments)-1])
+
+	if err = cmd.Run(); err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to fetch binlog segments. Error: %s", stderr.String())
+		return err
+	}
+
+	return nil
+}
+
+// Stream reads the binlog events of the target continuously by `mysqlbinlog --stop-never` to the spool dir, the segment
+// is closed when the server rotates its binlog and the stream goes on with the next one. The ready is called each time
+// a new closed segment appears in the spool, the closed segments are delivered by the backup run of the job.
+// It returns when mysqlbinlog exits, the stream is resumed from the newest segment in the spool.
+func (j *job) Stream(logCh chan logger.LogRecord, ofs string, ready func()) error {
+	tgt, ok := j.targets[ofs]
+	if !ok {
+		return fmt.Errorf("Target `%s` not found in job `%s` ", ofs, j.name)
+	}
+
+	// mysqlbinlog is killed when the thread started it exits
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	spool := j.spoolDir(ofs)
+	if err := os.MkdirAll(spool, os.ModePerm); err != nil {
+		return fmt.Errorf("Unable to create spool dir with next error: %s ", err)
+	}
+
+	start, err := j.streamStart(ofs, spool, tgt)
+	if err != nil {
+		return err
+	}
+
+	authFile, err := files.CreateTmpMysqlAuthFile(tgt.authFile)
+	if err != nil {
+		return fmt.Errorf("Failed to create tmp auth file. Error: %s ", err)
+	}
+	defer func() {
+		if err := files.DeleteTmpMysqlAuthFile(authFile); err != nil {
+			logCh <- logger.Log(j.name, "").Errorf("Failed to delete tmp auth file. Error: %s", err)
+		}
+	}()
+
+	args := []string{
+		"--defaults-file=" + authFile,
+		"--read-from-remote-server",
+		"--raw",
+		"--stop-never",
+		"--result-file=" + spool + "/",
+	}
+	args = append(args, tgt.extraKeys...)
+	args = append(args, start)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("mysqlbinlog", args...)
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+
+	logCh <- logger.Log(j.name, "").Debugf("Stream cmd: %s", cmd.String())
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("Unable to start mysqlbinlog. Error: %s ", err)
+	}
+	logCh <- logger.Log(j.name, "").Infof("Streaming binlogs of `%s` starting from segment `%s`", ofs, start)
+
+	tgt.streamed.Store(true)
+	defer tgt.streamed.Store(false)
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+
+	var notified string
+	for {
+		select {
+		case err = <-done:
+			return fmt.Errorf("mysqlbinlog stopped with error: %v %s", err, stderr.String())
+		case <-ticker.C:
+			segments, err := spooledSegments(spool)
+			if err != nil {
+				logCh <- logger.Log(j.name, "").Errorf("Unable to read spool dir of `%s`. Error: %s", ofs, err)
+				continue
+			}
+			if len(segments) > 1 && segments[len(segments)-2] != notified {
+				notified = segments[len(segments)-2]
+				ready()
+			}
+		}
+	}
+}
+
+// streamStart returns the segment the stream starts from. It's the newest segment in the spool, it's read again
+// from its beginning, or the segment following the last delivered one, or the first segment kept by the server.
+func (j *job) streamStart(ofs, spool string, tgt target) (string, error) {
+	last, err := j.lastDeliveredSegment(ofs)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get delivered binlog segments of `%s`. Error: %s ", ofs, err)
+	}
+
+	spooled, err := spooledSegments(spool)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read spool dir of `%s`. Error: %s ", ofs, err)
+	}
+	if len(spooled) > 0 && (last == "" || binlog.SegmentLess(last, spooled[len(spooled)-1])) {
+		return spooled[len(spooled)-1], nil
+	}
+
+	segments, err := binaryLogs(tgt.connect)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get binlog segments of `%s`. Error: %s ", ofs, err)
+	}
+	for _, seg := range segments {
+		if last == "" || binlog.SegmentLess(last, seg) {
+			return seg, nil
+		}
+	}
+	return "", fmt.Errorf("No binlog segments of `%s` after the delivered segment `%s` found on server ", ofs, last)
+}
+
+// spoolDir returns the dir the binlogs of the target are streamed to, it's kept between runs
+func (j *job) spoolDir(ofs string) string {
+	return path.Join(j.tmpDir, "binlog_stream", ofs)
+}
+
+// spooledSegments returns the binlog segments in the spool dir in their order
+func spooledSegments(spool string) ([]string, error) {
+	entries, err := os.ReadDir(spool)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var segments []string
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			segments = append(segments, e.Name())
+		}
+	}
+	sort.Slice(segments, func(i, k int) bool {
+		return binlog.SegmentLess(segments[i], segments[k])
+	})
+	return segments, nil
+}
+
+// DoRestore replays the binlog segments from the position of the restored full backup of the server.
+// The full backup has to be restored before, the replay is stopped at the restore time.
+func (j *job) DoRestore(logCh chan logger.LogRecord, p interfaces.RestoreParams) error {
+	tgt, ok := j.targets[p.Ofs]
+	if !ok {
+		return fmt.Errorf("Target `%s` not found in job `%s` ", p.Ofs, j.name)
+	}
+	if j.catalog == nil {
+		return fmt.Errorf("Backups catalog is disabled by config, it's required to find the binlog position of the full backup ")
+	}
+
+	full, err := j.findFullBackup(tgt, p.Time, p.FullBackup)
+	if err != nil {
+		logCh <- logger.Log(j.name, "").Error(err)
+		return err
+	}
+	logCh <- logger.Log(j.name, "").Infof("Replaying binlogs from position %s:%d of backup `%s` of job `%s`", full.Binlog.File, full.Binlog.Pos, full.File, full.Job)
+
+	segments, err := replaySegments(p.Files, full.Binlog.File)
+	if err != nil {
+		logCh <- logger.Log(j.name, p.Storage).Error(err)
+		return err
+	}
+
+	args := []string{"--start-position=" + strconv.FormatUint(full.Binlog.Pos, 10)}
+	if !p.Time.IsZero() {
+		args = append(args, "--stop-datetime="+p.Time.Format(time.DateTime))
+	}
+	// the transactions of the MySQL GTIDs are already executed on the server the backup is restored to
+	if strings.Contains(full.Binlog.GTID, ":") {
+		args = append(args, "--skip-gtids")
+	}
+	switch {
+	case full.Type == misc.Mysql && p.Dst != "":
+		args = append(args, "--rewrite-db="+full.Target+"->"+p.Dst, "--database="+p.Dst)
+	case full.Type == misc.Mysql:
+		args = append(args, "--database="+full.Target)
+	case p.Dst != "":
+		return fmt.Errorf("Restore destination is supported for binlogs replay after the `%s` job type backups only ", misc.Mysql)
+	}
+
+	tmpDir, err := os.MkdirTemp(j.tmpDir, "binlog_restore_")
+	if err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to create tmp dir with next error: %s", err)
+		return err
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	// the segments are got in their order up to the first one opened after the restore time, it has no events to replay
+	var prev string
+	covered := p.Time.IsZero()
+	for _, file := range segments {
+		seg := binlog.SegmentName(file)
+		if prev != "" && !binlog.IsNextSegment(prev, seg) {
+			err = fmt.Errorf("Binlog segments between `%s` and `%s` are not found on storage ", prev, seg)
+			logCh <- logger.Log(j.name, p.Storage).Error(err)
+			return err
+		}
+		segFile := path.Join(tmpDir, seg)
+		if err = j.getSegment(p.Storage, file, segFile); err != nil {
+			logCh <- logger.Log(j.name, p.Storage).Errorf("Unable to get binlog segment `%s` from storage. Error: %s", file, err)
+			return err
+		}
+		if prev != "" && !covered {
+			opened, err := binlog.FirstEventTime(segFile)
+			if err != nil {
+				logCh <- logger.Log(j.name, p.Storage).Errorf("Unable to read binlog segment `%s`. Error: %s", file, err)
+				return err
+			}
+			if opened.After(p.Time) {
+				_ = os.Remove(segFile)
+				covered = true
+				break
+			}
+		}
+		args = append(args, segFile)
+		prev = seg
+	}
+	if !covered {
+		logCh <- logger.Log(j.name, p.Storage).Warnf("Binlogs are replayed up to the end of the last delivered segment `%s`, the events after it are not delivered yet", prev)
+	}
+
+	return j.replay(logCh, args, tgt)
+}
+
+// findFullBackup returns the catalog record of the full backup of the target server the binlogs replay starts from.
+// It is the backup with the file name set or the latest backup taken before the time. The jobs and targets backing up
+// the same server have their own positions, so the latest backups of several of them make the choice ambiguous.
+func (j *job) findFullBackup(tgt target, t time.Time, file string) (catalog.Record, error) {
+	serverID, err := binlog.ServerID(tgt.connect)
+	if err != nil {
+		return catalog.Record{}, fmt.Errorf("Unable to get MySQL server id. Error: %s ", err)
+	}
+
+	records, err := j.catalog.Find(catalog.Query{SuccessOnly: true})
+	if err != nil {
+		return catalog.Record{}, fmt.Errorf("Failed to get backups list from catalog. Error: %v ", err)
+	}
+
+	// the latest backups by the job and target, the records of the backup copies on several storages are the same backup
+	latest := make(map[string]catalog.Record)
+	for _, r := range records {
+		if r.Binlog == nil || r.Binlog.ServerID != serverID || (file != "" && r.File != file) || (!t.IsZero() && r.CreatedAt.After(t)) {
+			continue
+		}
+		key := r.Job + "/" + r.Ofs
+		if l, ok := latest[key]; !ok || r.CreatedAt.After(l.CreatedAt) {
+			latest[key] = r
+		}
+	}
+
+	var found []string
+	for _, r := range latest {
+		if len(latest) == 1 {
+			return r, nil
+		}
+		found = append(found, fmt.Sprintf("`%s` of job `%s` target `%s`", r.File, r.Job, r.Ofs))
+	}
+	if len(found) > 0 {
+		sort.Strings(found)
+		return catalog.Record{}, fmt.Errorf("Several full backups of MySQL server %d with recorded binlog position match: %s. Set the restored one by `--full-backup` ", serverID, strings.Join(found, ", "))
+	}
+	if file != "" {
+		return catalog.Record{}, fmt.Errorf("Full backup `%s` of MySQL server %d with recorded binlog position created before %s not found in catalog ", file, serverID, t.Format(misc.BackupTimeFormat))
+	}
+	return catalog.Record{}, fmt.Errorf("No full backup of MySQL server %d with recorded binlog position found created before %s ", serverID, t.Format(misc.BackupTimeFormat))
+}
+
+// replaySegments returns the backup files of the segments ordered by the segments starting from the one with the full
+// backup position. The segments delivered several times are replayed once.
+func replaySegments(files []string, first string) ([]string, error) {
+	var (
+		segments []string
+		prev     string
+	)
+
+	files = slices.Clone(files)
+	sort.SliceStable(files, func(i, k int) bool {
+		return binlog.SegmentLess(binlog.SegmentName(files[i]), binlog.SegmentName(files[k]))
+	})
+	for _, f := range files {
+		seg := binlog.SegmentName(f)
+		if seg == "" || binlog.SegmentLess(seg, first) || (prev != "" && !binlog.SegmentLess(prev, seg)) {
+			continue
+		}
+		if prev == "" && seg != first {
+			return nil, fmt.Errorf("Binlog segment `%s` of the full backup position is not found on storage ", first)
+		}
+		segments = append(segments, f)
+		prev = seg
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("Binlog segment `%s` of the full backup position is not found on storage ", first)
+	}
+
+	return segments, nil
+}
+
+// getSegment writes the binlog segment from the storage to the file decompressed
+func (j *job) getSegment(stName, file, dst string) error {
+	src, err := j.storages.GetFileReader(stName, file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	r, err := compression.Decompress(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = r.Close() }()
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replay passes the events decoded by mysqlbinlog to mysql client
+func (j *job) replay(logCh chan logger.LogRecord, binlogArgs []string, tgt target) error {
+	authFile, err := files.CreateTmpMysqlAuthFile(getRestoreAuthFile(tgt.authFile))
+	if err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Failed to create tmp auth file. Error: %s", err)
+		return err
+	}
+	defer func() {
+		if err = files.DeleteTmpMysqlAuthFile(authFile); err != nil {
+			logCh <- logger.Log(j.name, "").Errorf("Failed to delete tmp auth file. Error: %s", err)
+		}
+	}()
+
+	var binlogStderr, mysqlStderr bytes.Buffer
+	decode := exec.Command("mysqlbinlog", binlogArgs...)
+	decode.Stderr = &binlogStderr
+	apply := exec.Command("mysql", "--defaults-file="+authFile)
+	apply.Stderr = &mysqlStderr
+
+	if apply.Stdin, err = decode.StdoutPipe(); err != nil {
+		return err
+	}
+
+	logCh <- logger.Log(j.name, "").Debugf("Restore cmd: %s | %s", decode.String(), apply.String())
+	logCh <- logger.Log(j.name, "").Info("Starting binlogs replay")
+
+	if err = apply.Start(); err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to start mysql. Error: %s", err)
+		return err
+	}
+	if err = decode.Run(); err != nil {
+		_ = apply.Process.Kill()
+		_ = apply.Wait()
+		logCh <- logger.Log(j.name, "").Errorf("Unable to decode binlogs. Error: %s", binlogStderr.String())
+		return err
+	}
+	if err = apply.Wait(); err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to replay binlogs. Error: %s", mysqlStderr.String())
+		return err
+	}
+
+	logCh <- logger.Log(j.name, "").Info("Binlogs replay completed")
+
+	return nil
+}
+
+// getRestoreAuthFile converts the mysqlbinlog auth file to the one readable by mysql client
+func getRestoreAuthFile(af *ini.File) *ini.File {
+	raf := ini.Empty()
+	sec, _ := raf.NewSection("mysql")
+	for _, k := range af.Section("mysqlbinlog").Keys() {
+		_, _ = sec.NewKey(k.Name(), k.Value())
+	}
+	return raf
+}
+
+func (j *job) Close() error {
+	for _, tgt := range j.targets {
+		_ = tgt.connect.Close()
+	}
+	for _, st := range j.storages {
+		_ = st.Close()
+	}
+	return nil
+}
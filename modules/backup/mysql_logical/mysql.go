@@ -3,10 +3,12 @@ package mysql_logical
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
@@ -16,25 +18,34 @@ import (
 	"github.com/nixys/nxs-backup/ds/mysql_connect"
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/binlog"
+	"github.com/nixys/nxs-backup/modules/backend/compression"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backend/exec_cmd"
 	"github.com/nixys/nxs-backup/modules/backend/files"
 	"github.com/nixys/nxs-backup/modules/backend/targz"
+	"github.com/nixys/nxs-backup/modules/catalog"
 	"github.com/nixys/nxs-backup/modules/logger"
 	"github.com/nixys/nxs-backup/modules/metrics"
 )
 
 type job struct {
-	name             string
-	tmpDir           string
-	needToMakeBackup bool
-	safetyBackup     bool
-	deferredCopying  bool
-	diskRateLimit    int64
-	storages         interfaces.Storages
-	targets          map[string]target
-	dumpedObjects    map[string]interfaces.DumpObject
-	authFilesKeys    map[string][]byte
-	appMetrics       *metrics.Data
+	name                string
+	tmpDir              string
+	needToMakeBackup    bool
+	safetyBackup        bool
+	deferredCopying     bool
+	deliveryConcurrency int
+	streaming           bool
+	diskRateLimit       int64
+	storages            interfaces.Storages
+	cipher              *crypt.Cipher
+	targets             map[string]target
+	dumpedObjects       map[string]interfaces.DumpObject
+	binlogPositions     map[string]catalog.BinlogPosition
+	authFilesKeys       map[string][]byte
+	appMetrics          *metrics.Data
+	catalog             *catalog.Catalog
 }
 
 type target struct {
@@ -44,19 +55,23 @@ type target struct {
 	ignoreTables []string
 	extraKeys    []string
 	isSlave      bool
-	gzip         bool
+	compressor   *compression.Compressor
 }
 
 type JobParams struct {
-	Name             string
-	TmpDir           string
-	NeedToMakeBackup bool
-	SafetyBackup     bool
-	DeferredCopying  bool
-	DiskRateLimit    int64
-	Storages         interfaces.Storages
-	Sources          []SourceParams
-	Metrics          *metrics.Data
+	Name                string
+	TmpDir              string
+	NeedToMakeBackup    bool
+	SafetyBackup        bool
+	DeferredCopying     bool
+	DeliveryConcurrency int
+	Streaming           bool
+	DiskRateLimit       int64
+	Storages            interfaces.Storages
+	Cipher              *crypt.Cipher
+	Sources             []SourceParams
+	Metrics             *metrics.Data
+	Catalog             *catalog.Catalog
 }
 
 type SourceParams struct {
@@ -65,7 +80,7 @@ type SourceParams struct {
 	TargetDBs     []string
 	Excludes      []string
 	ExtraKeys     []string
-	Gzip          bool
+	Compressor    *compression.Compressor
 	IsSlave       bool
 }
 
@@ -77,15 +92,20 @@ func Init(jp JobParams) (interfaces.Job, error) {
 	}
 
 	j := job{
-		name:             jp.Name,
-		tmpDir:           jp.TmpDir,
-		needToMakeBackup: jp.NeedToMakeBackup,
-		safetyBackup:     jp.SafetyBackup,
-		deferredCopying:  jp.DeferredCopying,
-		diskRateLimit:    jp.DiskRateLimit,
-		storages:         jp.Storages,
-		targets:          make(map[string]target),
-		dumpedObjects:    make(map[string]interfaces.DumpObject),
+		name:                jp.Name,
+		tmpDir:              jp.TmpDir,
+		needToMakeBackup:    jp.NeedToMakeBackup,
+		safetyBackup:        jp.SafetyBackup,
+		deferredCopying:     jp.DeferredCopying,
+		deliveryConcurrency: jp.DeliveryConcurrency,
+		streaming:           jp.Streaming,
+		diskRateLimit:       jp.DiskRateLimit,
+		storages:            jp.Storages,
+		cipher:              jp.Cipher,
+		targets:             make(map[string]target),
+		dumpedObjects:       make(map[string]interfaces.DumpObject),
+		binlogPositions:     make(map[string]catalog.BinlogPosition),
+		catalog:             jp.Catalog,
 		appMetrics: jp.Metrics.RegisterJob(
 			metrics.JobData{
 				JobName:       jp.Name,
@@ -132,7 +152,7 @@ func Init(jp JobParams) (interfaces.Job, error) {
 				dbName:       db,
 				ignoreTables: ignoreTables,
 				extraKeys:    src.ExtraKeys,
-				gzip:         src.Gzip,
+				compressor:   src.Compressor,
 				isSlave:      src.IsSlave,
 			}
 			j.appMetrics.Job[j.name].TargetMetrics[ofs] = metrics.TargetData{
@@ -147,9 +167,19 @@ func Init(jp JobParams) (interfaces.Job, error) {
 }
 
 func (j *job) SetOfsMetrics(ofs string, metricsMap map[string]float64) {
-	for m, v := range metricsMap {
-		j.appMetrics.Job[j.name].TargetMetrics[ofs].Values[m] = v
-	}
+	j.appMetrics.SetValues(j.name, ofs, metricsMap)
+}
+
+func (j *job) GetOfsMetrics(ofs string) map[string]float64 {
+	return j.appMetrics.GetValues(j.name, ofs)
+}
+
+func (j *job) GetCatalog() *catalog.Catalog {
+	return j.catalog
+}
+
+func (j *job) SetOfsStorageMetrics(ofs, storage string, metricsMap map[string]float64) {
+	j.appMetrics.SetStorageValues(j.name, ofs, storage, metricsMap)
 }
 
 func (j *job) GetName() string {
@@ -175,6 +205,14 @@ func (j *job) GetStoragesCount() int {
 	return len(j.storages)
 }
 
+func (j *job) GetStorages() interfaces.Storages {
+	return j.storages
+}
+
+func (j *job) GetDeliveryConcurrency() int {
+	return j.deliveryConcurrency
+}
+
 func (j *job) GetDumpObjects() map[string]interfaces.DumpObject {
 	return j.dumpedObjects
 }
@@ -232,7 +270,7 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 			metrics.BackupTimestamp: float64(startTime.Unix()),
 		})
 
-		tmpBackupFile := misc.GetFileFullPath(tmpDir, ofsPart, "sql", "", tgt.gzip)
+		tmpBackupFile := misc.GetFileFullPath(tmpDir, ofsPart, "sql", "", tgt.compressor.Ext()) + j.cipher.Ext()
 		err := os.MkdirAll(path.Dir(tmpBackupFile), os.ModePerm)
 		if err != nil {
 			logCh <- logger.Log(j.name, "").Errorf("Unable to create tmp dir with next error: %s", err)
@@ -240,7 +278,14 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 			continue
 		}
 
-		if err = j.createTmpBackup(logCh, tmpBackupFile, tgt); err != nil {
+		if j.streaming {
+			if err = j.streamBackup(logCh, ofsPart, tmpBackupFile, tgt, startTime); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+			continue
+		}
+
+		if err = j.createTmpBackup(logCh, tmpBackupFile, nil, tgt); err != nil {
 			j.SetOfsMetrics(ofsPart, map[string]float64{
 				metrics.BackupTime: float64(time.Since(startTime).Nanoseconds() / 1e6),
 			})
@@ -271,14 +316,66 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 		logCh <- logger.Log(j.name, "").Errorf("Failed to delivery backup. Errors: %v", err)
 		errs = multierror.Append(errs, err)
 	}
+	j.recordBinlogPositions(logCh)
 
 	return errs.ErrorOrNil()
 }
 
-func (j *job) createTmpBackup(logCh chan logger.LogRecord, tmpBackupFile string, target target) error {
-	var errs *multierror.Error
+// recordBinlogPositions saves the binlog positions of the delivered dumps to the catalog for the binlog replay
+func (j *job) recordBinlogPositions(logCh chan logger.LogRecord) {
+	for ofs, dumpObj := range j.dumpedObjects {
+		pos, ok := j.binlogPositions[dumpObj.TmpFile]
+		if !ok || !dumpObj.Delivered {
+			continue
+		}
+		if err := j.catalog.SetBinlogPosition(j.name, ofs, path.Base(dumpObj.TmpFile), pos); err != nil {
+			logCh <- logger.Log(j.name, "").Warnf("Failed to record binlog position of `%s` to catalog: %s", ofs, err)
+		}
+	}
+}
+
+// streamBackup makes the dump and passes it to the storages without the temp file
+func (j *job) streamBackup(logCh chan logger.LogRecord, ofsPart, tmpBackupFile string, tgt target, startTime time.Time) error {
+	size, dumpErr, deliveryErr := j.storages.DeliveryStream(logCh, j, ofsPart, tmpBackupFile, func(w io.Writer) error {
+		return j.createTmpBackup(logCh, tmpBackupFile, w, tgt)
+	})
+	// the stream can't be delivered again, the dump object is kept only to cleanup tmp data
+	j.dumpedObjects[ofsPart] = interfaces.DumpObject{TmpFile: tmpBackupFile, Delivered: true}
+
+	if dumpErr != nil {
+		j.SetOfsMetrics(ofsPart, map[string]float64{
+			metrics.BackupTime: float64(time.Since(startTime).Nanoseconds() / 1e6),
+		})
+		logCh <- logger.Log(j.name, "").Errorf("Unable to stream backup %s", tmpBackupFile)
+		return dumpErr
+	}
+	j.SetOfsMetrics(ofsPart, map[string]float64{
+		metrics.BackupOk:   float64(1),
+		metrics.BackupTime: float64(time.Since(startTime).Nanoseconds() / 1e6),
+		metrics.BackupSize: float64(size),
+	})
+
+	logCh <- logger.Log(j.name, "").Debugf("Streamed backup %s", tmpBackupFile)
 
-	backupWriter, err := targz.GetGZipFileWriter(tmpBackupFile, target.gzip, j.diskRateLimit)
+	if deliveryErr != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Failed to delivery backup. Errors: %v", deliveryErr)
+	}
+	return deliveryErr
+}
+
+// createTmpBackup makes the dump to the temp file, or to the stream if it's set
+func (j *job) createTmpBackup(logCh chan logger.LogRecord, tmpBackupFile string, stream io.Writer, target target) error {
+	var (
+		errs         *multierror.Error
+		backupWriter io.WriteCloser
+		err          error
+	)
+
+	if stream != nil {
+		backupWriter, err = targz.GetWriter(stream, tmpBackupFile, target.compressor, j.cipher)
+	} else {
+		backupWriter, err = targz.GetFileWriter(tmpBackupFile, target.compressor, j.diskRateLimit, j.cipher)
+	}
 	if err != nil {
 		logCh <- logger.Log(j.name, "").Errorf("Unable to create tmp file. Error: %s", err)
 		errs = multierror.Append(errs, err)
@@ -331,9 +428,12 @@ func (j *job) createTmpBackup(logCh chan logger.LogRecord, tmpBackupFile string,
 	// add db name
 	args = append(args, target.dbName)
 
-	var stderr bytes.Buffer
+	var (
+		stderr bytes.Buffer
+		head   binlog.Head
+	)
 	cmd := exec.Command("mysqldump", args...)
-	cmd.Stdout = backupWriter
+	cmd.Stdout = io.MultiWriter(backupWriter, &head)
 	cmd.Stderr = &stderr
 
 	logCh <- logger.Log(j.name, "").Debugf("Dump cmd: %s", cmd.String())
@@ -351,11 +451,100 @@ func (j *job) createTmpBackup(logCh chan logger.LogRecord, tmpBackupFile string,
 		return errs
 	}
 
+	// the end of compressed stream is written on close
+	if err = backupWriter.Close(); err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to finish `%s` dump. Error: %s", target.dbName, err)
+		errs = multierror.Append(errs, err)
+		return errs
+	}
+
 	logCh <- logger.Log(j.name, "").Infof("Dump of `%s` completed", target.dbName)
 
+	if pos, ok := head.Position(); !ok {
+		logCh <- logger.Log(j.name, "").Debugf("Binlog position isn't found in the dump of `%s`. Add `--source-data=2` or `--master-data=2` to `db_extra_keys` to replay binlogs after the dump restore", target.dbName)
+	} else if pos.ServerID, err = binlog.ServerID(target.connect); err != nil {
+		logCh <- logger.Log(j.name, "").Warnf("Unable to get MySQL server id, binlog position of `%s` dump isn't recorded. Error: %s", target.dbName, err)
+	} else {
+		j.binlogPositions[tmpBackupFile] = pos
+		logCh <- logger.Log(j.name, "").Infof("Dump of `%s` is taken at binlog position %s:%d", target.dbName, pos.File, pos.Pos)
+	}
+
 	return errs.ErrorOrNil()
 }
 
+func (j *job) DoRestore(logCh chan logger.LogRecord, p interfaces.RestoreParams) error {
+	tgt, ok := j.targets[p.Ofs]
+	if !ok {
+		return fmt.Errorf("Target `%s` not found in job `%s` ", p.Ofs, j.name)
+	}
+	if len(p.Files) == 0 {
+		return fmt.Errorf("No backups to restore for target `%s` ", p.Ofs)
+	}
+	file := p.Files[len(p.Files)-1]
+
+	dbName := tgt.dbName
+	if p.Dst != "" {
+		dbName = p.Dst
+	}
+
+	src, err := j.storages.GetFileReader(p.Storage, file)
+	if err != nil {
+		logCh <- logger.Log(j.name, p.Storage).Errorf("Unable to get backup `%s` from storage. Error: %s", file, err)
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	sqlReader, err := compression.Decompress(src)
+	if err != nil {
+		logCh <- logger.Log(j.name, p.Storage).Errorf("Unable to read backup `%s`. Error: %s", file, err)
+		return err
+	}
+	defer func() { _ = sqlReader.Close() }()
+
+	if _, err = tgt.connect.Exec("CREATE DATABASE IF NOT EXISTS `" + strings.ReplaceAll(dbName, "`", "``") + "`"); err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to create database `%s`. Error: %s", dbName, err)
+		return err
+	}
+
+	authFile, err := files.CreateTmpMysqlAuthFile(getRestoreAuthFile(tgt.authFile))
+	if err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Failed to create tmp auth file. Error: %s", err)
+		return err
+	}
+	defer func() {
+		if err = files.DeleteTmpMysqlAuthFile(authFile); err != nil {
+			logCh <- logger.Log(j.name, "").Errorf("Failed to delete tmp auth file. Error: %s", err)
+		}
+	}()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("mysql", "--defaults-file="+authFile, dbName)
+	cmd.Stdin = sqlReader
+	cmd.Stderr = &stderr
+
+	logCh <- logger.Log(j.name, "").Debugf("Restore cmd: %s", cmd.String())
+	logCh <- logger.Log(j.name, p.Storage).Infof("Starting to restore `%s` into `%s` database", file, dbName)
+
+	if err = cmd.Run(); err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to restore `%s`. Error: %s", dbName, stderr.String())
+		return err
+	}
+
+	logCh <- logger.Log(j.name, "").Infof("Restore of `%s` completed", dbName)
+
+	return nil
+}
+
+// getRestoreAuthFile converts the mysqldump auth file to the one readable by mysql client
+func getRestoreAuthFile(af *ini.File) *ini.File {
+	raf := ini.Empty()
+	sec, _ := raf.NewSection("mysql")
+	for _, k := range af.Section("mysqldump").Keys() {
+		_, _ = sec.NewKey(k.Name(), k.Value())
+	}
+	return raf
+}
+
 func (j *job) Close() error {
 	for _, tgt := range j.targets {
 		_ = tgt.connect.Close()
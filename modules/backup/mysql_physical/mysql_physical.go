@@ -13,52 +13,65 @@ import (
 
 	"github.com/docker/go-units"
 	"github.com/hashicorp/go-multierror"
+	"github.com/jmoiron/sqlx"
 	"gopkg.in/ini.v1"
 
 	"github.com/nixys/nxs-backup/ds/mysql_connect"
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/binlog"
+	"github.com/nixys/nxs-backup/modules/backend/compression"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backend/exec_cmd"
 	"github.com/nixys/nxs-backup/modules/backend/files"
 	"github.com/nixys/nxs-backup/modules/backend/targz"
+	"github.com/nixys/nxs-backup/modules/catalog"
 	"github.com/nixys/nxs-backup/modules/logger"
 	"github.com/nixys/nxs-backup/modules/metrics"
 )
 
 type job struct {
-	name             string
-	tmpDir           string
-	needToMakeBackup bool
-	safetyBackup     bool
-	deferredCopying  bool
-	diskRateLimit    int64
-	backupType       misc.BackupType
-	storages         interfaces.Storages
-	targets          map[string]target
-	dumpedObjects    map[string]interfaces.DumpObject
-	appMetrics       *metrics.Data
+	name                string
+	tmpDir              string
+	needToMakeBackup    bool
+	safetyBackup        bool
+	deferredCopying     bool
+	deliveryConcurrency int
+	diskRateLimit       int64
+	backupType          misc.BackupType
+	storages            interfaces.Storages
+	cipher              *crypt.Cipher
+	targets             map[string]target
+	dumpedObjects       map[string]interfaces.DumpObject
+	binlogPositions     map[string]catalog.BinlogPosition
+	appMetrics          *metrics.Data
+	catalog             *catalog.Catalog
 }
 
 type target struct {
+	connect         *sqlx.DB
 	extraKeys       []string
 	authFile        *ini.File
 	ignoreDatabases string
-	gzip            bool
+	compressor      *compression.Compressor
 	isSlave         bool
 	prepare         bool
 }
 
 type JobParams struct {
-	Name             string
-	TmpDir           string
-	NeedToMakeBackup bool
-	SafetyBackup     bool
-	DeferredCopying  bool
-	DiskRateLimit    int64
-	BackupType       misc.BackupType
-	Storages         interfaces.Storages
-	Sources          []SourceParams
-	Metrics          *metrics.Data
+	Name                string
+	TmpDir              string
+	NeedToMakeBackup    bool
+	SafetyBackup        bool
+	DeferredCopying     bool
+	DeliveryConcurrency int
+	DiskRateLimit       int64
+	BackupType          misc.BackupType
+	Storages            interfaces.Storages
+	Cipher              *crypt.Cipher
+	Sources             []SourceParams
+	Metrics             *metrics.Data
+	Catalog             *catalog.Catalog
 }
 
 type SourceParams struct {
@@ -67,7 +80,7 @@ type SourceParams struct {
 	TargetDBs     []string
 	Excludes      []string
 	ExtraKeys     []string
-	Gzip          bool
+	Compressor    *compression.Compressor
 	IsSlave       bool
 	Prepare       bool
 }
@@ -94,16 +107,20 @@ func Init(jp JobParams) (interfaces.Job, error) {
 	}
 
 	j := job{
-		name:             jp.Name,
-		tmpDir:           jp.TmpDir,
-		needToMakeBackup: jp.NeedToMakeBackup,
-		safetyBackup:     jp.SafetyBackup,
-		deferredCopying:  jp.DeferredCopying,
-		diskRateLimit:    jp.DiskRateLimit,
-		backupType:       jp.BackupType,
-		storages:         jp.Storages,
-		targets:          make(map[string]target),
-		dumpedObjects:    make(map[string]interfaces.DumpObject),
+		name:                jp.Name,
+		tmpDir:              jp.TmpDir,
+		needToMakeBackup:    jp.NeedToMakeBackup,
+		safetyBackup:        jp.SafetyBackup,
+		deferredCopying:     jp.DeferredCopying,
+		deliveryConcurrency: jp.DeliveryConcurrency,
+		diskRateLimit:       jp.DiskRateLimit,
+		backupType:          jp.BackupType,
+		storages:            jp.Storages,
+		cipher:              jp.Cipher,
+		targets:             make(map[string]target),
+		dumpedObjects:       make(map[string]interfaces.DumpObject),
+		binlogPositions:     make(map[string]catalog.BinlogPosition),
+		catalog:             jp.Catalog,
 		appMetrics: jp.Metrics.RegisterJob(
 			metrics.JobData{
 				JobName:       jp.Name,
@@ -115,7 +132,7 @@ func Init(jp JobParams) (interfaces.Job, error) {
 
 	for _, src := range jp.Sources {
 
-		_, authFile, err := mysql_connect.GetConnectAndCnfFile(src.ConnectParams, getApp(jp.BackupType))
+		dbConn, authFile, err := mysql_connect.GetConnectAndCnfFile(src.ConnectParams, getApp(jp.BackupType))
 		if err != nil {
 			return nil, err
 		}
@@ -130,10 +147,11 @@ func Init(jp JobParams) (interfaces.Job, error) {
 		ignoreDBs = strings.TrimSuffix(ignoreDBs, " ")
 
 		j.targets[src.Name] = target{
+			connect:         dbConn,
 			authFile:        authFile,
 			ignoreDatabases: ignoreDBs,
 			extraKeys:       src.ExtraKeys,
-			gzip:            src.Gzip,
+			compressor:      src.Compressor,
 			isSlave:         src.IsSlave,
 			prepare:         src.Prepare,
 		}
@@ -148,9 +166,19 @@ func Init(jp JobParams) (interfaces.Job, error) {
 }
 
 func (j *job) SetOfsMetrics(ofs string, metricsMap map[string]float64) {
-	for m, v := range metricsMap {
-		j.appMetrics.Job[j.name].TargetMetrics[ofs].Values[m] = v
-	}
+	j.appMetrics.SetValues(j.name, ofs, metricsMap)
+}
+
+func (j *job) GetOfsMetrics(ofs string) map[string]float64 {
+	return j.appMetrics.GetValues(j.name, ofs)
+}
+
+func (j *job) GetCatalog() *catalog.Catalog {
+	return j.catalog
+}
+
+func (j *job) SetOfsStorageMetrics(ofs, storage string, metricsMap map[string]float64) {
+	j.appMetrics.SetStorageValues(j.name, ofs, storage, metricsMap)
 }
 
 func (j *job) GetName() string {
@@ -176,6 +204,14 @@ func (j *job) GetStoragesCount() int {
 	return len(j.storages)
 }
 
+func (j *job) GetStorages() interfaces.Storages {
+	return j.storages
+}
+
+func (j *job) GetDeliveryConcurrency() int {
+	return j.deliveryConcurrency
+}
+
 func (j *job) GetDumpObjects() map[string]interfaces.DumpObject {
 	return j.dumpedObjects
 }
@@ -233,7 +269,7 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 			metrics.BackupTimestamp: float64(startTime.Unix()),
 		})
 
-		tmpBackupFile := misc.GetFileFullPath(tmpDir, ofsPart, "tar", "", tgt.gzip)
+		tmpBackupFile := misc.GetFileFullPath(tmpDir, ofsPart, "tar", "", tgt.compressor.Ext()) + j.cipher.Ext()
 		err := os.MkdirAll(path.Dir(tmpBackupFile), os.ModePerm)
 		if err != nil {
 			logCh <- logger.Log(j.name, "").Errorf("Unable to create tmp dir with next error: %s", err)
@@ -272,10 +308,24 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 		logCh <- logger.Log(j.name, "").Errorf("Failed to delivery backup. Errors: %v", err)
 		errs = multierror.Append(errs, err)
 	}
+	j.recordBinlogPositions(logCh)
 
 	return errs.ErrorOrNil()
 }
 
+// recordBinlogPositions saves the binlog positions of the delivered backups to the catalog for the binlog replay
+func (j *job) recordBinlogPositions(logCh chan logger.LogRecord) {
+	for ofs, dumpObj := range j.dumpedObjects {
+		pos, ok := j.binlogPositions[dumpObj.TmpFile]
+		if !ok || !dumpObj.Delivered {
+			continue
+		}
+		if err := j.catalog.SetBinlogPosition(j.name, ofs, path.Base(dumpObj.TmpFile), pos); err != nil {
+			logCh <- logger.Log(j.name, "").Warnf("Failed to record binlog position of `%s` to catalog: %s", ofs, err)
+		}
+	}
+}
+
 func (j *job) createTmpBackup(logCh chan logger.LogRecord, tmpBackupFile, tgtName string, target target) error {
 
 	var (
@@ -373,14 +423,26 @@ func (j *job) createTmpBackup(logCh chan logger.LogRecord, tmpBackupFile, tgtNam
 		}
 	}
 
+	if pos, ok, err := binlog.ReadInfoFile(tmpBackupPath); err != nil {
+		logCh <- logger.Log(j.name, "").Warnf("Unable to read binlog position of `%s` backup. Error: %s", tgtName, err)
+	} else if ok {
+		if pos.ServerID, err = binlog.ServerID(target.connect); err != nil {
+			logCh <- logger.Log(j.name, "").Warnf("Unable to get MySQL server id, binlog position of `%s` backup isn't recorded. Error: %s", tgtName, err)
+		} else {
+			j.binlogPositions[tmpBackupFile] = pos
+			logCh <- logger.Log(j.name, "").Infof("Backup of `%s` is taken at binlog position %s:%d", tgtName, pos.File, pos.Pos)
+		}
+	}
+
 	if err = targz.Tar(targz.TarOpts{
 		Src:         tmpBackupPath,
 		Dst:         tmpBackupFile,
 		Incremental: false,
-		Gzip:        target.gzip,
+		Compressor:  target.compressor,
 		SaveAbsPath: false,
 		RateLim:     j.diskRateLimit,
 		Excludes:    nil,
+		Cipher:      j.cipher,
 	}); err != nil {
 		logCh <- logger.Log(j.name, "").Errorf("Unable to make tar: %s", err)
 		var serr targz.Error
@@ -400,7 +462,48 @@ func (j *job) backupStatusErr(out string) error {
 	return fmt.Errorf("%s finished not success. Please check result:\n%s", getApp(j.backupType), out)
 }
 
+func (j *job) DoRestore(logCh chan logger.LogRecord, p interfaces.RestoreParams) error {
+	if _, ok := j.targets[p.Ofs]; !ok {
+		return fmt.Errorf("Target `%s` not found in job `%s` ", p.Ofs, j.name)
+	}
+	if len(p.Files) == 0 {
+		return fmt.Errorf("No backups to restore for target `%s` ", p.Ofs)
+	}
+	if p.Dst == "" {
+		return fmt.Errorf("Restore destination directory is required for `%s` job type ", j.backupType)
+	}
+	file := p.Files[len(p.Files)-1]
+
+	src, err := j.storages.GetFileReader(p.Storage, file)
+	if err != nil {
+		logCh <- logger.Log(j.name, p.Storage).Errorf("Unable to get backup `%s` from storage. Error: %s", file, err)
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	logCh <- logger.Log(j.name, p.Storage).Infof("Starting to restore `%s` to `%s`", file, p.Dst)
+	if err = targz.Untar(targz.UntarOpts{
+		Src:         src,
+		Dst:         p.Dst,
+		Incremental: false,
+	}); err != nil {
+		logCh <- logger.Log(j.name, p.Storage).Errorf("Failed to restore backup `%s`. Error: %v", file, err)
+		var serr targz.Error
+		if errors.As(err, &serr) {
+			logCh <- logger.Log(j.name, p.Storage).Debugf("STDERR: %s", serr.Stderr)
+		}
+		return err
+	}
+
+	logCh <- logger.Log(j.name, p.Storage).Infof("Restore of `%s` completed. Data files are prepared and may be placed into the MySQL data dir", p.Ofs)
+
+	return nil
+}
+
 func (j *job) Close() error {
+	for _, tgt := range j.targets {
+		_ = tgt.connect.Close()
+	}
 	for _, st := range j.storages {
 		_ = st.Close()
 	}
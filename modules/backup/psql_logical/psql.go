@@ -3,6 +3,7 @@ package psql_logical
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"os/exec"
@@ -17,23 +18,30 @@ import (
 	"github.com/nixys/nxs-backup/ds/psql_connect"
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/compression"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backend/exec_cmd"
 	"github.com/nixys/nxs-backup/modules/backend/targz"
+	"github.com/nixys/nxs-backup/modules/catalog"
 	"github.com/nixys/nxs-backup/modules/logger"
 	"github.com/nixys/nxs-backup/modules/metrics"
 )
 
 type job struct {
-	name             string
-	tmpDir           string
-	needToMakeBackup bool
-	safetyBackup     bool
-	deferredCopying  bool
-	diskRateLimit    int64
-	storages         interfaces.Storages
-	targets          map[string]target
-	dumpedObjects    map[string]interfaces.DumpObject
-	appMetrics       *metrics.Data
+	name                string
+	tmpDir              string
+	needToMakeBackup    bool
+	safetyBackup        bool
+	deferredCopying     bool
+	deliveryConcurrency int
+	streaming           bool
+	diskRateLimit       int64
+	storages            interfaces.Storages
+	cipher              *crypt.Cipher
+	targets             map[string]target
+	dumpedObjects       map[string]interfaces.DumpObject
+	appMetrics          *metrics.Data
+	catalog             *catalog.Catalog
 }
 
 type target struct {
@@ -41,19 +49,23 @@ type target struct {
 	dbName       string
 	ignoreTables []string
 	extraKeys    []string
-	gzip         bool
+	compressor   *compression.Compressor
 }
 
 type JobParams struct {
-	Name             string
-	TmpDir           string
-	NeedToMakeBackup bool
-	SafetyBackup     bool
-	DeferredCopying  bool
-	DiskRateLimit    int64
-	Storages         interfaces.Storages
-	Sources          []SourceParams
-	Metrics          *metrics.Data
+	Name                string
+	TmpDir              string
+	NeedToMakeBackup    bool
+	SafetyBackup        bool
+	DeferredCopying     bool
+	DeliveryConcurrency int
+	Streaming           bool
+	DiskRateLimit       int64
+	Storages            interfaces.Storages
+	Cipher              *crypt.Cipher
+	Sources             []SourceParams
+	Metrics             *metrics.Data
+	Catalog             *catalog.Catalog
 }
 
 type SourceParams struct {
@@ -62,7 +74,7 @@ type SourceParams struct {
 	TargetDBs     []string
 	Excludes      []string
 	ExtraKeys     []string
-	Gzip          bool
+	Compressor    *compression.Compressor
 	IsSlave       bool
 }
 
@@ -75,15 +87,19 @@ func Init(jp JobParams) (interfaces.Job, error) {
 	}
 
 	j := job{
-		name:             jp.Name,
-		tmpDir:           jp.TmpDir,
-		needToMakeBackup: jp.NeedToMakeBackup,
-		safetyBackup:     jp.SafetyBackup,
-		deferredCopying:  jp.DeferredCopying,
-		diskRateLimit:    jp.DiskRateLimit,
-		storages:         jp.Storages,
-		targets:          make(map[string]target),
-		dumpedObjects:    make(map[string]interfaces.DumpObject),
+		name:                jp.Name,
+		tmpDir:              jp.TmpDir,
+		needToMakeBackup:    jp.NeedToMakeBackup,
+		safetyBackup:        jp.SafetyBackup,
+		deferredCopying:     jp.DeferredCopying,
+		deliveryConcurrency: jp.DeliveryConcurrency,
+		streaming:           jp.Streaming,
+		diskRateLimit:       jp.DiskRateLimit,
+		storages:            jp.Storages,
+		cipher:              jp.Cipher,
+		targets:             make(map[string]target),
+		dumpedObjects:       make(map[string]interfaces.DumpObject),
+		catalog:             jp.Catalog,
 		appMetrics: jp.Metrics.RegisterJob(
 			metrics.JobData{
 				JobName:       jp.Name,
@@ -159,7 +175,7 @@ func Init(jp JobParams) (interfaces.Job, error) {
 				dbName:       db,
 				ignoreTables: ignoreTables,
 				extraKeys:    src.ExtraKeys,
-				gzip:         src.Gzip,
+				compressor:   src.Compressor,
 			}
 			j.appMetrics.Job[j.name].TargetMetrics[ofs] = metrics.TargetData{
 				Source: src.Name,
@@ -173,9 +189,19 @@ func Init(jp JobParams) (interfaces.Job, error) {
 }
 
 func (j *job) SetOfsMetrics(ofs string, metricsMap map[string]float64) {
-	for m, v := range metricsMap {
-		j.appMetrics.Job[j.name].TargetMetrics[ofs].Values[m] = v
-	}
+	j.appMetrics.SetValues(j.name, ofs, metricsMap)
+}
+
+func (j *job) GetOfsMetrics(ofs string) map[string]float64 {
+	return j.appMetrics.GetValues(j.name, ofs)
+}
+
+func (j *job) GetCatalog() *catalog.Catalog {
+	return j.catalog
+}
+
+func (j *job) SetOfsStorageMetrics(ofs, storage string, metricsMap map[string]float64) {
+	j.appMetrics.SetStorageValues(j.name, ofs, storage, metricsMap)
 }
 
 func (j *job) GetName() string {
@@ -201,6 +227,14 @@ func (j *job) GetStoragesCount() int {
 	return len(j.storages)
 }
 
+func (j *job) GetStorages() interfaces.Storages {
+	return j.storages
+}
+
+func (j *job) GetDeliveryConcurrency() int {
+	return j.deliveryConcurrency
+}
+
 func (j *job) GetDumpObjects() map[string]interfaces.DumpObject {
 	return j.dumpedObjects
 }
@@ -258,7 +292,7 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 			metrics.BackupTimestamp: float64(startTime.Unix()),
 		})
 
-		tmpBackupFile := misc.GetFileFullPath(tmpDir, ofsPart, "sql", "", tgt.gzip)
+		tmpBackupFile := misc.GetFileFullPath(tmpDir, ofsPart, "sql", "", tgt.compressor.Ext()) + j.cipher.Ext()
 		err := os.MkdirAll(path.Dir(tmpBackupFile), os.ModePerm)
 		if err != nil {
 			logCh <- logger.Log(j.name, "").Errorf("Unable to create tmp dir with next error: %s", err)
@@ -266,7 +300,14 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 			continue
 		}
 
-		if err = j.createTmpBackup(logCh, tmpBackupFile, tgt); err != nil {
+		if j.streaming {
+			if err = j.streamBackup(logCh, ofsPart, tmpBackupFile, tgt, startTime); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+			continue
+		}
+
+		if err = j.createTmpBackup(logCh, tmpBackupFile, nil, tgt); err != nil {
 			j.SetOfsMetrics(ofsPart, map[string]float64{
 				metrics.BackupTime: float64(time.Since(startTime).Nanoseconds() / 1e6),
 			})
@@ -301,10 +342,48 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 	return errs.ErrorOrNil()
 }
 
-func (j *job) createTmpBackup(logCh chan logger.LogRecord, tmpBackupPath string, target target) error {
-	var stderr bytes.Buffer
+// streamBackup makes the dump and passes it to the storages without the temp file
+func (j *job) streamBackup(logCh chan logger.LogRecord, ofsPart, tmpBackupFile string, tgt target, startTime time.Time) error {
+	size, dumpErr, deliveryErr := j.storages.DeliveryStream(logCh, j, ofsPart, tmpBackupFile, func(w io.Writer) error {
+		return j.createTmpBackup(logCh, tmpBackupFile, w, tgt)
+	})
+	// the stream can't be delivered again, the dump object is kept only to cleanup tmp data
+	j.dumpedObjects[ofsPart] = interfaces.DumpObject{TmpFile: tmpBackupFile, Delivered: true}
+
+	if dumpErr != nil {
+		j.SetOfsMetrics(ofsPart, map[string]float64{
+			metrics.BackupTime: float64(time.Since(startTime).Nanoseconds() / 1e6),
+		})
+		logCh <- logger.Log(j.name, "").Errorf("Failed to stream backup %s", tmpBackupFile)
+		return dumpErr
+	}
+	j.SetOfsMetrics(ofsPart, map[string]float64{
+		metrics.BackupOk:   float64(1),
+		metrics.BackupTime: float64(time.Since(startTime).Nanoseconds() / 1e6),
+		metrics.BackupSize: float64(size),
+	})
+
+	logCh <- logger.Log(j.name, "").Debugf("Streamed backup %s", tmpBackupFile)
 
-	backupWriter, err := targz.GetGZipFileWriter(tmpBackupPath, target.gzip, j.diskRateLimit)
+	if deliveryErr != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Failed to delivery backup. Errors: %v", deliveryErr)
+	}
+	return deliveryErr
+}
+
+// createTmpBackup makes the dump to the temp file, or to the stream if it's set
+func (j *job) createTmpBackup(logCh chan logger.LogRecord, tmpBackupPath string, stream io.Writer, target target) error {
+	var (
+		stderr       bytes.Buffer
+		backupWriter io.WriteCloser
+		err          error
+	)
+
+	if stream != nil {
+		backupWriter, err = targz.GetWriter(stream, tmpBackupPath, target.compressor, j.cipher)
+	} else {
+		backupWriter, err = targz.GetFileWriter(tmpBackupPath, target.compressor, j.diskRateLimit, j.cipher)
+	}
 	if err != nil {
 		logCh <- logger.Log(j.name, "").Errorf("Unable to create tmp file. Error: %s", err)
 		return err
@@ -340,11 +419,69 @@ func (j *job) createTmpBackup(logCh chan logger.LogRecord, tmpBackupPath string,
 		return err
 	}
 
+	// the end of compressed stream is written on close
+	if err = backupWriter.Close(); err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to finish `%s` dump. Error: %s", target.dbName, err)
+		return err
+	}
+
 	logCh <- logger.Log(j.name, "").Infof("Dump of `%s` completed", target.dbName)
 
 	return nil
 }
 
+func (j *job) DoRestore(logCh chan logger.LogRecord, p interfaces.RestoreParams) error {
+	tgt, ok := j.targets[p.Ofs]
+	if !ok {
+		return fmt.Errorf("Target `%s` not found in job `%s` ", p.Ofs, j.name)
+	}
+	if len(p.Files) == 0 {
+		return fmt.Errorf("No backups to restore for target `%s` ", p.Ofs)
+	}
+	file := p.Files[len(p.Files)-1]
+
+	connUrl := *tgt.connUrl
+	dbName := tgt.dbName
+	if p.Dst != "" {
+		dbName = p.Dst
+		connUrl.Path = "/" + dbName
+	}
+
+	src, err := j.storages.GetFileReader(p.Storage, file)
+	if err != nil {
+		logCh <- logger.Log(j.name, p.Storage).Errorf("Unable to get backup `%s` from storage. Error: %s", file, err)
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	sqlReader, err := compression.Decompress(src)
+	if err != nil {
+		logCh <- logger.Log(j.name, p.Storage).Errorf("Unable to read backup `%s`. Error: %s", file, err)
+		return err
+	}
+	defer func() { _ = sqlReader.Close() }()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("psql", "--quiet", "--dbname="+connUrl.String())
+	cmd.Stdin = sqlReader
+	cmd.Stderr = &stderr
+
+	logCh <- logger.Log(j.name, "").Debugf("Restore cmd: %s", cmd.String())
+	logCh <- logger.Log(j.name, p.Storage).Infof("Starting to restore `%s` into `%s` database", file, dbName)
+
+	if err = cmd.Run(); err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to restore `%s`. Error: %s", dbName, stderr.String())
+		return err
+	}
+	if stderr.Len() > 0 {
+		logCh <- logger.Log(j.name, "").Warnf("Restore of `%s` finished with messages: %s", dbName, stderr.String())
+	}
+
+	logCh <- logger.Log(j.name, "").Infof("Restore of `%s` completed", dbName)
+
+	return nil
+}
+
 func (j *job) Close() error {
 	for _, st := range j.storages {
 		_ = st.Close()
@@ -3,10 +3,10 @@ package redis
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
-	"strings"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
@@ -14,46 +14,56 @@ import (
 	"github.com/nixys/nxs-backup/ds/redis_connect"
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backend/compression"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backend/exec_cmd"
 	"github.com/nixys/nxs-backup/modules/backend/targz"
+	"github.com/nixys/nxs-backup/modules/catalog"
 	"github.com/nixys/nxs-backup/modules/logger"
 	"github.com/nixys/nxs-backup/modules/metrics"
 )
 
 type job struct {
-	name             string
-	tmpDir           string
-	needToMakeBackup bool
-	safetyBackup     bool
-	deferredCopying  bool
-	diskRateLimit    int64
-	appMetrics       *metrics.Data
-	storages         interfaces.Storages
-	targets          map[string]target
-	dumpedObjects    map[string]interfaces.DumpObject
+	name                string
+	tmpDir              string
+	needToMakeBackup    bool
+	safetyBackup        bool
+	deferredCopying     bool
+	deliveryConcurrency int
+	diskRateLimit       int64
+	appMetrics          *metrics.Data
+	catalog             *catalog.Catalog
+	storages            interfaces.Storages
+	cipher              *crypt.Cipher
+	targets             map[string]target
+	dumpedObjects       map[string]interfaces.DumpObject
 }
 
 type target struct {
-	dsn  string
-	gzip bool
+	dsn        string
+	compressor *compression.Compressor
 }
 
 type JobParams struct {
-	Name             string
-	TmpDir           string
-	NeedToMakeBackup bool
-	SafetyBackup     bool
-	DeferredCopying  bool
-	DiskRateLimit    int64
-	Storages         interfaces.Storages
-	Sources          []SourceParams
-	Metrics          *metrics.Data
+	Name                string
+	TmpDir              string
+	NeedToMakeBackup    bool
+	SafetyBackup        bool
+	DeferredCopying     bool
+	DeliveryConcurrency int
+	DiskRateLimit       int64
+	Storages            interfaces.Storages
+	Cipher              *crypt.Cipher
+	Sources             []SourceParams
+	Metrics             *metrics.Data
+	Catalog             *catalog.Catalog
 }
 
 type SourceParams struct {
 	Name          string
 	ConnectParams redis_connect.Params
-	Gzip          bool
+	Compressor    *compression.Compressor
 }
 
 func Init(jp JobParams) (interfaces.Job, error) {
@@ -65,15 +75,18 @@ func Init(jp JobParams) (interfaces.Job, error) {
 	}
 
 	j := job{
-		name:             jp.Name,
-		tmpDir:           jp.TmpDir,
-		needToMakeBackup: jp.NeedToMakeBackup,
-		safetyBackup:     jp.SafetyBackup,
-		deferredCopying:  jp.DeferredCopying,
-		diskRateLimit:    jp.DiskRateLimit,
-		storages:         jp.Storages,
-		targets:          make(map[string]target),
-		dumpedObjects:    make(map[string]interfaces.DumpObject),
+		name:                jp.Name,
+		tmpDir:              jp.TmpDir,
+		needToMakeBackup:    jp.NeedToMakeBackup,
+		safetyBackup:        jp.SafetyBackup,
+		deferredCopying:     jp.DeferredCopying,
+		deliveryConcurrency: jp.DeliveryConcurrency,
+		diskRateLimit:       jp.DiskRateLimit,
+		storages:            jp.Storages,
+		cipher:              jp.Cipher,
+		targets:             make(map[string]target),
+		dumpedObjects:       make(map[string]interfaces.DumpObject),
+		catalog:             jp.Catalog,
 		appMetrics: jp.Metrics.RegisterJob(
 			metrics.JobData{
 				JobName:       jp.Name,
@@ -92,8 +105,8 @@ func Init(jp JobParams) (interfaces.Job, error) {
 		_ = conn.Close()
 
 		j.targets[src.Name] = target{
-			gzip: src.Gzip,
-			dsn:  dsn,
+			compressor: src.Compressor,
+			dsn:        dsn,
 		}
 		j.appMetrics.Job[j.name].TargetMetrics[src.Name] = metrics.TargetData{
 			Source: src.Name,
@@ -106,9 +119,19 @@ func Init(jp JobParams) (interfaces.Job, error) {
 }
 
 func (j *job) SetOfsMetrics(ofs string, metricsMap map[string]float64) {
-	for m, v := range metricsMap {
-		j.appMetrics.Job[j.name].TargetMetrics[ofs].Values[m] = v
-	}
+	j.appMetrics.SetValues(j.name, ofs, metricsMap)
+}
+
+func (j *job) GetOfsMetrics(ofs string) map[string]float64 {
+	return j.appMetrics.GetValues(j.name, ofs)
+}
+
+func (j *job) GetCatalog() *catalog.Catalog {
+	return j.catalog
+}
+
+func (j *job) SetOfsStorageMetrics(ofs, storage string, metricsMap map[string]float64) {
+	j.appMetrics.SetStorageValues(j.name, ofs, storage, metricsMap)
 }
 
 func (j *job) GetName() string {
@@ -134,6 +157,14 @@ func (j *job) GetStoragesCount() int {
 	return len(j.storages)
 }
 
+func (j *job) GetStorages() interfaces.Storages {
+	return j.storages
+}
+
+func (j *job) GetDeliveryConcurrency() int {
+	return j.deliveryConcurrency
+}
+
 func (j *job) GetDumpObjects() map[string]interfaces.DumpObject {
 	return j.dumpedObjects
 }
@@ -191,7 +222,7 @@ func (j *job) DoBackup(logCh chan logger.LogRecord, tmpDir string) error {
 			metrics.BackupTimestamp: float64(startTime.Unix()),
 		})
 
-		tmpBackupFile := misc.GetFileFullPath(tmpDir, ofsPart, "rdb", "", tgt.gzip)
+		tmpBackupFile := misc.GetFileFullPath(tmpDir, ofsPart, "rdb", "", tgt.compressor.Ext()) + j.cipher.Ext()
 		err := os.MkdirAll(path.Dir(tmpBackupFile), os.ModePerm)
 		if err != nil {
 			logCh <- logger.Log(j.name, "").Errorf("Unable to create tmp dir with next error: %s", err)
@@ -235,7 +266,7 @@ func (j *job) createTmpBackup(logCh chan logger.LogRecord, tmpBackupFile, tgtNam
 
 	var stderr, stdout bytes.Buffer
 
-	tmpBackupRdb := strings.TrimSuffix(tmpBackupFile, ".gz")
+	tmpBackupRdb := compression.TrimExt(crypt.TrimExt(tmpBackupFile))
 
 	var args []string
 	// define command args
@@ -261,12 +292,15 @@ func (j *job) createTmpBackup(logCh chan logger.LogRecord, tmpBackupFile, tgtNam
 		return err
 	}
 
-	if tgt.gzip {
-		if err := targz.GZip(tmpBackupRdb, tmpBackupFile, j.diskRateLimit); err != nil {
-			logCh <- logger.Log(j.name, "").Errorf("Unable to gzip tmp backup: %s", err)
+	if tgt.compressor != nil || j.cipher != nil {
+		if err := targz.Pack(tmpBackupRdb, tmpBackupFile, tgt.compressor, j.diskRateLimit, j.cipher); err != nil {
+			logCh <- logger.Log(j.name, "").Errorf("Unable to pack tmp backup: %s", err)
 			return err
 		}
 		_ = os.RemoveAll(tmpBackupRdb)
+	} else if err := checksum.CreateManifest(tmpBackupFile); err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to create checksum manifest: %s", err)
+		return err
 	}
 
 	logCh <- logger.Log(j.name, "").Infof("Dumping of source `%s` completed", tgtName)
@@ -277,6 +311,55 @@ func (j *job) createTmpBackup(logCh chan logger.LogRecord, tmpBackupFile, tgtNam
 	return nil
 }
 
+func (j *job) DoRestore(logCh chan logger.LogRecord, p interfaces.RestoreParams) error {
+	if _, ok := j.targets[p.Ofs]; !ok {
+		return fmt.Errorf("Target `%s` not found in job `%s` ", p.Ofs, j.name)
+	}
+	if len(p.Files) == 0 {
+		return fmt.Errorf("No backups to restore for target `%s` ", p.Ofs)
+	}
+	if p.Dst == "" {
+		return fmt.Errorf("Restore destination file is required for `%s` job type ", misc.Redis)
+	}
+	file := p.Files[len(p.Files)-1]
+
+	src, err := j.storages.GetFileReader(p.Storage, file)
+	if err != nil {
+		logCh <- logger.Log(j.name, p.Storage).Errorf("Unable to get backup `%s` from storage. Error: %s", file, err)
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	gzr, err := compression.Decompress(src)
+	if err != nil {
+		logCh <- logger.Log(j.name, p.Storage).Errorf("Unable to read backup `%s`. Error: %s", file, err)
+		return err
+	}
+	defer func() { _ = gzr.Close() }()
+
+	if err = os.MkdirAll(path.Dir(p.Dst), os.ModePerm); err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to create restore dir. Error: %s", err)
+		return err
+	}
+	dst, err := os.Create(p.Dst)
+	if err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to create restore file. Error: %s", err)
+		return err
+	}
+	defer func() { _ = dst.Close() }()
+
+	logCh <- logger.Log(j.name, p.Storage).Infof("Starting to restore `%s` into `%s`", file, p.Dst)
+
+	if _, err = io.Copy(dst, gzr); err != nil {
+		logCh <- logger.Log(j.name, "").Errorf("Unable to restore `%s`. Error: %s", file, err)
+		return err
+	}
+
+	logCh <- logger.Log(j.name, "").Infof("Restore of `%s` completed. Place the file as `dump.rdb` into redis data dir and restart redis", p.Ofs)
+
+	return nil
+}
+
 func (j *job) Close() error {
 	for _, st := range j.storages {
 		_ = st.Close()
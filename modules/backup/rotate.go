@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"errors"
+	"io/fs"
+
+	"github.com/docker/go-units"
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/logger"
+	"github.com/nixys/nxs-backup/modules/metrics"
+	"github.com/nixys/nxs-backup/modules/storage"
+)
+
+// Rotate deletes the outdated backups of the job without making a new one, the count based retention keeps
+// the whole count of backups then. The number of the deleted backup files and the space freed on each storage are set to the job metrics,
+// the space is known for the storages able to report the size of backups only.
+func Rotate(logCh chan logger.LogRecord, job interfaces.Job) error {
+	var errs *multierror.Error
+
+	if job.GetStoragesCount() == 0 {
+		logCh <- logger.Log(job.GetName(), "").Warn("There are no configured storages for job.")
+		return nil
+	}
+
+	logCh <- logger.Log(job.GetName(), "").Info("Rotation starting")
+
+	before := make(map[string]map[string]map[string]int64)
+	for _, st := range job.GetStorages() {
+		before[st.GetName()] = make(map[string]map[string]int64)
+		for _, ofs := range job.GetTargetOfsList() {
+			files, err := storedFiles(st, ofs)
+			if err != nil {
+				logCh <- logger.Log(job.GetName(), st.GetName()).Warnf("Unable to list backups of `%s` before rotation, its metrics are not updated: %s", ofs, err)
+				continue
+			}
+			before[st.GetName()][ofs] = files
+		}
+	}
+
+	if err := RotationJob(job).DeleteOldBackups(logCh, ""); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	for _, st := range job.GetStorages() {
+		for ofs, was := range before[st.GetName()] {
+			files, err := storedFiles(st, ofs)
+			if err != nil {
+				logCh <- logger.Log(job.GetName(), st.GetName()).Warnf("Unable to list backups of `%s` after rotation, its metrics are not updated: %s", ofs, err)
+				continue
+			}
+
+			var deleted, freed int64
+			for f, size := range was {
+				freed += size
+				if _, ok := files[f]; !ok && !checksum.IsManifest(f) {
+					deleted++
+				}
+			}
+			// the backups moved to the longer period dirs take the space still
+			for _, size := range files {
+				freed -= size
+			}
+			freed = max(freed, 0)
+
+			job.SetOfsStorageMetrics(ofs, st.GetName(), map[string]float64{
+				metrics.RotationDeleted: float64(deleted),
+				metrics.RotationFreed:   float64(freed),
+			})
+			if deleted > 0 {
+				logCh <- logger.Log(job.GetName(), st.GetName()).Infof("Rotation deleted %d backup files of `%s`, %s freed", deleted, ofs, units.HumanSize(float64(freed)))
+			}
+		}
+	}
+
+	PruneCatalog(logCh, job)
+
+	logCh <- logger.Log(job.GetName(), "").Info("Rotation finished")
+
+	return errs.ErrorOrNil()
+}
+
+// rotationJob makes the storages keep the whole count of the job backups, since there is no new backup
+// to replace the oldest one when the rotation is run on its own
+type rotationJob struct {
+	interfaces.Job
+}
+
+// RotationJob returns the job to be rotated apart from its backup
+func RotationJob(job interfaces.Job) interfaces.Job {
+	return rotationJob{job}
+}
+
+func (j rotationJob) IsBackupSafety() bool {
+	return true
+}
+
+func (j rotationJob) DeleteOldBackups(logCh chan logger.LogRecord, ofsPath string) error {
+	if j.Job.IsBackupSafety() {
+		return j.Job.DeleteOldBackups(logCh, ofsPath)
+	}
+	logCh <- logger.Log(j.GetName(), "").Debugf("Starting rotate outdated backups.")
+	return j.GetStorages().DeleteOldBackups(logCh, j, ofsPath)
+}
+
+// storedFiles returns the backup files of the job target on the storage with their sizes.
+// The sizes are zero if the storage can't report them.
+func storedFiles(st interfaces.Storage, ofs string) (map[string]int64, error) {
+	list, err := st.ListBackups(ofs)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	ss, sized := interfaces.WithoutRetry(st).(interfaces.SizeStorage)
+	files := make(map[string]int64, len(list))
+	for _, f := range list {
+		ofsPath := storage.GetOfsRelPath(f, ofs)
+		if sized {
+			if files[ofsPath], err = ss.FileSize(ofsPath); err != nil {
+				return nil, err
+			}
+		} else {
+			files[ofsPath] = 0
+		}
+	}
+	return files, nil
+}
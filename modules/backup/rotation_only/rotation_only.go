@@ -0,0 +1,224 @@
+package rotation_only
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/catalog"
+	"github.com/nixys/nxs-backup/modules/logger"
+	"github.com/nixys/nxs-backup/modules/metrics"
+	"github.com/nixys/nxs-backup/modules/storage"
+)
+
+// layoutDirRegexp matches the dirs the backups of the target are stored in: the retention period dirs of the
+// backups and the year dirs and the metadata dir of the incremental backups
+var layoutDirRegexp = regexp.MustCompile(`^(daily|weekly|monthly|yearly|inc_meta_info|\d{4})$`)
+
+// job keeps rotating the backups of the job which source failed to init. Its targets are the ones found on storages,
+// the backup and restore fail with the init error.
+type job struct {
+	name       string
+	bakType    misc.BackupType
+	initErr    error
+	sources    []string
+	storages   interfaces.Storages
+	appMetrics *metrics.Data
+	catalog    *catalog.Catalog
+}
+
+type JobParams struct {
+	Name     string
+	Type     misc.BackupType
+	InitErr  error
+	Sources  []string
+	Storages interfaces.Storages
+	Metrics  *metrics.Data
+	Catalog  *catalog.Catalog
+}
+
+func Init(jp JobParams) interfaces.Job {
+	j := &job{
+		name:     jp.Name,
+		bakType:  jp.Type,
+		initErr:  jp.InitErr,
+		sources:  jp.Sources,
+		storages: jp.Storages,
+		catalog:  jp.Catalog,
+		appMetrics: jp.Metrics.RegisterJob(
+			metrics.JobData{
+				JobName:       jp.Name,
+				JobType:       jp.Type,
+				TargetMetrics: make(map[string]metrics.TargetData),
+			},
+		),
+	}
+
+	for _, ofs := range j.GetTargetOfsList() {
+		j.registerOfs(ofs)
+	}
+
+	return j
+}
+
+func (j *job) SetOfsMetrics(ofs string, metricsMap map[string]float64) {
+	j.registerOfs(ofs)
+	j.appMetrics.SetValues(j.name, ofs, metricsMap)
+}
+
+func (j *job) GetOfsMetrics(ofs string) map[string]float64 {
+	return j.appMetrics.GetValues(j.name, ofs)
+}
+
+func (j *job) GetCatalog() *catalog.Catalog {
+	return j.catalog
+}
+
+func (j *job) SetOfsStorageMetrics(ofs, storage string, metricsMap map[string]float64) {
+	j.registerOfs(ofs)
+	j.appMetrics.SetStorageValues(j.name, ofs, storage, metricsMap)
+}
+
+// registerOfs adds the metrics of the target found on storages
+func (j *job) registerOfs(ofs string) {
+	src, tgt, _ := strings.Cut(ofs, "/")
+	j.appMetrics.RegisterTarget(j.name, ofs, metrics.TargetData{
+		Source: src,
+		Target: tgt,
+		Values: make(map[string]float64),
+	})
+}
+
+func (j *job) GetName() string {
+	return j.name
+}
+
+func (j *job) GetTempDir() string {
+	return ""
+}
+
+func (j *job) GetType() misc.BackupType {
+	return j.bakType
+}
+
+// GetTargetOfsList returns the targets of the job sources which backups are found on storages
+func (j *job) GetTargetOfsList() (ofsList []string) {
+	found := make(map[string]bool)
+
+	for _, st := range j.storages {
+		for _, src := range j.sources {
+			list, err := st.ListBackups(src)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			for _, f := range list {
+				if ofs := targetOfs(storage.GetOfsRelPath(f, src), src); ofs != "" {
+					found[ofs] = true
+				}
+			}
+		}
+	}
+
+	for ofs := range found {
+		ofsList = append(ofsList, ofs)
+	}
+	sort.Strings(ofsList)
+	return
+}
+
+// targetOfs returns the target of the backup file path relative to the storage backup path,
+// it's the path of the source dir up to the dirs of the backups layout
+func targetOfs(relPath, src string) string {
+	parts := strings.Split(relPath, "/")
+	if len(parts) < 3 || parts[0] != src {
+		return ""
+	}
+	for i := 2; i < len(parts)-1; i++ {
+		if layoutDirRegexp.MatchString(parts[i]) {
+			return path.Join(parts[:i]...)
+		}
+	}
+	return ""
+}
+
+func (j *job) GetStoragesCount() int {
+	return len(j.storages)
+}
+
+func (j *job) GetStorages() interfaces.Storages {
+	return j.storages
+}
+
+func (j *job) GetDeliveryConcurrency() int {
+	return 1
+}
+
+func (j *job) GetDumpObjects() map[string]interfaces.DumpObject {
+	return nil
+}
+
+func (j *job) ListBackups() interfaces.JobTargets {
+	jt := make(interfaces.JobTargets)
+
+	for _, ofs := range j.GetTargetOfsList() {
+		jt[ofs] = j.storages.ListBackups(ofs)
+	}
+
+	return jt
+}
+
+func (j *job) SetDumpObjectDelivered(_ string) {}
+
+// IsBackupSafety is always true, the backups are never deleted before the new ones are made
+func (j *job) IsBackupSafety() bool {
+	return true
+}
+
+// NeedToMakeBackup is always true, so the backup runs fail with the init error
+func (j *job) NeedToMakeBackup() bool {
+	return true
+}
+
+func (j *job) NeedToUpdateIncMeta() bool {
+	return false
+}
+
+func (j *job) DeleteOldBackups(logCh chan logger.LogRecord, ofsPath string) error {
+	logCh <- logger.Log(j.name, "").Debugf("Starting rotate outdated backups.")
+	return j.storages.DeleteOldBackups(logCh, j, ofsPath)
+}
+
+func (j *job) CleanupTmpData() error {
+	return nil
+}
+
+func (j *job) DoBackup(logCh chan logger.LogRecord, _ string) error {
+	for _, ofs := range j.GetTargetOfsList() {
+		j.SetOfsMetrics(ofs, map[string]float64{
+			metrics.BackupOk:        float64(0),
+			metrics.BackupTimestamp: float64(time.Now().Unix()),
+		})
+	}
+
+	err := fmt.Errorf("Job `%s` source init failed, its backups are rotated only: %v ", j.name, j.initErr)
+	logCh <- logger.Log(j.name, "").Error(err)
+	return err
+}
+
+func (j *job) DoRestore(_ chan logger.LogRecord, _ interfaces.RestoreParams) error {
+	return fmt.Errorf("Job `%s` source init failed, restore is not available: %v ", j.name, j.initErr)
+}
+
+func (j *job) Close() error {
+	for _, st := range j.storages {
+		_ = st.Close()
+	}
+	return nil
+}
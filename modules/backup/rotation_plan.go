@@ -0,0 +1,95 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/modules/logger"
+	"github.com/nixys/nxs-backup/modules/storage"
+)
+
+// PlanRotation adds the files the job backups rotation would delete to the plan, the storages are not changed
+func PlanRotation(logCh chan logger.LogRecord, job interfaces.Job, plan *storage.RotationPlan) error {
+	var dss []interfaces.DryRunStorage
+	for _, st := range job.GetStorages() {
+		ds, ok := interfaces.WithoutRetry(st).(interfaces.DryRunStorage)
+		if !ok {
+			return fmt.Errorf("storage `%s` of job `%s` doesn't support rotation dry run", st.GetName(), job.GetName())
+		}
+		dss = append(dss, ds)
+	}
+
+	for _, ds := range dss {
+		ds.SetDryRun(plan)
+	}
+	defer func() {
+		for _, ds := range dss {
+			ds.SetDryRun(nil)
+		}
+	}()
+
+	return job.DeleteOldBackups(logCh, "")
+}
+
+// PrintRotationPlan writes the plan actions as a table or as JSON
+func PrintRotationPlan(w io.Writer, plan *storage.RotationPlan, asJSON bool) error {
+	actions := plan.Actions()
+	// the storages list the files in no particular order
+	sort.SliceStable(actions, func(i, j int) bool {
+		a, b := actions[i], actions[j]
+		if a.Job != b.Job {
+			return a.Job < b.Job
+		}
+		if a.Storage != b.Storage {
+			return a.Storage < b.Storage
+		}
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		return a.Path < b.Path
+	})
+
+	if asJSON {
+		if actions == nil {
+			actions = []storage.RotationAction{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(actions)
+	}
+
+	if len(actions) == 0 {
+		_, err := fmt.Fprintln(w, "Nothing to rotate.")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "JOB\tSTORAGE\tTARGET\tPERIOD\tRULE\tACTION")
+	for _, a := range actions {
+		action := "delete " + a.Path
+		if a.MoveTo != "" {
+			action = fmt.Sprintf("move %s to %s", a.Path, a.MoveTo)
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", a.Job, a.Storage, a.Target, a.Period, ruleString(a.RotationRule), action)
+	}
+	return tw.Flush()
+}
+
+func ruleString(r storage.RotationRule) string {
+	switch {
+	case r.Budget > 0:
+		return "size budget " + units.HumanSize(float64(r.Budget))
+	case r.Period == "inc":
+		return "months before " + r.Cutoff.Format("2006-01")
+	case r.Cutoff == nil:
+		return fmt.Sprintf("keep %d existing", r.Count)
+	default:
+		return "older than " + r.Cutoff.Format("2006-01-02 15:04")
+	}
+}
@@ -0,0 +1,136 @@
+package backup
+
+import (
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/nightlyone/lockfile"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/modules/logger"
+)
+
+// Runner performs jobs not more than maxParallelJobs at a time.
+// A job waits until all jobs holding any of its locks (same tmp dir, source host, etc.) are finished.
+// The same job is never performed twice at the same time.
+type Runner struct {
+	mu              sync.Mutex
+	cond            *sync.Cond
+	running         int
+	maxParallelJobs int
+	jobLocks        map[string][]string
+	busy            map[string]bool
+}
+
+func NewRunner(maxParallelJobs int, jobLocks map[string][]string) *Runner {
+	r := &Runner{
+		maxParallelJobs: max(maxParallelJobs, 1),
+		jobLocks:        jobLocks,
+		busy:            make(map[string]bool),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// Run performs the jobs keeping their order and returns errors of failed jobs.
+// It is safe to call Run from several goroutines, jobs share the same limits.
+func (r *Runner) Run(logCh chan logger.LogRecord, jobs interfaces.Jobs) []error {
+	return r.run(logCh, jobs, Perform)
+}
+
+// Rotate deletes the outdated backups of the jobs with the same limits as Run does
+func (r *Runner) Rotate(logCh chan logger.LogRecord, jobs interfaces.Jobs) []error {
+	return r.run(logCh, jobs, Rotate)
+}
+
+func (r *Runner) run(logCh chan logger.LogRecord, jobs interfaces.Jobs, do func(chan logger.LogRecord, interfaces.Job) error) (errs []error) {
+	var wg sync.WaitGroup
+
+	r.mu.Lock()
+	for len(jobs) > 0 {
+		next := -1
+		if r.running < r.maxParallelJobs {
+			for i, job := range jobs {
+				if !r.isBusy(job) {
+					next = i
+					break
+				}
+			}
+		}
+		if next < 0 {
+			r.cond.Wait()
+			continue
+		}
+
+		job := jobs[next]
+		jobs = append(jobs[:next:next], jobs[next+1:]...)
+		r.running++
+		r.setBusy(job, true)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := do(logCh, job)
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+			}
+			r.running--
+			r.setBusy(job, false)
+			r.cond.Broadcast()
+		}()
+	}
+	r.mu.Unlock()
+
+	wg.Wait()
+
+	return
+}
+
+func (r *Runner) isBusy(job interfaces.Job) bool {
+	if r.busy["job:"+job.GetName()] {
+		return true
+	}
+	for _, l := range r.jobLocks[job.GetName()] {
+		if r.busy[l] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Runner) setBusy(job interfaces.Job, b bool) {
+	r.busy["job:"+job.GetName()] = b
+	for _, l := range r.jobLocks[job.GetName()] {
+		r.busy[l] = b
+	}
+}
+
+// Lock creates the nxs-backup lockfile. If waitPrev is set, it waits up to waitPrev minutes
+// for the previous nxs-backup process to finish.
+func Lock(waitPrev time.Duration) (lockfile.Lockfile, error) {
+	lock, err := lockfile.New(path.Join(os.TempDir(), "nxs-backup.lck"))
+	if err != nil {
+		return lock, err
+	}
+
+	if waitPrev != 0 {
+		now := time.Now()
+		waitTill := now.Add(time.Minute * waitPrev)
+		for waitTill.After(time.Now()) {
+			if err = lock.TryLock(); err != nil {
+				time.Sleep(time.Second * 5)
+			} else {
+				break
+			}
+		}
+	} else {
+		err = lock.TryLock()
+	}
+
+	return lock, err
+}
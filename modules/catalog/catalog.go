@@ -0,0 +1,489 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/compression"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
+)
+
+const (
+	// openTimeout limits waiting for the catalog locked by another nxs-backup process
+	openTimeout = 30 * time.Second
+	keySep      = "\x00"
+	// pinsBucket can't be confused with the job bucket, the job names don't contain the separator
+	pinsBucket = keySep + "pins"
+)
+
+// Record describes the backup delivered to the storage
+type Record struct {
+	Job         string          `json:"job"`
+	Type        misc.BackupType `json:"type"`
+	Source      string          `json:"source"`
+	Target      string          `json:"target"`
+	Ofs         string          `json:"ofs"`
+	Storage     string          `json:"storage"`
+	File        string          `json:"file"`
+	Paths       []string        `json:"paths"`
+	Size        int64           `json:"size"`
+	Checksum    string          `json:"checksum,omitempty"`
+	Compression string          `json:"compression"`
+	Encryption  string          `json:"encryption,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	DeliveredAt time.Time       `json:"delivered_at"`
+	Success     bool            `json:"success"`
+	Error       string          `json:"error,omitempty"`
+	// Binlog is the position of the MySQL full backups, the binlog replay starts from it
+	Binlog *BinlogPosition `json:"binlog,omitempty"`
+}
+
+// BinlogPosition is the position in the binary log of the MySQL server the full backup was taken at
+type BinlogPosition struct {
+	ServerID uint32 `json:"server_id"`
+	File     string `json:"file"`
+	Pos      uint64 `json:"pos"`
+	GTID     string `json:"gtid,omitempty"`
+}
+
+// Pin protects the backup file of the job target on the storage against the rotation.
+// The paths of the file copies are relative to the storage backup path.
+type Pin struct {
+	Job      string    `json:"job"`
+	Ofs      string    `json:"ofs"`
+	Storage  string    `json:"storage"`
+	File     string    `json:"file"`
+	Paths    []string  `json:"paths"`
+	PinnedAt time.Time `json:"pinned_at"`
+}
+
+// Query filters the catalog records, empty fields match any value
+type Query struct {
+	Job         string
+	Ofs         string
+	Storage     string
+	SuccessOnly bool
+}
+
+// Catalog keeps the records of the delivered backups in the local bbolt database.
+// The database is opened for each operation only, so it can be shared by the server and the commands run manually.
+// A nil *Catalog is valid and means the catalog is disabled.
+type Catalog struct {
+	path string
+	mu   sync.Mutex
+}
+
+func Init(filePath string) *Catalog {
+	return &Catalog{path: filePath}
+}
+
+// NewRecord returns the record of the job target backup file with the fields defined by the file name filled
+func NewRecord(jobName string, bakType misc.BackupType, ofs, storage, fileName string) Record {
+	r := Record{
+		Job:         jobName,
+		Type:        bakType,
+		Ofs:         ofs,
+		Storage:     storage,
+		File:        fileName,
+		Compression: string(compression.AlgoOf(crypt.TrimExt(fileName))),
+		Encryption:  string(crypt.AlgoOf(fileName)),
+	}
+
+	// the ofs of the external jobs is the job name, others are prefixed with the source name
+	if src, target, ok := strings.Cut(ofs, "/"); ok {
+		r.Source, r.Target = src, target
+	} else {
+		r.Target = ofs
+	}
+	if t, ok := misc.GetBackupFileTime(fileName); ok {
+		r.CreatedAt = t
+	}
+
+	return r
+}
+
+func (c *Catalog) Path() string {
+	if c == nil {
+		return ""
+	}
+	return c.path
+}
+
+// Put adds the records to the catalog replacing the records of the same backups
+func (c *Catalog) Put(records ...Record) error {
+	if c == nil || len(records) == 0 {
+		return nil
+	}
+
+	return c.update(func(tx *bolt.Tx) error {
+		for _, r := range records {
+			b, err := tx.CreateBucketIfNotExists([]byte(r.Job))
+			if err != nil {
+				return err
+			}
+			if err = putRecord(b, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Replace replaces all the job records, it's used on the catalog rebuild.
+// The binlog positions can't be read from storages, so they are kept from the replaced records.
+func (c *Catalog) Replace(jobName string, records []Record) error {
+	if c == nil {
+		return nil
+	}
+
+	return c.update(func(tx *bolt.Tx) error {
+		positions := make(map[string]*BinlogPosition)
+		if old := tx.Bucket([]byte(jobName)); old != nil {
+			err := old.ForEach(func(k, v []byte) error {
+				var r Record
+				if err := json.Unmarshal(v, &r); err != nil {
+					return err
+				}
+				if r.Binlog != nil {
+					positions[string(k)] = r.Binlog
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if err = tx.DeleteBucket([]byte(jobName)); err != nil {
+				return err
+			}
+		}
+		b, err := tx.CreateBucket([]byte(jobName))
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			if r.Binlog == nil {
+				r.Binlog = positions[string(recordKey(r))]
+			}
+			if err = putRecord(b, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Prune removes the paths of the job target backups missing on the storage after the rotation.
+// Records left without paths are deleted, as well as records of failed deliveries followed by a successful one.
+// It returns the number of deleted records.
+func (c *Catalog) Prune(jobName, ofs, storage string, exists map[string]bool) (deleted int, err error) {
+	if c == nil {
+		return
+	}
+
+	err = c.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(jobName))
+		if b == nil {
+			return nil
+		}
+
+		var (
+			records     []Record
+			lastSuccess time.Time
+		)
+		prefix := []byte(ofs + keySep + storage + keySep)
+		cur := b.Cursor()
+		for k, v := cur.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = cur.Next() {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			records = append(records, r)
+			if r.Success && r.CreatedAt.After(lastSuccess) {
+				lastSuccess = r.CreatedAt
+			}
+		}
+
+		for _, r := range records {
+			if r.Success {
+				var paths []string
+				for _, p := range r.Paths {
+					if exists[p] {
+						paths = append(paths, p)
+					}
+				}
+				if len(paths) > 0 {
+					if len(paths) < len(r.Paths) {
+						r.Paths = paths
+						if err := putRecord(b, r); err != nil {
+							return err
+						}
+					}
+					continue
+				}
+			} else if !r.CreatedAt.Before(lastSuccess) {
+				continue
+			}
+			if err := b.Delete(recordKey(r)); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return
+}
+
+// DeletePath removes the path of the job backup deleted from the storage, the record is deleted along with its last path
+func (c *Catalog) DeletePath(jobName, ofs, storage, ofsPath string) error {
+	if c == nil {
+		return nil
+	}
+
+	return c.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(jobName))
+		if b == nil {
+			return nil
+		}
+		key := recordKey(Record{Ofs: ofs, Storage: storage, File: path.Base(ofsPath)})
+		v := b.Get(key)
+		if v == nil {
+			return nil
+		}
+		var r Record
+		if err := json.Unmarshal(v, &r); err != nil {
+			return err
+		}
+
+		var paths []string
+		for _, p := range r.Paths {
+			if p != ofsPath {
+				paths = append(paths, p)
+			}
+		}
+		if len(paths) == 0 {
+			return b.Delete(key)
+		}
+		r.Paths = paths
+		return putRecord(b, r)
+	})
+}
+
+// Find returns the records matching the query ordered by job, target, storage and creation time
+func (c *Catalog) Find(q Query) ([]Record, error) {
+	var records []Record
+
+	if c == nil {
+		return nil, fmt.Errorf("backups catalog is disabled")
+	}
+
+	err := c.view(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if string(name) == pinsBucket || (q.Job != "" && q.Job != string(name)) {
+				return nil
+			}
+			return b.ForEach(func(_, v []byte) error {
+				var r Record
+				if err := json.Unmarshal(v, &r); err != nil {
+					return err
+				}
+				if (q.Ofs != "" && q.Ofs != r.Ofs) ||
+					(q.Storage != "" && q.Storage != r.Storage) ||
+					(q.SuccessOnly && !r.Success) {
+					return nil
+				}
+				records = append(records, r)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		ri, rj := records[i], records[j]
+		if ri.Job != rj.Job {
+			return ri.Job < rj.Job
+		}
+		if ri.Ofs != rj.Ofs {
+			return ri.Ofs < rj.Ofs
+		}
+		if ri.Storage != rj.Storage {
+			return ri.Storage < rj.Storage
+		}
+		return ri.CreatedAt.Before(rj.CreatedAt)
+	})
+
+	return records, nil
+}
+
+// SetBinlogPosition records the binlog position of the job target backup file on all storages
+func (c *Catalog) SetBinlogPosition(jobName, ofs, file string, pos BinlogPosition) error {
+	if c == nil {
+		return nil
+	}
+
+	return c.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(jobName))
+		if b == nil {
+			return nil
+		}
+
+		var records []Record
+		err := b.ForEach(func(_, v []byte) error {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if r.Ofs == ofs && r.File == file {
+				r.Binlog = &pos
+				records = append(records, r)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, r := range records {
+			if err = putRecord(b, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PutPin adds the pin of the backup replacing the previous pin of the same backup
+func (c *Catalog) PutPin(p Pin) error {
+	if c == nil {
+		return fmt.Errorf("backups catalog is disabled")
+	}
+
+	return c.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(pinsBucket))
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		return b.Put(pinKey(p), v)
+	})
+}
+
+// DeletePin removes the pin of the backup, it reports whether the backup was pinned
+func (c *Catalog) DeletePin(jobName, ofs, storage, file string) (deleted bool, err error) {
+	if c == nil {
+		return false, fmt.Errorf("backups catalog is disabled")
+	}
+
+	err = c.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(pinsBucket))
+		if b == nil {
+			return nil
+		}
+		key := pinKey(Pin{Job: jobName, Ofs: ofs, Storage: storage, File: file})
+		if b.Get(key) == nil {
+			return nil
+		}
+		deleted = true
+		return b.Delete(key)
+	})
+	return
+}
+
+// Pins returns the pins matching the query ordered by job, target, storage and file.
+// There are no pins if the catalog is disabled.
+func (c *Catalog) Pins(q Query) ([]Pin, error) {
+	var pins []Pin
+
+	if c == nil {
+		return nil, nil
+	}
+
+	err := c.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(pinsBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var p Pin
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			if (q.Job != "" && q.Job != p.Job) ||
+				(q.Ofs != "" && q.Ofs != p.Ofs) ||
+				(q.Storage != "" && q.Storage != p.Storage) {
+				return nil
+			}
+			pins = append(pins, p)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the keys are ordered by job, target, storage and file already
+	return pins, nil
+}
+
+func (c *Catalog) update(fn func(tx *bolt.Tx) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.MkdirAll(path.Dir(c.path), 0750); err != nil {
+		return err
+	}
+	db, err := bolt.Open(c.path, 0600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return fmt.Errorf("failed to open backups catalog `%s`: %w", c.path, err)
+	}
+	defer func() { _ = db.Close() }()
+
+	return db.Update(fn)
+}
+
+func (c *Catalog) view(fn func(tx *bolt.Tx) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := os.Stat(c.path); os.IsNotExist(err) {
+		// nothing is recorded yet
+		return nil
+	}
+	db, err := bolt.Open(c.path, 0600, &bolt.Options{Timeout: openTimeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to open backups catalog `%s`: %w", c.path, err)
+	}
+	defer func() { _ = db.Close() }()
+
+	return db.View(fn)
+}
+
+func putRecord(b *bolt.Bucket, r Record) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return b.Put(recordKey(r), v)
+}
+
+func pinKey(p Pin) []byte {
+	return []byte(p.Job + keySep + p.Ofs + keySep + p.Storage + keySep + p.File)
+}
+
+func recordKey(r Record) []byte {
+	return []byte(r.Ofs + keySep + r.Storage + keySep + r.File)
+}
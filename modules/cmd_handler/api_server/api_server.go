@@ -8,32 +8,52 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/nixys/nxs-backup/api"
+	"github.com/nixys/nxs-backup/api/endpoints"
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/modules/logger"
 	"github.com/nixys/nxs-backup/modules/metrics"
+	"github.com/nixys/nxs-backup/modules/scheduler"
 )
 
 type Opts struct {
+	InitErr        error
 	Bind           string
+	APIToken       string
 	MetricFilePath string
+	MetricsData    *metrics.Data
+	Scheduler      *scheduler.Scheduler
+	Jobs           map[string]interfaces.Job
+	JobGroups      map[string]interfaces.Jobs
 	Log            *logrus.Logger
+	EvCh           chan logger.LogRecord
 	Done           chan error
 }
 
 type httpServer struct {
 	http.Server
-	log      *logrus.Logger
-	exporter *metrics.Exporter
-	registry *prometheus.Registry
-	done     chan error
+	initErr   error
+	log       *logrus.Logger
+	exporter  *metrics.Exporter
+	registry  *prometheus.Registry
+	scheduler *scheduler.Scheduler
+	done      chan error
 }
 
 func Init(o Opts) (*httpServer, error) {
 
-	exporter := metrics.InitExporter(
-		metrics.ExporterOpts{
-			Log:            o.Log,
-			MetricFilePath: o.MetricFilePath,
-		},
-	)
+	eo := metrics.ExporterOpts{
+		Log:            o.Log,
+		MetricFilePath: o.MetricFilePath,
+	}
+	// restore metrics of previous runs, since the server saves metrics of its own runs to the file
+	if err := o.MetricsData.LoadFile(); err != nil {
+		o.Log.Warnf("Failed to read metric file: %v", err)
+	}
+	// scheduled backups are made by the server itself, so metrics are exported directly from memory
+	if o.Scheduler.Scheduled() {
+		eo.Data = o.MetricsData
+	}
+	exporter := metrics.InitExporter(eo)
 
 	registry := prometheus.NewRegistry()
 	if err := registry.Register(exporter); err != nil {
@@ -41,22 +61,45 @@ func Init(o Opts) (*httpServer, error) {
 		return nil, err
 	}
 
+	var v1 *endpoints.V1
+	if o.APIToken != "" {
+		v1 = endpoints.NewV1(
+			endpoints.V1Opts{
+				Token:     o.APIToken,
+				EvCh:      o.EvCh,
+				Scheduler: o.Scheduler,
+				Jobs:      o.Jobs,
+				JobGroups: o.JobGroups,
+			},
+		)
+	} else {
+		o.Log.Warn("REST API is disabled, set `server.api_token` to enable it")
+	}
+
 	return &httpServer{
 		Server: http.Server{
 			Addr:         o.Bind,
 			ReadTimeout:  10 * time.Second,
 			WriteTimeout: 10 * time.Second,
-			Handler:      api.RoutesSet(o.Log, registry),
+			Handler:      api.RoutesSet(o.Log, registry, v1),
 		},
-		exporter: exporter,
-		registry: registry,
-		log:      o.Log,
-		done:     o.Done,
+		initErr:   o.InitErr,
+		exporter:  exporter,
+		registry:  registry,
+		scheduler: o.Scheduler,
+		log:       o.Log,
+		done:      o.Done,
 	}, nil
 }
 
 func (s *httpServer) Run() {
 
+	if s.initErr != nil {
+		s.log.Errorf("Backup plan initialised with errors: %v", s.initErr)
+	}
+
+	s.scheduler.Start()
+
 	s.log.Trace("api: starting")
 	err := s.ListenAndServe()
 	if err != nil {
@@ -77,6 +77,9 @@ type storageConnect struct {
 	NfsParams    *nfsParams    `yaml:"nfs_params,omitempty"`
 	WebDavParams *webDavParams `yaml:"webdav_params,omitempty"`
 	SmbParams    *smbParams    `yaml:"smb_params,omitempty"`
+	AzureParams  *azureParams  `yaml:"azure_params,omitempty"`
+	GcsParams    *gcsParams    `yaml:"gcs_params,omitempty"`
+	ExecParams   *execParams   `yaml:"exec_params,omitempty"`
 }
 
 type s3Params struct {
@@ -126,6 +129,22 @@ type smbParams struct {
 	Share    string `yaml:"share"`
 }
 
+type azureParams struct {
+	AccountName string `yaml:"account_name"`
+	Container   string `yaml:"container"`
+	AccountKey  string `yaml:"account_key"`
+}
+
+type gcsParams struct {
+	BucketName      string `yaml:"bucket_name"`
+	CredentialsFile string `yaml:"credentials_file"`
+}
+
+type execParams struct {
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+}
+
 type Opts struct {
 	Done     chan error
 	CfgPath  string
@@ -250,6 +269,26 @@ func (gc *generateConfig) Run() {
 				ExtraKeys:         "--datadir=/var/lib/mysql",
 			},
 		}
+	case misc.MysqlBinlog:
+		job.StoragesOptions = genStorageOpts(gc.storages, false)
+		// binlogs are kept for the days only, they're replayed after the full backups of the last week
+		for i := range job.StoragesOptions {
+			job.StoragesOptions[i].Retention = cfgRetentionYaml{Days: 7}
+		}
+		job.Sources = []sourceYaml{
+			{
+				Name: "mysql",
+				Gzip: true,
+				Connect: srcConnectYaml{
+					DBHost:     "mysql",
+					DBPort:     "3306",
+					DBUser:     "root",
+					DBPassword: "rootP@5s",
+					Socket:     "",
+					AuthFile:   "",
+				},
+			},
+		}
 	case misc.Postgresql:
 		job.StoragesOptions = genStorageOpts(gc.storages, false)
 		job.Sources = []sourceYaml{
@@ -475,6 +514,9 @@ func getStorageConnects(storages map[string]string) ([]*yaml.Node, error) {
 		"smb",
 		"nfs",
 		"webdav",
+		"azure",
+		"gcs",
+		"exec",
 	}
 	var sts []*yaml.Node
 
@@ -528,6 +570,22 @@ func getStorageConnects(storages map[string]string) ([]*yaml.Node, error) {
 				Password:   "my_webdav_pass",
 				OAuthToken: "my_webdav_oauth_token",
 			}
+		case ast[8]:
+			st.AzureParams = &azureParams{
+				AccountName: "my_azure_account",
+				Container:   "my_azure_container",
+				AccountKey:  "my_azure_account_key",
+			}
+		case ast[9]:
+			st.GcsParams = &gcsParams{
+				BucketName:      "my_bucket",
+				CredentialsFile: "/path/to/service_account.json",
+			}
+		case ast[10]:
+			st.ExecParams = &execParams{
+				Command: "/path/to/storage_helper",
+				Args:    []string{"my_helper_arg"},
+			}
 		default:
 			return nil, fmt.Errorf("Unknown storage type. Supported types: %s ", strings.Join(ast, ", "))
 		}
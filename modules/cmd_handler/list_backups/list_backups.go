@@ -2,11 +2,17 @@ package list_backups
 
 import (
 	"fmt"
+	"path"
+	"strings"
+
+	"github.com/docker/go-units"
 	"github.com/fatih/color"
 	"github.com/hashicorp/go-multierror"
 
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/compression"
+	"github.com/nixys/nxs-backup/modules/catalog"
 )
 
 type Opts struct {
@@ -17,16 +23,19 @@ type Opts struct {
 	DBJobs   interfaces.Jobs
 	ExtJobs  interfaces.Jobs
 	Jobs     map[string]interfaces.Job
+	// FromCatalog makes the backups to be read from the catalog instead of listing the storages
+	FromCatalog bool
 }
 
 type listBackups struct {
-	jobName  string
-	initErr  error
-	done     chan error
-	fileJobs interfaces.Jobs
-	dbJobs   interfaces.Jobs
-	extJobs  interfaces.Jobs
-	jobs     map[string]interfaces.Job
+	jobName     string
+	initErr     error
+	done        chan error
+	fileJobs    interfaces.Jobs
+	dbJobs      interfaces.Jobs
+	extJobs     interfaces.Jobs
+	jobs        map[string]interfaces.Job
+	fromCatalog bool
 }
 
 type treeElement struct {
@@ -42,13 +51,14 @@ var (
 
 func Init(o Opts) *listBackups {
 	return &listBackups{
-		jobName:  o.JobName,
-		initErr:  o.InitErr,
-		done:     o.Done,
-		fileJobs: o.FileJobs,
-		dbJobs:   o.DBJobs,
-		extJobs:  o.ExtJobs,
-		jobs:     o.Jobs,
+		jobName:     o.JobName,
+		initErr:     o.InitErr,
+		done:        o.Done,
+		fileJobs:    o.FileJobs,
+		dbJobs:      o.DBJobs,
+		extJobs:     o.ExtJobs,
+		jobs:        o.Jobs,
+		fromCatalog: o.FromCatalog,
 	}
 }
 
@@ -66,19 +76,19 @@ func (lb *listBackups) Run() {
 	}
 
 	if lb.jobName == "external" || lb.jobName == "all" {
-		err := printBackups("External", lb.extJobs)
+		err := printBackups("External", lb.extJobs, lb.fromCatalog)
 		errs = multierror.Append(err, errs)
 	}
 	if lb.jobName == "databases" || lb.jobName == "all" {
-		err := printBackups("Database", lb.dbJobs)
+		err := printBackups("Database", lb.dbJobs, lb.fromCatalog)
 		errs = multierror.Append(err, errs)
 	}
 	if lb.jobName == "files" || lb.jobName == "all" {
-		err := printBackups("File", lb.fileJobs)
+		err := printBackups("File", lb.fileJobs, lb.fromCatalog)
 		errs = multierror.Append(err, errs)
 	}
 	if job, ok := lb.jobs[lb.jobName]; ok {
-		err := printBackups("", interfaces.Jobs{job})
+		err := printBackups("", interfaces.Jobs{job}, lb.fromCatalog)
 		errs = multierror.Append(err, errs)
 	}
 	if errs.Len() > 0 {
@@ -87,7 +97,7 @@ func (lb *listBackups) Run() {
 	}
 }
 
-func printBackups(bType string, jobs interfaces.Jobs) (err error) {
+func printBackups(bType string, jobs interfaces.Jobs, fromCatalog bool) (err error) {
 	var backupsTree []treeElement
 
 	if len(bType) > 0 && len(jobs) > 0 {
@@ -96,7 +106,7 @@ func printBackups(bType string, jobs interfaces.Jobs) (err error) {
 
 	for _, job := range jobs {
 		var jobTargets []treeElement
-		jt := job.ListBackups()
+		jt := listJobBackups(job, fromCatalog)
 		for tName, tOnSt := range jt {
 			jobTargetSts := make([]treeElement, 0, len(tOnSt))
 			for st, tFiles := range tOnSt {
@@ -140,6 +150,69 @@ func printBackups(bType string, jobs interfaces.Jobs) (err error) {
 	return
 }
 
+// listJobBackups returns the job backups listed on the storages or recorded in the catalog along with their details
+func listJobBackups(job interfaces.Job, fromCatalog bool) interfaces.JobTargets {
+	if !fromCatalog {
+		return job.ListBackups()
+	}
+
+	jt := make(interfaces.JobTargets)
+	for _, ofs := range job.GetTargetOfsList() {
+		jt[ofs] = make(interfaces.TargetsOnStorages)
+		for _, st := range job.GetStorages() {
+			jt[ofs][st.GetName()] = interfaces.TargetFiles{}
+		}
+	}
+
+	records, err := job.GetCatalog().Find(catalog.Query{Job: job.GetName()})
+	if err != nil {
+		for _, tOnSt := range jt {
+			for st := range tOnSt {
+				tOnSt[st] = interfaces.TargetFiles{ListErr: err}
+			}
+		}
+		return jt
+	}
+
+	for _, r := range records {
+		tOnSt, ok := jt[r.Ofs]
+		if !ok {
+			// the target isn't backed up anymore, but its backups are still kept
+			tOnSt = make(interfaces.TargetsOnStorages)
+			jt[r.Ofs] = tOnSt
+		}
+		tf := tOnSt[r.Storage]
+		tf.List = append(tf.List, describeRecord(r))
+		tOnSt[r.Storage] = tf
+	}
+
+	return jt
+}
+
+func describeRecord(r catalog.Record) string {
+	if !r.Success {
+		return fmt.Sprintf("%s (delivery failed: %s)", r.File, r.Error)
+	}
+
+	var details []string
+	if r.Size > 0 {
+		details = append(details, units.BytesSize(float64(r.Size)))
+	}
+	if r.Compression != string(compression.NoneAlgo) {
+		details = append(details, r.Compression)
+	}
+	if r.Encryption != "" {
+		details = append(details, r.Encryption)
+	}
+	var dirs []string
+	for _, p := range r.Paths {
+		dirs = append(dirs, path.Base(path.Dir(p)))
+	}
+	details = append(details, strings.Join(dirs, ", "))
+
+	return fmt.Sprintf("%s (%s)", r.File, strings.Join(details, "; "))
+}
+
 func printTree(elements []treeElement, prefix string, lvl int) {
 	for i, e := range elements {
 		if i == len(elements)-1 {
@@ -0,0 +1,107 @@
+package list_pins
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fatih/color"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/catalog"
+)
+
+type Opts struct {
+	JobName   string
+	InitErr   error
+	Done      chan error
+	Catalog   *catalog.Catalog
+	Jobs      map[string]interfaces.Job
+	JobGroups map[string]interfaces.Jobs
+}
+
+type listPins struct {
+	jobName   string
+	initErr   error
+	done      chan error
+	catalog   *catalog.Catalog
+	jobs      map[string]interfaces.Job
+	jobGroups map[string]interfaces.Jobs
+}
+
+func Init(o Opts) *listPins {
+	return &listPins{
+		jobName:   o.JobName,
+		initErr:   o.InitErr,
+		done:      o.Done,
+		catalog:   o.Catalog,
+		jobs:      o.Jobs,
+		jobGroups: o.JobGroups,
+	}
+}
+
+func (lp *listPins) Run() {
+	var err error
+
+	defer func() {
+		lp.done <- err
+	}()
+
+	if lp.initErr != nil {
+		color.HiRed("[WARNING!] Backup plan initialised with errors:")
+		fmt.Println(lp.initErr)
+	}
+
+	if lp.catalog == nil {
+		color.HiRed("Backups catalog is disabled by config.")
+		err = misc.ErrExecution
+		return
+	}
+
+	var jobNames []string
+	switch {
+	case lp.jobName == "all":
+	case lp.jobGroups[lp.jobName] != nil:
+		for _, job := range lp.jobGroups[lp.jobName] {
+			jobNames = append(jobNames, job.GetName())
+		}
+	case lp.jobs[lp.jobName] != nil:
+		jobNames = []string{lp.jobName}
+	default:
+		color.HiRed("Job `%s` not found.", lp.jobName)
+		err = misc.ErrExecution
+		return
+	}
+
+	var pins []catalog.Pin
+	if jobNames == nil {
+		pins, err = lp.catalog.Pins(catalog.Query{})
+	} else {
+		for _, name := range jobNames {
+			var jobPins []catalog.Pin
+			if jobPins, err = lp.catalog.Pins(catalog.Query{Job: name}); err != nil {
+				break
+			}
+			pins = append(pins, jobPins...)
+		}
+	}
+	if err != nil {
+		color.HiRed("Failed to read pinned backups: %v", err)
+		err = misc.ErrExecution
+		return
+	}
+
+	if len(pins) == 0 {
+		fmt.Println("No pinned backups.")
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "JOB\tTARGET\tSTORAGE\tFILE\tPINNED AT\tPATHS")
+	for _, p := range pins {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", p.Job, p.Ofs, p.Storage, p.File, p.PinnedAt.Format("2006-01-02 15:04"), strings.Join(p.Paths, ", "))
+	}
+	_ = tw.Flush()
+}
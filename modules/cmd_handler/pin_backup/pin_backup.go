@@ -0,0 +1,183 @@
+package pin_backup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backup"
+	"github.com/nixys/nxs-backup/modules/catalog"
+	"github.com/nixys/nxs-backup/modules/logger"
+	"github.com/nixys/nxs-backup/modules/storage"
+)
+
+type Opts struct {
+	InitErr  error
+	Done     chan error
+	EvCh     chan logger.LogRecord
+	WaitPrev time.Duration
+	JobName  string
+	Target   string
+	File     string
+	Storage  string
+	// Unpin makes the pin of the backup to be removed
+	Unpin bool
+	Jobs  map[string]interfaces.Job
+}
+
+type pinBackup struct {
+	initErr  error
+	done     chan error
+	evCh     chan logger.LogRecord
+	waitPrev time.Duration
+	jobName  string
+	target   string
+	file     string
+	storage  string
+	unpin    bool
+	jobs     map[string]interfaces.Job
+}
+
+func Init(o Opts) *pinBackup {
+	return &pinBackup{
+		initErr:  o.InitErr,
+		done:     o.Done,
+		evCh:     o.EvCh,
+		waitPrev: o.WaitPrev,
+		jobName:  o.JobName,
+		target:   o.Target,
+		file:     strings.TrimSuffix(path.Base(o.File), checksum.Ext),
+		storage:  o.Storage,
+		unpin:    o.Unpin,
+		jobs:     o.Jobs,
+	}
+}
+
+func (pb *pinBackup) Run() {
+	var err error
+
+	defer func() {
+		pb.done <- err
+	}()
+
+	if pb.initErr != nil {
+		pb.evCh <- logger.Log("", "").Errorf("Backup plan initialised with errors: %v", pb.initErr)
+	}
+
+	job, ok := pb.jobs[pb.jobName]
+	if !ok {
+		err = fmt.Errorf("Job `%s` not found. ", pb.jobName)
+		pb.evCh <- logger.Log("", "").Error(err)
+		return
+	}
+	if job.GetCatalog() == nil {
+		err = fmt.Errorf("Backups catalog is disabled by config, it's required to pin backups. ")
+		pb.evCh <- logger.Log(pb.jobName, "").Error(err)
+		return
+	}
+	if !slices.Contains(job.GetTargetOfsList(), pb.target) {
+		err = fmt.Errorf("Target `%s` not found in job `%s`. Available targets: %s ", pb.target, pb.jobName, strings.Join(job.GetTargetOfsList(), ", "))
+		pb.evCh <- logger.Log(pb.jobName, "").Error(err)
+		return
+	}
+
+	var sts interfaces.Storages
+	for _, st := range job.GetStorages() {
+		if pb.storage == "" || st.GetName() == pb.storage {
+			sts = append(sts, st)
+		}
+	}
+	if len(sts) == 0 {
+		err = fmt.Errorf("Storage `%s` not found in job `%s`. ", pb.storage, pb.jobName)
+		pb.evCh <- logger.Log(pb.jobName, "").Error(err)
+		return
+	}
+
+	if pb.unpin {
+		err = pb.unpinBackup(job, sts)
+	} else {
+		err = pb.pinBackup(job, sts)
+	}
+}
+
+// pinBackup pins the backup on the storages it's found on, at least one storage is required
+func (pb *pinBackup) pinBackup(job interfaces.Job, sts interfaces.Storages) error {
+	// the backup can't be pinned while the rotation is in progress
+	lock, err := backup.Lock(pb.waitPrev)
+	if err != nil {
+		err = fmt.Errorf("Can't pin backup. Another nxs-backup process already running. ")
+		pb.evCh <- logger.Log(pb.jobName, "").Error(err)
+		return err
+	}
+	defer func() { _ = lock.Unlock() }()
+
+	pinned := 0
+	for _, st := range sts {
+		list, err := st.ListBackups(pb.target)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			pb.evCh <- logger.Log(pb.jobName, st.GetName()).Errorf("Failed to get backups list of `%s`. Error: %v", pb.target, err)
+			return err
+		}
+
+		var paths []string
+		for _, f := range list {
+			if strings.TrimSuffix(path.Base(f), checksum.Ext) == pb.file {
+				paths = append(paths, storage.GetOfsRelPath(f, pb.target))
+			}
+		}
+		if len(paths) == 0 {
+			pb.evCh <- logger.Log(pb.jobName, st.GetName()).Warnf("Backup `%s` of `%s` not found on storage.", pb.file, pb.target)
+			continue
+		}
+
+		err = job.GetCatalog().PutPin(catalog.Pin{
+			Job:      pb.jobName,
+			Ofs:      pb.target,
+			Storage:  st.GetName(),
+			File:     pb.file,
+			Paths:    paths,
+			PinnedAt: time.Now(),
+		})
+		if err != nil {
+			pb.evCh <- logger.Log(pb.jobName, st.GetName()).Errorf("Failed to pin backup `%s`. Error: %v", pb.file, err)
+			return err
+		}
+		pb.evCh <- logger.Log(pb.jobName, st.GetName()).Infof("Backup `%s` of `%s` pinned.", pb.file, pb.target)
+		pinned++
+	}
+
+	if pinned == 0 {
+		err = fmt.Errorf("Backup `%s` of `%s` not found. ", pb.file, pb.target)
+		pb.evCh <- logger.Log(pb.jobName, "").Error(err)
+		return err
+	}
+	return nil
+}
+
+func (pb *pinBackup) unpinBackup(job interfaces.Job, sts interfaces.Storages) error {
+	unpinned := 0
+	for _, st := range sts {
+		deleted, err := job.GetCatalog().DeletePin(pb.jobName, pb.target, st.GetName(), pb.file)
+		if err != nil {
+			pb.evCh <- logger.Log(pb.jobName, st.GetName()).Errorf("Failed to unpin backup `%s`. Error: %v", pb.file, err)
+			return err
+		}
+		if deleted {
+			pb.evCh <- logger.Log(pb.jobName, st.GetName()).Infof("Backup `%s` of `%s` unpinned.", pb.file, pb.target)
+			unpinned++
+		}
+	}
+
+	if unpinned == 0 {
+		err := fmt.Errorf("Backup `%s` of `%s` is not pinned. ", pb.file, pb.target)
+		pb.evCh <- logger.Log(pb.jobName, "").Error(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package rebuild_catalog
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backup"
+	"github.com/nixys/nxs-backup/modules/catalog"
+	"github.com/nixys/nxs-backup/modules/logger"
+	"github.com/nixys/nxs-backup/modules/storage"
+)
+
+type Opts struct {
+	InitErr  error
+	Done     chan error
+	EvCh     chan logger.LogRecord
+	WaitPrev time.Duration
+	JobName  string
+	Catalog  *catalog.Catalog
+	Jobs     map[string]interfaces.Job
+	FileJobs interfaces.Jobs
+	DBJobs   interfaces.Jobs
+	ExtJobs  interfaces.Jobs
+}
+
+type rebuildCatalog struct {
+	initErr  error
+	done     chan error
+	evCh     chan logger.LogRecord
+	waitPrev time.Duration
+	jobName  string
+	catalog  *catalog.Catalog
+	jobs     map[string]interfaces.Job
+	fileJobs interfaces.Jobs
+	dbJobs   interfaces.Jobs
+	extJobs  interfaces.Jobs
+}
+
+func Init(o Opts) *rebuildCatalog {
+	return &rebuildCatalog{
+		initErr:  o.InitErr,
+		done:     o.Done,
+		evCh:     o.EvCh,
+		waitPrev: o.WaitPrev,
+		jobName:  o.JobName,
+		catalog:  o.Catalog,
+		jobs:     o.Jobs,
+		fileJobs: o.FileJobs,
+		dbJobs:   o.DBJobs,
+		extJobs:  o.ExtJobs,
+	}
+}
+
+func (rc *rebuildCatalog) Run() {
+	var (
+		err  error
+		errs *multierror.Error
+	)
+
+	defer func() {
+		if errs.ErrorOrNil() != nil {
+			err = fmt.Errorf("Catalog rebuild failed with next errors:\n%w", errs)
+		}
+		rc.done <- err
+	}()
+
+	if rc.initErr != nil {
+		rc.evCh <- logger.Log("", "").Errorf("Backup plan initialised with errors: %v", rc.initErr)
+	}
+
+	if rc.catalog == nil {
+		err = fmt.Errorf("Backups catalog is disabled by config. ")
+		rc.evCh <- logger.Log("", "").Error(err)
+		return
+	}
+
+	var jobs interfaces.Jobs
+	switch rc.jobName {
+	case "all":
+		jobs = append(jobs, rc.extJobs...)
+		jobs = append(jobs, rc.dbJobs...)
+		jobs = append(jobs, rc.fileJobs...)
+	case "external":
+		jobs = rc.extJobs
+	case "databases":
+		jobs = rc.dbJobs
+	case "files":
+		jobs = rc.fileJobs
+	default:
+		job, ok := rc.jobs[rc.jobName]
+		if !ok {
+			err = fmt.Errorf("Job `%s` not found. ", rc.jobName)
+			rc.evCh <- logger.Log("", "").Error(err)
+			return
+		}
+		jobs = interfaces.Jobs{job}
+	}
+
+	// backups must not be delivered or rotated while the catalog is rebuilt
+	lock, err := backup.Lock(rc.waitPrev)
+	if err != nil {
+		err = fmt.Errorf("Can't start catalog rebuild. Another nxs-backup process already running. ")
+		rc.evCh <- logger.Log("", "").Error(err)
+		return
+	}
+	defer func() { _ = lock.Unlock() }()
+
+	rc.evCh <- logger.Log("", "").Infof("Catalog `%s` rebuild starting.", rc.catalog.Path())
+
+	for _, job := range jobs {
+		if err = rc.rebuildJob(job); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	rc.evCh <- logger.Log("", "").Info("Catalog rebuild finished.")
+}
+
+// rebuildJob replaces the job records by the backups found on the job storages.
+// Details unknown from the storages, such as size and delivery time, are kept from the existing records.
+// Records of the storages failed to be listed are kept as is.
+func (rc *rebuildCatalog) rebuildJob(job interfaces.Job) error {
+	var errs *multierror.Error
+
+	existing, err := rc.catalog.Find(catalog.Query{Job: job.GetName()})
+	if err != nil {
+		rc.evCh <- logger.Log(job.GetName(), "").Errorf("Failed to read catalog: %v", err)
+		return err
+	}
+	known := make(map[string]catalog.Record, len(existing))
+	for _, r := range existing {
+		known[recordID(r.Ofs, r.Storage, r.File)] = r
+	}
+
+	var records []catalog.Record
+	for _, st := range job.GetStorages() {
+		for _, ofs := range job.GetTargetOfsList() {
+			list, err := st.ListBackups(ofs)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				rc.evCh <- logger.Log(job.GetName(), st.GetName()).Errorf("Failed to get backups list of `%s`. Error: %v", ofs, err)
+				errs = multierror.Append(errs, err)
+				for _, r := range existing {
+					if r.Ofs == ofs && r.Storage == st.GetName() {
+						records = append(records, r)
+					}
+				}
+				continue
+			}
+			records = append(records, storageRecords(rc.evCh, job, st, ofs, list, known)...)
+		}
+	}
+
+	if err = rc.catalog.Replace(job.GetName(), records); err != nil {
+		rc.evCh <- logger.Log(job.GetName(), "").Errorf("Failed to update catalog: %v", err)
+		return multierror.Append(errs, err)
+	}
+	rc.evCh <- logger.Log(job.GetName(), "").Infof("Catalog rebuilt. Backups recorded: %d", len(records))
+
+	return errs.ErrorOrNil()
+}
+
+// storageRecords groups the listed files of the job target by the backup, since the same backup may be stored in several rotation dirs
+func storageRecords(logCh chan logger.LogRecord, job interfaces.Job, st interfaces.Storage, ofs string, list []string, known map[string]catalog.Record) []catalog.Record {
+	var (
+		records []catalog.Record
+		files   = make(map[string]bool, len(list))
+		idx     = make(map[string]int)
+	)
+
+	for _, f := range list {
+		files[storage.GetOfsRelPath(f, ofs)] = true
+	}
+
+	for _, f := range list {
+		relPath := storage.GetOfsRelPath(f, ofs)
+		if checksum.IsManifest(relPath) || strings.Contains(relPath, "inc_meta_info") || strings.HasSuffix(relPath, ".inc") {
+			continue
+		}
+
+		name := path.Base(relPath)
+		if i, ok := idx[name]; ok {
+			records[i].Paths = append(records[i].Paths, relPath)
+			continue
+		}
+
+		r, ok := known[recordID(ofs, st.GetName(), name)]
+		if !ok || !r.Success {
+			r = catalog.NewRecord(job.GetName(), job.GetType(), ofs, st.GetName(), name)
+			r.Success = true
+		}
+		r.Paths = []string{relPath}
+		if r.Checksum == "" && files[relPath+checksum.Ext] {
+			r.Checksum = readChecksum(logCh, job, st, relPath+checksum.Ext)
+		}
+
+		idx[name] = len(records)
+		records = append(records, r)
+	}
+
+	return records
+}
+
+func readChecksum(logCh chan logger.LogRecord, job interfaces.Job, st interfaces.Storage, sumPath string) string {
+	r, err := st.GetFileReader(sumPath)
+	if err != nil {
+		logCh <- logger.Log(job.GetName(), st.GetName()).Warnf("Failed to read checksum manifest `%s`: %v", sumPath, err)
+		return ""
+	}
+	defer func() { _ = r.Close() }()
+
+	sum, err := checksum.ReadManifest(r)
+	if err != nil {
+		logCh <- logger.Log(job.GetName(), st.GetName()).Warnf("Failed to read checksum manifest `%s`: %v", sumPath, err)
+	}
+	return sum
+}
+
+func recordID(ofs, storage, file string) string {
+	return ofs + "/" + storage + "/" + file
+}
@@ -0,0 +1,289 @@
+package restore_backup
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/binlog"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/catalog"
+	"github.com/nixys/nxs-backup/modules/logger"
+	"github.com/nixys/nxs-backup/modules/storage"
+)
+
+type Opts struct {
+	InitErr error
+	Done    chan error
+	EvCh    chan logger.LogRecord
+	JobName string
+	Target  string
+	Storage string
+	Date    string
+	Dst     string
+	Jobs    map[string]interfaces.Job
+	// FromCatalog makes the backups to be looked up in the catalog instead of listing the storage
+	FromCatalog bool
+	// FullBackup is the file name of the restored full backup the binlogs replay starts from
+	FullBackup string
+}
+
+type restoreBackup struct {
+	initErr     error
+	done        chan error
+	evCh        chan logger.LogRecord
+	jobName     string
+	target      string
+	storage     string
+	date        string
+	dst         string
+	jobs        map[string]interfaces.Job
+	fromCatalog bool
+	fullBackup  string
+}
+
+type backupFile struct {
+	path string
+	time time.Time
+}
+
+func Init(o Opts) *restoreBackup {
+	return &restoreBackup{
+		initErr:     o.InitErr,
+		done:        o.Done,
+		evCh:        o.EvCh,
+		jobName:     o.JobName,
+		target:      o.Target,
+		storage:     o.Storage,
+		date:        o.Date,
+		dst:         o.Dst,
+		jobs:        o.Jobs,
+		fromCatalog: o.FromCatalog,
+		fullBackup:  o.FullBackup,
+	}
+}
+
+func (rb *restoreBackup) Run() {
+	var err error
+
+	defer func() {
+		rb.done <- err
+	}()
+
+	if rb.initErr != nil {
+		rb.evCh <- logger.Log("", "").Errorf("Backup plan initialised with errors: %v", rb.initErr)
+	}
+
+	job, ok := rb.jobs[rb.jobName]
+	if !ok {
+		err = fmt.Errorf("Job `%s` not found. ", rb.jobName)
+		rb.evCh <- logger.Log("", "").Error(err)
+		return
+	}
+	if job.GetType() == misc.External {
+		err = fmt.Errorf("Restore is not supported for `%s` job type. ", misc.External)
+		rb.evCh <- logger.Log(rb.jobName, "").Error(err)
+		return
+	}
+	if rb.fullBackup != "" && job.GetType() != misc.MysqlBinlog {
+		err = fmt.Errorf("Option `--full-backup` is supported by `%s` job type only. ", misc.MysqlBinlog)
+		rb.evCh <- logger.Log(rb.jobName, "").Error(err)
+		return
+	}
+
+	found := false
+	for _, ofs := range job.GetTargetOfsList() {
+		if ofs == rb.target {
+			found = true
+			break
+		}
+	}
+	if !found {
+		err = fmt.Errorf("Target `%s` not found in job `%s`. Available targets: %s ", rb.target, rb.jobName, strings.Join(job.GetTargetOfsList(), ", "))
+		rb.evCh <- logger.Log(rb.jobName, "").Error(err)
+		return
+	}
+
+	restoreTime, err := parseDate(rb.date)
+	if err != nil {
+		rb.evCh <- logger.Log(rb.jobName, "").Error(err)
+		return
+	}
+
+	stName, backups, err := rb.getStorageBackups(job)
+	if err != nil {
+		rb.evCh <- logger.Log(rb.jobName, "").Error(err)
+		return
+	}
+
+	chain, err := getRestoreChain(job.GetType(), backups, restoreTime)
+	if err != nil {
+		rb.evCh <- logger.Log(rb.jobName, stName).Error(err)
+		return
+	}
+
+	rb.evCh <- logger.Log(rb.jobName, stName).Infof("Restore starting. Backups to restore: %s", strings.Join(chain, ", "))
+
+	err = job.DoRestore(rb.evCh, interfaces.RestoreParams{
+		Ofs:        rb.target,
+		Storage:    stName,
+		Files:      chain,
+		Dst:        rb.dst,
+		Time:       restoreTime,
+		FullBackup: path.Base(rb.fullBackup),
+	})
+	if err != nil {
+		err = fmt.Errorf("Restore failed with next error: %w ", err)
+		return
+	}
+
+	rb.evCh <- logger.Log(rb.jobName, stName).Info("Restore finished.")
+}
+
+// getStorageBackups returns the name of the storage to restore from and the target backups stored on it
+func (rb *restoreBackup) getStorageBackups(job interfaces.Job) (string, []backupFile, error) {
+	var (
+		stName = rb.storage
+		names  []string
+		list   []string
+	)
+
+	for _, st := range job.GetStorages() {
+		names = append(names, st.GetName())
+	}
+	if stName == "" {
+		if slices.Contains(names, "local") {
+			stName = "local"
+		} else {
+			if len(names) == 0 {
+				return "", nil, fmt.Errorf("No storages configured for job `%s`. ", rb.jobName)
+			}
+			sort.Strings(names)
+			stName = names[0]
+		}
+	}
+	if !slices.Contains(names, stName) {
+		return "", nil, fmt.Errorf("Storage `%s` is not configured for job `%s`. ", stName, rb.jobName)
+	}
+
+	if rb.fromCatalog {
+		records, err := job.GetCatalog().Find(catalog.Query{Job: rb.jobName, Ofs: rb.target, Storage: stName, SuccessOnly: true})
+		if err != nil {
+			return "", nil, fmt.Errorf("Failed to get backups list from catalog. Error: %v ", err)
+		}
+		for _, r := range records {
+			list = append(list, r.Paths...)
+		}
+	} else {
+		tFiles := job.GetStorages().ListBackups(rb.target)[stName]
+		if tFiles.ListErr != nil {
+			return "", nil, fmt.Errorf("Failed to get backups list from storage `%s`. Error: %v ", stName, tFiles.ListErr)
+		}
+		list = tFiles.List
+	}
+
+	var backups []backupFile
+	seen := make(map[string]int)
+	for _, f := range list {
+		relPath := storage.GetOfsRelPath(f, rb.target)
+		if strings.Contains(relPath, "inc_meta_info") || strings.HasSuffix(relPath, ".inc") || checksum.IsManifest(relPath) {
+			continue
+		}
+		t, ok := misc.GetBackupFileTime(relPath)
+		if !ok {
+			continue
+		}
+		// the same backup may be stored in several rotation dirs,
+		// the yearly copy is preferred since it marks a full incremental backup
+		if i, ok := seen[path.Base(relPath)]; ok {
+			if strings.Contains(relPath, "/year/") {
+				backups[i].path = relPath
+			}
+			continue
+		}
+		seen[path.Base(relPath)] = len(backups)
+		backups = append(backups, backupFile{path: relPath, time: t})
+	}
+
+	// the binlog segments delivered by one run have the same time, their order is the order of the segments
+	sort.SliceStable(backups, func(i, j int) bool {
+		if job.GetType() == misc.MysqlBinlog {
+			return binlog.SegmentLess(binlog.SegmentName(backups[i].path), binlog.SegmentName(backups[j].path))
+		}
+		return backups[i].time.Before(backups[j].time)
+	})
+
+	return stName, backups, nil
+}
+
+// getRestoreChain returns a chronologically ordered list of backups required to restore the state at a specified time
+func getRestoreChain(bType misc.BackupType, backups []backupFile, restoreTime time.Time) ([]string, error) {
+	if bType == misc.MysqlBinlog {
+		// the segments delivered after the time may hold the events before it as well, the segment delivery is
+		// delayed until it's closed or by the failed runs. The replay starts from the position of the full backup
+		// and gets the segments up to the first one opened after the time
+		if len(backups) == 0 {
+			return nil, fmt.Errorf("No binlog segments found. ")
+		}
+		var chain []string
+		for _, b := range backups {
+			chain = append(chain, b.path)
+		}
+		return chain, nil
+	}
+
+	sel := -1
+	for i, b := range backups {
+		if b.time.After(restoreTime) {
+			break
+		}
+		sel = i
+	}
+
+	if sel < 0 {
+		return nil, fmt.Errorf("No backups found created before %s. ", restoreTime.Format(misc.BackupTimeFormat))
+	}
+
+	if bType != misc.IncFiles {
+		return []string{backups[sel].path}, nil
+	}
+
+	// incremental backups have to be replayed starting from the latest full backup
+	full := -1
+	for i := sel; i >= 0; i-- {
+		if strings.Contains(backups[i].path, "/year/") {
+			full = i
+			break
+		}
+	}
+	if full < 0 {
+		return nil, fmt.Errorf("No full backup found for incremental backup `%s`. ", backups[sel].path)
+	}
+
+	var chain []string
+	for i := full; i <= sel; i++ {
+		chain = append(chain, backups[i].path)
+	}
+
+	return chain, nil
+}
+
+func parseDate(date string) (time.Time, error) {
+	if date == "" {
+		return time.Now(), nil
+	}
+	if t, err := time.ParseInLocation(misc.BackupTimeFormat, date, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("Wrong date format `%s`. Use `2006-01-02` or `2006-01-02_15-04`. ", date)
+	}
+	// the whole day is included
+	return t.Add(24*time.Hour - time.Second), nil
+}
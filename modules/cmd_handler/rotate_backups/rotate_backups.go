@@ -0,0 +1,160 @@
+package rotate_backups
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/modules/backup"
+	"github.com/nixys/nxs-backup/modules/logger"
+	"github.com/nixys/nxs-backup/modules/metrics"
+	"github.com/nixys/nxs-backup/modules/storage"
+)
+
+type Opts struct {
+	InitErr         error
+	Done            chan error
+	EvCh            chan logger.LogRecord
+	WaitPrev        time.Duration
+	JobName         string
+	MaxParallelJobs int
+	// DryRun makes the rotation to be printed instead of deleting backups
+	DryRun      bool
+	JSON        bool
+	Jobs        map[string]interfaces.Job
+	JobGroups   map[string]interfaces.Jobs
+	JobLocks    map[string][]string
+	FileJobs    interfaces.Jobs
+	DBJobs      interfaces.Jobs
+	ExtJobs     interfaces.Jobs
+	MetricsData *metrics.Data
+}
+
+type rotateBackups struct {
+	initErr         error
+	done            chan error
+	evCh            chan logger.LogRecord
+	waitPrev        time.Duration
+	jobName         string
+	maxParallelJobs int
+	dryRun          bool
+	json            bool
+	jobs            map[string]interfaces.Job
+	jobGroups       map[string]interfaces.Jobs
+	jobLocks        map[string][]string
+	fileJobs        interfaces.Jobs
+	dbJobs          interfaces.Jobs
+	extJobs         interfaces.Jobs
+	metricsData     *metrics.Data
+}
+
+func Init(o Opts) *rotateBackups {
+	return &rotateBackups{
+		initErr:         o.InitErr,
+		done:            o.Done,
+		evCh:            o.EvCh,
+		waitPrev:        o.WaitPrev,
+		jobName:         o.JobName,
+		maxParallelJobs: max(o.MaxParallelJobs, 1),
+		dryRun:          o.DryRun,
+		json:            o.JSON,
+		jobs:            o.Jobs,
+		jobGroups:       o.JobGroups,
+		jobLocks:        o.JobLocks,
+		fileJobs:        o.FileJobs,
+		dbJobs:          o.DBJobs,
+		extJobs:         o.ExtJobs,
+		metricsData:     o.MetricsData,
+	}
+}
+
+func (rb *rotateBackups) Run() {
+	var (
+		err  error
+		errs *multierror.Error
+	)
+
+	defer func() {
+		if errs.ErrorOrNil() != nil {
+			err = fmt.Errorf("Rotation failed with next errors:\n%w", errs)
+		}
+		rb.done <- err
+	}()
+
+	if rb.initErr != nil {
+		rb.evCh <- logger.Log("", "").Errorf("Backup plan initialised with errors: %v", rb.initErr)
+	}
+
+	var jobs interfaces.Jobs
+	switch rb.jobName {
+	case "all":
+		jobs = append(jobs, rb.extJobs...)
+		jobs = append(jobs, rb.dbJobs...)
+		jobs = append(jobs, rb.fileJobs...)
+	case "external":
+		jobs = rb.extJobs
+	case "databases":
+		jobs = rb.dbJobs
+	case "files":
+		jobs = rb.fileJobs
+	default:
+		if group, ok := rb.jobGroups[rb.jobName]; ok {
+			jobs = group
+		} else if job, ok := rb.jobs[rb.jobName]; ok {
+			jobs = interfaces.Jobs{job}
+		} else {
+			err = fmt.Errorf("Job `%s` not found. ", rb.jobName)
+			rb.evCh <- logger.Log("", "").Error(err)
+			return
+		}
+	}
+
+	if rb.dryRun {
+		errs = rb.planRotation(jobs)
+		return
+	}
+
+	// backups must not be delivered while they are rotated
+	lock, err := backup.Lock(rb.waitPrev)
+	if err != nil {
+		err = fmt.Errorf("Can't start rotation. Another nxs-backup process already running. ")
+		rb.evCh <- logger.Log("", "").Error(err)
+		return
+	}
+	defer func() { _ = lock.Unlock() }()
+
+	// the metrics of the backups are kept as is, the rotation ones are updated only
+	if lErr := rb.metricsData.LoadFile(); lErr != nil {
+		rb.evCh <- logger.Log("", "").Warnf("Failed to read metrics file: %v", lErr)
+	}
+
+	rb.evCh <- logger.Log("", "").Infof("Starting rotation of %d job(s), up to %d in parallel.", len(jobs), rb.maxParallelJobs)
+	errs = multierror.Append(errs, backup.NewRunner(rb.maxParallelJobs, rb.jobLocks).Rotate(rb.evCh, jobs)...)
+
+	if sErr := rb.metricsData.SaveFile(); sErr != nil {
+		rb.evCh <- logger.Log("", "").Errorf("Failed to save metrics to file: %v", sErr)
+		errs = multierror.Append(errs, sErr)
+	}
+
+	rb.evCh <- logger.Log("", "").Info("Rotation finished.")
+}
+
+// planRotation prints the backups the rotation would delete, the storages are not changed,
+// so it may be done along with the running backups
+func (rb *rotateBackups) planRotation(jobs interfaces.Jobs) (errs *multierror.Error) {
+	plan := new(storage.RotationPlan)
+	for _, job := range jobs {
+		if err := backup.PlanRotation(rb.evCh, backup.RotationJob(job), plan); err != nil {
+			rb.evCh <- logger.Log(job.GetName(), "").Errorf("Failed to plan rotation: %v", err)
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	if err := backup.PrintRotationPlan(os.Stdout, plan, rb.json); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	return
+}
@@ -3,60 +3,80 @@ package start_backup
 import (
 	"fmt"
 	"os"
-	"path"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
-	"github.com/nightlyone/lockfile"
 
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/modules/backup"
 	"github.com/nixys/nxs-backup/modules/logger"
 	"github.com/nixys/nxs-backup/modules/metrics"
+	"github.com/nixys/nxs-backup/modules/storage"
 )
 
 type Opts struct {
-	InitErr     error
-	Done        chan error
-	EvCh        chan logger.LogRecord
-	WaitPrev    time.Duration
-	JobName     string
-	Jobs        map[string]interfaces.Job
-	FileJobs    interfaces.Jobs
-	DBJobs      interfaces.Jobs
-	ExtJobs     interfaces.Jobs
-	MetricsData *metrics.Data
+	InitErr         error
+	Done            chan error
+	EvCh            chan logger.LogRecord
+	WaitPrev        time.Duration
+	JobName         string
+	MaxParallelJobs int
+	Jobs            map[string]interfaces.Job
+	JobGroups       map[string]interfaces.Jobs
+	JobLocks        map[string][]string
+	FileJobs        interfaces.Jobs
+	DBJobs          interfaces.Jobs
+	ExtJobs         interfaces.Jobs
+	MetricsData     *metrics.Data
+	// DryRun makes the rotation of the jobs to be printed instead of making backups
+	DryRun bool
+	JSON   bool
 }
 
 type startBackup struct {
-	initErr     error
-	done        chan error
-	evCh        chan logger.LogRecord
-	waitPrev    time.Duration
-	jobName     string
-	jobs        map[string]interfaces.Job
-	fileJobs    interfaces.Jobs
-	dbJobs      interfaces.Jobs
-	extJobs     interfaces.Jobs
-	metricsData *metrics.Data
+	initErr         error
+	done            chan error
+	evCh            chan logger.LogRecord
+	waitPrev        time.Duration
+	jobName         string
+	maxParallelJobs int
+	jobs            map[string]interfaces.Job
+	jobGroups       map[string]interfaces.Jobs
+	jobLocks        map[string][]string
+	fileJobs        interfaces.Jobs
+	dbJobs          interfaces.Jobs
+	extJobs         interfaces.Jobs
+	metricsData     *metrics.Data
+	dryRun          bool
+	json            bool
 }
 
 func Init(o Opts) *startBackup {
 	return &startBackup{
-		initErr:     o.InitErr,
-		done:        o.Done,
-		evCh:        o.EvCh,
-		waitPrev:    o.WaitPrev,
-		jobName:     o.JobName,
-		jobs:        o.Jobs,
-		fileJobs:    o.FileJobs,
-		dbJobs:      o.DBJobs,
-		extJobs:     o.ExtJobs,
-		metricsData: o.MetricsData,
+		initErr:         o.InitErr,
+		done:            o.Done,
+		evCh:            o.EvCh,
+		waitPrev:        o.WaitPrev,
+		jobName:         o.JobName,
+		maxParallelJobs: max(o.MaxParallelJobs, 1),
+		jobs:            o.Jobs,
+		jobGroups:       o.JobGroups,
+		jobLocks:        o.JobLocks,
+		fileJobs:        o.FileJobs,
+		dbJobs:          o.DBJobs,
+		extJobs:         o.ExtJobs,
+		metricsData:     o.MetricsData,
+		dryRun:          o.DryRun,
+		json:            o.JSON,
 	}
 }
 
 func (sb *startBackup) Run() {
+	if sb.dryRun {
+		sb.planRotation()
+		return
+	}
+
 	var (
 		err  error
 		errs *multierror.Error
@@ -80,20 +100,7 @@ func (sb *startBackup) Run() {
 	sb.evCh <- logger.Log("", "").Info("Backup starting.")
 
 	// Crate lockfile
-	lock, err := lockfile.New(path.Join(os.TempDir(), "nxs-backup.lck"))
-	if sb.waitPrev != 0 {
-		now := time.Now()
-		waitTill := now.Add(time.Minute * sb.waitPrev)
-		for waitTill.After(time.Now()) {
-			if err = lock.TryLock(); err != nil {
-				time.Sleep(time.Second * 5)
-			} else {
-				break
-			}
-		}
-	} else {
-		err = lock.TryLock()
-	}
+	lock, err := backup.Lock(sb.waitPrev)
 	if err != nil {
 		err = fmt.Errorf("Can't start nxs-backup. Another nxs-backup process already running. ")
 		sb.evCh <- logger.Log("", "").Error(err)
@@ -101,48 +108,81 @@ func (sb *startBackup) Run() {
 	}
 	defer func() { _ = lock.Unlock() }()
 
+	// restore metrics of previous runs, the backups sizes are used to check free space before the backups
+	if lErr := sb.metricsData.LoadFile(); lErr != nil {
+		sb.evCh <- logger.Log("", "").Warnf("Failed to read metrics file: %v", lErr)
+	}
+
+	jobs := sb.selectJobs()
+
+	if len(jobs) > 0 {
+		sb.evCh <- logger.Log("", "").Infof("Starting backup of %d job(s), up to %d in parallel.", len(jobs), sb.maxParallelJobs)
+		errs = multierror.Append(errs, backup.NewRunner(sb.maxParallelJobs, sb.jobLocks).Run(sb.evCh, jobs)...)
+	}
+
+	sb.evCh <- logger.Log("", "").Infof("Backup finished.\n")
+}
+
+// planRotation prints the rotation of the jobs making backups today, nothing is changed on the storages
+func (sb *startBackup) planRotation() {
+	var errs *multierror.Error
+
+	defer func() {
+		var err error
+		if errs.ErrorOrNil() != nil {
+			err = fmt.Errorf("Rotation plan failed with next errors:\n%w", errs)
+		}
+		sb.done <- err
+	}()
+
+	if sb.initErr != nil {
+		sb.evCh <- logger.Log("", "").Errorf("Backup plan initialised with errors: %v", sb.initErr)
+	}
+
+	plan := new(storage.RotationPlan)
+	for _, job := range sb.selectJobs() {
+		if !job.NeedToMakeBackup() {
+			sb.evCh <- logger.Log(job.GetName(), "").Infof("According to the backup plan today new backups are not created for job %s", job.GetName())
+			continue
+		}
+		if err := backup.PlanRotation(sb.evCh, job, plan); err != nil {
+			sb.evCh <- logger.Log(job.GetName(), "").Errorf("Failed to plan rotation: %v", err)
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	if err := backup.PrintRotationPlan(os.Stdout, plan, sb.json); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+}
+
+func (sb *startBackup) selectJobs() (jobs interfaces.Jobs) {
 	if sb.jobName == "external" || sb.jobName == "all" {
 		if len(sb.extJobs) > 0 {
-			sb.evCh <- logger.Log("", "").Info("Starting backup external jobs.")
-			for _, job := range sb.extJobs {
-				if err := backup.Perform(sb.evCh, job); err != nil {
-					errs = multierror.Append(errs, err)
-				}
-			}
+			jobs = append(jobs, sb.extJobs...)
 		} else {
 			sb.evCh <- logger.Log("", "").Info("No external jobs.")
 		}
 	}
 	if sb.jobName == "databases" || sb.jobName == "all" {
 		if len(sb.dbJobs) > 0 {
-			sb.evCh <- logger.Log("", "").Info("Starting backup databases jobs.")
-			for _, job := range sb.dbJobs {
-				if err := backup.Perform(sb.evCh, job); err != nil {
-					errs = multierror.Append(errs, err)
-				}
-			}
+			jobs = append(jobs, sb.dbJobs...)
 		} else {
 			sb.evCh <- logger.Log("", "").Info("No databases jobs.")
 		}
 	}
 	if sb.jobName == "files" || sb.jobName == "all" {
 		if len(sb.fileJobs) > 0 {
-			sb.evCh <- logger.Log("", "").Info("Starting backup files jobs.")
-			for _, job := range sb.fileJobs {
-				if err := backup.Perform(sb.evCh, job); err != nil {
-					errs = multierror.Append(errs, err)
-				}
-			}
+			jobs = append(jobs, sb.fileJobs...)
 		} else {
 			sb.evCh <- logger.Log("", "").Info("No files jobs.")
 		}
 	}
-
+	if group, ok := sb.jobGroups[sb.jobName]; ok {
+		jobs = group
+	}
 	if job, ok := sb.jobs[sb.jobName]; ok {
-		if err = backup.Perform(sb.evCh, job); err != nil {
-			errs = multierror.Append(errs, err)
-		}
+		jobs = interfaces.Jobs{job}
 	}
-
-	sb.evCh <- logger.Log("", "").Infof("Backup finished.\n")
+	return
 }
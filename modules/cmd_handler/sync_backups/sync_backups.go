@@ -0,0 +1,307 @@
+package sync_backups
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/modules/backup"
+	"github.com/nixys/nxs-backup/modules/logger"
+	"github.com/nixys/nxs-backup/modules/storage"
+)
+
+type Opts struct {
+	InitErr  error
+	Done     chan error
+	EvCh     chan logger.LogRecord
+	WaitPrev time.Duration
+	JobName  string
+	From     string
+	To       string
+	Prune    bool
+	Jobs     map[string]interfaces.Job
+	FileJobs interfaces.Jobs
+	DBJobs   interfaces.Jobs
+	ExtJobs  interfaces.Jobs
+	// JobStorages are the jobs storages reading files without decryption, so the files are copied as is
+	JobStorages map[string]map[string]interfaces.Storage
+}
+
+type syncBackups struct {
+	initErr     error
+	done        chan error
+	evCh        chan logger.LogRecord
+	waitPrev    time.Duration
+	jobName     string
+	from        string
+	to          string
+	prune       bool
+	jobs        map[string]interfaces.Job
+	fileJobs    interfaces.Jobs
+	dbJobs      interfaces.Jobs
+	extJobs     interfaces.Jobs
+	jobStorages map[string]map[string]interfaces.Storage
+}
+
+type syncStat struct {
+	copied  int
+	linked  int
+	deleted int
+	failed  int
+}
+
+func Init(o Opts) *syncBackups {
+	return &syncBackups{
+		initErr:     o.InitErr,
+		done:        o.Done,
+		evCh:        o.EvCh,
+		waitPrev:    o.WaitPrev,
+		jobName:     o.JobName,
+		from:        o.From,
+		to:          o.To,
+		prune:       o.Prune,
+		jobs:        o.Jobs,
+		fileJobs:    o.FileJobs,
+		dbJobs:      o.DBJobs,
+		extJobs:     o.ExtJobs,
+		jobStorages: o.JobStorages,
+	}
+}
+
+func (sb *syncBackups) Run() {
+	var (
+		err  error
+		errs *multierror.Error
+	)
+
+	defer func() {
+		if errs.ErrorOrNil() != nil {
+			err = fmt.Errorf("Sync failed with next errors:\n%w", errs)
+		}
+		sb.done <- err
+	}()
+
+	if sb.initErr != nil {
+		sb.evCh <- logger.Log("", "").Errorf("Backup plan initialised with errors: %v", sb.initErr)
+	}
+
+	if sb.from == sb.to {
+		err = fmt.Errorf("Source and target storages must differ. ")
+		sb.evCh <- logger.Log("", "").Error(err)
+		return
+	}
+
+	var jobs interfaces.Jobs
+	switch sb.jobName {
+	case "all":
+		jobs = append(jobs, sb.extJobs...)
+		jobs = append(jobs, sb.dbJobs...)
+		jobs = append(jobs, sb.fileJobs...)
+	case "external":
+		jobs = sb.extJobs
+	case "databases":
+		jobs = sb.dbJobs
+	case "files":
+		jobs = sb.fileJobs
+	default:
+		job, ok := sb.jobs[sb.jobName]
+		if !ok {
+			err = fmt.Errorf("Job `%s` not found. ", sb.jobName)
+			sb.evCh <- logger.Log("", "").Error(err)
+			return
+		}
+		jobs = interfaces.Jobs{job}
+	}
+
+	// backups must not be changed by the running jobs while they are synced
+	lock, err := backup.Lock(sb.waitPrev)
+	if err != nil {
+		err = fmt.Errorf("Can't start sync. Another nxs-backup process already running. ")
+		sb.evCh <- logger.Log("", "").Error(err)
+		return
+	}
+	defer func() { _ = lock.Unlock() }()
+
+	sb.evCh <- logger.Log("", "").Infof("Sync from `%s` to `%s` starting.", sb.from, sb.to)
+
+	for _, job := range jobs {
+		src, srcOk := sb.jobStorages[job.GetName()][sb.from]
+		dst, dstOk := sb.jobStorages[job.GetName()][sb.to]
+		if !srcOk || !dstOk {
+			msg := fmt.Sprintf("Job `%s` has no storages `%s` and `%s` both configured. Skipping.", job.GetName(), sb.from, sb.to)
+			// the job set explicitly has to be synced
+			if len(jobs) == 1 {
+				err = errors.New(msg)
+				sb.evCh <- logger.Log(job.GetName(), "").Error(err)
+				errs = multierror.Append(errs, err)
+			} else {
+				sb.evCh <- logger.Log(job.GetName(), "").Debug(msg)
+			}
+			continue
+		}
+		if err = sb.syncJob(job, src, dst); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	sb.evCh <- logger.Log("", "").Info("Sync finished.")
+}
+
+// syncJob copies the backups files of the job targets missing on the target storage from the source one.
+// The files present on the target storage only are deleted if the prune is set.
+func (sb *syncBackups) syncJob(job interfaces.Job, src, dst interfaces.Storage) error {
+	var (
+		errs *multierror.Error
+		stat syncStat
+	)
+
+	ss, ok := interfaces.WithoutRetry(dst).(interfaces.SyncStorage)
+	if !ok {
+		err := fmt.Errorf("storage `%s` doesn't support sync", dst.GetName())
+		sb.evCh <- logger.Log(job.GetName(), dst.GetName()).Error(err)
+		return err
+	}
+	ls, canLink := interfaces.WithoutRetry(dst).(interfaces.LinkStorage)
+
+	for _, ofs := range job.GetTargetOfsList() {
+		srcFiles, err := listFiles(src, ofs)
+		if err != nil {
+			sb.evCh <- logger.Log(job.GetName(), src.GetName()).Errorf("Failed to get backups list of `%s`. Error: %v", ofs, err)
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		dstFiles, err := listFiles(dst, ofs)
+		if err != nil {
+			sb.evCh <- logger.Log(job.GetName(), dst.GetName()).Errorf("Failed to get backups list of `%s`. Error: %v", ofs, err)
+			errs = multierror.Append(errs, err)
+			continue
+		}
+
+		// the backup names are unique, so the files with the same name are the copies of the backup in the retention
+		// periods dirs, linked on delivery. They are linked on the target storage to the copy made first as well
+		copies := backupCopies(dstFiles)
+		for _, f := range deliveryOrder(srcFiles) {
+			if dstFiles[f] {
+				continue
+			}
+			if target, ok := copies[path.Base(f)]; ok && canLink && !isMetadata(f) {
+				if err = ls.PutLink(sb.evCh, job.GetName(), ofs, string(job.GetType()), f, target); err != nil {
+					sb.evCh <- logger.Log(job.GetName(), dst.GetName()).Errorf("Failed to link `%s` to `%s`: %v", f, target, err)
+					errs = multierror.Append(errs, fmt.Errorf("%s: %s: %w", dst.GetName(), f, err))
+					stat.failed++
+					continue
+				}
+				stat.linked++
+				continue
+			}
+			if err = copyFile(sb.evCh, job, ofs, f, src, ss); err != nil {
+				sb.evCh <- logger.Log(job.GetName(), dst.GetName()).Errorf("Failed to copy `%s`: %v", f, err)
+				errs = multierror.Append(errs, fmt.Errorf("%s: %s: %w", dst.GetName(), f, err))
+				stat.failed++
+				continue
+			}
+			if _, ok := copies[path.Base(f)]; !ok && !isMetadata(f) {
+				copies[path.Base(f)] = f
+			}
+			stat.copied++
+		}
+
+		if !sb.prune {
+			continue
+		}
+		pins, err := storage.LoadPins(job.GetCatalog(), job.GetName(), ofs, dst.GetName())
+		if err != nil {
+			sb.evCh <- logger.Log(job.GetName(), dst.GetName()).Errorf("Prune of `%s` skipped. Failed to read pinned backups: %v", ofs, err)
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		for _, f := range sortedFiles(dstFiles) {
+			if srcFiles[f] {
+				continue
+			}
+			if pins.Pinned(f) {
+				sb.evCh <- logger.Log(job.GetName(), dst.GetName()).Infof("Pinned `%s` missing on storage `%s` is kept", f, src.GetName())
+				continue
+			}
+			if err = dst.DeleteFile(f); err != nil {
+				sb.evCh <- logger.Log(job.GetName(), dst.GetName()).Errorf("Failed to delete `%s`: %v", f, err)
+				errs = multierror.Append(errs, fmt.Errorf("%s: %s: %w", dst.GetName(), f, err))
+				stat.failed++
+				continue
+			}
+			sb.evCh <- logger.Log(job.GetName(), dst.GetName()).Infof("Deleted `%s` missing on storage `%s`", f, src.GetName())
+			stat.deleted++
+		}
+	}
+
+	sb.evCh <- logger.Log(job.GetName(), dst.GetName()).Infof(
+		"Synced from `%s`. Copied files: %d, linked: %d, deleted: %d, failed: %d",
+		src.GetName(), stat.copied, stat.linked, stat.deleted, stat.failed)
+
+	return errs.ErrorOrNil()
+}
+
+func copyFile(logCh chan logger.LogRecord, job interfaces.Job, ofs, filePath string, src interfaces.Storage, dst interfaces.SyncStorage) error {
+	r, err := src.GetFileReader(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	defer func() { _ = r.Close() }()
+
+	return dst.PutFile(logCh, job.GetName(), ofs, string(job.GetType()), filePath, r)
+}
+
+// listFiles returns the files of the job target relative to the backup path. Missing target has no files.
+func listFiles(st interfaces.Storage, ofs string) (map[string]bool, error) {
+	list, err := st.ListBackups(ofs)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	files := make(map[string]bool, len(list))
+	for _, f := range list {
+		files[storage.GetOfsRelPath(f, ofs)] = true
+	}
+	return files, nil
+}
+
+// backupCopies maps the backups names to the files on the storage the other copies are linked to
+func backupCopies(files map[string]bool) map[string]string {
+	copies := make(map[string]string)
+	for _, f := range deliveryOrder(files) {
+		if _, ok := copies[path.Base(f)]; !ok && !isMetadata(f) {
+			copies[path.Base(f)] = f
+		}
+	}
+	return copies
+}
+
+// deliveryOrder sorts the files so the copy of the backup other ones are linked to goes first
+func deliveryOrder(files map[string]bool) []string {
+	list := sortedFiles(files)
+	sort.SliceStable(list, func(i, j int) bool {
+		return storage.DeliveryRank(list[i]) < storage.DeliveryRank(list[j])
+	})
+	return list
+}
+
+// isMetadata reports whether the file is the incremental backup metadata, its names are not unique
+func isMetadata(ofsPath string) bool {
+	return strings.Contains(ofsPath, "inc_meta_info")
+}
+
+func sortedFiles(files map[string]bool) []string {
+	list := make([]string, 0, len(files))
+	for f := range files {
+		list = append(list, f)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,145 @@
+package test_config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/logger"
+	"github.com/nixys/nxs-backup/modules/storage"
+)
+
+const probeOfs = ".nxs-backup-probe"
+
+// StorageTarget is the backup path of the storage checked by the probe
+type StorageTarget struct {
+	Name       string
+	BackupPath string
+	Storage    interfaces.Storage // nil if the storage failed to init
+}
+
+type probeResult struct {
+	storage    string
+	backupPath string
+	status     string
+	latency    time.Duration
+	err        error
+}
+
+// probe runs the round trip in the backup path of the storage: writes the small object to the probe dir,
+// reads it back, finds it in the list of backups and deletes it. The object and the probe dirs are removed even if the round trip fails.
+func probe(t StorageTarget) (res probeResult) {
+	res = probeResult{storage: t.Name, backupPath: t.BackupPath, status: "FAIL"}
+
+	switch {
+	case t.Storage == nil:
+		res.err = fmt.Errorf("connect: storage init failed")
+		return
+	case t.BackupPath == "":
+		res.status = "SKIP"
+		res.err = fmt.Errorf("storage is not used by jobs")
+		return
+	}
+
+	tmpDir, err := os.MkdirTemp("", "nxs-backup-probe-")
+	if err != nil {
+		res.err = fmt.Errorf("prepare: %w", err)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	data := []byte(fmt.Sprintf("nxs-backup storage probe %s\n", misc.GetDateTimeNow("")))
+	tmpFile := path.Join(tmpDir, fmt.Sprintf("probe_%s.txt", misc.GetDateTimeNow("")))
+	if err = os.WriteFile(tmpFile, data, 0600); err != nil {
+		res.err = fmt.Errorf("prepare: %w", err)
+		return
+	}
+
+	// Errors are reported in the probe results, the storage logs aren't needed
+	logCh := make(chan logger.LogRecord)
+	defer close(logCh)
+	go func() {
+		for range logCh {
+		}
+	}()
+
+	st := interfaces.WithoutRetry(t.Storage).Clone()
+	st.Configure(storage.Params{
+		BackupPath: t.BackupPath,
+		Retention:  storage.Retention{Days: 1},
+	})
+	defer func() { _ = st.Close() }()
+
+	ofsFile := path.Join(probeOfs, "daily", path.Base(tmpFile))
+	startTime := time.Now()
+	defer func() { res.latency = time.Since(startTime) }()
+
+	defer removeProbeDirs(st)
+	if err = st.DeliveryBackup(logCh, "probe", tmpFile, probeOfs, string(misc.DescFiles)); err != nil {
+		res.err = fmt.Errorf("write: %w", err)
+		return
+	}
+	deleted := false
+	defer func() {
+		if !deleted {
+			_ = st.DeleteFile(ofsFile)
+		}
+	}()
+
+	r, err := st.GetFileReader(ofsFile)
+	if err != nil {
+		res.err = fmt.Errorf("read: %w", err)
+		return
+	}
+	got, err := io.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		res.err = fmt.Errorf("read: %w", err)
+		return
+	}
+	if !bytes.Equal(got, data) {
+		res.err = fmt.Errorf("read: content of the read object differs from the written one")
+		return
+	}
+
+	list, err := st.ListBackups(probeOfs)
+	if err != nil {
+		res.err = fmt.Errorf("list: %w", err)
+		return
+	}
+	found := false
+	for _, f := range list {
+		if path.Base(f) == path.Base(ofsFile) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		res.err = fmt.Errorf("list: written object not found in the list")
+		return
+	}
+
+	if err = st.DeleteFile(ofsFile); err != nil {
+		res.err = fmt.Errorf("delete: %w", err)
+		return
+	}
+	deleted = true
+
+	res.status = "OK"
+	return
+}
+
+// removeProbeDirs removes the dirs made by the probe delivery
+func removeProbeDirs(st interfaces.Storage) {
+	ds, ok := st.(interfaces.DirStorage)
+	if !ok {
+		return
+	}
+	_ = ds.DeleteDir(path.Join(probeOfs, "daily"))
+	_ = ds.DeleteDir(probeOfs)
+}
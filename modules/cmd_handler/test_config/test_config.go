@@ -1,7 +1,12 @@
 package test_config
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
 	"github.com/nixys/nxs-backup/interfaces"
 )
 
@@ -11,6 +16,9 @@ type Opts struct {
 	FileJobs interfaces.Jobs
 	DBJobs   interfaces.Jobs
 	ExtJobs  interfaces.Jobs
+	// ProbeStorages enables the round trip check of the storages targets
+	ProbeStorages  bool
+	StorageTargets []StorageTarget
 }
 
 type testConfig struct {
@@ -19,6 +27,8 @@ type testConfig struct {
 	fileJobs interfaces.Jobs
 	dbJobs   interfaces.Jobs
 	extJobs  interfaces.Jobs
+	probe    bool
+	targets  []StorageTarget
 }
 
 func Init(o Opts) *testConfig {
@@ -28,6 +38,8 @@ func Init(o Opts) *testConfig {
 		fileJobs: o.FileJobs,
 		dbJobs:   o.DBJobs,
 		extJobs:  o.ExtJobs,
+		probe:    o.ProbeStorages,
+		targets:  o.StorageTargets,
 	}
 }
 
@@ -63,5 +75,40 @@ func (tc *testConfig) Run() {
 	} else {
 		fmt.Println("No files jobs")
 	}
-	tc.done <- tc.initErr
+
+	err := tc.initErr
+	if tc.probe && !tc.probeStorages() {
+		err = errors.Join(err, fmt.Errorf("storages probe failed"))
+	}
+	tc.done <- err
+}
+
+// probeStorages checks the storages targets one by one and prints the results table.
+// Returns false if any of the checks failed.
+func (tc *testConfig) probeStorages() bool {
+	ok := true
+
+	fmt.Println("\nStorages probe:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "  STORAGE\tBACKUP PATH\tRESULT\tLATENCY\tERROR")
+	for _, t := range tc.targets {
+		res := probe(t)
+		if res.status == "FAIL" {
+			ok = false
+		}
+		errMsg, latency, backupPath := "", "", res.backupPath
+		if res.err != nil {
+			errMsg = res.err.Error()
+		}
+		if res.latency > 0 {
+			latency = res.latency.Round(time.Millisecond).String()
+		}
+		if backupPath == "" {
+			backupPath = "-"
+		}
+		_, _ = fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", res.storage, backupPath, res.status, latency, errMsg)
+	}
+	_ = w.Flush()
+
+	return ok
 }
@@ -0,0 +1,199 @@
+package verify_backup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/logger"
+	"github.com/nixys/nxs-backup/modules/storage"
+)
+
+type Opts struct {
+	InitErr  error
+	Done     chan error
+	EvCh     chan logger.LogRecord
+	JobName  string
+	Jobs     map[string]interfaces.Job
+	FileJobs interfaces.Jobs
+	DBJobs   interfaces.Jobs
+	ExtJobs  interfaces.Jobs
+	// JobStorages are the jobs storages reading files without decryption, the checksums are of the stored data
+	JobStorages map[string]map[string]interfaces.Storage
+}
+
+type verifyBackup struct {
+	initErr  error
+	done     chan error
+	evCh     chan logger.LogRecord
+	jobName  string
+	jobs     map[string]interfaces.Job
+	fileJobs interfaces.Jobs
+	dbJobs   interfaces.Jobs
+	extJobs  interfaces.Jobs
+	// jobStorages are the raw storages by job and storage names
+	jobStorages map[string]map[string]interfaces.Storage
+}
+
+type verifyStat struct {
+	ok        int
+	failed    int
+	noSumFile int
+}
+
+func Init(o Opts) *verifyBackup {
+	return &verifyBackup{
+		initErr:     o.InitErr,
+		done:        o.Done,
+		evCh:        o.EvCh,
+		jobName:     o.JobName,
+		jobs:        o.Jobs,
+		fileJobs:    o.FileJobs,
+		dbJobs:      o.DBJobs,
+		extJobs:     o.ExtJobs,
+		jobStorages: o.JobStorages,
+	}
+}
+
+func (vb *verifyBackup) Run() {
+	var (
+		err  error
+		errs *multierror.Error
+	)
+
+	defer func() {
+		if errs.ErrorOrNil() != nil {
+			err = fmt.Errorf("Verification failed with next errors:\n%w", errs)
+		}
+		vb.done <- err
+	}()
+
+	if vb.initErr != nil {
+		vb.evCh <- logger.Log("", "").Errorf("Backup plan initialised with errors: %v", vb.initErr)
+	}
+
+	var jobs interfaces.Jobs
+	switch vb.jobName {
+	case "all":
+		jobs = append(jobs, vb.extJobs...)
+		jobs = append(jobs, vb.dbJobs...)
+		jobs = append(jobs, vb.fileJobs...)
+	case "external":
+		jobs = vb.extJobs
+	case "databases":
+		jobs = vb.dbJobs
+	case "files":
+		jobs = vb.fileJobs
+	default:
+		job, ok := vb.jobs[vb.jobName]
+		if !ok {
+			err = fmt.Errorf("Job `%s` not found. ", vb.jobName)
+			vb.evCh <- logger.Log("", "").Error(err)
+			return
+		}
+		jobs = interfaces.Jobs{job}
+	}
+
+	vb.evCh <- logger.Log("", "").Info("Verification starting.")
+
+	for _, job := range jobs {
+		if err := verifyJob(vb.evCh, job, vb.jobStorages[job.GetName()]); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	vb.evCh <- logger.Log("", "").Info("Verification finished.")
+}
+
+func verifyJob(logCh chan logger.LogRecord, job interfaces.Job, rawStorages map[string]interfaces.Storage) error {
+	var errs *multierror.Error
+
+	for _, jst := range job.GetStorages() {
+		var stat verifyStat
+
+		st, ok := rawStorages[jst.GetName()]
+		if !ok {
+			err := fmt.Errorf("Storage `%s` of job `%s` is not available for reading the raw backups ", jst.GetName(), job.GetName())
+			logCh <- logger.Log(job.GetName(), jst.GetName()).Error(err)
+			errs = multierror.Append(errs, err)
+			continue
+		}
+
+		for _, ofs := range job.GetTargetOfsList() {
+			list, err := st.ListBackups(ofs)
+			if err != nil {
+				logCh <- logger.Log(job.GetName(), st.GetName()).Errorf("Failed to get backups list of `%s`. Error: %v", ofs, err)
+				errs = multierror.Append(errs, err)
+				continue
+			}
+
+			files := make(map[string]bool, len(list))
+			for _, f := range list {
+				files[storage.GetOfsRelPath(f, ofs)] = true
+			}
+
+			var bakFiles []string
+			for f := range files {
+				if checksum.IsManifest(f) || strings.Contains(f, "inc_meta_info") {
+					continue
+				}
+				bakFiles = append(bakFiles, f)
+			}
+			sort.Strings(bakFiles)
+
+			for _, f := range bakFiles {
+				if !files[f+checksum.Ext] {
+					logCh <- logger.Log(job.GetName(), st.GetName()).Debugf("No checksum manifest found for `%s`. Skipping.", f)
+					stat.noSumFile++
+					continue
+				}
+				if err = verifyFile(st, f); err != nil {
+					logCh <- logger.Log(job.GetName(), st.GetName()).Errorf("Backup `%s` verification failed: %v", f, err)
+					errs = multierror.Append(errs, fmt.Errorf("%s: %s: %w", st.GetName(), f, err))
+					stat.failed++
+					continue
+				}
+				logCh <- logger.Log(job.GetName(), st.GetName()).Debugf("Backup `%s` verified", f)
+				stat.ok++
+			}
+		}
+
+		logCh <- logger.Log(job.GetName(), st.GetName()).Infof(
+			"Verified backups: %d, failed: %d, without checksum: %d", stat.ok, stat.failed, stat.noSumFile)
+	}
+
+	return errs.ErrorOrNil()
+}
+
+func verifyFile(st interfaces.Storage, filePath string) error {
+	sr, err := st.GetFileReader(filePath + checksum.Ext)
+	if err != nil {
+		return fmt.Errorf("failed to read checksum manifest: %w", err)
+	}
+	expected, err := checksum.ReadManifest(sr)
+	_ = sr.Close()
+	if err != nil {
+		return err
+	}
+
+	fr, err := st.GetFileReader(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+	defer func() { _ = fr.Close() }()
+
+	actual, err := checksum.Sum(fr)
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	if actual != expected {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", expected, actual)
+	}
+
+	return nil
+}
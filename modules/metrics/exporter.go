@@ -9,14 +9,18 @@ import (
 
 type Exporter struct {
 	metrics        map[string]*prometheus.Desc
+	storageMetrics map[string]*prometheus.Desc
 	ctx            context.Context
 	log            *logrus.Logger
 	metricFilePath string
+	data           *Data
 }
 
 type ExporterOpts struct {
 	Log            *logrus.Logger
 	MetricFilePath string
+	// Data is used instead of the metrics file when backups are made by the same process
+	Data *Data
 }
 
 func InitExporter(s ExporterOpts) *Exporter {
@@ -59,10 +63,35 @@ func InitExporter(s ExporterOpts) *Exporter {
 		),
 	}
 
+	storageMetrics := map[string]*prometheus.Desc{
+		DeliveryOk: prometheus.NewDesc(
+			prometheus.BuildFQName("nxs_backup", "storage_delivery", "success"),
+			"Backup delivery to the storage finished successfully",
+			[]string{"project", "server", "job_name", "job_type", "source", "target", "storage"}, nil,
+		),
+		DeliveryTime: prometheus.NewDesc(
+			prometheus.BuildFQName("nxs_backup", "storage_delivery", "time"),
+			"Backup delivering time to the storage",
+			[]string{"project", "server", "job_name", "job_type", "source", "target", "storage"}, nil,
+		),
+		RotationDeleted: prometheus.NewDesc(
+			prometheus.BuildFQName("nxs_backup", "rotation", "deleted"),
+			"Number of backup files deleted from the storage by the last rotate run",
+			[]string{"project", "server", "job_name", "job_type", "source", "target", "storage"}, nil,
+		),
+		RotationFreed: prometheus.NewDesc(
+			prometheus.BuildFQName("nxs_backup", "rotation", "freed_bytes"),
+			"Space freed on the storage by the last rotate run",
+			[]string{"project", "server", "job_name", "job_type", "source", "target", "storage"}, nil,
+		),
+	}
+
 	return &Exporter{
 		metrics:        metrics,
+		storageMetrics: storageMetrics,
 		log:            s.Log,
 		metricFilePath: s.MetricFilePath,
+		data:           s.Data,
 	}
 }
 
@@ -74,14 +103,23 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	for _, m := range e.metrics {
 		ch <- m
 	}
+	for _, m := range e.storageMetrics {
+		ch <- m
+	}
 }
 
 // Collect function, called on by Prometheus Client library
 // This function is called when a scrape is performed on the /metrics page
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 
-	data, err := readFile(e.metricFilePath)
-	if err != nil {
+	var (
+		data *Data
+		err  error
+	)
+
+	if e.data != nil {
+		data = e.data.Copy()
+	} else if data, err = readFile(e.metricFilePath); err != nil {
 		e.log.Warnf("Failed to read metric file: %v", err)
 		return
 	}
@@ -106,6 +144,31 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 				}
 				ch <- d
 			}
+			for st, values := range t.StorageValues {
+				for k, v := range values {
+					desc, ok := e.storageMetrics[k]
+					if !ok {
+						continue
+					}
+					d, err := prometheus.NewConstMetric(
+						desc,
+						prometheus.GaugeValue,
+						v,
+						data.Project,
+						data.Server,
+						j.JobName,
+						string(j.JobType),
+						t.Source,
+						t.Target,
+						st,
+					)
+					if err != nil {
+						e.log.Warnf("Failed to export prometheus metric: %v", err)
+						continue
+					}
+					ch <- d
+				}
+			}
 		}
 
 	}
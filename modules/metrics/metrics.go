@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/vmihailenco/msgpack"
@@ -20,6 +21,8 @@ const (
 	BackupSize      = "size"
 	DeliveryOk      = "delivery_ok"
 	DeliveryTime    = "delivery_time"
+	RotationDeleted = "rotation_deleted"
+	RotationFreed   = "rotation_freed"
 	UpdateAvailable = "update_available"
 )
 
@@ -32,6 +35,7 @@ type Data struct {
 	Job map[string]JobData
 
 	metricsFile string
+	mu          sync.RWMutex
 }
 
 type JobData struct {
@@ -41,9 +45,10 @@ type JobData struct {
 }
 
 type TargetData struct {
-	Source string
-	Target string
-	Values map[string]float64
+	Source        string
+	Target        string
+	Values        map[string]float64
+	StorageValues map[string]map[string]float64
 }
 
 type DataOpts struct {
@@ -72,16 +77,72 @@ func (md *Data) MetricFilePath() string {
 }
 
 func (md *Data) RegisterJob(jd JobData) *Data {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
 	md.Job[jd.JobName] = jd
 	return md
 }
 
+// RegisterTarget adds the metrics of the job target unless they are registered already
+func (md *Data) RegisterTarget(jobName, ofs string, td TargetData) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	if _, ok := md.Job[jobName].TargetMetrics[ofs]; !ok {
+		md.Job[jobName].TargetMetrics[ofs] = td
+	}
+}
+
+// SetValues sets the values of the job target metrics
+func (md *Data) SetValues(jobName, ofs string, values map[string]float64) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	for m, v := range values {
+		md.Job[jobName].TargetMetrics[ofs].Values[m] = v
+	}
+}
+
+// GetValues returns the copy of the job target metrics values
+func (md *Data) GetValues(jobName, ofs string) map[string]float64 {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+
+	values := make(map[string]float64)
+	for m, v := range md.Job[jobName].TargetMetrics[ofs].Values {
+		values[m] = v
+	}
+	return values
+}
+
+// SetStorageValues sets the values of the job target metrics related to the storage
+func (md *Data) SetStorageValues(jobName, ofs, storage string, values map[string]float64) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	td := md.Job[jobName].TargetMetrics[ofs]
+	if td.StorageValues == nil {
+		td.StorageValues = make(map[string]map[string]float64)
+	}
+	if td.StorageValues[storage] == nil {
+		td.StorageValues[storage] = make(map[string]float64)
+	}
+	for m, v := range values {
+		td.StorageValues[storage][m] = v
+	}
+	md.Job[jobName].TargetMetrics[ofs] = td
+}
+
 func (md *Data) SaveFile() error {
 	//skip if metrics disabled
 	if !md.Enabled {
 		return nil
 	}
 
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
 	od, err := readFile(md.metricsFile)
 	if err != nil {
 		return err
@@ -104,6 +165,80 @@ func (md *Data) SaveFile() error {
 	return enc.Encode(md)
 }
 
+// LoadFile restores the values of registered jobs targets saved to the metrics file by the previous runs
+func (md *Data) LoadFile() error {
+	//skip if metrics disabled
+	if !md.Enabled {
+		return nil
+	}
+
+	od, err := readFile(md.metricsFile)
+	if err != nil {
+		return err
+	}
+
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	for jobName, job := range od.Job {
+		if _, ok := md.Job[jobName]; !ok {
+			continue
+		}
+		for ofs, td := range job.TargetMetrics {
+			if _, ok := md.Job[jobName].TargetMetrics[ofs]; ok {
+				md.Job[jobName].TargetMetrics[ofs] = td
+			}
+		}
+	}
+
+	return nil
+}
+
+// Copy returns the deep copy of the metrics data safe to read while backups are running
+func (md *Data) Copy() *Data {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+
+	d := &Data{
+		Project:             md.Project,
+		Server:              md.Server,
+		NewVersionAvailable: md.NewVersionAvailable,
+		Enabled:             md.Enabled,
+		Job:                 make(map[string]JobData, len(md.Job)),
+		metricsFile:         md.metricsFile,
+	}
+	for jobName, job := range md.Job {
+		jd := JobData{
+			JobName:       job.JobName,
+			JobType:       job.JobType,
+			TargetMetrics: make(map[string]TargetData, len(job.TargetMetrics)),
+		}
+		for ofs, td := range job.TargetMetrics {
+			ntd := TargetData{
+				Source: td.Source,
+				Target: td.Target,
+				Values: make(map[string]float64, len(td.Values)),
+			}
+			for m, v := range td.Values {
+				ntd.Values[m] = v
+			}
+			if td.StorageValues != nil {
+				ntd.StorageValues = make(map[string]map[string]float64, len(td.StorageValues))
+				for st, values := range td.StorageValues {
+					ntd.StorageValues[st] = make(map[string]float64, len(values))
+					for m, v := range values {
+						ntd.StorageValues[st][m] = v
+					}
+				}
+			}
+			jd.TargetMetrics[ofs] = ntd
+		}
+		d.Job[jobName] = jd
+	}
+
+	return d
+}
+
 func readFile(path string) (*Data, error) {
 	var (
 		f   *os.File
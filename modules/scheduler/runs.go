@@ -0,0 +1,192 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/logger"
+)
+
+const (
+	TriggerAPI      = "api"
+	TriggerSchedule = "schedule"
+	// TriggerStream is the run delivering the data closed by the job stream
+	TriggerStream = "stream"
+
+	RunBackup = "backup"
+	RunRotate = "rotate"
+
+	RunRunning = "running"
+	RunSuccess = "success"
+	RunFailed  = "failed"
+
+	// runsHistory is the number of finished runs kept in memory
+	runsHistory = 100
+)
+
+// Run describes the run of the job or jobs group
+type Run struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Trigger    string     `json:"trigger"`
+	Type       string     `json:"type"`
+	Jobs       []string   `json:"jobs"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Errors     []string   `json:"errors,omitempty"`
+	Logs       []RunLog   `json:"logs,omitempty"`
+}
+
+// RunLog is the log record written during the run
+type RunLog struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Job     string    `json:"job,omitempty"`
+	Storage string    `json:"storage,omitempty"`
+	Message string    `json:"message"`
+}
+
+// GetRuns returns runs without logs, the latest first
+func (s *Scheduler) GetRuns() []Run {
+	s.runsMu.RLock()
+	defer s.runsMu.RUnlock()
+
+	runs := make([]Run, 0, len(s.runs))
+	for i := len(s.runs) - 1; i >= 0; i-- {
+		r := s.runs[i].copy()
+		r.Logs = nil
+		runs = append(runs, r)
+	}
+	return runs
+}
+
+// GetRun returns the run with its logs
+func (s *Scheduler) GetRun(id int) (Run, error) {
+	s.runsMu.RLock()
+	defer s.runsMu.RUnlock()
+
+	for _, r := range s.runs {
+		if r.ID == id {
+			return r.copy(), nil
+		}
+	}
+	return Run{}, fmt.Errorf("run `%d` %w", id, misc.ErrNotFound)
+}
+
+func (s *Scheduler) newRun(name, trigger, runType string, jobs interfaces.Jobs) *Run {
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+
+	s.lastRunID++
+	r := &Run{
+		ID:        s.lastRunID,
+		Name:      name,
+		Trigger:   trigger,
+		Type:      runType,
+		Status:    RunRunning,
+		StartedAt: time.Now(),
+	}
+	for _, job := range jobs {
+		r.Jobs = append(r.Jobs, job.GetName())
+	}
+
+	// forget the oldest finished runs
+	if len(s.runs) >= runsHistory {
+		for i, old := range s.runs {
+			if old.Status != RunRunning {
+				s.runs = append(s.runs[:i:i], s.runs[i+1:]...)
+				break
+			}
+		}
+	}
+	s.runs = append(s.runs, r)
+
+	return r
+}
+
+// perform runs the jobs backups or rotation under the nxs-backup lock, collecting the run logs
+func (s *Scheduler) perform(r *Run, jobs interfaces.Jobs) error {
+	var errs *multierror.Error
+
+	logCh := make(chan logger.LogRecord)
+	logsDone := make(chan struct{})
+	go func() {
+		for rec := range logCh {
+			s.addRunLog(r, rec)
+			s.evCh <- rec
+		}
+		close(logsDone)
+	}()
+
+	if err := s.acquireLock(); err != nil {
+		err = fmt.Errorf("Can't start %s. Another nxs-backup process already running. ", r.Type)
+		logCh <- logger.Log("", "").Error(err)
+		errs = multierror.Append(errs, err)
+	} else {
+		if r.Type == RunRotate {
+			errs = multierror.Append(errs, s.runner.Rotate(logCh, jobs)...)
+		} else {
+			errs = multierror.Append(errs, s.runner.Run(logCh, jobs)...)
+		}
+		if err = s.metricsData.SaveFile(); err != nil {
+			logCh <- logger.Log("", "").Errorf("Failed to save metrics to file: %v", err)
+		}
+		s.releaseLock()
+	}
+
+	close(logCh)
+	<-logsDone
+
+	s.finishRun(r, errs.ErrorOrNil())
+
+	return errs.ErrorOrNil()
+}
+
+func (s *Scheduler) addRunLog(r *Run, rec logger.LogRecord) {
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+
+	r.Logs = append(r.Logs, RunLog{
+		Time:    time.Now(),
+		Level:   rec.Level.String(),
+		Job:     rec.JobName,
+		Storage: rec.StorageName,
+		Message: rec.Message,
+	})
+}
+
+func (s *Scheduler) finishRun(r *Run, err error) {
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+
+	now := time.Now()
+	r.FinishedAt = &now
+	r.Status = RunSuccess
+	if err != nil {
+		r.Status = RunFailed
+		if me, ok := err.(*multierror.Error); ok {
+			for _, e := range me.WrappedErrors() {
+				r.Errors = append(r.Errors, e.Error())
+			}
+		} else {
+			r.Errors = append(r.Errors, err.Error())
+		}
+	}
+}
+
+func (r *Run) copy() Run {
+	c := *r
+	c.Jobs = append([]string(nil), r.Jobs...)
+	c.Errors = append([]string(nil), r.Errors...)
+	c.Logs = append([]RunLog(nil), r.Logs...)
+	if r.FinishedAt != nil {
+		t := *r.FinishedAt
+		c.FinishedAt = &t
+	}
+	return c
+}
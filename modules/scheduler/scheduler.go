@@ -0,0 +1,289 @@
+package scheduler
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nightlyone/lockfile"
+	"github.com/robfig/cron/v3"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backup"
+	"github.com/nixys/nxs-backup/modules/logger"
+	"github.com/nixys/nxs-backup/modules/metrics"
+)
+
+// streamRestartDelay is the delay the failed job stream is restarted after
+const streamRestartDelay = time.Minute
+
+// Schedule defines when the job has to be run
+type Schedule struct {
+	Job    interfaces.Job
+	Cron   string
+	Spec   cron.Schedule
+	Jitter time.Duration
+}
+
+type Opts struct {
+	EvCh        chan logger.LogRecord
+	WaitPrev    time.Duration
+	Runner      *backup.Runner
+	MetricsData *metrics.Data
+	Schedules   []Schedule
+	// RotateSchedules define when the outdated backups of jobs are deleted apart from the backups
+	RotateSchedules []Schedule
+	Jobs            map[string]interfaces.Job
+	JobGroups       map[string]interfaces.Jobs
+	FileJobs        interfaces.Jobs
+	DBJobs          interfaces.Jobs
+	ExtJobs         interfaces.Jobs
+}
+
+// Scheduler performs jobs by their schedules and on demand, keeping the history of runs
+type Scheduler struct {
+	cron         *cron.Cron
+	evCh         chan logger.LogRecord
+	waitPrev     time.Duration
+	runner       *backup.Runner
+	metricsData  *metrics.Data
+	entries      map[string]cron.EntryID
+	schedules    map[string]Schedule
+	rotEntries   map[string]cron.EntryID
+	rotSchedules map[string]Schedule
+	jobs         map[string]interfaces.Job
+	jobGroups    map[string]interfaces.Jobs
+	fileJobs     interfaces.Jobs
+	dbJobs       interfaces.Jobs
+	extJobs      interfaces.Jobs
+
+	lockMu  sync.Mutex
+	lockCnt int
+	lock    lockfile.Lockfile
+
+	runsMu    sync.RWMutex
+	runs      []*Run
+	lastRunID int
+
+	// streamRuns are the running deliveries of the streaming jobs data
+	streamRuns map[string]*atomic.Bool
+}
+
+type task struct {
+	s       *Scheduler
+	job     interfaces.Job
+	jitter  time.Duration
+	rotate  bool
+	running atomic.Bool
+}
+
+func Init(o Opts) *Scheduler {
+	s := &Scheduler{
+		cron:         cron.New(),
+		evCh:         o.EvCh,
+		waitPrev:     o.WaitPrev,
+		runner:       o.Runner,
+		metricsData:  o.MetricsData,
+		entries:      make(map[string]cron.EntryID),
+		schedules:    make(map[string]Schedule),
+		rotEntries:   make(map[string]cron.EntryID),
+		rotSchedules: make(map[string]Schedule),
+		jobs:         o.Jobs,
+		jobGroups:    o.JobGroups,
+		fileJobs:     o.FileJobs,
+		dbJobs:       o.DBJobs,
+		extJobs:      o.ExtJobs,
+		streamRuns:   make(map[string]*atomic.Bool),
+	}
+
+	for _, sch := range o.Schedules {
+		s.entries[sch.Job.GetName()] = s.cron.Schedule(sch.Spec, &task{
+			s:      s,
+			job:    sch.Job,
+			jitter: sch.Jitter,
+		})
+		s.schedules[sch.Job.GetName()] = sch
+	}
+	for _, sch := range o.RotateSchedules {
+		s.rotEntries[sch.Job.GetName()] = s.cron.Schedule(sch.Spec, &task{
+			s:      s,
+			job:    sch.Job,
+			jitter: sch.Jitter,
+			rotate: true,
+		})
+		s.rotSchedules[sch.Job.GetName()] = sch
+	}
+	for name, job := range s.jobs {
+		if sj, ok := job.(interfaces.StreamingJob); ok && sj.IsStreaming() {
+			s.streamRuns[name] = new(atomic.Bool)
+		}
+	}
+
+	return s
+}
+
+// Start runs the scheduler in its own goroutine
+func (s *Scheduler) Start() {
+	s.cron.Start()
+
+	for jobName, id := range s.entries {
+		s.evCh <- logger.Log(jobName, "").Infof("Backup scheduled. Next run at %s", s.cron.Entry(id).Next.Format(time.DateTime))
+	}
+	for jobName, id := range s.rotEntries {
+		s.evCh <- logger.Log(jobName, "").Infof("Rotation scheduled. Next run at %s", s.cron.Entry(id).Next.Format(time.DateTime))
+	}
+	for jobName := range s.streamRuns {
+		job := s.jobs[jobName]
+		for _, ofs := range job.GetTargetOfsList() {
+			go s.stream(job, ofs)
+		}
+	}
+}
+
+// stream keeps the job target streamed, the failed stream is restarted after a delay
+func (s *Scheduler) stream(job interfaces.Job, ofs string) {
+	sj := job.(interfaces.StreamingJob)
+	for {
+		err := sj.Stream(s.evCh, ofs, func() { go s.deliverStreamed(job) })
+		s.evCh <- logger.Log(job.GetName(), "").Errorf("Streaming of `%s` failed: %v. Restarting in %s", ofs, err, streamRestartDelay)
+		time.Sleep(streamRestartDelay)
+	}
+}
+
+// deliverStreamed runs the backup of the streaming job delivering its closed data, the run is skipped if the previous one
+// is still in progress, its data is delivered by the next one
+func (s *Scheduler) deliverStreamed(job interfaces.Job) {
+	running := s.streamRuns[job.GetName()]
+	if !running.CompareAndSwap(false, true) {
+		return
+	}
+	defer running.Store(false)
+
+	jobs := interfaces.Jobs{job}
+	if err := s.perform(s.newRun(job.GetName(), TriggerStream, RunBackup, jobs), jobs); err != nil {
+		s.evCh <- logger.Log(job.GetName(), "").Errorf("Delivery of streamed data failed with next errors:\n%v", err)
+	}
+}
+
+// Scheduled reports whether any of jobs has a schedule or is streamed
+func (s *Scheduler) Scheduled() bool {
+	return len(s.entries) > 0 || len(s.rotEntries) > 0 || len(s.streamRuns) > 0
+}
+
+// GetSchedule returns the job schedule and the time of its next run
+func (s *Scheduler) GetSchedule(jobName string) (Schedule, time.Time, bool) {
+	id, ok := s.entries[jobName]
+	if !ok {
+		return Schedule{}, time.Time{}, false
+	}
+	return s.schedules[jobName], s.cron.Entry(id).Next, true
+}
+
+// GetRotateSchedule returns the job rotation schedule and the time of its next run
+func (s *Scheduler) GetRotateSchedule(jobName string) (Schedule, time.Time, bool) {
+	id, ok := s.rotEntries[jobName]
+	if !ok {
+		return Schedule{}, time.Time{}, false
+	}
+	return s.rotSchedules[jobName], s.cron.Entry(id).Next, true
+}
+
+// Trigger starts the backup of the job or jobs group in background
+func (s *Scheduler) Trigger(name string) (Run, error) {
+	return s.trigger(name, RunBackup)
+}
+
+// TriggerRotate starts the rotation of the job or jobs group backups in background
+func (s *Scheduler) TriggerRotate(name string) (Run, error) {
+	return s.trigger(name, RunRotate)
+}
+
+func (s *Scheduler) trigger(name, runType string) (Run, error) {
+	var jobs interfaces.Jobs
+
+	switch name {
+	case "all":
+		jobs = append(jobs, s.extJobs...)
+		jobs = append(jobs, s.dbJobs...)
+		jobs = append(jobs, s.fileJobs...)
+	case "external":
+		jobs = s.extJobs
+	case "databases":
+		jobs = s.dbJobs
+	case "files":
+		jobs = s.fileJobs
+	default:
+		if job, ok := s.jobs[name]; ok {
+			jobs = interfaces.Jobs{job}
+		} else if group, ok := s.jobGroups[name]; ok {
+			jobs = group
+		} else {
+			return Run{}, fmt.Errorf("job or group `%s` %w", name, misc.ErrNotFound)
+		}
+	}
+	if len(jobs) == 0 {
+		return Run{}, fmt.Errorf("no jobs in group `%s`", name)
+	}
+
+	r := s.newRun(name, TriggerAPI, runType, jobs)
+	go func() { _ = s.perform(r, jobs) }()
+
+	return s.GetRun(r.ID)
+}
+
+func (t *task) Run() {
+	jobName := t.job.GetName()
+
+	runType := RunBackup
+	if t.rotate {
+		runType = RunRotate
+	}
+
+	if !t.running.CompareAndSwap(false, true) {
+		t.s.evCh <- logger.Log(jobName, "").Warnf("Previous scheduled %s is still in progress. Skipping.", runType)
+		return
+	}
+	defer t.running.Store(false)
+
+	if t.jitter > 0 {
+		delay := rand.N(t.jitter)
+		t.s.evCh <- logger.Log(jobName, "").Debugf("Scheduled %s is delayed for %s.", runType, delay.Round(time.Second))
+		time.Sleep(delay)
+	}
+
+	jobs := interfaces.Jobs{t.job}
+	if err := t.s.perform(t.s.newRun(jobName, TriggerSchedule, runType, jobs), jobs); err != nil {
+		t.s.evCh <- logger.Log(jobName, "").Errorf("Scheduled %s failed with next errors:\n%v", runType, err)
+	}
+}
+
+// acquireLock creates the same lockfile as `start` command does.
+// The lockfile is held while at least one of runs is in progress.
+func (s *Scheduler) acquireLock() error {
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+
+	if s.lockCnt == 0 {
+		lock, err := backup.Lock(s.waitPrev)
+		if err != nil {
+			return err
+		}
+		s.lock = lock
+	}
+	s.lockCnt++
+
+	return nil
+}
+
+func (s *Scheduler) releaseLock() {
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+
+	s.lockCnt--
+	if s.lockCnt == 0 {
+		_ = s.lock.Unlock()
+	}
+}
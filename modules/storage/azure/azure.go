@@ -0,0 +1,299 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
+	"github.com/nixys/nxs-backup/modules/backend/files"
+	"github.com/nixys/nxs-backup/modules/logger"
+	. "github.com/nixys/nxs-backup/modules/storage"
+)
+
+type Azure struct {
+	client        *container.Client
+	name          string
+	containerName string
+	backupPath    string
+	rateLimit     int64
+	rotateEnabled bool
+	cipher        *crypt.Cipher
+	Retention
+	DryRun
+}
+
+type Opts struct {
+	AccountName             string
+	Container               string
+	AccountKey              string
+	SASToken                string
+	Endpoint                string
+	ManagedIdentity         bool
+	ManagedIdentityClientID string
+}
+
+func Init(name string, opts Opts, rl int64) (*Azure, error) {
+	var (
+		client *container.Client
+		err    error
+	)
+
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", opts.AccountName)
+	}
+	containerURL := strings.TrimSuffix(endpoint, "/") + "/" + opts.Container
+
+	switch {
+	case opts.AccountKey != "":
+		var cred *container.SharedKeyCredential
+		if cred, err = container.NewSharedKeyCredential(opts.AccountName, opts.AccountKey); err == nil {
+			client, err = container.NewClientWithSharedKeyCredential(containerURL, cred, nil)
+		}
+	case opts.SASToken != "":
+		client, err = container.NewClientWithNoCredential(containerURL+"?"+strings.TrimPrefix(opts.SASToken, "?"), nil)
+	case opts.ManagedIdentity:
+		var miOpts azidentity.ManagedIdentityCredentialOptions
+		if opts.ManagedIdentityClientID != "" {
+			miOpts.ID = azidentity.ClientID(opts.ManagedIdentityClientID)
+		}
+		var cred *azidentity.ManagedIdentityCredential
+		if cred, err = azidentity.NewManagedIdentityCredential(&miOpts); err == nil {
+			client, err = container.NewClient(containerURL, cred, nil)
+		}
+	default:
+		return nil, fmt.Errorf("Failed to init '%s' Azure storage. One of `account_key`, `sas_token` or `managed_identity` is required ", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to init '%s' Azure storage. Error: %v ", name, err)
+	}
+
+	if _, err = client.GetProperties(context.Background(), nil); err != nil {
+		if bloberror.HasCode(err, bloberror.ContainerNotFound) {
+			return nil, fmt.Errorf("Container '%s' doesn't exist. ", opts.Container)
+		}
+		return nil, fmt.Errorf("Failed to check container exist in Azure storage '%s'. Error: %v ", name, err)
+	}
+
+	return &Azure{
+		name:          name,
+		client:        client,
+		containerName: opts.Container,
+		rateLimit:     rl,
+	}, nil
+}
+
+func (a *Azure) Configure(p Params) {
+	a.backupPath = strings.TrimPrefix(p.BackupPath, "/")
+	a.rateLimit = p.RateLimit
+	a.rotateEnabled = p.RotateEnabled
+	a.Retention = p.Retention
+	a.cipher = p.Cipher
+}
+
+func (a *Azure) IsLocal() int { return 0 }
+
+func (a *Azure) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFile, ofs, bakType string) error {
+	var bakRemPaths, mtdRemPaths []string
+
+	if bakType == string(misc.IncFiles) {
+		bakRemPaths, mtdRemPaths = GetIncBackupDstList(tmpBackupFile, ofs, a.backupPath)
+	} else {
+		bakRemPaths = GetDescBackupDstList(tmpBackupFile, ofs, a.backupPath, a.Retention)
+	}
+
+	if len(mtdRemPaths) > 0 {
+		if err := a.uploadFile(logCh, jobName, tmpBackupFile+".inc", mtdRemPaths); err != nil {
+			return err
+		}
+	}
+
+	if err := a.uploadFile(logCh, jobName, tmpBackupFile, bakRemPaths); err != nil {
+		return err
+	}
+
+	return a.uploadFile(logCh, jobName, tmpBackupFile+checksum.Ext, GetChecksumDstList(tmpBackupFile, bakRemPaths))
+}
+
+// uploadFile uploads the local file to every of blob paths
+func (a *Azure) uploadFile(logCh chan logger.LogRecord, jobName, srcPath string, blobPaths []string) error {
+	if len(blobPaths) == 0 {
+		return nil
+	}
+
+	source, err := files.GetLimitedFileReader(srcPath, a.rateLimit)
+	if err != nil {
+		logCh <- logger.Log(jobName, a.name).Errorf("Unable to open '%s'", err)
+		return err
+	}
+	defer func() { _ = source.Close() }()
+
+	for _, blobPath := range blobPaths {
+		if _, err = source.Seek(0, io.SeekStart); err != nil {
+			logCh <- logger.Log(jobName, a.name).Errorf("Failed to reset file reader to start. Error: %v", err)
+			return err
+		}
+		_, err = a.client.NewBlockBlobClient(blobPath).UploadStream(context.Background(), source, &blockblob.UploadStreamOptions{
+			HTTPHeaders: &blob.HTTPHeaders{BlobContentType: to.Ptr("application/octet-stream")},
+		})
+		if err != nil {
+			logCh <- logger.Log(jobName, a.name).Errorf("Failed to upload blob '%s' to container %s. Error: %v", blobPath, a.containerName, err)
+			return err
+		}
+		logCh <- logger.Log(jobName, a.name).Infof("Successfully uploaded blob '%s' to container %s", blobPath, a.containerName)
+	}
+
+	return nil
+}
+
+func (a *Azure) DeleteOldBackups(logCh chan logger.LogRecord, ofs string, job interfaces.Job, full bool) error {
+	if !a.rotateEnabled {
+		logCh <- logger.Log(job.GetName(), a.name).Debugf("Backup rotate skipped by config.")
+		return nil
+	}
+
+	blobs, err := a.listBlobs(path.Join(a.backupPath, ofs))
+	if err != nil {
+		logCh <- logger.Log(job.GetName(), a.name).Errorf("Failed get blobs: '%s'", err)
+		return err
+	}
+
+	pins, err := LoadPins(job.GetCatalog(), job.GetName(), ofs, a.name)
+	if err != nil {
+		logCh <- logger.Log(job.GetName(), a.name).Errorf("Backup rotate skipped. Failed to read pinned backups: %s", err)
+		return err
+	}
+
+	toDelete, rules := a.SelectRotated(logCh, RotationTarget{
+		JobName:   job.GetName(),
+		Storage:   a.name,
+		BackupDir: path.Join(a.backupPath, ofs),
+		Inc:       job.GetType() == misc.IncFiles,
+		Full:      full,
+		Safety:    job.IsBackupSafety(),
+	}, blobs, pins)
+
+	if a.IsDryRun() {
+		for _, b := range toDelete {
+			a.Planned(RotationAction{Job: job.GetName(), Storage: a.name, Target: ofs, Path: b.Name, RotationRule: rules[b.Name]})
+		}
+		return nil
+	}
+
+	var errs *multierror.Error
+	for _, b := range toDelete {
+		if err = a.deleteBlob(b.Name); err != nil {
+			logCh <- logger.Log(job.GetName(), a.name).Errorf("Failed to delete blob '%s' with next error: %s", b.Name, err)
+			errs = multierror.Append(errs, err)
+		} else {
+			logCh <- logger.Log(job.GetName(), a.name).Infof("Deleted old backup blob '%s'", b.Name)
+		}
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// listBlobs returns all blobs stored under the dir
+func (a *Azure) listBlobs(dir string) ([]RemoteFile, error) {
+	var blobs []RemoteFile
+
+	pager := a.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: to.Ptr(dir + "/")})
+	for pager.More() {
+		page, err := pager.NextPage(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Segment.BlobItems {
+			b := RemoteFile{Name: *item.Name}
+			if item.Properties != nil && item.Properties.LastModified != nil {
+				b.ModTime = *item.Properties.LastModified
+			}
+			blobs = append(blobs, b)
+		}
+	}
+
+	return blobs, nil
+}
+
+func (a *Azure) deleteBlob(blobPath string) error {
+	_, err := a.client.NewBlobClient(blobPath).Delete(context.Background(), &blob.DeleteOptions{
+		DeleteSnapshots: to.Ptr(blob.DeleteSnapshotsOptionTypeInclude),
+	})
+	return err
+}
+
+func (a *Azure) GetFileReader(ofsPath string) (io.ReadCloser, error) {
+	resp, err := a.client.NewBlobClient(path.Join(a.backupPath, ofsPath)).DownloadStream(context.Background(), nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			err = fs.ErrNotExist
+		}
+		return nil, err
+	}
+
+	return a.cipher.DecryptReadCloser(resp.Body)
+}
+
+// PutFile uploads the file copied from another storage as is
+func (a *Azure) PutFile(logCh chan logger.LogRecord, jobName, _, _, ofsPath string, src io.Reader) error {
+	blobPath := path.Join(a.backupPath, ofsPath)
+	_, err := a.client.NewBlockBlobClient(blobPath).UploadStream(context.Background(), files.GetLimitedReader(src, a.rateLimit), &blockblob.UploadStreamOptions{
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: to.Ptr("application/octet-stream")},
+	})
+	if err != nil {
+		logCh <- logger.Log(jobName, a.name).Errorf("Failed to upload blob '%s' to container %s. Error: %v", blobPath, a.containerName, err)
+		return err
+	}
+	logCh <- logger.Log(jobName, a.name).Infof("Successfully uploaded blob '%s' to container %s", blobPath, a.containerName)
+
+	return nil
+}
+
+func (a *Azure) DeleteFile(ofsPath string) error {
+	err := a.deleteBlob(path.Join(a.backupPath, ofsPath))
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return fs.ErrNotExist
+	}
+	return err
+}
+
+func (a *Azure) ListBackups(ofsPath string) ([]string, error) {
+	blobs, err := a.listBlobs(path.Join(a.backupPath, ofsPath))
+	if err != nil {
+		return nil, err
+	}
+
+	fList := make([]string, 0, len(blobs))
+	for _, b := range blobs {
+		fList = append(fList, b.Name)
+	}
+	return fList, nil
+}
+
+func (a *Azure) Close() error {
+	return nil
+}
+
+func (a *Azure) Clone() interfaces.Storage {
+	cl := *a
+	return &cl
+}
+
+func (a *Azure) GetName() string {
+	return a.name
+}
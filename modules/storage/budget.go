@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"path"
+	"slices"
+	"sort"
+
+	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+)
+
+// SizedFile is the backup file of the job target with the space it takes on the storage
+type SizedFile struct {
+	Ofs    string
+	Path   string
+	Size   int64
+	Pinned bool
+}
+
+// SizeBudget returns the total size limit of the job backups on the storage, zero means no limit.
+// It's promoted to the storages, so the limit can be read without knowing the storage type.
+func (r Retention) SizeBudget() int64 {
+	return r.MaxTotalSize
+}
+
+// SizeBudgetEvictions returns the files to be deleted to fit the total size of the files into the budget and the total size left.
+// The oldest daily copies are evicted first, then the weekly, monthly and yearly ones. The newest backup of each target is always kept.
+// Links to the backups stored in the longer periods take no space, they are evicted together with the backup they point to.
+// Checksum manifests are evicted together with their backups. Pinned backups take the space, but they are never evicted.
+func SizeBudgetEvictions(files []SizedFile, budget int64) (evict []SizedFile, total int64) {
+	var (
+		backups []SizedFile
+		sums    = make(map[string]SizedFile)
+		links   = make(map[string][]SizedFile)
+		newest  = make(map[string]SizedFile)
+	)
+
+	for _, f := range files {
+		total += f.Size
+		switch {
+		case checksum.IsManifest(f.Path):
+			sums[f.Path] = f
+		case f.Size == 0:
+			links[f.Ofs+"/"+path.Base(f.Path)] = append(links[f.Ofs+"/"+path.Base(f.Path)], f)
+		default:
+			backups = append(backups, f)
+		}
+		if n, ok := newest[f.Ofs]; !checksum.IsManifest(f.Path) && (!ok || isNewer(f.Path, n.Path)) {
+			newest[f.Ofs] = f
+		}
+	}
+
+	if total <= budget {
+		return
+	}
+
+	// the periods list is ordered from the longest one, the files out of the period dirs are evicted last
+	sort.SliceStable(backups, func(i, j int) bool {
+		pi, pj := periodIndex(backups[i].Path), periodIndex(backups[j].Path)
+		if pi != pj {
+			return pi > pj
+		}
+		return isNewer(backups[j].Path, backups[i].Path)
+	})
+
+	for _, b := range backups {
+		if total <= budget {
+			break
+		}
+		if b.Pinned || path.Base(b.Path) == path.Base(newest[b.Ofs].Path) {
+			continue
+		}
+
+		copies := []SizedFile{b}
+		// the links are evicted with the last copy they may point to
+		if !slices.ContainsFunc(backups, func(f SizedFile) bool {
+			return f.Ofs == b.Ofs && f.Path != b.Path && path.Base(f.Path) == path.Base(b.Path) && !slices.Contains(evict, f)
+		}) {
+			copies = append(copies, links[b.Ofs+"/"+path.Base(b.Path)]...)
+		}
+		for _, f := range copies {
+			evict = append(evict, f)
+			total -= f.Size
+			if s, ok := sums[f.Path+checksum.Ext]; ok {
+				evict = append(evict, s)
+				total -= s.Size
+			}
+		}
+	}
+
+	return
+}
+
+func periodIndex(ofsPath string) int {
+	return slices.Index(RetentionPeriodsList, retentionPeriod(path.Base(path.Dir(ofsPath))))
+}
+
+// isNewer compares the backup files by the creation time in their names, the names are compared if the time is the same or unknown
+func isNewer(a, b string) bool {
+	ta, _ := misc.GetBackupFileTime(a)
+	tb, _ := misc.GetBackupFileTime(b)
+	if !ta.Equal(tb) {
+		return ta.After(tb)
+	}
+	return path.Base(a) > path.Base(b)
+}
@@ -7,9 +7,12 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 )
 
 type retentionPeriod string
@@ -18,14 +21,18 @@ const (
 	Daily   retentionPeriod = "daily"
 	Weekly  retentionPeriod = "weekly"
 	Monthly retentionPeriod = "monthly"
+	Yearly  retentionPeriod = "yearly"
 )
 
-var RetentionPeriodsList = []retentionPeriod{Monthly, Weekly, Daily}
+// RetentionPeriodsList is ordered from the longest period, a backup is stored in the longest period due and linked to the others
+var RetentionPeriodsList = []retentionPeriod{Yearly, Monthly, Weekly, Daily}
 
 type Params struct {
 	RateLimit     int64
 	BackupPath    string
+	TmpDir        string
 	RotateEnabled bool
+	Cipher        *crypt.Cipher
 	Retention
 }
 
@@ -33,44 +40,108 @@ type Retention struct {
 	Days     int
 	Weeks    int
 	Months   int
+	Years    int
 	UseCount bool
+	// WeeklyDay is the day of the week the weekly backups are kept
+	WeeklyDay time.Weekday
+	// MonthlyDay is the day of the month the monthly backups are kept, the days beyond the month length mean its last day
+	MonthlyDay int
+	// YearlyMonth and YearlyDay are the date of the year the yearly backups are kept
+	YearlyMonth time.Month
+	YearlyDay   int
+	// MaxTotalSize limits the total size of the job backups on the storage, zero means no limit
+	MaxTotalSize int64
 }
 
 func (p retentionPeriod) String() string {
 	return string(p)
 }
 
-func GetRetention(p retentionPeriod, r Retention) (retentionCount int, retentionDate time.Time) {
-	curDate := time.Now().Round(24 * time.Hour)
+// BackupRelPaths returns the paths relative to the backup path the temp backup is delivered to by the storage with the retention.
+// It's promoted to the storages, so the paths of the delivered backups can be known without listing the storage.
+func (r Retention) BackupRelPaths(tmpBackupFile, ofs, bakType string) []string {
+	if bakType == string(misc.IncFiles) {
+		bakDst, _ := GetIncBackupDstList(tmpBackupFile, ofs, "")
+		return bakDst
+	}
+	return GetDescBackupDstList(tmpBackupFile, ofs, "", r)
+}
 
+// IsBackupDay reports whether the backups of the retention period are kept on the day of the time
+func (r Retention) IsBackupDay(p retentionPeriod, t time.Time) bool {
 	switch p {
 	case Daily:
-		if r.Days == 0 {
-			return
+		return r.Days > 0
+	case Weekly:
+		return r.Weeks > 0 && t.Weekday() == r.WeeklyDay
+	case Monthly:
+		return r.Months > 0 && t.Day() == clampDay(t.Year(), t.Month(), r.MonthlyDay)
+	case Yearly:
+		month := r.YearlyMonth
+		if month == 0 {
+			month = time.January
 		}
+		return r.Years > 0 && t.Month() == month && t.Day() == clampDay(t.Year(), month, r.YearlyDay)
+	}
+	return false
+}
+
+// clampDay limits the day to the month length, the zero day means the first one
+func clampDay(year int, month time.Month, day int) int {
+	lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	return min(max(day, 1), lastDay)
+}
+
+func GetRetention(p retentionPeriod, r Retention) (retentionCount int, retentionDate time.Time) {
+	now := time.Now()
+	curDate := now.Round(24 * time.Hour)
+
+	if !r.IsBackupDay(p, now) {
+		return
+	}
+
+	switch p {
+	case Daily:
 		retentionCount = r.Days
 		retentionDate = curDate.AddDate(0, 0, -r.Days+1)
 	case Weekly:
-		if misc.GetDateTimeNow("dow") != misc.WeeklyBackupDay || r.Weeks == 0 {
-			return
-		}
 		retentionCount = r.Weeks
 		retentionDate = curDate.AddDate(0, 0, -r.Weeks*7+1)
 	case Monthly:
-		if misc.GetDateTimeNow("dom") != misc.MonthlyBackupDay || r.Months == 0 {
-			return
-		}
 		retentionCount = r.Months
 		retentionDate = curDate.AddDate(0, -r.Months, 1)
+	case Yearly:
+		retentionCount = r.Years
+		retentionDate = curDate.AddDate(-r.Years, 0, 1)
 	}
 	return
 }
 
-func IsNeedToBackup(day, week, month int) bool {
-	if day > 0 ||
-		(week > 0 && misc.GetDateTimeNow("dow") == misc.WeeklyBackupDay) ||
-		(month > 0 && misc.GetDateTimeNow("dom") == misc.MonthlyBackupDay) {
-		return true
+// RetainUntil returns the time the backup modified at t may be deleted by the rotation with the date based retention,
+// it's the inverse of the GetRetention cutoff. The cutoff is counted from the current date rounded to a day and the
+// months of different length shift it as well, so a day is taken off to get the time before the earliest rotation.
+func RetainUntil(p retentionPeriod, r Retention, t time.Time) time.Time {
+	day := t.Truncate(24 * time.Hour)
+
+	switch p {
+	case Daily:
+		day = day.AddDate(0, 0, r.Days)
+	case Weekly:
+		day = day.AddDate(0, 0, r.Weeks*7)
+	case Monthly:
+		day = day.AddDate(0, r.Months, 0)
+	case Yearly:
+		day = day.AddDate(r.Years, 0, 0)
+	}
+	return day.AddDate(0, 0, -1)
+}
+
+func IsNeedToBackup(r Retention) bool {
+	now := time.Now()
+	for _, p := range RetentionPeriodsList {
+		if r.IsBackupDay(p, now) {
+			return true
+		}
 	}
 
 	return false
@@ -82,24 +153,13 @@ func GetDescBackupDstAndLinks(tmpBackupFile, ofs, bakPath string, retention Rete
 	links = make(map[string]string)
 
 	bakFileName := path.Base(tmpBackupFile)
+	now := time.Now()
 
-	if misc.GetDateTimeNow("dom") == misc.MonthlyBackupDay && retention.Months > 0 {
-		dst = path.Join(bakPath, ofs, "monthly", bakFileName)
-	}
-	if misc.GetDateTimeNow("dow") == misc.WeeklyBackupDay && retention.Weeks > 0 {
-		dstPath := path.Join(bakPath, ofs, "weekly")
-		if dst != "" {
-			relative, err = filepath.Rel(dstPath, dst)
-			if err != nil {
-				return
-			}
-			links[path.Join(dstPath, bakFileName)] = relative
-		} else {
-			dst = path.Join(dstPath, bakFileName)
+	for _, p := range RetentionPeriodsList {
+		if !retention.IsBackupDay(p, now) {
+			continue
 		}
-	}
-	if retention.Days > 0 {
-		dstPath := path.Join(bakPath, ofs, "daily")
+		dstPath := path.Join(bakPath, ofs, p.String())
 		if dst != "" {
 			relative, err = filepath.Rel(dstPath, dst)
 			if err != nil {
@@ -188,19 +248,31 @@ func GetIncBackupDstAndLinks(tmpBackupFile, ofs, bakPath string) (bakDst, mtdDst
 	return
 }
 
+// DeliveryRank orders the copies of the backup in the retention periods dirs the way the delivery makes them,
+// the backup is stored in the longest period and the copies with the greater rank are linked to it
+func DeliveryRank(ofsPath string) int {
+	switch path.Base(path.Dir(ofsPath)) {
+	case "year":
+		return 0
+	case "monthly":
+		return 1
+	}
+	if i := periodIndex(ofsPath); i >= 0 {
+		return i
+	}
+	return len(RetentionPeriodsList)
+}
+
 func GetDescBackupDstList(tmpBackupFile, ofs, bakPath string, retention Retention) (dst []string) {
 
 	bakFile := path.Base(tmpBackupFile)
 	basePath := path.Join(bakPath, ofs)
+	now := time.Now()
 
-	if misc.GetDateTimeNow("dom") == misc.MonthlyBackupDay && retention.Months > 0 {
-		dst = append(dst, path.Join(basePath, "monthly", bakFile))
-	}
-	if misc.GetDateTimeNow("dow") == misc.WeeklyBackupDay && retention.Weeks > 0 {
-		dst = append(dst, path.Join(basePath, "weekly", bakFile))
-	}
-	if retention.Days > 0 {
-		dst = append(dst, path.Join(basePath, "daily", bakFile))
+	for _, p := range RetentionPeriodsList {
+		if retention.IsBackupDay(p, now) {
+			dst = append(dst, path.Join(basePath, p.String(), bakFile))
+		}
 	}
 
 	return
@@ -241,3 +313,110 @@ func GetIncBackupDstList(tmpBackupFile, ofs, bakPath string) (bakDst, mtdDst []s
 
 	return
 }
+
+// GetOfsRelPath converts the file path returned by storage listing to the path relative to the storage backup path
+func GetOfsRelPath(filePath, ofs string) string {
+	p := "/" + strings.TrimPrefix(filePath, "/")
+	idx := strings.LastIndex(p, "/"+ofs+"/")
+	if idx < 0 {
+		return filePath
+	}
+	return p[idx+1:]
+}
+
+// GetChecksumDstAndLinks returns the checksum manifest destination and links mirroring the backup ones.
+// Empty destination returned if the manifest of the temp backup doesn't exist.
+func GetChecksumDstAndLinks(tmpBackupFile, bakDst string, links map[string]string) (sumDst string, sumLinks map[string]string) {
+	if _, err := os.Stat(tmpBackupFile + checksum.Ext); err != nil {
+		return
+	}
+
+	sumDst = bakDst + checksum.Ext
+	sumLinks = make(map[string]string)
+	for dst, src := range links {
+		// skip links of the incremental backup metadata
+		if path.Base(dst) == path.Base(bakDst) {
+			sumLinks[dst+checksum.Ext] = src + checksum.Ext
+		}
+	}
+
+	return
+}
+
+// GetChecksumDstList returns the checksum manifest destinations for the backup ones.
+// Nil returned if the manifest of the temp backup doesn't exist.
+func GetChecksumDstList(tmpBackupFile string, bakDst []string) (sumDst []string) {
+	if _, err := os.Stat(tmpBackupFile + checksum.Ext); err != nil {
+		return
+	}
+
+	for _, dst := range bakDst {
+		sumDst = append(sumDst, dst+checksum.Ext)
+	}
+
+	return
+}
+
+// PartExt is appended to the name of the file while it is uploaded to a remote storage.
+// The file gets its final name only after the upload is complete, so a listed backup is always a complete one.
+const PartExt = ".part"
+
+// IsPartFile reports whether the file is an incomplete upload
+func IsPartFile(name string) bool {
+	return strings.HasSuffix(name, PartExt)
+}
+
+// SplitPartFiles separates incomplete uploads from the complete files
+func SplitPartFiles[T any](files []T, name func(T) string) (complete, parts []T) {
+	for _, f := range files {
+		if IsPartFile(name(f)) {
+			parts = append(parts, f)
+		} else {
+			complete = append(complete, f)
+		}
+	}
+	return
+}
+
+// SplitChecksums separates the checksum manifests from the backup files
+func SplitChecksums[T any](files []T, name func(T) string) (backups, sums []T) {
+	for _, f := range files {
+		if checksum.IsManifest(name(f)) {
+			sums = append(sums, f)
+		} else {
+			backups = append(backups, f)
+		}
+	}
+	return
+}
+
+// AppendChecksums adds to the backup files list the checksum manifests belonging to them
+func AppendChecksums[T any](backups, sums []T, name func(T) string) []T {
+	bakNames := make(map[string]bool, len(backups))
+	res := make([]T, 0, len(backups)+len(sums))
+	for _, b := range backups {
+		bakNames[name(b)] = true
+		res = append(res, b)
+	}
+	for _, s := range sums {
+		if bakNames[strings.TrimSuffix(name(s), checksum.Ext)] {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// NearestFreeSpace returns the free space reported by stat for the path or, if it doesn't exist yet, for its nearest parent
+func NearestFreeSpace(p string, stat func(string) (uint64, error)) (uint64, error) {
+	for {
+		free, err := stat(p)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return free, err
+		}
+		parent := path.Dir(p)
+		if parent == p {
+			return 0, err
+		}
+		p = parent
+	}
+}
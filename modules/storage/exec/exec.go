@@ -0,0 +1,403 @@
+// Package exec implements the storage driven by an external helper program.
+//
+// The helper is started once and kept running while the storage is in use. nxs-backup writes requests
+// to its stdin and reads responses from its stdout, one JSON object per line. The helper stderr is passed through.
+// Files are passed by local paths, so the storage rate limit isn't applied and has to be set by the helper options.
+// The helper not responding within the request timeout is killed and started again by the next request.
+//
+// Requests:
+//
+//	{"op":"put","path":"<remote file>","file":"<local file>"}    upload the local file
+//	{"op":"get","path":"<remote file>","file":"<local file>"}    download the remote file
+//	{"op":"list","path":"<remote dir>"}                         list all files under the dir recursively
+//	{"op":"delete","path":"<remote file>"}                      delete the remote file
+//	{"op":"mkdir","path":"<remote dir>"}                        create the dir with all parents
+//
+// Responses:
+//
+//	{}                                                          success
+//	{"files":[{"path":"<remote file>","mod_time":"<RFC 3339>"}]} success of `list`, missing dir is an empty list
+//	{"error":"<message>","not_found":true}                      failure, `not_found` is set if the path doesn't exist
+package exec
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
+	"github.com/nixys/nxs-backup/modules/logger"
+	. "github.com/nixys/nxs-backup/modules/storage"
+)
+
+type Exec struct {
+	helper        *helper
+	name          string
+	backupPath    string
+	tmpDir        string
+	rotateEnabled bool
+	cipher        *crypt.Cipher
+	Retention
+	DryRun
+}
+
+type Opts struct {
+	Command        string
+	Args           []string
+	Env            []string
+	RequestTimeout time.Duration
+}
+
+type request struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	File string `json:"file,omitempty"`
+}
+
+type response struct {
+	Error    string       `json:"error,omitempty"`
+	NotFound bool         `json:"not_found,omitempty"`
+	Files    []remoteFile `json:"files,omitempty"`
+}
+
+type remoteFile struct {
+	Path    string    `json:"path"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// helper is the running helper process shared by the storage clones
+type helper struct {
+	mu     sync.Mutex
+	opts   Opts
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func Init(name string, opts Opts, _ int64) (*Exec, error) {
+	if _, err := exec.LookPath(opts.Command); err != nil {
+		return nil, fmt.Errorf("Failed to init '%s' exec storage. Error: %v ", name, err)
+	}
+
+	return &Exec{
+		name:   name,
+		helper: &helper{opts: opts},
+	}, nil
+}
+
+func (e *Exec) Configure(p Params) {
+	e.backupPath = path.Join("/", p.BackupPath)
+	e.tmpDir = p.TmpDir
+	e.rotateEnabled = p.RotateEnabled
+	e.Retention = p.Retention
+	e.cipher = p.Cipher
+}
+
+func (e *Exec) IsLocal() int { return 0 }
+
+func (e *Exec) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFile, ofs, bakType string) error {
+	var bakRemPaths, mtdRemPaths []string
+
+	if bakType == string(misc.IncFiles) {
+		bakRemPaths, mtdRemPaths = GetIncBackupDstList(tmpBackupFile, ofs, e.backupPath)
+	} else {
+		bakRemPaths = GetDescBackupDstList(tmpBackupFile, ofs, e.backupPath, e.Retention)
+	}
+
+	if err := e.putFile(logCh, jobName, tmpBackupFile+".inc", mtdRemPaths); err != nil {
+		return err
+	}
+	if err := e.putFile(logCh, jobName, tmpBackupFile, bakRemPaths); err != nil {
+		return err
+	}
+	return e.putFile(logCh, jobName, tmpBackupFile+checksum.Ext, GetChecksumDstList(tmpBackupFile, bakRemPaths))
+}
+
+// putFile uploads the local file to every of remote paths
+func (e *Exec) putFile(logCh chan logger.LogRecord, jobName, srcPath string, dstPaths []string) error {
+	if len(dstPaths) == 0 {
+		return nil
+	}
+
+	for _, dstPath := range dstPaths {
+		if _, err := e.helper.call(request{Op: "mkdir", Path: path.Dir(dstPath)}); err != nil {
+			logCh <- logger.Log(jobName, e.name).Errorf("Unable to create remote directory '%s': '%s'", path.Dir(dstPath), err)
+			return err
+		}
+		if _, err := e.helper.call(request{Op: "put", Path: dstPath, File: srcPath}); err != nil {
+			logCh <- logger.Log(jobName, e.name).Errorf("Unable to upload file '%s': %s", dstPath, err)
+			return err
+		}
+		logCh <- logger.Log(jobName, e.name).Infof("File %s successfully uploaded", dstPath)
+	}
+
+	return nil
+}
+
+func (e *Exec) DeleteOldBackups(logCh chan logger.LogRecord, ofs string, job interfaces.Job, full bool) error {
+	if !e.rotateEnabled {
+		logCh <- logger.Log(job.GetName(), e.name).Debugf("Backup rotate skipped by config.")
+		return nil
+	}
+
+	remFiles, err := e.list(path.Join(e.backupPath, ofs))
+	if err != nil {
+		logCh <- logger.Log(job.GetName(), e.name).Errorf("Failed to list files: '%s'", err)
+		return err
+	}
+
+	pins, err := LoadPins(job.GetCatalog(), job.GetName(), ofs, e.name)
+	if err != nil {
+		logCh <- logger.Log(job.GetName(), e.name).Errorf("Backup rotate skipped. Failed to read pinned backups: %s", err)
+		return err
+	}
+
+	toDelete, rules := e.SelectRotated(logCh, RotationTarget{
+		JobName:   job.GetName(),
+		Storage:   e.name,
+		BackupDir: path.Join(e.backupPath, ofs),
+		Inc:       job.GetType() == misc.IncFiles,
+		Full:      full,
+		Safety:    job.IsBackupSafety(),
+	}, remFiles, pins)
+
+	if e.IsDryRun() {
+		for _, f := range toDelete {
+			e.Planned(RotationAction{Job: job.GetName(), Storage: e.name, Target: ofs, Path: f.Name, RotationRule: rules[f.Name]})
+		}
+		return nil
+	}
+
+	var errs *multierror.Error
+	for _, f := range toDelete {
+		if _, err = e.helper.call(request{Op: "delete", Path: f.Name}); err != nil {
+			logCh <- logger.Log(job.GetName(), e.name).Errorf("Failed to delete file '%s' with next error: %s", f.Name, err)
+			errs = multierror.Append(errs, err)
+		} else {
+			logCh <- logger.Log(job.GetName(), e.name).Infof("Deleted old backup file '%s'", f.Name)
+		}
+	}
+
+	return errs.ErrorOrNil()
+}
+
+func (e *Exec) list(dir string) ([]RemoteFile, error) {
+	resp, err := e.helper.call(request{Op: "list", Path: dir})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]RemoteFile, 0, len(resp.Files))
+	for _, f := range resp.Files {
+		files = append(files, RemoteFile{Name: f.Path, ModTime: f.ModTime})
+	}
+	return files, nil
+}
+
+func (e *Exec) GetFileReader(ofsPath string) (io.ReadCloser, error) {
+	tmp, err := e.createTemp()
+	if err != nil {
+		return nil, err
+	}
+	_ = tmp.Close()
+
+	if _, err = e.helper.call(request{Op: "get", Path: path.Join(e.backupPath, ofsPath), File: tmp.Name()}); err != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return e.cipher.DecryptReadCloser(&tmpFileReader{File: f})
+}
+
+// createTemp creates the file the helper exchanges the data with in the job temp dir
+func (e *Exec) createTemp() (*os.File, error) {
+	if e.tmpDir != "" {
+		if err := os.MkdirAll(e.tmpDir, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	return os.CreateTemp(e.tmpDir, "nxs-backup-exec-")
+}
+
+// PutFile uploads the file copied from another storage as is. The helper reads local files only, so the file is saved to the temp one first.
+func (e *Exec) PutFile(logCh chan logger.LogRecord, jobName, _, _, ofsPath string, src io.Reader) error {
+	tmp, err := e.createTemp()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	_, err = io.Copy(tmp, src)
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		logCh <- logger.Log(jobName, e.name).Errorf("Unable to write temp file: %s", err)
+		return err
+	}
+
+	return e.putFile(logCh, jobName, tmp.Name(), []string{path.Join(e.backupPath, ofsPath)})
+}
+
+func (e *Exec) DeleteFile(ofsPath string) error {
+	_, err := e.helper.call(request{Op: "delete", Path: path.Join(e.backupPath, ofsPath)})
+	return err
+}
+
+func (e *Exec) ListBackups(ofsPath string) ([]string, error) {
+	remFiles, err := e.list(path.Join(e.backupPath, ofsPath))
+	if err != nil {
+		return nil, err
+	}
+
+	fList := make([]string, 0, len(remFiles))
+	for _, f := range remFiles {
+		fList = append(fList, f.Name)
+	}
+	return fList, nil
+}
+
+func (e *Exec) Close() error {
+	return e.helper.stop()
+}
+
+func (e *Exec) Clone() interfaces.Storage {
+	cl := *e
+	return &cl
+}
+
+func (e *Exec) GetName() string {
+	return e.name
+}
+
+// call sends the request to the helper and waits for the response. The helper is started on the first call.
+// The helper is killed if the response isn't got within the request timeout, zero timeout disables it.
+func (h *helper) call(req request) (response, error) {
+	var resp response
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.cmd == nil {
+		if err := h.start(); err != nil {
+			return resp, fmt.Errorf("failed to start helper: %w", err)
+		}
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+
+	// killed helper closes its stdout, so the blocked read below returns
+	var timer *time.Timer
+	if h.opts.RequestTimeout > 0 {
+		process := h.cmd.Process
+		timer = time.AfterFunc(h.opts.RequestTimeout*time.Second, func() { _ = process.Kill() })
+	}
+
+	if _, err = h.stdin.Write(append(data, '\n')); err == nil {
+		var line []byte
+		if line, err = h.stdout.ReadBytes('\n'); err == nil {
+			err = json.Unmarshal(line, &resp)
+		}
+	}
+	if timer != nil && !timer.Stop() {
+		h.kill()
+		return resp, fmt.Errorf("helper didn't respond to `%s` request within %s and was killed", req.Op, h.opts.RequestTimeout*time.Second)
+	}
+	if err != nil {
+		h.kill()
+		return resp, fmt.Errorf("failed `%s` request to helper: %w", req.Op, err)
+	}
+
+	if resp.Error != "" {
+		err = errors.New(resp.Error)
+		if resp.NotFound {
+			err = fmt.Errorf("%w: %s", fs.ErrNotExist, resp.Error)
+		}
+		return resp, err
+	}
+
+	return resp, nil
+}
+
+func (h *helper) start() error {
+	cmd := exec.Command(h.opts.Command, h.opts.Args...)
+	cmd.Env = append(os.Environ(), h.opts.Env...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	h.cmd = cmd
+	h.stdin = stdin
+	h.stdout = bufio.NewReader(stdout)
+
+	return nil
+}
+
+// kill stops the helper after a protocol failure, it is restarted by the next call
+func (h *helper) kill() {
+	_ = h.cmd.Process.Kill()
+	_ = h.cmd.Wait()
+	h.cmd = nil
+}
+
+// stop closes the helper stdin and waits for its exit
+func (h *helper) stop() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.cmd == nil {
+		return nil
+	}
+
+	_ = h.stdin.Close()
+	err := h.cmd.Wait()
+	h.cmd = nil
+
+	return err
+}
+
+// tmpFileReader reads the file got by the helper and removes it on close
+type tmpFileReader struct {
+	*os.File
+}
+
+func (r *tmpFileReader) Close() error {
+	err := r.File.Close()
+	_ = os.Remove(r.Name())
+	return err
+}
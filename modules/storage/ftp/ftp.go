@@ -1,7 +1,7 @@
 package ftp
 
 import (
-	"bytes"
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
@@ -19,19 +19,34 @@ import (
 
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backend/files"
 	"github.com/nixys/nxs-backup/modules/logger"
 	. "github.com/nixys/nxs-backup/modules/storage"
 )
 
+// bufResponse reads the data of the response peeked into the buffer
+type bufResponse struct {
+	*bufio.Reader
+	resp *ftp.Response
+}
+
+func (r *bufResponse) Close() error {
+	return r.resp.Close()
+}
+
 type FTP struct {
 	conn          *ftp.ServerConn
 	name          string
 	backupPath    string
 	rateLimit     int64
 	rotateEnabled bool
+	cipher        *crypt.Cipher
 	opts          Opts
+	resume        bool
 	Retention
+	DryRun
 }
 
 type Opts struct {
@@ -64,6 +79,7 @@ func (f *FTP) Configure(p Params) {
 	f.rateLimit = p.RateLimit
 	f.rotateEnabled = p.RotateEnabled
 	f.Retention = p.Retention
+	f.cipher = p.Cipher
 }
 
 func (f *FTP) updateConn() error {
@@ -96,6 +112,8 @@ func (f *FTP) updateConn() error {
 
 func (f *FTP) IsLocal() int { return 0 }
 
+func (f *FTP) SetResume(resume bool) { f.resume = resume }
+
 func (f *FTP) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFile, ofs string, bakType string) error {
 	var bakRemPaths, mtdRemPaths []string
 
@@ -119,10 +137,27 @@ func (f *FTP) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFile
 		}
 	}
 
+	for _, dstPath := range GetChecksumDstList(tmpBackupFile, bakRemPaths) {
+		if err := f.copy(logCh, jobName, dstPath, tmpBackupFile+checksum.Ext); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (f *FTP) copy(logCh chan logger.LogRecord, job, dst, src string) error {
+	srcFile, err := files.GetLimitedFileReader(src, f.rateLimit)
+	if err != nil {
+		logCh <- logger.Log(job, f.name).Errorf("Unable to open file: '%s'", err)
+		return err
+	}
+	defer func() { _ = srcFile.Close() }()
+
+	return f.upload(logCh, job, dst, srcFile)
+}
+
+func (f *FTP) upload(logCh chan logger.LogRecord, job, dst string, srcFile io.Reader) error {
 
 	// Make remote directories
 	dstDir := path.Dir(dst)
@@ -131,17 +166,39 @@ func (f *FTP) copy(logCh chan logger.LogRecord, job, dst, src string) error {
 		return err
 	}
 
-	srcFile, err := files.GetLimitedFileReader(src, f.rateLimit)
+	err := f.updateConn()
 	if err != nil {
-		logCh <- logger.Log(job, f.name).Errorf("Unable to open file: '%s'", err)
 		return err
 	}
-	defer func() { _ = srcFile.Close() }()
 
-	if err = f.updateConn(); err != nil {
-		return err
+	// the partial file is kept on failure, so the upload can be resumed with REST command
+	var (
+		offset int64
+		done   bool
+	)
+	partDst := dst + PartExt
+	if f.resume && Resumable(dst) {
+		if offset, done, err = ResumeOffset(srcFile, f.fileSize(partDst), f.fileSize(dst)); err != nil {
+			logCh <- logger.Log(job, f.name).Errorf("Unable to resume upload of file '%s'. Err: %s", dst, err)
+			return err
+		}
+		if done {
+			logCh <- logger.Log(job, f.name).Infof("File '%s' was uploaded by previous attempt", dst)
+			return nil
+		}
+	}
+
+	if offset > 0 {
+		logCh <- logger.Log(job, f.name).Infof("Resuming upload of file '%s' from %d bytes", dst, offset)
+		err = f.conn.StorFrom(partDst, srcFile, uint64(offset))
+	} else {
+		err = f.conn.Stor(partDst, srcFile)
+	}
+	if err == nil {
+		// FTP servers differ in whether RNTO replaces the existing file
+		_ = f.conn.Delete(dst)
+		err = f.conn.Rename(partDst, dst)
 	}
-	err = f.conn.Stor(dst, srcFile)
 	if err != nil {
 		logCh <- logger.Log(job, f.name).Errorf("Unable to upload file '%s'. Err: %s", dst, err)
 		return err
@@ -151,6 +208,15 @@ func (f *FTP) copy(logCh chan logger.LogRecord, job, dst, src string) error {
 	return nil
 }
 
+// fileSize returns the size of the remote file or -1 if it can't be got
+func (f *FTP) fileSize(p string) int64 {
+	size, err := f.conn.FileSize(p)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
 func (f *FTP) DeleteOldBackups(logCh chan logger.LogRecord, ofsPart string, job interfaces.Job, full bool) error {
 	if !f.rotateEnabled {
 		logCh <- logger.Log(job.GetName(), f.name).Debugf("Backup rotate skipped by config.")
@@ -161,14 +227,24 @@ func (f *FTP) DeleteOldBackups(logCh chan logger.LogRecord, ofsPart string, job
 		return err
 	}
 
+	if !f.IsDryRun() {
+		f.deleteStaleParts(logCh, job.GetName(), ofsPart)
+	}
+
+	pins, err := LoadPins(job.GetCatalog(), job.GetName(), ofsPart, f.name)
+	if err != nil {
+		logCh <- logger.Log(job.GetName(), f.name).Errorf("Backup rotate skipped. Failed to read pinned backups: %s", err)
+		return err
+	}
+
 	if job.GetType() == misc.IncFiles {
-		return f.deleteIncBackup(logCh, job.GetName(), ofsPart, full)
+		return f.deleteIncBackup(logCh, job.GetName(), ofsPart, full, pins)
 	} else {
-		return f.deleteDescBackup(logCh, job.GetName(), ofsPart, job.IsBackupSafety())
+		return f.deleteDescBackup(logCh, job.GetName(), ofsPart, job.IsBackupSafety(), pins)
 	}
 }
 
-func (f *FTP) deleteDescBackup(logCh chan logger.LogRecord, job, ofsPart string, safety bool) error {
+func (f *FTP) deleteDescBackup(logCh chan logger.LogRecord, job, ofsPart string, safety bool, pins *Pins) error {
 	var errs *multierror.Error
 
 	for _, p := range RetentionPeriodsList {
@@ -192,7 +268,17 @@ func (f *FTP) deleteDescBackup(logCh chan logger.LogRecord, job, ofsPart string,
 			return err
 		}
 
+		fptFiles, _ = SplitPartFiles(fptFiles, func(f *ftp.Entry) string { return f.Name })
+
+		var pinned []*ftp.Entry
+		fptFiles, pinned = SplitPinned(fptFiles, pins, func(f *ftp.Entry) string { return f.Name })
+		for _, file := range pinned {
+			logCh <- logger.Log(job, f.name).Debugf("Backup file '%s' is pinned. Skipping rotate.", path.Join(bakDir, file.Name))
+		}
+
 		if f.Retention.UseCount {
+			var sums []*ftp.Entry
+			fptFiles, sums = SplitChecksums(fptFiles, func(f *ftp.Entry) string { return f.Name })
 			sort.Slice(fptFiles, func(i, j int) bool {
 				return fptFiles[i].Time.Before(fptFiles[j].Time)
 			})
@@ -204,6 +290,7 @@ func (f *FTP) deleteDescBackup(logCh chan logger.LogRecord, job, ofsPart string,
 			} else {
 				fptFiles = fptFiles[:0]
 			}
+			fptFiles = AppendChecksums(fptFiles, sums, func(f *ftp.Entry) string { return f.Name })
 		} else {
 			i := 0
 			for _, file := range fptFiles {
@@ -219,11 +306,16 @@ func (f *FTP) deleteDescBackup(logCh chan logger.LogRecord, job, ofsPart string,
 			fptFiles = fptFiles[:i]
 		}
 
+		rule := f.Rule(p, retentionCount, retentionDate)
 		for _, file := range fptFiles {
 			if file.Name == ".." || file.Name == "." {
 				continue
 			}
 
+			if f.Planned(RotationAction{Job: job, Storage: f.name, Target: ofsPart, Path: path.Join(bakDir, file.Name), RotationRule: rule}) {
+				continue
+			}
+
 			if err = f.updateConn(); err != nil {
 				return err
 			}
@@ -241,7 +333,27 @@ func (f *FTP) deleteDescBackup(logCh chan logger.LogRecord, job, ofsPart string,
 	return errs.ErrorOrNil()
 }
 
-func (f *FTP) deleteIncBackup(logCh chan logger.LogRecord, job, ofsPart string, full bool) error {
+// deleteStaleParts deletes files left by interrupted uploads
+func (f *FTP) deleteStaleParts(logCh chan logger.LogRecord, job, ofsPart string) {
+	paths, err := f.listAll(ofsPart)
+	if err != nil {
+		return
+	}
+
+	_, parts := SplitPartFiles(paths, func(p string) string { return p })
+	for _, p := range parts {
+		if err = f.updateConn(); err != nil {
+			return
+		}
+		if err = f.conn.Delete(p); err != nil {
+			logCh <- logger.Log(job, f.name).Warnf("Failed to delete stale partial upload '%s': %s", p, err)
+		} else {
+			logCh <- logger.Log(job, f.name).Infof("Deleted stale partial upload '%s'", p)
+		}
+	}
+}
+
+func (f *FTP) deleteIncBackup(logCh chan logger.LogRecord, job, ofsPart string, full bool, pins *Pins) error {
 	var errs *multierror.Error
 
 	if err := f.updateConn(); err != nil {
@@ -249,6 +361,10 @@ func (f *FTP) deleteIncBackup(logCh chan logger.LogRecord, job, ofsPart string,
 	}
 	if full {
 		backupDir := path.Join(f.backupPath, ofsPart)
+		if pins.Holds(backupDir) {
+			logCh <- logger.Log(job, f.name).Warnf("Directory '%s' contains pinned backups. Skipping delete.", backupDir)
+			return nil
+		}
 
 		if err := f.conn.ChangeDir(backupDir); err != nil {
 			protoErr := err.(*textproto.Error)
@@ -289,6 +405,13 @@ func (f *FTP) deleteIncBackup(logCh chan logger.LogRecord, job, ofsPart string,
 				dirParts := strings.Split(dir.Name, "_")
 				dirMonth, _ := strconv.Atoi(dirParts[1])
 				if dirMonth < lastMonth {
+					if pins.Holds(path.Join(backupDir, dir.Name)) {
+						logCh <- logger.Log(job, f.name).Infof("Backup '%s' in directory '%s' contains pinned backups. Skipping delete.", dir.Name, backupDir)
+						continue
+					}
+					if f.Planned(RotationAction{Job: job, Storage: f.name, Target: ofsPart, Path: path.Join(backupDir, dir.Name), RotationRule: IncRule(year, lastMonth)}) {
+						continue
+					}
 					if err = f.conn.RemoveDirRecur(path.Join(backupDir, dir.Name)); err != nil {
 						logCh <- logger.Log(job, f.name).Errorf("Failed to delete '%s' in dir '%s' with next error: %s",
 							dir.Name, backupDir, err)
@@ -331,7 +454,9 @@ func (f *FTP) mkDir(dstPath string) error {
 	return f.conn.MakeDir(dstPath)
 }
 
-func (f *FTP) GetFileReader(ofsPath string) (io.Reader, error) {
+// GetFileReader returns the reader of the file streamed over the storage connection,
+// it has to be closed before the next operation with the storage
+func (f *FTP) GetFileReader(ofsPath string) (io.ReadCloser, error) {
 	if err := f.updateConn(); err != nil {
 		return nil, err
 	}
@@ -351,21 +476,56 @@ func (f *FTP) GetFileReader(ofsPath string) (io.Reader, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = r.Close() }()
 
-	buf, err := io.ReadAll(r)
-	if err != nil {
-		return nil, err
-	}
 	// some ftp servers returns empty reader without error if file doesn't exist
-	if len(buf) == 0 {
+	br := bufio.NewReader(r)
+	if _, err = br.Peek(1); err != nil {
+		_ = r.Close()
 		return nil, errors.New("File empty or doesn't exist ")
 	}
 
-	return bytes.NewReader(buf), nil
+	return f.cipher.DecryptReadCloser(&bufResponse{Reader: br, resp: r})
+}
+
+// PutFile uploads the file copied from another storage as is
+func (f *FTP) PutFile(logCh chan logger.LogRecord, jobName, _, _, ofsPath string, src io.Reader) error {
+	return f.upload(logCh, jobName, path.Join(f.backupPath, ofsPath), files.GetLimitedReader(src, f.rateLimit))
+}
+
+func (f *FTP) DeleteFile(ofsPath string) error {
+	if err := f.updateConn(); err != nil {
+		return err
+	}
+	return f.conn.Delete(path.Join(f.backupPath, ofsPath))
+}
+
+// DeleteDir removes the empty dir
+func (f *FTP) DeleteDir(ofsPath string) error {
+	if err := f.updateConn(); err != nil {
+		return err
+	}
+	return f.conn.RemoveDir(path.Join(f.backupPath, ofsPath))
+}
+
+func (f *FTP) FileSize(ofsPath string) (int64, error) {
+	if err := f.updateConn(); err != nil {
+		return 0, err
+	}
+	return f.conn.FileSize(path.Join(f.backupPath, ofsPath))
 }
 
 func (f *FTP) ListBackups(ofsPath string) ([]string, error) {
+	paths, err := f.listAll(ofsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, _ = SplitPartFiles(paths, func(p string) string { return p })
+	return paths, nil
+}
+
+// listAll returns all files under the path including incomplete uploads
+func (f *FTP) listAll(ofsPath string) ([]string, error) {
 	bPath := path.Join(f.backupPath, ofsPath)
 
 	fl, err := f.listFiles(bPath)
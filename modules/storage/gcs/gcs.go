@@ -0,0 +1,361 @@
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/hashicorp/go-multierror"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"github.com/nixys/nxs-backup/interfaces"
+	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
+	"github.com/nixys/nxs-backup/modules/backend/files"
+	"github.com/nixys/nxs-backup/modules/logger"
+	. "github.com/nixys/nxs-backup/modules/storage"
+)
+
+const (
+	// uploadChunkSize is the size of resumable upload chunks, failed chunks are retried by the client
+	uploadChunkSize = 16 << 20
+	// batchSize is the max number of objects deleted in parallel
+	batchSize = 100
+)
+
+type GCS struct {
+	client        *storage.Client
+	bucket        *storage.BucketHandle
+	name          string
+	bucketName    string
+	backupPath    string
+	rateLimit     int64
+	rotateEnabled bool
+	cipher        *crypt.Cipher
+	batchDeletion bool
+	Retention
+	DryRun
+}
+
+type Opts struct {
+	BucketName      string
+	CredentialsFile string
+	Endpoint        string
+	BatchDeletion   bool
+}
+
+func Init(name string, opts Opts, rl int64) (*GCS, error) {
+	var clientOpts []option.ClientOption
+
+	if opts.CredentialsFile != "" {
+		clientOpts = append(clientOpts, option.WithCredentialsFile(opts.CredentialsFile))
+	}
+	if opts.Endpoint != "" {
+		clientOpts = append(clientOpts, option.WithEndpoint(strings.TrimSuffix(opts.Endpoint, "/")+"/storage/v1/"))
+		if opts.CredentialsFile == "" {
+			clientOpts = append(clientOpts, option.WithoutAuthentication())
+		}
+	}
+
+	client, err := storage.NewClient(context.Background(), clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to init '%s' GCS storage. Error: %v ", name, err)
+	}
+
+	bucket := client.Bucket(opts.BucketName)
+	if _, err = bucket.Attrs(context.Background()); err != nil {
+		if errors.Is(err, storage.ErrBucketNotExist) {
+			return nil, fmt.Errorf("Bucket '%s' doesn't exist. ", opts.BucketName)
+		}
+		return nil, fmt.Errorf("Failed to check bucket exist in GCS storage '%s'. Error: %v ", name, err)
+	}
+
+	return &GCS{
+		name:          name,
+		client:        client,
+		bucket:        bucket,
+		bucketName:    opts.BucketName,
+		batchDeletion: opts.BatchDeletion,
+		rateLimit:     rl,
+	}, nil
+}
+
+func (g *GCS) Configure(p Params) {
+	g.backupPath = strings.TrimPrefix(p.BackupPath, "/")
+	g.rateLimit = p.RateLimit
+	g.rotateEnabled = p.RotateEnabled
+	g.Retention = p.Retention
+	g.cipher = p.Cipher
+}
+
+func (g *GCS) IsLocal() int { return 0 }
+
+func (g *GCS) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFile, ofs, bakType string) error {
+	var bakRemPaths, mtdRemPaths []string
+
+	if bakType == string(misc.IncFiles) {
+		bakRemPaths, mtdRemPaths = GetIncBackupDstList(tmpBackupFile, ofs, g.backupPath)
+	} else {
+		bakRemPaths = GetDescBackupDstList(tmpBackupFile, ofs, g.backupPath, g.Retention)
+	}
+
+	if len(mtdRemPaths) > 0 {
+		if err := g.uploadFile(logCh, jobName, tmpBackupFile+".inc", mtdRemPaths); err != nil {
+			return err
+		}
+	}
+
+	if err := g.uploadFile(logCh, jobName, tmpBackupFile, bakRemPaths); err != nil {
+		return err
+	}
+
+	return g.uploadFile(logCh, jobName, tmpBackupFile+checksum.Ext, GetChecksumDstList(tmpBackupFile, bakRemPaths))
+}
+
+func (g *GCS) DeliveryBackupStream(logCh chan logger.LogRecord, jobName, tmpBackupFile, ofs, bakType string, src io.Reader) error {
+	bakRemPaths := GetDescBackupDstList(tmpBackupFile, ofs, g.backupPath, g.Retention)
+	if len(bakRemPaths) == 0 {
+		return nil
+	}
+
+	// the object is created only after the upload is finalized, so the failed stream doesn't leave a partial object
+	objPath := bakRemPaths[0]
+	if err := g.upload(logCh, jobName, files.GetLimitedReader(src, g.rateLimit), objPath); err != nil {
+		return err
+	}
+
+	// other copies are made on the server side, since the stream can't be read twice
+	for _, dstPath := range bakRemPaths[1:] {
+		if _, err := g.bucket.Object(dstPath).CopierFrom(g.bucket.Object(objPath)).Run(context.Background()); err != nil {
+			logCh <- logger.Log(jobName, g.name).Errorf("Failed to copy object '%s' to '%s' in bucket %s. Error: %v", objPath, dstPath, g.bucketName, err)
+			return err
+		}
+		logCh <- logger.Log(jobName, g.name).Infof("Successfully copied object '%s' to '%s' in bucket %s", objPath, dstPath, g.bucketName)
+	}
+
+	return g.uploadFile(logCh, jobName, tmpBackupFile+checksum.Ext, GetChecksumDstList(tmpBackupFile, bakRemPaths))
+}
+
+// uploadFile uploads the local file to every of object paths
+func (g *GCS) uploadFile(logCh chan logger.LogRecord, jobName, srcPath string, objPaths []string) error {
+	if len(objPaths) == 0 {
+		return nil
+	}
+
+	source, err := files.GetLimitedFileReader(srcPath, g.rateLimit)
+	if err != nil {
+		logCh <- logger.Log(jobName, g.name).Errorf("Unable to open '%s'", err)
+		return err
+	}
+	defer func() { _ = source.Close() }()
+
+	for _, objPath := range objPaths {
+		if _, err = source.Seek(0, io.SeekStart); err != nil {
+			logCh <- logger.Log(jobName, g.name).Errorf("Failed to reset file reader to start. Error: %v", err)
+			return err
+		}
+		if err = g.upload(logCh, jobName, source, objPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// upload writes the object with the resumable upload
+func (g *GCS) upload(logCh chan logger.LogRecord, jobName string, src io.Reader, objPath string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := g.bucket.Object(objPath).NewWriter(ctx)
+	w.ChunkSize = uploadChunkSize
+	w.ContentType = "application/octet-stream"
+
+	_, err := io.Copy(w, src)
+	if err != nil {
+		// cancel the upload, so the object isn't created
+		cancel()
+		_ = w.Close()
+	} else {
+		err = w.Close()
+	}
+	if err != nil {
+		logCh <- logger.Log(jobName, g.name).Errorf("Failed to upload object '%s' to bucket %s. Error: %v", objPath, g.bucketName, err)
+		return err
+	}
+
+	logCh <- logger.Log(jobName, g.name).Infof("Successfully uploaded object '%s' to bucket %s", objPath, g.bucketName)
+	return nil
+}
+
+func (g *GCS) DeleteOldBackups(logCh chan logger.LogRecord, ofs string, job interfaces.Job, full bool) error {
+	if !g.rotateEnabled {
+		logCh <- logger.Log(job.GetName(), g.name).Debugf("Backup rotate skipped by config.")
+		return nil
+	}
+
+	objects, err := g.listObjects(path.Join(g.backupPath, ofs))
+	if err != nil {
+		logCh <- logger.Log(job.GetName(), g.name).Errorf("Failed get objects: '%s'", err)
+		return err
+	}
+
+	pins, err := LoadPins(job.GetCatalog(), job.GetName(), ofs, g.name)
+	if err != nil {
+		logCh <- logger.Log(job.GetName(), g.name).Errorf("Backup rotate skipped. Failed to read pinned backups: %s", err)
+		return err
+	}
+
+	toDelete, rules := g.SelectRotated(logCh, RotationTarget{
+		JobName:   job.GetName(),
+		Storage:   g.name,
+		BackupDir: path.Join(g.backupPath, ofs),
+		Inc:       job.GetType() == misc.IncFiles,
+		Full:      full,
+		Safety:    job.IsBackupSafety(),
+	}, objects, pins)
+
+	if g.IsDryRun() {
+		for _, o := range toDelete {
+			g.Planned(RotationAction{Job: job.GetName(), Storage: g.name, Target: ofs, Path: o.Name, RotationRule: rules[o.Name]})
+		}
+		return nil
+	}
+
+	for _, o := range toDelete {
+		logCh <- logger.Log(job.GetName(), g.name).Infof("Object '%s' going to be deleted", o.Name)
+	}
+
+	if !g.batchDeletion {
+		var errs *multierror.Error
+		for _, o := range toDelete {
+			if err = g.bucket.Object(o.Name).Delete(context.Background()); err != nil {
+				logCh <- logger.Log(job.GetName(), g.name).Errorf("Error detected during single object deletion: '%s'", err)
+				errs = multierror.Append(errs, err)
+			}
+		}
+		return errs.ErrorOrNil()
+	}
+
+	return g.deleteBatch(logCh, job.GetName(), toDelete)
+}
+
+// deleteBatch deletes objects in parallel by batches
+func (g *GCS) deleteBatch(logCh chan logger.LogRecord, jobName string, objects []RemoteFile) error {
+	var (
+		mu   sync.Mutex
+		errs *multierror.Error
+	)
+
+	for start := 0; start < len(objects); start += batchSize {
+		var wg sync.WaitGroup
+		for _, o := range objects[start:min(start+batchSize, len(objects))] {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				if err := g.bucket.Object(name).Delete(context.Background()); err != nil {
+					mu.Lock()
+					errs = multierror.Append(errs, err)
+					mu.Unlock()
+				}
+			}(o.Name)
+		}
+		wg.Wait()
+	}
+
+	if errs != nil {
+		logCh <- logger.Log(jobName, g.name).Errorf("Error detected during multiple objects deletion: '%s'", errs)
+	}
+	return errs.ErrorOrNil()
+}
+
+// listObjects returns all objects stored under the dir
+func (g *GCS) listObjects(dir string) ([]RemoteFile, error) {
+	var objects []RemoteFile
+
+	it := g.bucket.Objects(context.Background(), &storage.Query{Prefix: dir + "/"})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, RemoteFile{Name: attrs.Name, ModTime: attrs.Updated})
+	}
+
+	return objects, nil
+}
+
+func (g *GCS) GetFileReader(ofsPath string) (io.ReadCloser, error) {
+	r, err := g.bucket.Object(path.Join(g.backupPath, ofsPath)).NewReader(context.Background())
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			err = fs.ErrNotExist
+		}
+		return nil, err
+	}
+
+	return g.cipher.DecryptReadCloser(r)
+}
+
+// PutLink makes the copy of the backup synced from another storage as the server side copy of the one already synced
+func (g *GCS) PutLink(logCh chan logger.LogRecord, jobName, _, _, ofsPath, targetOfsPath string) error {
+	srcPath := path.Join(g.backupPath, targetOfsPath)
+	dstPath := path.Join(g.backupPath, ofsPath)
+	if _, err := g.bucket.Object(dstPath).CopierFrom(g.bucket.Object(srcPath)).Run(context.Background()); err != nil {
+		logCh <- logger.Log(jobName, g.name).Errorf("Failed to copy object '%s' to '%s' in bucket %s. Error: %v", srcPath, dstPath, g.bucketName, err)
+		return err
+	}
+	logCh <- logger.Log(jobName, g.name).Infof("Successfully copied object '%s' to '%s' in bucket %s", srcPath, dstPath, g.bucketName)
+
+	return nil
+}
+
+// PutFile uploads the file copied from another storage as is
+func (g *GCS) PutFile(logCh chan logger.LogRecord, jobName, _, _, ofsPath string, src io.Reader) error {
+	return g.upload(logCh, jobName, files.GetLimitedReader(src, g.rateLimit), path.Join(g.backupPath, ofsPath))
+}
+
+func (g *GCS) DeleteFile(ofsPath string) error {
+	err := g.bucket.Object(path.Join(g.backupPath, ofsPath)).Delete(context.Background())
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return fs.ErrNotExist
+	}
+	return err
+}
+
+func (g *GCS) ListBackups(ofsPath string) ([]string, error) {
+	objects, err := g.listObjects(path.Join(g.backupPath, ofsPath))
+	if err != nil {
+		return nil, err
+	}
+
+	fList := make([]string, 0, len(objects))
+	for _, o := range objects {
+		fList = append(fList, o.Name)
+	}
+	return fList, nil
+}
+
+func (g *GCS) Close() error {
+	return nil
+}
+
+func (g *GCS) Clone() interfaces.Storage {
+	cl := *g
+	return &cl
+}
+
+func (g *GCS) GetName() string {
+	return g.name
+}
@@ -17,6 +17,8 @@ import (
 
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backend/files"
 	"github.com/nixys/nxs-backup/modules/logger"
 	. "github.com/nixys/nxs-backup/modules/storage"
@@ -26,7 +28,9 @@ type Local struct {
 	backupPath    string
 	rateLimit     int64
 	rotateEnabled bool
+	cipher        *crypt.Cipher
 	Retention
+	DryRun
 }
 
 func Init(rl int64) *Local {
@@ -40,6 +44,7 @@ func (l *Local) Configure(p Params) {
 	l.rateLimit = p.RateLimit
 	l.rotateEnabled = p.RotateEnabled
 	l.Retention = p.Retention
+	l.cipher = p.Cipher
 }
 
 func (l *Local) IsLocal() int { return 1 }
@@ -97,8 +102,44 @@ func (l *Local) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFi
 		logCh <- logger.Log(jobName, l.GetName()).Infof("Successfully moved temp backup to %s", bakDstPath)
 	}
 
+	return l.deliveryLinks(logCh, jobName, tmpBackupFile, bakDstPath, links)
+}
+
+func (l *Local) DeliveryBackupStream(logCh chan logger.LogRecord, jobName, tmpBackupFile, ofs, bakType string, src io.Reader) error {
+	bakDstPath, links, err := GetDescBackupDstAndLinks(tmpBackupFile, ofs, l.backupPath, l.Retention)
+	if err != nil {
+		logCh <- logger.Log(jobName, l.GetName()).Errorf("Unable to get destination path and links: '%s'", err)
+		return err
+	}
+
+	if err = os.MkdirAll(path.Dir(bakDstPath), os.ModePerm); err != nil {
+		logCh <- logger.Log(jobName, l.GetName()).Errorf("Unable to create directory: '%s'", err)
+		return err
+	}
+
+	bakDst, err := files.GetLimitedFileWriter(bakDstPath, l.rateLimit)
+	if err != nil {
+		logCh <- logger.Log(jobName, l.GetName()).Errorf("Unable to create backup file: '%s'", err)
+		return err
+	}
+	_, err = io.Copy(bakDst, src)
+	if cErr := bakDst.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		// partial backup is useless
+		_ = os.Remove(bakDstPath)
+		logCh <- logger.Log(jobName, l.GetName()).Errorf("Unable to save backup stream: %s", err)
+		return err
+	}
+	logCh <- logger.Log(jobName, l.GetName()).Infof("Successfully saved backup stream to %s", bakDstPath)
+
+	return l.deliveryLinks(logCh, jobName, tmpBackupFile, bakDstPath, links)
+}
+
+func (l *Local) deliveryLinks(logCh chan logger.LogRecord, jobName, tmpBackupFile, bakDstPath string, links map[string]string) error {
 	for dst, src := range links {
-		err = os.MkdirAll(path.Dir(dst), os.ModePerm)
+		err := os.MkdirAll(path.Dir(dst), os.ModePerm)
 		if err != nil {
 			logCh <- logger.Log(jobName, l.GetName()).Errorf("Unable to create directory: '%s'", err)
 			return err
@@ -110,7 +151,34 @@ func (l *Local) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFi
 		logCh <- logger.Log(jobName, l.GetName()).Infof("Successfully created symlink %s", dst)
 	}
 
-	return
+	if sumDst, sumLinks := GetChecksumDstAndLinks(tmpBackupFile, bakDstPath, links); sumDst != "" {
+		return l.deliveryChecksum(logCh, jobName, tmpBackupFile, sumDst, sumLinks)
+	}
+
+	return nil
+}
+
+func (l *Local) deliveryChecksum(logCh chan logger.LogRecord, jobName, tmpBackupFile, sumDst string, sumLinks map[string]string) error {
+	sum, err := os.ReadFile(tmpBackupFile + checksum.Ext)
+	if err != nil {
+		logCh <- logger.Log(jobName, l.GetName()).Errorf("Unable to read checksum manifest: '%s'", err)
+		return err
+	}
+	if err = os.WriteFile(sumDst, sum, 0644); err != nil {
+		logCh <- logger.Log(jobName, l.GetName()).Errorf("Unable to write checksum manifest: '%s'", err)
+		return err
+	}
+	logCh <- logger.Log(jobName, l.GetName()).Debugf("Successfully saved checksum manifest %s", sumDst)
+
+	for dst, src := range sumLinks {
+		_ = os.Remove(dst)
+		if err = os.Symlink(src, dst); err != nil {
+			logCh <- logger.Log(jobName, l.GetName()).Errorf("Unable to create symlink: '%s'", err)
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (l *Local) deliveryBackupMetadata(logCh chan logger.LogRecord, jobName, tmpBackupFile, mtdDstPath string) error {
@@ -157,17 +225,24 @@ func (l *Local) DeleteOldBackups(logCh chan logger.LogRecord, ofsPart string, jo
 		return nil
 	}
 
+	pins, err := LoadPins(job.GetCatalog(), job.GetName(), ofsPart, l.GetName())
+	if err != nil {
+		logCh <- logger.Log(job.GetName(), l.GetName()).Errorf("Backup rotate skipped. Failed to read pinned backups: %s", err)
+		return err
+	}
+
 	if job.GetType() == misc.IncFiles {
-		return l.deleteIncBackup(logCh, job.GetName(), ofsPart, full)
+		return l.deleteIncBackup(logCh, job.GetName(), ofsPart, full, pins)
 	} else {
-		return l.deleteDescBackup(logCh, job.GetName(), ofsPart, job.IsBackupSafety())
+		return l.deleteDescBackup(logCh, job.GetName(), ofsPart, job.IsBackupSafety(), pins)
 	}
 }
 
-func (l *Local) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart string, safety bool) error {
+func (l *Local) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart string, safety bool, pins *Pins) error {
+	// links of the backup file ordered from the longest retention period
 	type fileLinks struct {
-		wLink string
-		dLink string
+		links []string
+		rule  RotationRule
 	}
 	var errs *multierror.Error
 	filesMap := make(map[string]*fileLinks, 64)
@@ -211,18 +286,21 @@ func (l *Local) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart s
 				linkPath := filepath.Join(bakDir, link)
 
 				if fl, ok := filesMap[linkPath]; ok {
-					switch p {
-					case Weekly:
-						fl.wLink = fPath
-					case Daily:
-						fl.dLink = fPath
-					}
+					fl.links = append(fl.links, fPath)
 					filesMap[linkPath] = fl
 				}
 			}
 		}
 
+		var pinned []os.DirEntry
+		lFiles, pinned = SplitPinned(lFiles, pins, func(f os.DirEntry) string { return f.Name() })
+		for _, file := range pinned {
+			logCh <- logger.Log(jobName, l.GetName()).Debugf("Backup file '%s' is pinned. Skipping rotate.", path.Join(bakDir, file.Name()))
+		}
+
 		if l.Retention.UseCount {
+			var sums []os.DirEntry
+			lFiles, sums = SplitChecksums(lFiles, func(f os.DirEntry) string { return f.Name() })
 			sort.Slice(lFiles, func(i, j int) bool {
 				iInfo, _ := lFiles[i].Info()
 				jInfo, _ := lFiles[j].Info()
@@ -238,6 +316,7 @@ func (l *Local) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart s
 			} else {
 				lFiles = lFiles[:0]
 			}
+			lFiles = AppendChecksums(lFiles, sums, func(f os.DirEntry) string { return f.Name() })
 		} else {
 			i := 0
 			for _, file := range lFiles {
@@ -254,58 +333,32 @@ func (l *Local) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart s
 			lFiles = lFiles[:i]
 		}
 
+		rule := l.Rule(p, retentionCount, retentionDate)
 		for _, file := range lFiles {
 			if file.IsDir() {
 				logCh <- logger.Log(jobName, l.GetName()).Warnf("`%s` is directory in %s. Please check and remove it.", file.Name(), bakDir)
 				continue
 			}
 			fPath := path.Join(bakDir, file.Name())
+			filesMap[fPath].rule = rule
 			filesToDeleteMap[fPath] = filesMap[fPath]
 		}
 	}
 
 	for file, fl := range filesToDeleteMap {
-		delFile := true
-		moved := false
-		if fl.wLink != "" {
-			if _, toDel := filesToDeleteMap[fl.wLink]; !toDel {
-				delFile = false
-				if err := moveFile(file, fl.wLink); err != nil {
-					logCh <- logger.Log(jobName, l.GetName()).Error(err)
-					errs = multierror.Append(errs, err)
-				} else {
-					logCh <- logger.Log(jobName, l.GetName()).Debugf("Successfully moved old backup to %s", fl.wLink)
-					moved = true
-				}
-				if _, toDel = filesToDeleteMap[fl.dLink]; !toDel {
-					if err := os.Remove(fl.dLink); err != nil {
-						logCh <- logger.Log(jobName, l.GetName()).Error(err)
-						errs = multierror.Append(errs, err)
-						break
-					}
-					relative, _ := filepath.Rel(filepath.Dir(fl.dLink), fl.wLink)
-					if err := os.Symlink(relative, fl.dLink); err != nil {
-						logCh <- logger.Log(jobName, l.GetName()).Error(err)
-						errs = multierror.Append(errs, err)
-					} else {
-						logCh <- logger.Log(jobName, l.GetName()).Debugf("Successfully changed symlink %s", fl.dLink)
-					}
-				}
-			}
-		}
-		if fl.dLink != "" && !moved {
-			if _, toDel := filesToDeleteMap[fl.dLink]; !toDel {
-				delFile = false
-				if err := moveFile(file, fl.dLink); err != nil {
-					logCh <- logger.Log(jobName, l.GetName()).Error(err)
-					errs = multierror.Append(errs, err)
-				} else {
-					logCh <- logger.Log(jobName, l.GetName()).Debugf("Successfully moved old backup to %s", fl.dLink)
-				}
+		// the backup is moved to the longest period link kept, the rest of the kept links are pointed to it
+		var keptLinks []string
+		for _, link := range fl.links {
+			if _, toDel := filesToDeleteMap[link]; !toDel {
+				keptLinks = append(keptLinks, link)
 			}
 		}
 
-		if delFile {
+		action := RotationAction{Job: jobName, Storage: l.GetName(), Target: ofsPart, Path: file, RotationRule: fl.rule}
+		if len(keptLinks) == 0 {
+			if l.Planned(action) {
+				continue
+			}
 			if err := os.Remove(file); err != nil {
 				logCh <- logger.Log(jobName, l.GetName()).Errorf("Failed to delete file '%s' with next error: %s",
 					file, err)
@@ -313,17 +366,48 @@ func (l *Local) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart s
 			} else {
 				logCh <- logger.Log(jobName, l.GetName()).Infof("Deleted old backup file '%s'", file)
 			}
+			continue
+		}
+
+		action.MoveTo = keptLinks[0]
+		if l.Planned(action) {
+			continue
+		}
+		if err := moveFile(file, keptLinks[0]); err != nil {
+			logCh <- logger.Log(jobName, l.GetName()).Error(err)
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		logCh <- logger.Log(jobName, l.GetName()).Debugf("Successfully moved old backup to %s", keptLinks[0])
+
+		for _, link := range keptLinks[1:] {
+			if err := os.Remove(link); err != nil {
+				logCh <- logger.Log(jobName, l.GetName()).Error(err)
+				errs = multierror.Append(errs, err)
+				continue
+			}
+			relative, _ := filepath.Rel(filepath.Dir(link), keptLinks[0])
+			if err := os.Symlink(relative, link); err != nil {
+				logCh <- logger.Log(jobName, l.GetName()).Error(err)
+				errs = multierror.Append(errs, err)
+			} else {
+				logCh <- logger.Log(jobName, l.GetName()).Debugf("Successfully changed symlink %s", link)
+			}
 		}
 	}
 
 	return errs.ErrorOrNil()
 }
 
-func (l *Local) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart string, full bool) error {
+func (l *Local) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart string, full bool, pins *Pins) error {
 	var errs *multierror.Error
 
 	if full {
 		backupDir := path.Join(l.backupPath, ofsPart)
+		if pins.Holds(backupDir) {
+			logCh <- logger.Log(jobName, l.GetName()).Warnf("Directory '%s' contains pinned backups. Skipping delete.", backupDir)
+			return nil
+		}
 		if err := os.RemoveAll(backupDir); err != nil {
 			if errors.Is(err, fs.ErrNotExist) {
 				logCh <- logger.Log(jobName, l.GetName()).Debugf("Directory '%s' not exist. Skipping delete.", backupDir)
@@ -364,6 +448,13 @@ func (l *Local) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart st
 				dirParts := strings.Split(dirName, "_")
 				dirMonth, _ := strconv.Atoi(dirParts[1])
 				if dirMonth < lastMonth {
+					if pins.Holds(path.Join(backupDir, dirName)) {
+						logCh <- logger.Log(jobName, l.GetName()).Infof("Backup '%s' in directory '%s' contains pinned backups. Skipping delete.", dirName, backupDir)
+						continue
+					}
+					if l.Planned(RotationAction{Job: jobName, Storage: l.GetName(), Target: ofsPart, Path: path.Join(backupDir, dirName), RotationRule: IncRule(year, lastMonth)}) {
+						continue
+					}
 					if err = os.RemoveAll(path.Join(backupDir, dirName)); err != nil {
 						logCh <- logger.Log(jobName, l.GetName()).Errorf("Failed to delete '%s' in dir '%s' with next error: %s",
 							dirName, backupDir, err)
@@ -379,12 +470,86 @@ func (l *Local) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart st
 	return errs.ErrorOrNil()
 }
 
-func (l *Local) GetFileReader(filePath string) (io.Reader, error) {
+func (l *Local) GetFileReader(filePath string) (io.ReadCloser, error) {
 	fp, err := filepath.EvalSymlinks(path.Join(l.backupPath, filePath))
 	if err != nil {
 		return nil, err
 	}
-	return files.GetLimitedFileReader(fp, l.rateLimit)
+	r, err := files.GetLimitedFileReader(fp, l.rateLimit)
+	if err != nil {
+		return nil, err
+	}
+	return l.cipher.DecryptReadCloser(r)
+}
+
+// PutFile writes the file copied from another storage as is
+func (l *Local) PutFile(logCh chan logger.LogRecord, jobName, _, _, ofsPath string, src io.Reader) error {
+	dstPath := path.Join(l.backupPath, ofsPath)
+	if err := os.MkdirAll(path.Dir(dstPath), os.ModePerm); err != nil {
+		logCh <- logger.Log(jobName, l.GetName()).Errorf("Unable to create directory: '%s'", err)
+		return err
+	}
+
+	dst, err := files.GetLimitedFileWriter(dstPath, l.rateLimit)
+	if err != nil {
+		logCh <- logger.Log(jobName, l.GetName()).Errorf("Unable to create file: '%s'", err)
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if cErr := dst.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		// partial file is useless
+		_ = os.Remove(dstPath)
+		logCh <- logger.Log(jobName, l.GetName()).Errorf("Unable to write file: %s", err)
+		return err
+	}
+	logCh <- logger.Log(jobName, l.GetName()).Infof("File %s successfully written", dstPath)
+
+	return nil
+}
+
+func (l *Local) DeleteFile(ofsPath string) error {
+	return os.Remove(path.Join(l.backupPath, ofsPath))
+}
+
+// DeleteDir removes the empty dir
+func (l *Local) DeleteDir(ofsPath string) error {
+	return os.Remove(path.Join(l.backupPath, ofsPath))
+}
+
+// PutLink makes the copy of the backup synced from another storage as the symlink to the copy already synced
+func (l *Local) PutLink(logCh chan logger.LogRecord, jobName, _, _, ofsPath, targetOfsPath string) error {
+	dst := path.Join(l.backupPath, ofsPath)
+	relative, err := filepath.Rel(path.Dir(dst), path.Join(l.backupPath, targetOfsPath))
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(path.Dir(dst), os.ModePerm); err != nil {
+		logCh <- logger.Log(jobName, l.GetName()).Errorf("Unable to create directory: '%s'", err)
+		return err
+	}
+	_ = os.Remove(dst)
+	if err = os.Symlink(relative, dst); err != nil {
+		logCh <- logger.Log(jobName, l.GetName()).Errorf("Unable to create symlink: '%s'", err)
+		return err
+	}
+	logCh <- logger.Log(jobName, l.GetName()).Infof("Successfully created symlink %s", dst)
+
+	return nil
+}
+
+// FileSize returns the size of the backup file, the symlinks take no space
+func (l *Local) FileSize(ofsPath string) (int64, error) {
+	fi, err := os.Lstat(path.Join(l.backupPath, ofsPath))
+	if err != nil {
+		return 0, err
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return 0, nil
+	}
+	return fi.Size(), nil
 }
 
 func (l *Local) ListBackups(ofsPart string) ([]string, error) {
@@ -402,6 +567,10 @@ func (l *Local) ListBackups(ofsPart string) ([]string, error) {
 	return backups, err
 }
 
+func (l *Local) FreeSpace() (uint64, error) {
+	return NearestFreeSpace(l.backupPath, files.FreeSpace)
+}
+
 func (l *Local) Close() error {
 	return nil
 }
@@ -1,7 +1,6 @@
 package nfs
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -17,9 +16,12 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/vmware/go-nfs-client/nfs"
 	"github.com/vmware/go-nfs-client/nfs/rpc"
+	"github.com/vmware/go-nfs-client/nfs/xdr"
 
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backend/files"
 	"github.com/nixys/nxs-backup/modules/logger"
 	. "github.com/nixys/nxs-backup/modules/storage"
@@ -27,13 +29,22 @@ import (
 
 type NFS struct {
 	target        *nfs.Target
+	auth          rpc.Auth
 	name          string
 	backupPath    string
 	rateLimit     int64
 	rotateEnabled bool
+	cipher        *crypt.Cipher
 	Retention
+	DryRun
 }
 
+// RENAME and FSSTAT procedures numbers of NFSv3 protocol (RFC 1813)
+const (
+	nfsProc3Rename = 14
+	nfsProc3FSStat = 18
+)
+
 type Opts struct {
 	Host   string
 	Target string
@@ -70,6 +81,7 @@ func Init(name string, params Opts, rl int64) (*NFS, error) {
 	return &NFS{
 		name:      name,
 		target:    target,
+		auth:      auth.Auth(),
 		rateLimit: rl,
 	}, nil
 }
@@ -79,6 +91,7 @@ func (n *NFS) Configure(p Params) {
 	n.rateLimit = p.RateLimit
 	n.rotateEnabled = p.RotateEnabled
 	n.Retention = p.Retention
+	n.cipher = p.Cipher
 }
 
 func (n *NFS) IsLocal() int { return 0 }
@@ -106,6 +119,12 @@ func (n *NFS) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFile
 		}
 	}
 
+	for _, dstPath := range GetChecksumDstList(tmpBackupFile, bakRemPaths) {
+		if err := n.copy(logCh, jobName, dstPath, tmpBackupFile+checksum.Ext); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -122,9 +141,13 @@ func (n *NFS) copy(logCh chan logger.LogRecord, jobName, dst, src string) error
 	}
 	defer func() { _ = srcFile.Close() }()
 
+	return n.upload(logCh, jobName, dst, srcFile)
+}
+
+func (n *NFS) upload(logCh chan logger.LogRecord, jobName, dst string, srcFile io.Reader) error {
 	// Make remote directories
 	dstDir := path.Dir(dst)
-	err = n.mkDir(dstDir)
+	err := n.mkDir(dstDir)
 	if err != nil {
 		logCh <- logger.LogRecord{
 			Level:       logrus.ErrorLevel,
@@ -135,15 +158,23 @@ func (n *NFS) copy(logCh chan logger.LogRecord, jobName, dst, src string) error
 		return err
 	}
 
-	destination, err := n.target.OpenFile(dst, 0666)
+	partDst := dst + PartExt
+	destination, err := n.target.OpenFile(partDst, 0666)
 	if err != nil {
 		logCh <- logger.Log(jobName, n.name).Errorf("Unable to create destination file '%s': '%s'", dstDir, err)
 		return err
 	}
-	defer func() { _ = destination.Close() }()
 
 	_, err = io.Copy(destination, srcFile)
+	if cErr := destination.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = n.rename(partDst, dst)
+	}
 	if err != nil {
+		// partial file is useless
+		_ = n.target.Remove(partDst)
 		logCh <- logger.Log(jobName, n.name).Errorf("Unable to make copy '%s': '%s'", dstDir, err)
 		return err
 	}
@@ -152,20 +183,87 @@ func (n *NFS) copy(logCh chan logger.LogRecord, jobName, dst, src string) error
 	return nil
 }
 
+// rename moves the file replacing the destination one. The NFS client doesn't implement RENAME, so the call is made directly.
+func (n *NFS) rename(oldPath, newPath string) error {
+	type RenameArgs struct {
+		rpc.Header
+		From nfs.Diropargs3
+		To   nfs.Diropargs3
+	}
+
+	_, fromFH, err := n.target.Lookup(path.Dir(oldPath))
+	if err != nil {
+		return err
+	}
+	_, toFH, err := n.target.Lookup(path.Dir(newPath))
+	if err != nil {
+		return err
+	}
+
+	res, err := n.target.Call(&RenameArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfs.Nfs3Prog,
+			Vers:    nfs.Nfs3Vers,
+			Proc:    nfsProc3Rename,
+			Cred:    n.auth,
+			Verf:    rpc.AuthNull,
+		},
+		From: nfs.Diropargs3{FH: fromFH, Filename: path.Base(oldPath)},
+		To:   nfs.Diropargs3{FH: toFH, Filename: path.Base(newPath)},
+	})
+	if err != nil {
+		return err
+	}
+
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		return err
+	}
+	return nfs.NFS3Error(status)
+}
+
+// deleteStaleParts deletes files left by interrupted uploads
+func (n *NFS) deleteStaleParts(logCh chan logger.LogRecord, jobName, ofsPart string) {
+	paths, err := n.listAll(ofsPart)
+	if err != nil {
+		return
+	}
+
+	_, parts := SplitPartFiles(paths, func(p string) string { return p })
+	for _, p := range parts {
+		if err = n.target.Remove(p); err != nil {
+			logCh <- logger.Log(jobName, n.name).Warnf("Failed to delete stale partial upload '%s': %s", p, err)
+		} else {
+			logCh <- logger.Log(jobName, n.name).Infof("Deleted stale partial upload '%s'", p)
+		}
+	}
+}
+
 func (n *NFS) DeleteOldBackups(logCh chan logger.LogRecord, ofsPart string, job interfaces.Job, full bool) error {
 	if !n.rotateEnabled {
 		logCh <- logger.Log(job.GetName(), n.name).Debugf("Backup rotate skipped by config.")
 		return nil
 	}
 
+	if !n.IsDryRun() {
+		n.deleteStaleParts(logCh, job.GetName(), ofsPart)
+	}
+
+	pins, err := LoadPins(job.GetCatalog(), job.GetName(), ofsPart, n.name)
+	if err != nil {
+		logCh <- logger.Log(job.GetName(), n.name).Errorf("Backup rotate skipped. Failed to read pinned backups: %s", err)
+		return err
+	}
+
 	if job.GetType() == misc.IncFiles {
-		return n.deleteIncBackup(logCh, job.GetName(), ofsPart, full)
+		return n.deleteIncBackup(logCh, job.GetName(), ofsPart, full, pins)
 	} else {
-		return n.deleteDescBackup(logCh, job.GetName(), ofsPart, job.IsBackupSafety())
+		return n.deleteDescBackup(logCh, job.GetName(), ofsPart, job.IsBackupSafety(), pins)
 	}
 }
 
-func (n *NFS) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart string, safety bool) error {
+func (n *NFS) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart string, safety bool, pins *Pins) error {
 	var errs *multierror.Error
 
 	for _, p := range RetentionPeriodsList {
@@ -187,7 +285,7 @@ func (n *NFS) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart str
 
 		nfsFiles := make([]fs.FileInfo, 0, len(nfsFilesPlus))
 		for _, file := range nfsFilesPlus {
-			if file.Name() == ".." || file.Name() == "." {
+			if file.Name() == ".." || file.Name() == "." || IsPartFile(file.Name()) {
 				continue
 			}
 			f, _, err := n.target.Lookup(path.Join(bakDir, file.Name()))
@@ -198,7 +296,15 @@ func (n *NFS) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart str
 			nfsFiles = append(nfsFiles, f)
 		}
 
+		var pinned []fs.FileInfo
+		nfsFiles, pinned = SplitPinned(nfsFiles, pins, func(f fs.FileInfo) string { return f.Name() })
+		for _, file := range pinned {
+			logCh <- logger.Log(jobName, n.name).Debugf("Backup file '%s' is pinned. Skipping rotate.", path.Join(bakDir, file.Name()))
+		}
+
 		if n.Retention.UseCount {
+			var sums []fs.FileInfo
+			nfsFiles, sums = SplitChecksums(nfsFiles, func(f fs.FileInfo) string { return f.Name() })
 			sort.Slice(nfsFiles, func(i, j int) bool {
 				return nfsFiles[i].ModTime().Before(nfsFiles[j].ModTime())
 			})
@@ -211,6 +317,7 @@ func (n *NFS) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart str
 			} else {
 				nfsFiles = nfsFiles[:0]
 			}
+			nfsFiles = AppendChecksums(nfsFiles, sums, func(f fs.FileInfo) string { return f.Name() })
 		} else {
 			i := 0
 			for _, file := range nfsFiles {
@@ -226,7 +333,11 @@ func (n *NFS) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart str
 			nfsFiles = nfsFiles[:i]
 		}
 
+		rule := n.Rule(p, retentionCount, retentionDate)
 		for _, file := range nfsFiles {
+			if n.Planned(RotationAction{Job: jobName, Storage: n.name, Target: ofsPart, Path: path.Join(bakDir, file.Name()), RotationRule: rule}) {
+				continue
+			}
 			err = n.target.Remove(path.Join(bakDir, file.Name()))
 			if err != nil {
 				logCh <- logger.Log(jobName, n.name).Errorf("Failed to delete file '%s' in remote directory '%s' with next error: %s",
@@ -241,11 +352,15 @@ func (n *NFS) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart str
 	return errs
 }
 
-func (n *NFS) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart string, full bool) error {
+func (n *NFS) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart string, full bool, pins *Pins) error {
 	var errs *multierror.Error
 
 	if full {
 		backupDir := path.Join(n.backupPath, ofsPart)
+		if pins.Holds(backupDir) {
+			logCh <- logger.Log(jobName, n.name).Warnf("Directory '%s' contains pinned backups. Skipping delete.", backupDir)
+			return nil
+		}
 
 		err := n.target.RemoveAll(backupDir)
 		if err != nil {
@@ -279,6 +394,13 @@ func (n *NFS) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart stri
 				dirParts := strings.Split(dirName, "_")
 				dirMonth, _ := strconv.Atoi(dirParts[1])
 				if dirMonth < lastMonth {
+					if pins.Holds(path.Join(backupDir, dirName)) {
+						logCh <- logger.Log(jobName, n.name).Infof("Backup '%s' in directory '%s' contains pinned backups. Skipping delete.", dirName, backupDir)
+						continue
+					}
+					if n.Planned(RotationAction{Job: jobName, Storage: n.name, Target: ofsPart, Path: path.Join(backupDir, dirName), RotationRule: IncRule(year, lastMonth)}) {
+						continue
+					}
 					if err = n.target.RemoveAll(path.Join(backupDir, dirName)); err != nil {
 						logCh <- logger.Log(jobName, n.name).Errorf("Failed to delete '%s' in dir '%s' with next error: %s",
 							dir.Name(), backupDir, err)
@@ -323,24 +445,50 @@ func (n *NFS) mkDir(dstPath string) error {
 	return nil
 }
 
-func (n *NFS) GetFileReader(ofsPath string) (io.Reader, error) {
+func (n *NFS) GetFileReader(ofsPath string) (io.ReadCloser, error) {
 
 	file, err := n.target.Open(path.Join(n.backupPath, ofsPath))
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = file.Close() }()
 
-	var buf []byte
-	buf, err = io.ReadAll(file)
+	return n.cipher.DecryptReadCloser(file)
+}
+
+// PutFile uploads the file copied from another storage as is
+func (n *NFS) PutFile(logCh chan logger.LogRecord, jobName, _, _, ofsPath string, src io.Reader) error {
+	return n.upload(logCh, jobName, path.Join(n.backupPath, ofsPath), files.GetLimitedReader(src, n.rateLimit))
+}
+
+func (n *NFS) DeleteFile(ofsPath string) error {
+	return n.target.Remove(path.Join(n.backupPath, ofsPath))
+}
+
+// DeleteDir removes the empty dir
+func (n *NFS) DeleteDir(ofsPath string) error {
+	return n.target.RmDir(path.Join(n.backupPath, ofsPath))
+}
+
+func (n *NFS) FileSize(ofsPath string) (int64, error) {
+	fi, _, err := n.target.Lookup(path.Join(n.backupPath, ofsPath))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (n *NFS) ListBackups(fPath string) ([]string, error) {
+	paths, err := n.listAll(fPath)
 	if err != nil {
 		return nil, err
 	}
 
-	return bytes.NewReader(buf), err
+	paths, _ = SplitPartFiles(paths, func(p string) string { return p })
+	return paths, nil
 }
 
-func (n *NFS) ListBackups(fPath string) ([]string, error) {
+// listAll returns all files under the path including incomplete uploads
+func (n *NFS) listAll(fPath string) ([]string, error) {
 	bPath := path.Join(n.backupPath, fPath)
 	nfsFiles, err := n.listFiles(bPath)
 	if err != nil {
@@ -400,6 +548,56 @@ func (n *NFS) listPaths(base string, fList []*nfs.EntryPlus) ([]string, error) {
 	return paths, nil
 }
 
+// FreeSpace returns the space available in the backup path. The NFS client doesn't implement FSSTAT, so the call is made directly.
+func (n *NFS) FreeSpace() (uint64, error) {
+	type FSStatArgs struct {
+		rpc.Header
+		FsRoot []byte
+	}
+	type FSStatRes struct {
+		Attr   nfs.PostOpAttr
+		TBytes uint64
+		FBytes uint64
+		ABytes uint64
+	}
+
+	return NearestFreeSpace(n.backupPath, func(p string) (uint64, error) {
+		_, fh, err := n.target.Lookup(p)
+		if err != nil {
+			return 0, err
+		}
+
+		res, err := n.target.Call(&FSStatArgs{
+			Header: rpc.Header{
+				Rpcvers: 2,
+				Prog:    nfs.Nfs3Prog,
+				Vers:    nfs.Nfs3Vers,
+				Proc:    nfsProc3FSStat,
+				Cred:    n.auth,
+				Verf:    rpc.AuthNull,
+			},
+			FsRoot: fh,
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		status, err := xdr.ReadUint32(res)
+		if err != nil {
+			return 0, err
+		}
+		if err = nfs.NFS3Error(status); err != nil {
+			return 0, err
+		}
+
+		st := new(FSStatRes)
+		if err = xdr.Read(res, st); err != nil {
+			return 0, err
+		}
+		return st.ABytes, nil
+	})
+}
+
 func (n *NFS) Close() error {
 	return n.target.Close()
 }
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"path"
+	"strings"
+
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/catalog"
+)
+
+// Pins are the backups of the job target pinned on the storage.
+// The rotation keeps them along with the incremental backups they depend on.
+type Pins struct {
+	ofs   string
+	files map[string]bool
+	paths []string
+}
+
+// LoadPins reads the pins of the job target backups on the storage from the catalog, there are no pins with disabled catalog
+func LoadPins(cat *catalog.Catalog, jobName, ofs, storageName string) (*Pins, error) {
+	pins, err := cat.Pins(catalog.Query{Job: jobName, Ofs: ofs, Storage: storageName})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pins{ofs: ofs, files: make(map[string]bool, len(pins))}
+	for _, pin := range pins {
+		p.files[pin.File] = true
+		p.paths = append(p.paths, pin.Paths...)
+	}
+	return p, nil
+}
+
+// Pinned reports whether the backup file or its checksum manifest is pinned. Each copy of the backup in the period dirs is pinned.
+func (p *Pins) Pinned(filePath string) bool {
+	if p == nil {
+		return false
+	}
+	return p.files[strings.TrimSuffix(path.Base(filePath), checksum.Ext)]
+}
+
+// Holds reports whether the dir contains pinned backups. The dirs of the incremental backups are kept as a whole,
+// since the full and the previous incremental backups in them are needed to restore the pinned one.
+func (p *Pins) Holds(dirPath string) bool {
+	if p == nil {
+		return false
+	}
+	prefix := GetOfsRelPath(strings.TrimSuffix(dirPath, "/")+"/", p.ofs)
+	for _, fp := range p.paths {
+		if strings.HasPrefix(fp, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitPinned separates the pinned files from the ones the rotation may delete.
+// The pinned backups are kept in addition to the retention, they aren't counted by the count based one.
+func SplitPinned[T any](files []T, pins *Pins, name func(T) string) (unpinned, pinned []T) {
+	for _, f := range files {
+		if pins.Pinned(name(f)) {
+			pinned = append(pinned, f)
+		} else {
+			unpinned = append(unpinned, f)
+		}
+	}
+	return
+}
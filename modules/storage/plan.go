@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RotationRule is the retention rule the file is deleted by.
+// Count is the number of the existing backups kept by the count based retention, the new backup isn't counted.
+// Cutoff is set for the date based retention, the older files are deleted.
+type RotationRule struct {
+	Period string     `json:"period"`
+	Count  int        `json:"count"`
+	Cutoff *time.Time `json:"cutoff,omitempty"`
+	Budget int64      `json:"size_budget,omitempty"`
+}
+
+// RotationAction describes the file the rotation deletes. The path is relative to the storage backup path.
+// The backup is moved to MoveTo instead of deletion if its link in the other period dir is kept.
+type RotationAction struct {
+	Job     string `json:"job"`
+	Storage string `json:"storage"`
+	Target  string `json:"target"`
+	Path    string `json:"path"`
+	MoveTo  string `json:"move_to,omitempty"`
+	RotationRule
+}
+
+// RotationPlan collects the actions of the rotation made in the dry run mode
+type RotationPlan struct {
+	mu      sync.Mutex
+	actions []RotationAction
+}
+
+func (p *RotationPlan) Add(a RotationAction) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.actions = append(p.actions, a)
+}
+
+func (p *RotationPlan) Actions() []RotationAction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]RotationAction(nil), p.actions...)
+}
+
+// Deleted reports whether the file of the job target on the storage is deleted by the plan
+func (p *RotationPlan) Deleted(job, storage, target, path string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, a := range p.actions {
+		if a.Job == job && a.Storage == storage && a.Target == target && a.Path == path && a.MoveTo == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// DryRun is embedded by the storages. In the dry run mode the rotation adds its actions to the plan instead of deleting files.
+type DryRun struct {
+	plan *RotationPlan
+}
+
+// SetDryRun enables the dry run mode with the plan to collect the actions, nil plan disables it
+func (d *DryRun) SetDryRun(plan *RotationPlan) {
+	d.plan = plan
+}
+
+func (d *DryRun) DryRunPlan() *RotationPlan {
+	return d.plan
+}
+
+// IsDryRun reports whether the files must not be changed by the rotation
+func (d *DryRun) IsDryRun() bool {
+	return d.plan != nil
+}
+
+// Planned adds the action to the plan in the dry run mode, the file must be kept as is if it's done.
+// The path of the action is converted to the one relative to the backup path.
+func (d *DryRun) Planned(a RotationAction) bool {
+	if d.plan == nil {
+		return false
+	}
+	a.Path = GetOfsRelPath(a.Path, a.Target)
+	if a.MoveTo != "" {
+		a.MoveTo = GetOfsRelPath(a.MoveTo, a.Target)
+	}
+	d.plan.Add(a)
+	return true
+}
+
+// Rule returns the rule of the retention period. The count is the number of the backups kept by the count based retention.
+func (r Retention) Rule(p retentionPeriod, count int, date time.Time) RotationRule {
+	if r.UseCount {
+		return RotationRule{Period: p.String(), Count: count}
+	}
+	return RotationRule{Period: p.String(), Cutoff: &date}
+}
+
+// IncRule returns the rule of the incremental backups rotation, the months dirs of the year before the last month kept are deleted
+func IncRule(year string, lastMonth int) RotationRule {
+	y, _ := strconv.Atoi(year)
+	cutoff := time.Date(y, time.Month(lastMonth), 1, 0, 0, 0, 0, time.Local)
+	return RotationRule{Period: "inc", Cutoff: &cutoff}
+}
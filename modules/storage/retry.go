@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/nixys/nxs-backup/misc"
+)
+
+// Retry describes how the failed storage operations are repeated
+type Retry struct {
+	Attempts     int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// Do calls fn until it succeeds or the attempts are over. The delay between attempts starts from InitialDelay
+// and is doubled after each failure up to MaxDelay. Errors about missing files are returned at once, repeat won't help them.
+// onFail is called before each delay.
+func (r Retry) Do(fn func(attempt int) error, onFail func(attempt int, err error, delay time.Duration)) error {
+	delay := r.InitialDelay
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || attempt >= r.Attempts || errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if onFail != nil {
+			onFail(attempt, err, delay)
+		}
+		time.Sleep(delay)
+		delay = min(delay*2, max(r.MaxDelay, r.InitialDelay))
+	}
+}
+
+// Resumable reports whether the upload of the file may be resumed or skipped by the remote file left by the failed attempt.
+// Only the backup files named by their creation time are unique, the same named remote file of the other content is
+// possible for the rest of files. The incremental backups metadata is rewritten by each run, so it's always uploaded anew.
+func Resumable(ofsPath string) bool {
+	if path.Base(path.Dir(ofsPath)) == "inc_meta_info" || path.Ext(ofsPath) == ".inc" {
+		return false
+	}
+	_, ok := misc.GetBackupFileTime(ofsPath)
+	return ok
+}
+
+// ResumeOffset returns the offset the interrupted upload of the source can be continued from and moves the source to it.
+// partSize and dstSize are the sizes of the partial and the complete remote files, negative if the file doesn't exist.
+// done is set if the failed attempt has already completed the upload. Not seekable sources are uploaded from the start.
+func ResumeOffset(src io.Reader, partSize, dstSize int64) (offset int64, done bool, err error) {
+	seeker, ok := src.(io.Seeker)
+	if !ok {
+		return 0, false, nil
+	}
+
+	size, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false, err
+	}
+	if dstSize == size {
+		return 0, true, nil
+	}
+	if partSize > 0 && partSize <= size {
+		offset = partSize
+	}
+
+	_, err = seeker.Seek(offset, io.SeekStart)
+	return offset, false, err
+}
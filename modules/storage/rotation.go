@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/logger"
+)
+
+// RemoteFile is the file of the storage listing all the files of the backup target with their modification time at once
+type RemoteFile struct {
+	Name    string
+	ModTime time.Time
+}
+
+// RotationTarget is the job target rotated on the storage, the names of its files start with the BackupDir
+type RotationTarget struct {
+	JobName   string
+	Storage   string
+	BackupDir string
+	Inc       bool
+	Full      bool
+	Safety    bool
+}
+
+// SelectRotated selects the files of the target to be deleted by the rotation with the rules they are deleted by.
+// The pinned backups are kept, the incremental backups dirs holding the pinned ones are kept entirely.
+func (r Retention) SelectRotated(logCh chan logger.LogRecord, t RotationTarget, files []RemoteFile, pins *Pins) (toDelete []RemoteFile, rules map[string]RotationRule) {
+	rules = make(map[string]RotationRule)
+
+	if t.Inc {
+		if t.Full {
+			if pins.Holds(t.BackupDir) {
+				logCh <- logger.Log(t.JobName, t.Storage).Warnf("Directory '%s' contains pinned backups. Skipping delete.", t.BackupDir)
+				return
+			}
+			return files, rules
+		}
+
+		intMoy, _ := strconv.Atoi(misc.GetDateTimeNow("moy"))
+		lastMonth := intMoy - r.Months
+
+		var year string
+		if lastMonth > 0 {
+			year = misc.GetDateTimeNow("year")
+		} else {
+			year = misc.GetDateTimeNow("previous_year")
+			lastMonth += 12
+		}
+
+		rx := regexp.MustCompile(year + `/month_(\d\d)/`)
+		for _, f := range files {
+			if m := rx.FindStringSubmatch(f.Name); m != nil {
+				if pins.Holds(path.Join(t.BackupDir, year, "month_"+m[1])) {
+					continue
+				}
+				dirMonth, _ := strconv.Atoi(m[1])
+				if dirMonth < lastMonth {
+					toDelete = append(toDelete, f)
+					rules[f.Name] = IncRule(year, lastMonth)
+				}
+			}
+		}
+		return
+	}
+
+	name := func(f RemoteFile) string { return f.Name }
+	for _, p := range RetentionPeriodsList {
+		retentionCount, retentionDate := GetRetention(p, r)
+		if retentionCount == 0 && retentionDate.IsZero() {
+			continue
+		}
+
+		var periodFiles []RemoteFile
+		for _, f := range files {
+			if path.Base(path.Dir(f.Name)) == p.String() {
+				periodFiles = append(periodFiles, f)
+			}
+		}
+
+		var pinned []RemoteFile
+		periodFiles, pinned = SplitPinned(periodFiles, pins, name)
+		for _, f := range pinned {
+			logCh <- logger.Log(t.JobName, t.Storage).Debugf("Backup file '%s' is pinned. Skipping rotate.", f.Name)
+		}
+
+		expired := len(toDelete)
+		if r.UseCount {
+			var sums []RemoteFile
+			periodFiles, sums = SplitChecksums(periodFiles, name)
+			sort.Slice(periodFiles, func(i, j int) bool {
+				return periodFiles[i].ModTime.Before(periodFiles[j].ModTime)
+			})
+
+			if !t.Safety {
+				retentionCount--
+			}
+			if retentionCount <= len(periodFiles) {
+				periodFiles = periodFiles[:len(periodFiles)-retentionCount]
+			} else {
+				periodFiles = periodFiles[:0]
+			}
+			toDelete = append(toDelete, AppendChecksums(periodFiles, sums, name)...)
+		} else {
+			for _, f := range periodFiles {
+				if f.ModTime.Before(retentionDate) {
+					toDelete = append(toDelete, f)
+				}
+			}
+		}
+		rule := r.Rule(p, retentionCount, retentionDate)
+		for _, f := range toDelete[expired:] {
+			rules[f.Name] = rule
+		}
+	}
+
+	return
+}
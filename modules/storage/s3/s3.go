@@ -3,6 +3,8 @@ package s3
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -18,14 +20,29 @@ import (
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backend/files"
 	"github.com/nixys/nxs-backup/modules/logger"
 	. "github.com/nixys/nxs-backup/modules/storage"
 )
 
+// streamPartSize is the part size of the multipart upload used for streams, it allows to upload objects up to 1.2 TiB
+const streamPartSize = 128 << 20
+
+// multipartThreshold is the size of the backup starting from which it's uploaded by parts, so the failed upload can be resumed
+const multipartThreshold = 64 << 20
+
+const (
+	SSES3  = "sse-s3"
+	SSEKMS = "sse-kms"
+	SSEC   = "sse-c"
+)
+
 type S3 struct {
 	client        *minio.Client
 	name          string
@@ -33,18 +50,38 @@ type S3 struct {
 	backupPath    string
 	rateLimit     int64
 	rotateEnabled bool
+	cipher        *crypt.Cipher
 	batchDeletion bool
+	sse           encrypt.ServerSide
+	storageClass  string
+	periodClasses map[string]string
+	tagging       bool
+	lockMode      minio.RetentionMode
+	resume        bool
 	Retention
+	DryRun
 }
 
 type Opts struct {
-	BucketName    string
-	AccessKeyID   string
-	SecretKey     string
-	Endpoint      string
-	Region        string
-	BatchDeletion bool
-	Secure        bool
+	BucketName           string
+	AccessKeyID          string
+	SecretKey            string
+	Endpoint             string
+	Region               string
+	BatchDeletion        bool
+	Secure               bool
+	SSE                  *SSEOpts
+	StorageClass         string
+	PeriodStorageClasses map[string]string // storage classes of daily, weekly and monthly backups
+	Tagging              bool
+	ObjectLockMode       string
+}
+
+// SSEOpts defines the server-side encryption of uploaded objects
+type SSEOpts struct {
+	Type            string
+	KmsKeyID        string
+	CustomerKeyFile string
 }
 
 func Init(name string, opts Opts, rl int64) (*S3, error) {
@@ -72,13 +109,65 @@ func Init(name string, opts Opts, rl int64) (*S3, error) {
 		return nil, fmt.Errorf("Bucket '%s' doesn't exist. ", opts.BucketName)
 	}
 
-	return &S3{
+	s := &S3{
 		name:          name,
 		client:        s3Client,
 		bucketName:    opts.BucketName,
 		batchDeletion: opts.BatchDeletion,
 		rateLimit:     rl,
-	}, nil
+		storageClass:  opts.StorageClass,
+		periodClasses: opts.PeriodStorageClasses,
+		tagging:       opts.Tagging,
+	}
+
+	if opts.SSE != nil {
+		s.sse, err = getServerSide(*opts.SSE)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to init server-side encryption for S3 storage '%s'. Error: %v ", name, err)
+		}
+		if s.sse.Type() == encrypt.SSEC && !opts.Secure {
+			return nil, fmt.Errorf("Server-side encryption with customer key requires secure connection to S3 storage '%s'. ", name)
+		}
+	}
+
+	if opts.ObjectLockMode != "" {
+		s.lockMode = minio.RetentionMode(strings.ToUpper(opts.ObjectLockMode))
+		if !s.lockMode.IsValid() {
+			return nil, fmt.Errorf("Wrong object lock mode `%s` for S3 storage '%s'. Allowed modes: governance, compliance ", opts.ObjectLockMode, name)
+		}
+		lock, _, _, _, err := s3Client.GetObjectLockConfig(context.Background(), opts.BucketName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get object lock config of bucket '%s'. Error: %v ", opts.BucketName, err)
+		}
+		if lock != "Enabled" {
+			return nil, fmt.Errorf("Object lock isn't enabled for bucket '%s'. ", opts.BucketName)
+		}
+	}
+
+	return s, nil
+}
+
+func getServerSide(o SSEOpts) (encrypt.ServerSide, error) {
+	switch o.Type {
+	case SSES3:
+		return encrypt.NewSSE(), nil
+	case SSEKMS:
+		if o.KmsKeyID == "" {
+			return nil, fmt.Errorf("`kms_key_id` is required for %s", SSEKMS)
+		}
+		return encrypt.NewSSEKMS(o.KmsKeyID, nil)
+	case SSEC:
+		if o.CustomerKeyFile == "" {
+			return nil, fmt.Errorf("`customer_key_file` is required for %s", SSEC)
+		}
+		key, err := crypt.ReadKeyFile(o.CustomerKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return encrypt.NewSSEC(key)
+	default:
+		return nil, fmt.Errorf("unknown encryption type `%s`, allowed types: %s, %s, %s", o.Type, SSES3, SSEKMS, SSEC)
+	}
 }
 
 func (s *S3) Configure(p Params) {
@@ -86,10 +175,13 @@ func (s *S3) Configure(p Params) {
 	s.rateLimit = p.RateLimit
 	s.rotateEnabled = p.RotateEnabled
 	s.Retention = p.Retention
+	s.cipher = p.Cipher
 }
 
 func (s *S3) IsLocal() int { return 0 }
 
+func (s *S3) SetResume(resume bool) { s.resume = resume }
+
 func (s *S3) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFile, ofs, bakType string) error {
 	var bakRemPaths, mtdRemPaths []string
 
@@ -112,7 +204,7 @@ func (s *S3) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFile,
 		}
 
 		for _, bucketPath := range mtdRemPaths {
-			_, err = s.client.PutObject(context.Background(), s.bucketName, bucketPath, mtdSrc, mtdSrcStat.Size(), minio.PutObjectOptions{ContentType: "application/octet-stream"})
+			_, err = s.client.PutObject(context.Background(), s.bucketName, bucketPath, mtdSrc, mtdSrcStat.Size(), s.putOptions(bucketPath, "application/octet-stream", jobName, ofs, bakType))
 			if err != nil {
 				return err
 			}
@@ -132,19 +224,309 @@ func (s *S3) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFile,
 	}
 
 	for _, bucketPath := range bakRemPaths {
-		if _, err = source.Seek(0, io.SeekStart); err != nil {
-			logCh <- logger.Log(jobName, s.name).Errorf("Failed to reset file reader to start. Error: %v", err)
+		err = s.putFile(logCh, jobName, bucketPath, source, sourceStat.Size(), s.putOptions(bucketPath, "application/octet-stream", jobName, ofs, bakType))
+		if err != nil {
+			logCh <- logger.Log(jobName, s.name).Errorf("Failed to upload object '%s' to bucket %s. Error: %v", bucketPath, s.bucketName, err)
+			return err
+		}
+		logCh <- logger.Log(jobName, s.name).Infof("Successfully uploaded object '%s' to bucket %s", bucketPath, s.bucketName)
+	}
+
+	return s.deliveryChecksum(logCh, jobName, tmpBackupFile, ofs, bakType, bakRemPaths)
+}
+
+// putFile uploads the file to the bucket. Files bigger than multipartThreshold are uploaded by parts and the failed upload isn't aborted,
+// so the resumed delivery continues it skipping the uploaded parts. Stale uploads are aborted by rotation.
+func (s *S3) putFile(logCh chan logger.LogRecord, jobName, bucketPath string, src io.ReadSeeker, size int64, opts minio.PutObjectOptions) error {
+	ctx := context.Background()
+	resume := s.resume && Resumable(bucketPath)
+
+	if resume {
+		oi, err := s.client.StatObject(ctx, s.bucketName, bucketPath, minio.StatObjectOptions{ServerSideEncryption: s.customerSSE()})
+		if err == nil && oi.Size == size {
+			logCh <- logger.Log(jobName, s.name).Infof("Object '%s' was uploaded by previous attempt", bucketPath)
+			return nil
+		}
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if size < multipartThreshold {
+		_, err := s.client.PutObject(ctx, s.bucketName, bucketPath, src, size, opts)
+		return err
+	}
+
+	_, partSize, _, err := minio.OptimalPartInfo(size, 0)
+	if err != nil {
+		return err
+	}
+
+	var (
+		uploadID string
+		uploaded map[int]minio.ObjectPart
+	)
+	core := minio.Core{Client: s.client}
+	if resume {
+		if uploadID, uploaded, err = s.incompleteUpload(ctx, core, bucketPath); err != nil {
+			return err
+		}
+	}
+	if uploadID != "" {
+		logCh <- logger.Log(jobName, s.name).Infof("Resuming upload of object '%s', %d parts were uploaded by previous attempt", bucketPath, len(uploaded))
+	} else if uploadID, err = core.NewMultipartUpload(ctx, s.bucketName, bucketPath, opts); err != nil {
+		return err
+	}
+
+	var parts []minio.CompletePart
+	buf := make([]byte, partSize)
+	for num, offset := 1, int64(0); offset < size; num, offset = num+1, offset+partSize {
+		partLen := min(partSize, size-offset)
+		if p, ok := uploaded[num]; ok && p.Size == partLen {
+			parts = append(parts, minio.CompletePart{PartNumber: num, ETag: p.ETag})
+			continue
+		}
+
+		if _, err = src.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(src, buf[:partLen]); err != nil {
+			return err
+		}
+		partOpts := minio.PutObjectPartOptions{SSE: s.customerSSE()}
+		if opts.SendContentMd5 {
+			sum := md5.Sum(buf[:partLen])
+			partOpts.Md5Base64 = base64.StdEncoding.EncodeToString(sum[:])
+		}
+		p, err := core.PutObjectPart(ctx, s.bucketName, bucketPath, uploadID, num, bytes.NewReader(buf[:partLen]), partLen, partOpts)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, minio.CompletePart{PartNumber: num, ETag: p.ETag})
+	}
+
+	_, err = core.CompleteMultipartUpload(ctx, s.bucketName, bucketPath, uploadID, parts, opts)
+	return err
+}
+
+// incompleteUpload returns the latest incomplete multipart upload of the object and its uploaded parts
+func (s *S3) incompleteUpload(ctx context.Context, core minio.Core, bucketPath string) (uploadID string, parts map[int]minio.ObjectPart, err error) {
+	var initiated time.Time
+	for u := range s.client.ListIncompleteUploads(ctx, s.bucketName, bucketPath, false) {
+		if u.Err != nil {
+			return "", nil, u.Err
+		}
+		if u.Key == bucketPath && u.Initiated.After(initiated) {
+			uploadID, initiated = u.UploadID, u.Initiated
+		}
+	}
+	if uploadID == "" {
+		return
+	}
+
+	parts = make(map[int]minio.ObjectPart)
+	for marker := 0; ; {
+		res, err := core.ListObjectParts(ctx, s.bucketName, bucketPath, uploadID, marker, 1000)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, p := range res.ObjectParts {
+			parts[p.PartNumber] = p
+		}
+		if !res.IsTruncated {
+			break
+		}
+		marker = res.NextPartNumberMarker
+	}
+
+	return
+}
+
+// abortStaleUploads aborts multipart uploads left by interrupted deliveries.
+// Some S3 implementations (e.g. MinIO) list uploads only by the exact object name and expire stale uploads by themselves.
+func (s *S3) abortStaleUploads(logCh chan logger.LogRecord, jobName, dir string) {
+	core := minio.Core{Client: s.client}
+	for u := range s.client.ListIncompleteUploads(context.Background(), s.bucketName, dir+"/", true) {
+		if u.Err != nil {
+			logCh <- logger.Log(jobName, s.name).Warnf("Failed to list incomplete uploads: %s", u.Err)
+			return
+		}
+		if err := core.AbortMultipartUpload(context.Background(), s.bucketName, u.Key, u.UploadID); err != nil {
+			logCh <- logger.Log(jobName, s.name).Warnf("Failed to abort stale upload of object '%s': %s", u.Key, err)
+		} else {
+			logCh <- logger.Log(jobName, s.name).Infof("Aborted stale upload of object '%s'", u.Key)
+		}
+	}
+}
+
+func (s *S3) DeliveryBackupStream(logCh chan logger.LogRecord, jobName, tmpBackupFile, ofs, bakType string, src io.Reader) error {
+	bakRemPaths := GetDescBackupDstList(tmpBackupFile, ofs, s.backupPath, s.Retention)
+	if len(bakRemPaths) == 0 {
+		return nil
+	}
+
+	// the size of stream is unknown, so the object is uploaded by parts
+	// failed multipart upload is aborted by client, partial object isn't created
+	bucketPath := bakRemPaths[0]
+	putOpts := s.putOptions(bucketPath, "application/octet-stream", jobName, ofs, bakType)
+	putOpts.PartSize = streamPartSize
+	res, err := s.client.PutObject(context.Background(), s.bucketName, bucketPath, files.GetLimitedReader(src, s.rateLimit), -1, putOpts)
+	if err != nil {
+		logCh <- logger.Log(jobName, s.name).Errorf("Failed to upload object '%s' to bucket %s. Error: %v", bucketPath, s.bucketName, err)
+		logCh <- logger.Log(jobName, s.name).Debugf("Response: %+v\n", res)
+		return err
+	}
+	logCh <- logger.Log(jobName, s.name).Infof("Successfully uploaded object '%s' to bucket %s", bucketPath, s.bucketName)
+
+	// other copies are made on the server side, since the stream can't be read twice
+	for _, dstPath := range bakRemPaths[1:] {
+		_, err = s.client.ComposeObject(context.Background(),
+			s.copyDestOptions(dstPath, "application/octet-stream", jobName, ofs, bakType),
+			minio.CopySrcOptions{Bucket: s.bucketName, Object: bucketPath, Encryption: s.customerSSE()},
+		)
+		if err != nil {
+			logCh <- logger.Log(jobName, s.name).Errorf("Failed to copy object '%s' to '%s' in bucket %s. Error: %v", bucketPath, dstPath, s.bucketName, err)
 			return err
 		}
-		res, err := s.client.PutObject(context.Background(), s.bucketName, bucketPath, source, sourceStat.Size(), minio.PutObjectOptions{ContentType: "application/octet-stream"})
+		logCh <- logger.Log(jobName, s.name).Infof("Successfully copied object '%s' to '%s' in bucket %s", bucketPath, dstPath, s.bucketName)
+	}
+
+	return s.deliveryChecksum(logCh, jobName, tmpBackupFile, ofs, bakType, bakRemPaths)
+}
+
+func (s *S3) deliveryChecksum(logCh chan logger.LogRecord, jobName, tmpBackupFile, ofs, bakType string, bakRemPaths []string) error {
+	sumRemPaths := GetChecksumDstList(tmpBackupFile, bakRemPaths)
+	if len(sumRemPaths) == 0 {
+		return nil
+	}
+
+	sum, err := os.ReadFile(tmpBackupFile + checksum.Ext)
+	if err != nil {
+		return err
+	}
+	for _, bucketPath := range sumRemPaths {
+		_, err = s.client.PutObject(context.Background(), s.bucketName, bucketPath, bytes.NewReader(sum), int64(len(sum)), s.putOptions(bucketPath, "text/plain", jobName, ofs, bakType))
 		if err != nil {
 			logCh <- logger.Log(jobName, s.name).Errorf("Failed to upload object '%s' to bucket %s. Error: %v", bucketPath, s.bucketName, err)
-			logCh <- logger.Log(jobName, s.name).Debugf("Response: %+v\n", res)
 			return err
 		}
-		logCh <- logger.Log(jobName, s.name).Infof("Successfully uploaded object '%s' to bucket %s", bucketPath, s.bucketName)
+		logCh <- logger.Log(jobName, s.name).Debugf("Successfully uploaded object '%s' to bucket %s", bucketPath, s.bucketName)
+	}
+
+	return nil
+}
+
+// putOptions returns the object upload options defined by the storage settings and the backup retention period
+func (s *S3) putOptions(objPath, contentType, jobName, ofs, bakType string) minio.PutObjectOptions {
+	opts := minio.PutObjectOptions{
+		ContentType:          contentType,
+		ServerSideEncryption: s.sse,
+		StorageClass:         s.getStorageClass(objPath),
+	}
+
+	if s.tagging {
+		opts.UserTags = map[string]string{
+			"job":    jobName,
+			"target": ofs,
+			"type":   bakType,
+		}
+	}
+
+	if s.lockMode != "" {
+		if until := s.getRetainUntil(objPath, bakType); until.After(time.Now()) {
+			opts.Mode = s.lockMode
+			opts.RetainUntilDate = until
+			// S3 requires the checksum of objects uploaded with retention
+			opts.SendContentMd5 = true
+		}
+	}
+
+	return opts
+}
+
+// copyDestOptions returns the server side copy options equivalent to the upload ones
+func (s *S3) copyDestOptions(objPath, contentType, jobName, ofs, bakType string) minio.CopyDestOptions {
+	po := s.putOptions(objPath, contentType, jobName, ofs, bakType)
+
+	opts := minio.CopyDestOptions{
+		Bucket:          s.bucketName,
+		Object:          objPath,
+		Encryption:      po.ServerSideEncryption,
+		UserTags:        po.UserTags,
+		ReplaceTags:     po.UserTags != nil,
+		Mode:            po.Mode,
+		RetainUntilDate: po.RetainUntilDate,
+	}
+	// the storage class of the copy can be set only with the replaced metadata
+	if po.StorageClass != "" {
+		opts.ReplaceMetadata = true
+		opts.UserMetadata = map[string]string{
+			"Content-Type":        contentType,
+			"X-Amz-Storage-Class": po.StorageClass,
+		}
+	}
+
+	return opts
+}
+
+// getPeriod returns the retention period of the object by its directory
+func getPeriod(objPath string) string {
+	switch path.Base(path.Dir(objPath)) {
+	case Yearly.String():
+		return Yearly.String()
+	case Monthly.String(), "year":
+		return Monthly.String()
+	case Weekly.String():
+		return Weekly.String()
+	}
+	return Daily.String()
+}
+
+func (s *S3) getStorageClass(objPath string) string {
+	if class := s.periodClasses[getPeriod(objPath)]; class != "" {
+		return class
+	}
+	return s.storageClass
+}
+
+// ObjectLocked reports whether the objects are locked for their retention period
+func (s *S3) ObjectLocked() bool { return s.lockMode != "" }
+
+// getRetainUntil returns the date the object is locked until, the lock expires before the rotation deletes the object
+func (s *S3) getRetainUntil(objPath, bakType string) time.Time {
+	now := time.Now()
+
+	// incremental backups month dirs are deleted when the month is out of the number of months kept
+	if bakType == string(misc.IncFiles) {
+		return time.Date(now.Year(), now.Month()+time.Month(s.Months)+1, 1, 0, 0, 0, 0, now.Location()).AddDate(0, 0, -1)
+	}
+
+	switch getPeriod(objPath) {
+	case Yearly.String():
+		return RetainUntil(Yearly, s.Retention, now)
+	case Monthly.String():
+		return RetainUntil(Monthly, s.Retention, now)
+	case Weekly.String():
+		return RetainUntil(Weekly, s.Retention, now)
+	default:
+		return RetainUntil(Daily, s.Retention, now)
+	}
+}
+
+// isLocked reports whether the object version is kept by its retention, it can't be deleted until the retention expires
+func (s *S3) isLocked(key, versionID string) bool {
+	if s.lockMode == "" {
+		return false
 	}
+	_, until, err := s.client.GetObjectRetention(context.Background(), s.bucketName, key, versionID)
+	return err == nil && until != nil && until.After(time.Now())
+}
 
+// customerSSE returns the customer provided key, it is required to read objects encrypted with SSE-C
+func (s *S3) customerSSE() encrypt.ServerSide {
+	if s.sse != nil && s.sse.Type() == encrypt.SSEC {
+		return s.sse
+	}
 	return nil
 }
 
@@ -154,20 +536,38 @@ func (s *S3) DeleteOldBackups(logCh chan logger.LogRecord, ofs string, job inter
 		return nil
 	}
 
-	curDate := time.Now().Round(24 * time.Hour)
-
 	objCh := make(chan minio.ObjectInfo)
 
 	// Send object that are needed to be removed to objCh
 	filesList := make(map[string][]minio.ObjectInfo)
+	rules := make(map[string]RotationRule)
 
 	backupDir := path.Join(s.backupPath, ofs)
+	if !s.IsDryRun() {
+		s.abortStaleUploads(logCh, job.GetName(), backupDir)
+	}
 
-	for object := range s.client.ListObjects(context.Background(), s.bucketName, minio.ListObjectsOptions{Recursive: true, Prefix: backupDir}) {
+	pins, err := LoadPins(job.GetCatalog(), job.GetName(), ofs, s.name)
+	if err != nil {
+		logCh <- logger.Log(job.GetName(), s.name).Errorf("Backup rotate skipped. Failed to read pinned backups: %s", err)
+		return err
+	}
+	if job.GetType() == misc.IncFiles && full && pins.Holds(backupDir) {
+		logCh <- logger.Log(job.GetName(), s.name).Warnf("Directory '%s' contains pinned backups. Skipping delete.", backupDir)
+		return nil
+	}
+
+	// the objects of the bucket with object lock are versioned, the versions are deleted since the object deletion
+	// only hides it by the delete marker
+	listOpts := minio.ListObjectsOptions{Recursive: true, Prefix: backupDir, WithVersions: s.lockMode != ""}
+	for object := range s.client.ListObjects(context.Background(), s.bucketName, listOpts) {
 		if object.Err != nil {
 			logCh <- logger.Log(job.GetName(), s.name).Errorf("Failed get objects: '%s'", object.Err)
 			return object.Err
 		}
+		if object.IsDeleteMarker {
+			continue
+		}
 
 		if job.GetType() == misc.IncFiles {
 			if full {
@@ -184,30 +584,38 @@ func (s *S3) DeleteOldBackups(logCh chan logger.LogRecord, ofs string, job inter
 					lastMonth += 12
 				}
 				rx := regexp.MustCompile(year + "/month_\\d\\d")
-				if rx.MatchString(object.Key) {
+				if loc := rx.FindStringIndex(object.Key); loc != nil {
+					if pins.Holds(object.Key[:loc[1]]) {
+						continue
+					}
 					dirParts := strings.Split(path.Base(object.Key), "_")
 					dirMonth, _ := strconv.Atoi(dirParts[1])
 					if dirMonth < lastMonth {
 						filesList["inc"] = append(filesList["inc"], object)
+						rules["inc"] = IncRule(year, lastMonth)
 					}
 				}
 			}
 		} else {
-			if object.LastModified.Location() != curDate.Location() {
-				curDate = curDate.In(object.LastModified.Location())
-			}
-
-			if strings.Contains(object.Key, Daily.String()) && s.Retention.Days > 0 {
-				if s.Retention.UseCount || object.LastModified.Before(curDate.AddDate(0, 0, -s.Retention.Days+1)) {
-					filesList["daily"] = append(filesList["daily"], object)
+			periodDir := path.Base(path.Dir(object.Key))
+			for _, p := range RetentionPeriodsList {
+				if p.String() != periodDir {
+					continue
+				}
+				retentionCount, retentionDate := GetRetention(p, s.Retention)
+				if retentionCount == 0 && retentionDate.IsZero() {
+					break
 				}
-			} else if strings.Contains(object.Key, Weekly.String()) && s.Retention.Weeks > 0 && misc.GetDateTimeNow("dow") == misc.WeeklyBackupDay {
-				if s.Retention.UseCount || object.LastModified.Before(curDate.AddDate(0, 0, -s.Retention.Weeks*7+1)) {
-					filesList["weekly"] = append(filesList["weekly"], object)
+				if pins.Pinned(object.Key) {
+					logCh <- logger.Log(job.GetName(), s.name).Debugf("Backup file '%s' is pinned. Skipping rotate.", object.Key)
+					break
 				}
-			} else if strings.Contains(object.Key, Monthly.String()) && s.Retention.Weeks > 0 && misc.GetDateTimeNow("dom") == misc.MonthlyBackupDay {
-				if s.Retention.UseCount || object.LastModified.Before(curDate.AddDate(0, -s.Retention.Months, 1)) {
-					filesList["monthly"] = append(filesList["monthly"], object)
+				if retentionDate.Location() != object.LastModified.Location() {
+					retentionDate = retentionDate.In(object.LastModified.Location())
+				}
+				if s.Retention.UseCount || object.LastModified.Before(retentionDate) {
+					filesList[periodDir] = append(filesList[periodDir], object)
+					rules[periodDir] = s.Rule(p, retentionCount, retentionDate)
 				}
 			}
 		}
@@ -218,6 +626,7 @@ func (s *S3) DeleteOldBackups(logCh chan logger.LogRecord, ofs string, job inter
 		for period, s3Files := range filesList {
 			needSort := true
 			retentionCount := 0
+			rule := rules[period]
 			switch period {
 			case "inc":
 				needSort = false
@@ -227,9 +636,13 @@ func (s *S3) DeleteOldBackups(logCh chan logger.LogRecord, ofs string, job inter
 				retentionCount = s.Retention.Weeks
 			case "monthly":
 				retentionCount = s.Retention.Months
+			case "yearly":
+				retentionCount = s.Retention.Years
 			}
 
 			if needSort && s.Retention.UseCount {
+				var sums []minio.ObjectInfo
+				s3Files, sums = SplitChecksums(s3Files, func(f minio.ObjectInfo) string { return f.Key })
 				sort.Slice(s3Files, func(i, j int) bool {
 					return s3Files[i].LastModified.Before(s3Files[j].LastModified)
 				})
@@ -237,14 +650,19 @@ func (s *S3) DeleteOldBackups(logCh chan logger.LogRecord, ofs string, job inter
 				if !job.IsBackupSafety() {
 					retentionCount--
 				}
+				rule.Count = retentionCount
 				if retentionCount <= len(s3Files) {
 					s3Files = s3Files[:len(s3Files)-retentionCount]
 				} else {
 					s3Files = s3Files[:0]
 				}
+				s3Files = AppendChecksums(s3Files, sums, func(f minio.ObjectInfo) string { return f.Key })
 			}
 
 			for _, file := range s3Files {
+				if s.Planned(RotationAction{Job: job.GetName(), Storage: s.name, Target: ofs, Path: file.Key, RotationRule: rule}) {
+					continue
+				}
 				logCh <- logger.Log(job.GetName(), s.name).Infof("File '%s' going to be deleted", file.Key)
 				objCh <- file
 			}
@@ -252,13 +670,21 @@ func (s *S3) DeleteOldBackups(logCh chan logger.LogRecord, ofs string, job inter
 	}()
 
 	if s.batchDeletion {
-		for err := range s.client.RemoveObjects(context.Background(), s.bucketName, objCh, minio.RemoveObjectsOptions{GovernanceBypass: true}) {
+		for err := range s.client.RemoveObjects(context.Background(), s.bucketName, objCh, minio.RemoveObjectsOptions{}) {
+			if s.isLocked(err.ObjectName, err.VersionID) {
+				logCh <- logger.Log(job.GetName(), s.name).Warnf("Object '%s' is locked by its retention. Skipping delete.", err.ObjectName)
+				continue
+			}
 			logCh <- logger.Log(job.GetName(), s.name).Errorf("Error detected during multiple objects deletion: '%s'", err)
 			return err.Err
 		}
 	} else {
 		for object := range objCh {
-			if err := s.client.RemoveObject(context.Background(), s.bucketName, object.Key, minio.RemoveObjectOptions{GovernanceBypass: true}); err != nil {
+			if err := s.client.RemoveObject(context.Background(), s.bucketName, object.Key, minio.RemoveObjectOptions{VersionID: object.VersionID}); err != nil {
+				if s.isLocked(object.Key, object.VersionID) {
+					logCh <- logger.Log(job.GetName(), s.name).Warnf("Object '%s' is locked by its retention. Skipping delete.", object.Key)
+					continue
+				}
 				logCh <- logger.Log(job.GetName(), s.name).Errorf("Error detected during single object deletion: '%s'", err)
 				return err
 			}
@@ -267,8 +693,8 @@ func (s *S3) DeleteOldBackups(logCh chan logger.LogRecord, ofs string, job inter
 	return nil
 }
 
-func (s *S3) GetFileReader(ofsPath string) (io.Reader, error) {
-	_, err := s.client.StatObject(context.Background(), s.bucketName, path.Join(s.backupPath, ofsPath), minio.StatObjectOptions{})
+func (s *S3) GetFileReader(ofsPath string) (io.ReadCloser, error) {
+	_, err := s.client.StatObject(context.Background(), s.bucketName, path.Join(s.backupPath, ofsPath), minio.StatObjectOptions{ServerSideEncryption: s.customerSSE()})
 	if err != nil {
 		var rErr minio.ErrorResponse
 		if errors.As(err, &rErr) {
@@ -279,19 +705,77 @@ func (s *S3) GetFileReader(ofsPath string) (io.Reader, error) {
 		return nil, err
 	}
 
-	o, err := s.client.GetObject(context.Background(), s.bucketName, path.Join(s.backupPath, ofsPath), minio.GetObjectOptions{})
+	o, err := s.client.GetObject(context.Background(), s.bucketName, path.Join(s.backupPath, ofsPath), minio.GetObjectOptions{ServerSideEncryption: s.customerSSE()})
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = o.Close() }()
 
-	var buf []byte
-	buf, err = io.ReadAll(o)
+	return s.cipher.DecryptReadCloser(o)
+}
+
+// PutFile uploads the file copied from another storage as is
+func (s *S3) PutFile(logCh chan logger.LogRecord, jobName, ofs, bakType, ofsPath string, src io.Reader) error {
+	bucketPath := path.Join(s.backupPath, ofsPath)
+	contentType := "application/octet-stream"
+	if checksum.IsManifest(ofsPath) {
+		contentType = "text/plain"
+	}
+	opts := s.putOptions(bucketPath, contentType, jobName, ofs, bakType)
+
+	var err error
+	if rs, ok := src.(io.ReadSeeker); ok {
+		var size int64
+		if size, err = rs.Seek(0, io.SeekEnd); err == nil {
+			limited := struct {
+				io.Reader
+				io.Seeker
+			}{files.GetLimitedReader(rs, s.rateLimit), rs}
+			err = s.putFile(logCh, jobName, bucketPath, limited, size, opts)
+		}
+	} else {
+		_, err = s.client.PutObject(context.Background(), s.bucketName, bucketPath, files.GetLimitedReader(src, s.rateLimit), -1, opts)
+	}
+	if err != nil {
+		logCh <- logger.Log(jobName, s.name).Errorf("Failed to upload object '%s' to bucket %s. Error: %v", bucketPath, s.bucketName, err)
+		return err
+	}
+	logCh <- logger.Log(jobName, s.name).Infof("Successfully uploaded object '%s' to bucket %s", bucketPath, s.bucketName)
+
+	return nil
+}
+
+func (s *S3) DeleteFile(ofsPath string) error {
+	return s.client.RemoveObject(context.Background(), s.bucketName, path.Join(s.backupPath, ofsPath), minio.RemoveObjectOptions{})
+}
+
+// PutLink makes the copy of the backup synced from another storage as the server side copy of the one already synced
+func (s *S3) PutLink(logCh chan logger.LogRecord, jobName, ofs, bakType, ofsPath, targetOfsPath string) error {
+	srcPath := path.Join(s.backupPath, targetOfsPath)
+	dstPath := path.Join(s.backupPath, ofsPath)
+	contentType := "application/octet-stream"
+	if checksum.IsManifest(ofsPath) {
+		contentType = "text/plain"
+	}
+
+	_, err := s.client.ComposeObject(context.Background(),
+		s.copyDestOptions(dstPath, contentType, jobName, ofs, bakType),
+		minio.CopySrcOptions{Bucket: s.bucketName, Object: srcPath, Encryption: s.customerSSE()},
+	)
 	if err != nil {
-		return nil, err
+		logCh <- logger.Log(jobName, s.name).Errorf("Failed to copy object '%s' to '%s' in bucket %s. Error: %v", srcPath, dstPath, s.bucketName, err)
+		return err
 	}
+	logCh <- logger.Log(jobName, s.name).Infof("Successfully copied object '%s' to '%s' in bucket %s", srcPath, dstPath, s.bucketName)
 
-	return bytes.NewReader(buf), err
+	return nil
+}
+
+func (s *S3) FileSize(ofsPath string) (int64, error) {
+	obj, err := s.client.StatObject(context.Background(), s.bucketName, path.Join(s.backupPath, ofsPath), minio.StatObjectOptions{ServerSideEncryption: s.customerSSE()})
+	if err != nil {
+		return 0, err
+	}
+	return obj.Size, nil
 }
 
 func (s *S3) ListBackups(ofsPath string) ([]string, error) {
@@ -21,6 +21,8 @@ import (
 
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backend/files"
 	"github.com/nixys/nxs-backup/modules/logger"
 	. "github.com/nixys/nxs-backup/modules/storage"
@@ -32,7 +34,10 @@ type SFTP struct {
 	backupPath    string
 	rateLimit     int64
 	rotateEnabled bool
+	cipher        *crypt.Cipher
+	resume        bool
 	Retention
+	DryRun
 }
 
 type Opts struct {
@@ -95,10 +100,13 @@ func (s *SFTP) Configure(p Params) {
 	s.rateLimit = p.RateLimit
 	s.rotateEnabled = p.RotateEnabled
 	s.Retention = p.Retention
+	s.cipher = p.Cipher
 }
 
 func (s *SFTP) IsLocal() int { return 0 }
 
+func (s *SFTP) SetResume(resume bool) { s.resume = resume }
+
 func (s *SFTP) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFile, ofs, bakType string) (err error) {
 	var (
 		bakDstPath, mtdDstPath string
@@ -121,49 +129,84 @@ func (s *SFTP) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFil
 		}
 	}
 
-	// Make remote directories
-	rmDir := path.Dir(bakDstPath)
-	if err = s.client.MkdirAll(rmDir); err != nil {
-		logCh <- logger.Log(jobName, s.name).Errorf("Unable to create remote directory '%s': '%s'", rmDir, err)
+	srcFile, err := files.GetLimitedFileReader(tmpBackupFile, s.rateLimit)
+	if err != nil {
+		logCh <- logger.Log(jobName, s.name).Errorf("Unable to open tmp backup: '%s'", err)
 		return err
 	}
+	defer func() { _ = srcFile.Close() }()
+
+	return s.deliveryBackup(logCh, jobName, tmpBackupFile, bakDstPath, links, srcFile)
+}
 
-	dstFile, err := s.client.Create(bakDstPath)
+func (s *SFTP) DeliveryBackupStream(logCh chan logger.LogRecord, jobName, tmpBackupFile, ofs, bakType string, src io.Reader) error {
+	bakDstPath, links, err := GetDescBackupDstAndLinks(tmpBackupFile, ofs, s.backupPath, s.Retention)
 	if err != nil {
-		logCh <- logger.Log(jobName, s.name).Errorf("Unable to create remote file: %s", err)
+		logCh <- logger.Log(jobName, s.name).Errorf("Unable to get destination path and links: '%s'", err)
 		return err
 	}
-	defer func() { _ = dstFile.Close() }()
 
-	srcFile, err := files.GetLimitedFileReader(tmpBackupFile, s.rateLimit)
-	if err != nil {
-		logCh <- logger.Log(jobName, s.name).Errorf("Unable to open tmp backup: '%s'", err)
+	return s.deliveryBackup(logCh, jobName, tmpBackupFile, bakDstPath, links, files.GetLimitedReader(src, s.rateLimit))
+}
+
+func (s *SFTP) deliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFile, bakDstPath string, links map[string]string, src io.Reader) error {
+	// Make remote directories
+	rmDir := path.Dir(bakDstPath)
+	if err := s.client.MkdirAll(rmDir); err != nil {
+		logCh <- logger.Log(jobName, s.name).Errorf("Unable to create remote directory '%s': '%s'", rmDir, err)
 		return err
 	}
-	defer func() { _ = srcFile.Close() }()
 
-	_, err = io.Copy(dstFile, srcFile)
-	if err != nil {
+	if err := s.upload(src, bakDstPath); err != nil {
 		logCh <- logger.Log(jobName, s.name).Errorf("Unable to upload file: %s", err)
 		return err
 	}
-	logCh <- logger.Log(jobName, s.name).Infof("file %s uploaded", dstFile.Name())
+	logCh <- logger.Log(jobName, s.name).Infof("file %s uploaded", bakDstPath)
 
 	for dst, src := range links {
 		rmDir = path.Dir(dst)
-		err = s.client.MkdirAll(rmDir)
+		err := s.client.MkdirAll(rmDir)
 		if err != nil {
 			logCh <- logger.Log(jobName, s.name).Errorf("Unable to create remote directory '%s': '%s'", rmDir, err)
-			return
+			return err
 		}
+		_ = s.client.Remove(dst)
 		err = s.client.Symlink(src, dst)
 		if err != nil {
 			logCh <- logger.Log(jobName, s.name).Errorf("Unable to create symlink: %s", err)
-			return
+			return err
 		}
 	}
 
-	return
+	if sumDst, sumLinks := GetChecksumDstAndLinks(tmpBackupFile, bakDstPath, links); sumDst != "" {
+		return s.deliveryChecksum(logCh, jobName, tmpBackupFile, sumDst, sumLinks)
+	}
+
+	return nil
+}
+
+func (s *SFTP) deliveryChecksum(logCh chan logger.LogRecord, jobName, tmpBackupFile, sumDst string, sumLinks map[string]string) error {
+	sum, err := os.ReadFile(tmpBackupFile + checksum.Ext)
+	if err != nil {
+		logCh <- logger.Log(jobName, s.name).Errorf("Unable to read checksum manifest: '%s'", err)
+		return err
+	}
+
+	if err = s.upload(bytes.NewReader(sum), sumDst); err != nil {
+		logCh <- logger.Log(jobName, s.name).Errorf("Unable to upload checksum manifest: %s", err)
+		return err
+	}
+	logCh <- logger.Log(jobName, s.name).Debugf("file %s uploaded", sumDst)
+
+	for dst, src := range sumLinks {
+		_ = s.client.Remove(dst)
+		if err = s.client.Symlink(src, dst); err != nil {
+			logCh <- logger.Log(jobName, s.name).Errorf("Unable to create symlink: %s", err)
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (s *SFTP) deliveryBackupMetadata(logCh chan logger.LogRecord, jobName, tmpBackupFile, mtdDstPath string) error {
@@ -176,21 +219,13 @@ func (s *SFTP) deliveryBackupMetadata(logCh chan logger.LogRecord, jobName, tmpB
 		return err
 	}
 
-	_ = s.client.Remove(mtdDstPath)
-	mtdDst, err := s.client.Create(mtdDstPath)
-	if err != nil {
-		return err
-	}
-	defer func() { _ = mtdDst.Close() }()
-
 	mtdSrc, err := files.GetLimitedFileReader(mtdSrcPath, s.rateLimit)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = mtdSrc.Close() }()
 
-	_, err = io.Copy(mtdDst, mtdSrc)
-	if err != nil {
+	if err = s.upload(mtdSrc, mtdDstPath); err != nil {
 		logCh <- logger.Log(jobName, s.name).Errorf("Unable to make copy: %s", err)
 		return err
 	}
@@ -199,23 +234,108 @@ func (s *SFTP) deliveryBackupMetadata(logCh chan logger.LogRecord, jobName, tmpB
 	return nil
 }
 
+// upload writes the file under the temporary name and renames it after the upload is complete.
+// The partial file is kept on failure, so the upload can be resumed from its end. Stale ones are deleted by rotation.
+func (s *SFTP) upload(src io.Reader, dstPath string) error {
+	var (
+		dstFile *sftp.File
+		offset  int64
+		done    bool
+		err     error
+	)
+	partPath := dstPath + PartExt
+
+	if s.resume && Resumable(dstPath) {
+		offset, done, err = ResumeOffset(src, s.fileSize(partPath), s.fileSize(dstPath))
+		if err != nil || done {
+			return err
+		}
+	}
+
+	if offset > 0 {
+		dstFile, err = s.client.OpenFile(partPath, os.O_WRONLY)
+		if err == nil {
+			_, err = dstFile.Seek(offset, io.SeekStart)
+		}
+	} else {
+		dstFile, err = s.client.Create(partPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dstFile, src)
+	if cErr := dstFile.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.rename(partPath, dstPath)
+}
+
+// fileSize returns the size of the remote file or -1 if it can't be got
+func (s *SFTP) fileSize(p string) int64 {
+	fi, err := s.client.Stat(p)
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
+
+// rename replaces the destination file, the atomic rename is used if the server supports it
+func (s *SFTP) rename(oldPath, newPath string) error {
+	if err := s.client.PosixRename(oldPath, newPath); err == nil {
+		return nil
+	}
+	_ = s.client.Remove(newPath)
+	return s.client.Rename(oldPath, newPath)
+}
+
+// deleteStaleParts deletes files left by interrupted uploads
+func (s *SFTP) deleteStaleParts(logCh chan logger.LogRecord, jobName, ofsPart string) {
+	walker := s.client.Walk(path.Join(s.backupPath, ofsPart))
+	for walker.Step() {
+		if walker.Err() != nil || walker.Stat().IsDir() || !IsPartFile(walker.Path()) {
+			continue
+		}
+		if err := s.client.Remove(walker.Path()); err != nil {
+			logCh <- logger.Log(jobName, s.name).Warnf("Failed to delete stale partial upload '%s': %s", walker.Path(), err)
+		} else {
+			logCh <- logger.Log(jobName, s.name).Infof("Deleted stale partial upload '%s'", walker.Path())
+		}
+	}
+}
+
 func (s *SFTP) DeleteOldBackups(logCh chan logger.LogRecord, ofsPart string, job interfaces.Job, full bool) error {
 	if !s.rotateEnabled {
 		logCh <- logger.Log(job.GetName(), s.name).Debugf("Backup rotate skipped by config.")
 		return nil
 	}
 
+	if !s.IsDryRun() {
+		s.deleteStaleParts(logCh, job.GetName(), ofsPart)
+	}
+
+	pins, err := LoadPins(job.GetCatalog(), job.GetName(), ofsPart, s.name)
+	if err != nil {
+		logCh <- logger.Log(job.GetName(), s.name).Errorf("Backup rotate skipped. Failed to read pinned backups: %s", err)
+		return err
+	}
+
 	if job.GetType() == misc.IncFiles {
-		return s.deleteIncBackup(logCh, job.GetName(), ofsPart, full)
+		return s.deleteIncBackup(logCh, job.GetName(), ofsPart, full, pins)
 	} else {
-		return s.deleteDescBackup(logCh, job.GetName(), ofsPart, job.IsBackupSafety())
+		return s.deleteDescBackup(logCh, job.GetName(), ofsPart, job.IsBackupSafety(), pins)
 	}
 }
 
-func (s *SFTP) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart string, safety bool) error {
+func (s *SFTP) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart string, safety bool, pins *Pins) error {
+	// links of the backup file ordered from the longest retention period
 	type fileLinks struct {
-		wLink string
-		dLink string
+		links []string
+		rule  RotationRule
 	}
 	var errs *multierror.Error
 	filesMap := make(map[string]*fileLinks, 64)
@@ -236,6 +356,7 @@ func (s *SFTP) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart st
 			logCh <- logger.Log(jobName, s.name).Errorf("Failed to read files in remote directory '%s' with next error: %s", bakDir, err)
 			return err
 		}
+		files, _ = SplitPartFiles(files, func(f os.FileInfo) string { return f.Name() })
 
 		for _, file := range files {
 			fPath := path.Join(bakDir, file.Name())
@@ -250,19 +371,22 @@ func (s *SFTP) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart st
 				linkPath := filepath.Join(bakDir, link)
 
 				if fl, ok := filesMap[linkPath]; ok {
-					switch p {
-					case Weekly:
-						fl.wLink = fPath
-					case Daily:
-						fl.dLink = fPath
-					}
+					fl.links = append(fl.links, fPath)
 					filesMap[linkPath] = fl
 				}
 			}
 			filesMap[fPath] = &fileLinks{}
 		}
 
+		var pinned []os.FileInfo
+		files, pinned = SplitPinned(files, pins, func(f os.FileInfo) string { return f.Name() })
+		for _, file := range pinned {
+			logCh <- logger.Log(jobName, s.name).Debugf("Backup file '%s' is pinned. Skipping rotate.", path.Join(bakDir, file.Name()))
+		}
+
 		if s.Retention.UseCount {
+			var sums []os.FileInfo
+			files, sums = SplitChecksums(files, func(f os.FileInfo) string { return f.Name() })
 			sort.Slice(files, func(i, j int) bool {
 				return files[i].ModTime().Before(files[j].ModTime())
 			})
@@ -275,6 +399,7 @@ func (s *SFTP) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart st
 			} else {
 				files = files[:0]
 			}
+			files = AppendChecksums(files, sums, func(f os.FileInfo) string { return f.Name() })
 		} else {
 			i := 0
 			for _, file := range files {
@@ -290,57 +415,31 @@ func (s *SFTP) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart st
 			files = files[:i]
 		}
 
+		rule := s.Rule(p, retentionCount, retentionDate)
 		for _, file := range files {
 			if file.Name() == ".." || file.Name() == "." {
 				continue
 			}
 			fPath := path.Join(bakDir, file.Name())
+			filesMap[fPath].rule = rule
 			filesToDeleteMap[fPath] = filesMap[fPath]
 		}
 	}
 
 	for file, fl := range filesToDeleteMap {
-		delFile := true
-		moved := false
-		if fl.wLink != "" {
-			if _, toDel := filesToDeleteMap[fl.wLink]; !toDel {
-				delFile = false
-				if err := s.moveFile(file, fl.wLink); err != nil {
-					logCh <- logger.Log(jobName, s.name).Error(err)
-					errs = multierror.Append(errs, err)
-				} else {
-					logCh <- logger.Log(jobName, s.name).Debugf("Successfully moved old backup to %s", fl.wLink)
-					moved = true
-				}
-				if _, toDel = filesToDeleteMap[fl.dLink]; !toDel {
-					if err := s.client.Remove(fl.dLink); err != nil {
-						logCh <- logger.Log(jobName, s.name).Error(err)
-						errs = multierror.Append(errs, err)
-						break
-					}
-					relative, _ := filepath.Rel(filepath.Dir(fl.dLink), fl.wLink)
-					if err := s.client.Symlink(relative, fl.dLink); err != nil {
-						logCh <- logger.Log(jobName, s.name).Error(err)
-						errs = multierror.Append(errs, err)
-					} else {
-						logCh <- logger.Log(jobName, s.name).Debugf("Successfully changed symlink %s", fl.dLink)
-					}
-				}
-			}
-		}
-		if fl.dLink != "" && !moved {
-			if _, toDel := filesToDeleteMap[fl.dLink]; !toDel {
-				delFile = false
-				if err := s.moveFile(file, fl.dLink); err != nil {
-					logCh <- logger.Log(jobName, s.name).Error(err)
-					errs = multierror.Append(errs, err)
-				} else {
-					logCh <- logger.Log(jobName, s.name).Debugf("Successfully moved old backup to %s", fl.dLink)
-				}
+		// the backup is moved to the longest period link kept, the rest of the kept links are pointed to it
+		var keptLinks []string
+		for _, link := range fl.links {
+			if _, toDel := filesToDeleteMap[link]; !toDel {
+				keptLinks = append(keptLinks, link)
 			}
 		}
 
-		if delFile {
+		action := RotationAction{Job: jobName, Storage: s.name, Target: ofsPart, Path: file, RotationRule: fl.rule}
+		if len(keptLinks) == 0 {
+			if s.Planned(action) {
+				continue
+			}
 			if err := s.client.Remove(file); err != nil {
 				logCh <- logger.Log(jobName, s.name).Errorf("Failed to delete file '%s' with next error: %s",
 					file, err)
@@ -348,17 +447,48 @@ func (s *SFTP) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart st
 			} else {
 				logCh <- logger.Log(jobName, s.name).Infof("Deleted old backup file '%s'", file)
 			}
+			continue
+		}
+
+		action.MoveTo = keptLinks[0]
+		if s.Planned(action) {
+			continue
+		}
+		if err := s.moveFile(file, keptLinks[0]); err != nil {
+			logCh <- logger.Log(jobName, s.name).Error(err)
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		logCh <- logger.Log(jobName, s.name).Debugf("Successfully moved old backup to %s", keptLinks[0])
+
+		for _, link := range keptLinks[1:] {
+			if err := s.client.Remove(link); err != nil {
+				logCh <- logger.Log(jobName, s.name).Error(err)
+				errs = multierror.Append(errs, err)
+				continue
+			}
+			relative, _ := filepath.Rel(filepath.Dir(link), keptLinks[0])
+			if err := s.client.Symlink(relative, link); err != nil {
+				logCh <- logger.Log(jobName, s.name).Error(err)
+				errs = multierror.Append(errs, err)
+			} else {
+				logCh <- logger.Log(jobName, s.name).Debugf("Successfully changed symlink %s", link)
+			}
 		}
 	}
 
 	return errs.ErrorOrNil()
 }
 
-func (s *SFTP) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart string, full bool) error {
+func (s *SFTP) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart string, full bool, pins *Pins) error {
 	var errs *multierror.Error
 
 	if full {
 		backupDir := path.Join(s.backupPath, ofsPart)
+		if pins.Holds(backupDir) {
+			logCh <- logger.Log(jobName, s.name).Warnf("Directory '%s' contains pinned backups. Skipping delete.", backupDir)
+			return nil
+		}
 		if err := s.client.Remove(backupDir); err != nil {
 			if errors.Is(err, os.ErrNotExist) {
 				logCh <- logger.Log(jobName, s.name).Debugf("Directory '%s' not exist. Skipping delete.", backupDir)
@@ -397,6 +527,13 @@ func (s *SFTP) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart str
 				dirParts := strings.Split(dirName, "_")
 				dirMonth, _ := strconv.Atoi(dirParts[1])
 				if dirMonth < lastMonth {
+					if pins.Holds(path.Join(backupDir, dirName)) {
+						logCh <- logger.Log(jobName, s.name).Infof("Backup '%s' in directory '%s' contains pinned backups. Skipping delete.", dirName, backupDir)
+						continue
+					}
+					if s.Planned(RotationAction{Job: jobName, Storage: s.name, Target: ofsPart, Path: path.Join(backupDir, dirName), RotationRule: IncRule(year, lastMonth)}) {
+						continue
+					}
 					if err = s.client.Remove(path.Join(backupDir, dirName)); err != nil {
 						logCh <- logger.Log(jobName, s.name).Errorf("Failed to delete '%s' in dir '%s' with next error: %s",
 							dirName, backupDir, err)
@@ -412,20 +549,71 @@ func (s *SFTP) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart str
 	return errs.ErrorOrNil()
 }
 
-func (s *SFTP) GetFileReader(ofsPath string) (io.Reader, error) {
+func (s *SFTP) GetFileReader(ofsPath string) (io.ReadCloser, error) {
 	f, err := s.client.Open(path.Join(s.backupPath, ofsPath))
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = f.Close() }()
 
-	var buf []byte
-	buf, err = io.ReadAll(f)
+	return s.cipher.DecryptReadCloser(f)
+}
+
+// PutFile uploads the file copied from another storage as is
+func (s *SFTP) PutFile(logCh chan logger.LogRecord, jobName, _, _, ofsPath string, src io.Reader) error {
+	dstPath := path.Join(s.backupPath, ofsPath)
+	if err := s.client.MkdirAll(path.Dir(dstPath)); err != nil {
+		logCh <- logger.Log(jobName, s.name).Errorf("Unable to create remote directory '%s': '%s'", path.Dir(dstPath), err)
+		return err
+	}
+
+	if err := s.upload(files.GetLimitedReader(src, s.rateLimit), dstPath); err != nil {
+		logCh <- logger.Log(jobName, s.name).Errorf("Unable to upload file: %s", err)
+		return err
+	}
+	logCh <- logger.Log(jobName, s.name).Infof("File %s successfully uploaded", dstPath)
+
+	return nil
+}
+
+func (s *SFTP) DeleteFile(ofsPath string) error {
+	return s.client.Remove(path.Join(s.backupPath, ofsPath))
+}
+
+// DeleteDir removes the empty dir
+func (s *SFTP) DeleteDir(ofsPath string) error {
+	return s.client.RemoveDirectory(path.Join(s.backupPath, ofsPath))
+}
+
+// PutLink makes the copy of the backup synced from another storage as the symlink to the copy already synced
+func (s *SFTP) PutLink(logCh chan logger.LogRecord, jobName, _, _, ofsPath, targetOfsPath string) error {
+	dst := path.Join(s.backupPath, ofsPath)
+	relative, err := filepath.Rel(path.Dir(dst), path.Join(s.backupPath, targetOfsPath))
 	if err != nil {
-		return nil, err
+		return err
 	}
+	if err = s.client.MkdirAll(path.Dir(dst)); err != nil {
+		logCh <- logger.Log(jobName, s.name).Errorf("Unable to create remote directory '%s': '%s'", path.Dir(dst), err)
+		return err
+	}
+	if err = s.client.Symlink(relative, dst); err != nil {
+		logCh <- logger.Log(jobName, s.name).Errorf("Unable to make symlink: %s", err)
+		return err
+	}
+	logCh <- logger.Log(jobName, s.name).Infof("Successfully created symlink %s", dst)
 
-	return bytes.NewReader(buf), err
+	return nil
+}
+
+// FileSize returns the size of the backup file, the symlinks take no space
+func (s *SFTP) FileSize(ofsPath string) (int64, error) {
+	fi, err := s.client.Lstat(path.Join(s.backupPath, ofsPath))
+	if err != nil {
+		return 0, err
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return 0, nil
+	}
+	return fi.Size(), nil
 }
 
 func (s *SFTP) ListBackups(filePath string) (fl []string, err error) {
@@ -437,11 +625,11 @@ func (s *SFTP) ListBackups(filePath string) (fl []string, err error) {
 		err = walker.Err()
 		if err != nil {
 			if errors.Is(err, fs.ErrNotExist) {
-				err = fmt.Errorf("%s: %v", walker.Path(), err)
+				err = fmt.Errorf("%s: %w", walker.Path(), err)
 			}
 			return
 		}
-		if !walker.Stat().IsDir() {
+		if !walker.Stat().IsDir() && !IsPartFile(walker.Path()) {
 			fl = append(fl, walker.Path())
 		}
 	}
@@ -449,6 +637,17 @@ func (s *SFTP) ListBackups(filePath string) (fl []string, err error) {
 	return
 }
 
+// FreeSpace returns the space available in the backup path, requires the statvfs@openssh.com extension on the server
+func (s *SFTP) FreeSpace() (uint64, error) {
+	return NearestFreeSpace(s.backupPath, func(p string) (uint64, error) {
+		st, err := s.client.StatVFS(p)
+		if err != nil {
+			return 0, err
+		}
+		return st.Bavail * st.Frsize, nil
+	})
+}
+
 func (s *SFTP) Close() error {
 	return s.client.Close()
 }
@@ -1,7 +1,6 @@
 package smb
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"io/fs"
@@ -20,6 +19,8 @@ import (
 
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backend/files"
 	"github.com/nixys/nxs-backup/modules/logger"
 	. "github.com/nixys/nxs-backup/modules/storage"
@@ -32,7 +33,9 @@ type SMB struct {
 	backupPath    string
 	rateLimit     int64
 	rotateEnabled bool
+	cipher        *crypt.Cipher
 	Retention
+	DryRun
 }
 
 type Opts struct {
@@ -88,6 +91,7 @@ func (s *SMB) Configure(p Params) {
 	s.rateLimit = p.RateLimit
 	s.rotateEnabled = p.RotateEnabled
 	s.Retention = p.Retention
+	s.cipher = p.Cipher
 }
 
 func (s *SMB) IsLocal() int { return 0 }
@@ -110,7 +114,7 @@ func (s *SMB) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFile
 	}
 
 	if mtdDstPath != "" {
-		if err = s.copy(logCh, jobName, tmpBackupFile+".inc", bakDstPath); err != nil {
+		if err = s.copy(logCh, jobName, tmpBackupFile+".inc", mtdDstPath); err != nil {
 			logCh <- logger.Log(jobName, s.name).Errorf("Unable to upload tmp backup")
 			return
 		}
@@ -121,6 +125,25 @@ func (s *SMB) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFile
 		return
 	}
 
+	return s.deliveryLinks(logCh, jobName, tmpBackupFile, bakDstPath, links)
+}
+
+func (s *SMB) DeliveryBackupStream(logCh chan logger.LogRecord, jobName, tmpBackupFile, ofs, bakType string, src io.Reader) error {
+	bakDstPath, links, err := GetDescBackupDstAndLinks(tmpBackupFile, ofs, s.backupPath, s.Retention)
+	if err != nil {
+		logCh <- logger.Log(jobName, s.name).Errorf("Unable to get destination path and links: '%s'", err)
+		return err
+	}
+
+	if err = s.upload(logCh, jobName, files.GetLimitedReader(src, s.rateLimit), bakDstPath); err != nil {
+		logCh <- logger.Log(jobName, s.name).Errorf("Unable to upload backup stream")
+		return err
+	}
+
+	return s.deliveryLinks(logCh, jobName, tmpBackupFile, bakDstPath, links)
+}
+
+func (s *SMB) deliveryLinks(logCh chan logger.LogRecord, jobName, tmpBackupFile, bakDstPath string, links map[string]string) (err error) {
 	for dst, src := range links {
 		remDir := path.Dir(dst)
 		err = s.share.MkdirAll(remDir, os.ModeDir)
@@ -135,10 +158,34 @@ func (s *SMB) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackupFile
 		}
 	}
 
+	if sumDst, sumLinks := GetChecksumDstAndLinks(tmpBackupFile, bakDstPath, links); sumDst != "" {
+		if err = s.copy(logCh, jobName, tmpBackupFile+checksum.Ext, sumDst); err != nil {
+			logCh <- logger.Log(jobName, s.name).Errorf("Unable to upload checksum manifest")
+			return err
+		}
+		for dst, src := range sumLinks {
+			if err = s.share.Symlink(src, dst); err != nil {
+				logCh <- logger.Log(jobName, s.name).Errorf("Unable to make symlink: %s", err)
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
 func (s *SMB) copy(logCh chan logger.LogRecord, jobName, srcPath, dstPath string) (err error) {
+	srcFile, err := files.GetLimitedFileReader(srcPath, s.rateLimit)
+	if err != nil {
+		logCh <- logger.Log(jobName, s.name).Errorf("Unable to open '%s'", err)
+		return
+	}
+	defer func() { _ = srcFile.Close() }()
+
+	return s.upload(logCh, jobName, srcFile, dstPath)
+}
+
+func (s *SMB) upload(logCh chan logger.LogRecord, jobName string, src io.Reader, dstPath string) (err error) {
 	// Make remote directories
 	remDir := path.Dir(dstPath)
 	if err = s.share.MkdirAll(remDir, os.ModeDir); err != nil {
@@ -146,22 +193,24 @@ func (s *SMB) copy(logCh chan logger.LogRecord, jobName, srcPath, dstPath string
 		return
 	}
 
-	dstFile, err := s.share.Create(dstPath)
+	partPath := dstPath + PartExt
+	dstFile, err := s.share.Create(partPath)
 	if err != nil {
 		logCh <- logger.Log(jobName, s.name).Errorf("Unable to create remote file: %s", err)
 		return
 	}
-	defer func() { _ = dstFile.Close() }()
 
-	srcFile, err := files.GetLimitedFileReader(srcPath, s.rateLimit)
-	if err != nil {
-		logCh <- logger.Log(jobName, s.name).Errorf("Unable to open '%s'", err)
-		return
+	_, err = io.Copy(dstFile, src)
+	if cErr := dstFile.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		_ = s.share.Remove(dstPath)
+		err = s.share.Rename(partPath, dstPath)
 	}
-	defer func() { _ = srcFile.Close() }()
-
-	_, err = io.Copy(dstFile, srcFile)
 	if err != nil {
+		// partial file is useless
+		_ = s.share.Remove(partPath)
 		logCh <- logger.Log(jobName, s.name).Errorf("Unable to make copy: %s", err)
 	} else {
 		logCh <- logger.Log(jobName, s.name).Infof("File %s successfully uploaded", dstPath)
@@ -175,17 +224,28 @@ func (s *SMB) DeleteOldBackups(logCh chan logger.LogRecord, ofsPart string, job
 		return nil
 	}
 
+	if !s.IsDryRun() {
+		s.deleteStaleParts(logCh, job.GetName(), ofsPart)
+	}
+
+	pins, err := LoadPins(job.GetCatalog(), job.GetName(), ofsPart, s.name)
+	if err != nil {
+		logCh <- logger.Log(job.GetName(), s.name).Errorf("Backup rotate skipped. Failed to read pinned backups: %s", err)
+		return err
+	}
+
 	if job.GetType() == misc.IncFiles {
-		return s.deleteIncBackup(logCh, job.GetName(), ofsPart, full)
+		return s.deleteIncBackup(logCh, job.GetName(), ofsPart, full, pins)
 	} else {
-		return s.deleteDescBackup(logCh, job.GetName(), ofsPart, job.IsBackupSafety())
+		return s.deleteDescBackup(logCh, job.GetName(), ofsPart, job.IsBackupSafety(), pins)
 	}
 }
 
-func (s *SMB) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart string, safety bool) error {
+func (s *SMB) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart string, safety bool, pins *Pins) error {
+	// links of the backup file ordered from the longest retention period
 	type fileLinks struct {
-		wLink string
-		dLink string
+		links []string
+		rule  RotationRule
 	}
 	var errs *multierror.Error
 	filesMap := make(map[string]*fileLinks, 64)
@@ -206,6 +266,7 @@ func (s *SMB) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart str
 			logCh <- logger.Log(jobName, s.name).Errorf("Failed to read files in remote directory '%s' with next error: %s", bakDir, err)
 			return err
 		}
+		smbFiles, _ = SplitPartFiles(smbFiles, func(f fs.FileInfo) string { return f.Name() })
 
 		for _, file := range smbFiles {
 			fPath := path.Join(bakDir, file.Name())
@@ -220,19 +281,22 @@ func (s *SMB) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart str
 				linkPath := filepath.Join(bakDir, link)
 
 				if fl, ok := filesMap[linkPath]; ok {
-					switch p {
-					case Weekly:
-						fl.wLink = fPath
-					case Daily:
-						fl.dLink = fPath
-					}
+					fl.links = append(fl.links, fPath)
 					filesMap[linkPath] = fl
 				}
 			}
 			filesMap[fPath] = &fileLinks{}
 		}
 
+		var pinned []os.FileInfo
+		smbFiles, pinned = SplitPinned(smbFiles, pins, func(f os.FileInfo) string { return f.Name() })
+		for _, file := range pinned {
+			logCh <- logger.Log(jobName, s.name).Debugf("Backup file '%s' is pinned. Skipping rotate.", path.Join(bakDir, file.Name()))
+		}
+
 		if s.Retention.UseCount {
+			var sums []os.FileInfo
+			smbFiles, sums = SplitChecksums(smbFiles, func(f os.FileInfo) string { return f.Name() })
 			sort.Slice(smbFiles, func(i, j int) bool {
 				return smbFiles[i].ModTime().Before(smbFiles[j].ModTime())
 			})
@@ -245,6 +309,7 @@ func (s *SMB) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart str
 			} else {
 				smbFiles = smbFiles[:0]
 			}
+			smbFiles = AppendChecksums(smbFiles, sums, func(f os.FileInfo) string { return f.Name() })
 		} else {
 			i := 0
 			for _, file := range smbFiles {
@@ -260,58 +325,32 @@ func (s *SMB) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart str
 			smbFiles = smbFiles[:i]
 		}
 
+		rule := s.Rule(p, retentionCount, retentionDate)
 		for _, file := range smbFiles {
 			if file.Name() == ".." || file.Name() == "." {
 				continue
 			}
 
 			fPath := path.Join(bakDir, file.Name())
+			filesMap[fPath].rule = rule
 			filesToDeleteMap[fPath] = filesMap[fPath]
 		}
 	}
 
 	for file, fl := range filesToDeleteMap {
-		delFile := true
-		moved := false
-		if fl.wLink != "" {
-			if _, toDel := filesToDeleteMap[fl.wLink]; !toDel {
-				delFile = false
-				if err := s.moveFile(file, fl.wLink); err != nil {
-					logCh <- logger.Log(jobName, s.name).Error(err)
-					errs = multierror.Append(errs, err)
-				} else {
-					logCh <- logger.Log(jobName, s.name).Debugf("Successfully moved old backup to %s", fl.wLink)
-					moved = true
-				}
-				if _, toDel = filesToDeleteMap[fl.dLink]; !toDel {
-					if err := s.share.Remove(fl.dLink); err != nil {
-						logCh <- logger.Log(jobName, s.name).Error(err)
-						errs = multierror.Append(errs, err)
-						break
-					}
-					relative, _ := filepath.Rel(filepath.Dir(fl.dLink), fl.wLink)
-					if err := s.share.Symlink(relative, fl.dLink); err != nil {
-						logCh <- logger.Log(jobName, s.name).Error(err)
-						errs = multierror.Append(errs, err)
-					} else {
-						logCh <- logger.Log(jobName, s.name).Debugf("Successfully changed symlink %s", fl.dLink)
-					}
-				}
-			}
-		}
-		if fl.dLink != "" && !moved {
-			if _, toDel := filesToDeleteMap[fl.dLink]; !toDel {
-				delFile = false
-				if err := s.moveFile(file, fl.dLink); err != nil {
-					logCh <- logger.Log(jobName, s.name).Error(err)
-					errs = multierror.Append(errs, err)
-				} else {
-					logCh <- logger.Log(jobName, s.name).Debugf("Successfully moved old backup to %s", fl.dLink)
-				}
+		// the backup is moved to the longest period link kept, the rest of the kept links are pointed to it
+		var keptLinks []string
+		for _, link := range fl.links {
+			if _, toDel := filesToDeleteMap[link]; !toDel {
+				keptLinks = append(keptLinks, link)
 			}
 		}
 
-		if delFile {
+		action := RotationAction{Job: jobName, Storage: s.name, Target: ofsPart, Path: file, RotationRule: fl.rule}
+		if len(keptLinks) == 0 {
+			if s.Planned(action) {
+				continue
+			}
 			if err := s.share.Remove(file); err != nil {
 				logCh <- logger.Log(jobName, s.name).Errorf("Failed to delete file '%s' with next error: %s",
 					file, err)
@@ -319,17 +358,65 @@ func (s *SMB) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart str
 			} else {
 				logCh <- logger.Log(jobName, s.name).Infof("Deleted old backup file '%s'", file)
 			}
+			continue
+		}
+
+		action.MoveTo = keptLinks[0]
+		if s.Planned(action) {
+			continue
+		}
+		if err := s.moveFile(file, keptLinks[0]); err != nil {
+			logCh <- logger.Log(jobName, s.name).Error(err)
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		logCh <- logger.Log(jobName, s.name).Debugf("Successfully moved old backup to %s", keptLinks[0])
+
+		for _, link := range keptLinks[1:] {
+			if err := s.share.Remove(link); err != nil {
+				logCh <- logger.Log(jobName, s.name).Error(err)
+				errs = multierror.Append(errs, err)
+				continue
+			}
+			relative, _ := filepath.Rel(filepath.Dir(link), keptLinks[0])
+			if err := s.share.Symlink(relative, link); err != nil {
+				logCh <- logger.Log(jobName, s.name).Error(err)
+				errs = multierror.Append(errs, err)
+			} else {
+				logCh <- logger.Log(jobName, s.name).Debugf("Successfully changed symlink %s", link)
+			}
 		}
 	}
 
 	return errs.ErrorOrNil()
 }
 
-func (s *SMB) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart string, full bool) error {
+// deleteStaleParts deletes files left by interrupted uploads
+func (s *SMB) deleteStaleParts(logCh chan logger.LogRecord, jobName, ofsPart string) {
+	paths, err := s.listAll(ofsPart)
+	if err != nil {
+		return
+	}
+
+	_, parts := SplitPartFiles(paths, func(p string) string { return p })
+	for _, p := range parts {
+		if err = s.share.Remove(p); err != nil {
+			logCh <- logger.Log(jobName, s.name).Warnf("Failed to delete stale partial upload '%s': %s", p, err)
+		} else {
+			logCh <- logger.Log(jobName, s.name).Infof("Deleted stale partial upload '%s'", p)
+		}
+	}
+}
+
+func (s *SMB) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart string, full bool, pins *Pins) error {
 	var errs *multierror.Error
 
 	if full {
 		backupDir := path.Join(s.backupPath, ofsPart)
+		if pins.Holds(backupDir) {
+			logCh <- logger.Log(jobName, s.name).Warnf("Directory '%s' contains pinned backups. Skipping delete.", backupDir)
+			return nil
+		}
 
 		err := s.share.RemoveAll(backupDir)
 		if err != nil {
@@ -362,6 +449,13 @@ func (s *SMB) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart stri
 				dirParts := strings.Split(dirName, "_")
 				dirMonth, _ := strconv.Atoi(dirParts[1])
 				if dirMonth < lastMonth {
+					if pins.Holds(path.Join(backupDir, dirName)) {
+						logCh <- logger.Log(jobName, s.name).Infof("Backup '%s' in directory '%s' contains pinned backups. Skipping delete.", dirName, backupDir)
+						continue
+					}
+					if s.Planned(RotationAction{Job: jobName, Storage: s.name, Target: ofsPart, Path: path.Join(backupDir, dirName), RotationRule: IncRule(year, lastMonth)}) {
+						continue
+					}
 					if err = s.share.RemoveAll(path.Join(backupDir, dirName)); err != nil {
 						logCh <- logger.Log(jobName, s.name).Errorf("Failed to delete '%s' in dir '%s' with next error: %s",
 							dirName, backupDir, err)
@@ -377,23 +471,73 @@ func (s *SMB) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart stri
 	return errs.ErrorOrNil()
 }
 
-func (s *SMB) GetFileReader(ofsPath string) (io.Reader, error) {
+func (s *SMB) GetFileReader(ofsPath string) (io.ReadCloser, error) {
 	f, err := s.share.Open(path.Join(s.backupPath, ofsPath))
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = f.Close() }()
 
-	var buf []byte
-	buf, err = io.ReadAll(f)
+	return s.cipher.DecryptReadCloser(f)
+}
+
+// PutFile uploads the file copied from another storage as is
+func (s *SMB) PutFile(logCh chan logger.LogRecord, jobName, _, _, ofsPath string, src io.Reader) error {
+	return s.upload(logCh, jobName, files.GetLimitedReader(src, s.rateLimit), path.Join(s.backupPath, ofsPath))
+}
+
+func (s *SMB) DeleteFile(ofsPath string) error {
+	return s.share.Remove(path.Join(s.backupPath, ofsPath))
+}
+
+// DeleteDir removes the empty dir
+func (s *SMB) DeleteDir(ofsPath string) error {
+	return s.share.Remove(path.Join(s.backupPath, ofsPath))
+}
+
+// PutLink makes the copy of the backup synced from another storage as the symlink to the copy already synced
+func (s *SMB) PutLink(logCh chan logger.LogRecord, jobName, _, _, ofsPath, targetOfsPath string) error {
+	dst := path.Join(s.backupPath, ofsPath)
+	relative, err := filepath.Rel(path.Dir(dst), path.Join(s.backupPath, targetOfsPath))
+	if err != nil {
+		return err
+	}
+	if err = s.share.MkdirAll(path.Dir(dst), os.ModeDir); err != nil {
+		logCh <- logger.Log(jobName, s.name).Errorf("Unable to create remote directory '%s': '%s'", path.Dir(dst), err)
+		return err
+	}
+	if err = s.share.Symlink(relative, dst); err != nil {
+		logCh <- logger.Log(jobName, s.name).Errorf("Unable to make symlink: %s", err)
+		return err
+	}
+	logCh <- logger.Log(jobName, s.name).Infof("Successfully created symlink %s", dst)
+
+	return nil
+}
+
+// FileSize returns the size of the backup file, the symlinks take no space
+func (s *SMB) FileSize(ofsPath string) (int64, error) {
+	fi, err := s.share.Lstat(path.Join(s.backupPath, ofsPath))
+	if err != nil {
+		return 0, err
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return 0, nil
+	}
+	return fi.Size(), nil
+}
+
+func (s *SMB) ListBackups(ofsPath string) ([]string, error) {
+	paths, err := s.listAll(ofsPath)
 	if err != nil {
 		return nil, err
 	}
 
-	return bytes.NewReader(buf), err
+	paths, _ = SplitPartFiles(paths, func(p string) string { return p })
+	return paths, nil
 }
 
-func (s *SMB) ListBackups(ofsPath string) ([]string, error) {
+// listAll returns all files under the path including incomplete uploads
+func (s *SMB) listAll(ofsPath string) ([]string, error) {
 	bPath := path.Join(s.backupPath, ofsPath)
 
 	fl, err := s.listFiles(bPath)
@@ -441,6 +585,17 @@ func (s *SMB) listPaths(base string, fList []fs.FileInfo) ([]string, error) {
 	return paths, nil
 }
 
+func (s *SMB) FreeSpace() (uint64, error) {
+	return NearestFreeSpace(s.backupPath, func(p string) (uint64, error) {
+		fi, err := s.share.Statfs(p)
+		if err != nil {
+			return 0, err
+		}
+		// the client returns the bytes per sector as the block size and the sectors per allocation unit as the fragment size
+		return fi.AvailableBlockCount() * fi.FragmentSize() * fi.BlockSize(), nil
+	})
+}
+
 func (s *SMB) Close() error {
 	_ = s.share.Umount()
 	return s.session.Logoff()
@@ -1,7 +1,6 @@
 package webdav
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -18,6 +17,8 @@ import (
 
 	"github.com/nixys/nxs-backup/interfaces"
 	"github.com/nixys/nxs-backup/misc"
+	"github.com/nixys/nxs-backup/modules/backend/checksum"
+	"github.com/nixys/nxs-backup/modules/backend/crypt"
 	"github.com/nixys/nxs-backup/modules/backend/files"
 	"github.com/nixys/nxs-backup/modules/backend/webdav"
 	"github.com/nixys/nxs-backup/modules/logger"
@@ -30,7 +31,9 @@ type WebDav struct {
 	backupPath    string
 	rateLimit     int64
 	rotateEnabled bool
+	cipher        *crypt.Cipher
 	Retention
+	DryRun
 }
 
 type Opts struct {
@@ -66,6 +69,7 @@ func (wd *WebDav) Configure(p Params) {
 	wd.rateLimit = p.RateLimit
 	wd.rotateEnabled = p.RotateEnabled
 	wd.Retention = p.Retention
+	wd.cipher = p.Cipher
 }
 
 func (wd *WebDav) IsLocal() int { return 0 }
@@ -88,7 +92,7 @@ func (wd *WebDav) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackup
 	}
 
 	if mtdDstPath != "" {
-		if err = wd.copy(logCh, jobName, tmpBackupFile+".inc", bakDstPath); err != nil {
+		if err = wd.copy(logCh, jobName, tmpBackupFile+".inc", mtdDstPath); err != nil {
 			logCh <- logger.Log(jobName, wd.name).Errorf("Unable to upload tmp backup")
 			return
 		}
@@ -99,6 +103,25 @@ func (wd *WebDav) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackup
 		return
 	}
 
+	return wd.deliveryLinks(logCh, jobName, tmpBackupFile, bakDstPath, links)
+}
+
+func (wd *WebDav) DeliveryBackupStream(logCh chan logger.LogRecord, jobName, tmpBackupFile, ofs, bakType string, src io.Reader) error {
+	bakDstPath, links, err := GetDescBackupDstAndLinks(tmpBackupFile, ofs, wd.backupPath, wd.Retention)
+	if err != nil {
+		logCh <- logger.Log(jobName, wd.name).Errorf("Unable to get destination path and links: '%s'", err)
+		return err
+	}
+
+	if err = wd.upload(logCh, jobName, files.GetLimitedReader(src, wd.rateLimit), bakDstPath); err != nil {
+		logCh <- logger.Log(jobName, wd.name).Errorf("Unable to upload backup stream")
+		return err
+	}
+
+	return wd.deliveryLinks(logCh, jobName, tmpBackupFile, bakDstPath, links)
+}
+
+func (wd *WebDav) deliveryLinks(logCh chan logger.LogRecord, jobName, tmpBackupFile, bakDstPath string, links map[string]string) (err error) {
 	for dst, src := range links {
 		remDir := path.Dir(dst)
 		err = wd.mkDir(path.Dir(dst))
@@ -113,11 +136,34 @@ func (wd *WebDav) DeliveryBackup(logCh chan logger.LogRecord, jobName, tmpBackup
 		}
 	}
 
+	if sumDst, sumLinks := GetChecksumDstAndLinks(tmpBackupFile, bakDstPath, links); sumDst != "" {
+		if err = wd.copy(logCh, jobName, tmpBackupFile+checksum.Ext, sumDst); err != nil {
+			logCh <- logger.Log(jobName, wd.name).Errorf("Unable to upload checksum manifest")
+			return
+		}
+		for dst, src := range sumLinks {
+			if err = wd.client.Copy(src, dst); err != nil {
+				logCh <- logger.Log(jobName, wd.name).Errorf("Unable to make copy: %s", err)
+				return
+			}
+		}
+	}
+
 	return
 }
 
 func (wd *WebDav) copy(logCh chan logger.LogRecord, jobName, srcPath, dstPath string) (err error) {
+	srcFile, err := files.GetLimitedFileReader(srcPath, wd.rateLimit)
+	if err != nil {
+		logCh <- logger.Log(jobName, wd.name).Errorf("Unable to open '%s'", err)
+		return
+	}
+	defer func() { _ = srcFile.Close() }()
+
+	return wd.upload(logCh, jobName, srcFile, dstPath)
+}
 
+func (wd *WebDav) upload(logCh chan logger.LogRecord, jobName string, src io.Reader, dstPath string) (err error) {
 	// Make remote directories
 	remDir := path.Dir(dstPath)
 	if err = wd.mkDir(remDir); err != nil {
@@ -125,15 +171,14 @@ func (wd *WebDav) copy(logCh chan logger.LogRecord, jobName, srcPath, dstPath st
 		return
 	}
 
-	srcFile, err := files.GetLimitedFileReader(srcPath, wd.rateLimit)
-	if err != nil {
-		logCh <- logger.Log(jobName, wd.name).Errorf("Unable to open '%s'", err)
-		return
+	partPath := dstPath + PartExt
+	err = wd.client.Upload(partPath, src)
+	if err == nil {
+		err = wd.client.Move(partPath, dstPath)
 	}
-	defer func() { _ = srcFile.Close() }()
-
-	err = wd.client.Upload(dstPath, srcFile)
 	if err != nil {
+		// partial file is useless
+		_ = wd.client.Rm(partPath)
 		logCh <- logger.Log(jobName, wd.name).Errorf("Unable to upload file: %s", err)
 	} else {
 		logCh <- logger.Log(jobName, wd.name).Infof("File %s successfull uploaded", dstPath)
@@ -148,14 +193,24 @@ func (wd *WebDav) DeleteOldBackups(logCh chan logger.LogRecord, ofsPart string,
 		return nil
 	}
 
+	if !wd.IsDryRun() {
+		wd.deleteStaleParts(logCh, job.GetName(), ofsPart)
+	}
+
+	pins, err := LoadPins(job.GetCatalog(), job.GetName(), ofsPart, wd.name)
+	if err != nil {
+		logCh <- logger.Log(job.GetName(), wd.name).Errorf("Backup rotate skipped. Failed to read pinned backups: %s", err)
+		return err
+	}
+
 	if job.GetType() == misc.IncFiles {
-		return wd.deleteIncBackup(logCh, job.GetName(), ofsPart, full)
+		return wd.deleteIncBackup(logCh, job.GetName(), ofsPart, full, pins)
 	} else {
-		return wd.deleteDescBackup(logCh, job.GetName(), ofsPart, job.IsBackupSafety())
+		return wd.deleteDescBackup(logCh, job.GetName(), ofsPart, job.IsBackupSafety(), pins)
 	}
 }
 
-func (wd *WebDav) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart string, safety bool) error {
+func (wd *WebDav) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart string, safety bool, pins *Pins) error {
 	var errs *multierror.Error
 
 	for _, p := range RetentionPeriodsList {
@@ -174,7 +229,17 @@ func (wd *WebDav) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart
 			return err
 		}
 
+		wdFiles, _ = SplitPartFiles(wdFiles, func(f os.FileInfo) string { return f.Name() })
+
+		var pinned []os.FileInfo
+		wdFiles, pinned = SplitPinned(wdFiles, pins, func(f os.FileInfo) string { return f.Name() })
+		for _, file := range pinned {
+			logCh <- logger.Log(jobName, wd.name).Debugf("Backup file '%s' is pinned. Skipping rotate.", path.Join(bakDir, file.Name()))
+		}
+
 		if wd.Retention.UseCount {
+			var sums []os.FileInfo
+			wdFiles, sums = SplitChecksums(wdFiles, func(f os.FileInfo) string { return f.Name() })
 			sort.Slice(wdFiles, func(i, j int) bool {
 				return wdFiles[i].ModTime().Before(wdFiles[j].ModTime())
 			})
@@ -187,6 +252,7 @@ func (wd *WebDav) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart
 			} else {
 				wdFiles = wdFiles[:0]
 			}
+			wdFiles = AppendChecksums(wdFiles, sums, func(f os.FileInfo) string { return f.Name() })
 		} else {
 			i := 0
 			for _, file := range wdFiles {
@@ -202,7 +268,11 @@ func (wd *WebDav) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart
 			wdFiles = wdFiles[:i]
 		}
 
+		rule := wd.Rule(p, retentionCount, retentionDate)
 		for _, file := range wdFiles {
+			if wd.Planned(RotationAction{Job: jobName, Storage: wd.name, Target: ofsPart, Path: path.Join(bakDir, file.Name()), RotationRule: rule}) {
+				continue
+			}
 			err = wd.client.Rm(path.Join(bakDir, file.Name()))
 			if err != nil {
 				logCh <- logger.Log(jobName, wd.name).Errorf("Failed to delete file '%s' in remote directory '%s' with next error: %s",
@@ -217,11 +287,32 @@ func (wd *WebDav) deleteDescBackup(logCh chan logger.LogRecord, jobName, ofsPart
 	return errs.ErrorOrNil()
 }
 
-func (wd *WebDav) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart string, full bool) error {
+// deleteStaleParts deletes files left by interrupted uploads
+func (wd *WebDav) deleteStaleParts(logCh chan logger.LogRecord, jobName, ofsPart string) {
+	paths, err := wd.listAll(ofsPart)
+	if err != nil {
+		return
+	}
+
+	_, parts := SplitPartFiles(paths, func(p string) string { return p })
+	for _, p := range parts {
+		if err = wd.client.Rm(p); err != nil {
+			logCh <- logger.Log(jobName, wd.name).Warnf("Failed to delete stale partial upload '%s': %s", p, err)
+		} else {
+			logCh <- logger.Log(jobName, wd.name).Infof("Deleted stale partial upload '%s'", p)
+		}
+	}
+}
+
+func (wd *WebDav) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart string, full bool, pins *Pins) error {
 	var errs *multierror.Error
 
 	if full {
 		backupDir := path.Join(wd.backupPath, ofsPart)
+		if pins.Holds(backupDir) {
+			logCh <- logger.Log(jobName, wd.name).Warnf("Directory '%s' contains pinned backups. Skipping delete.", backupDir)
+			return nil
+		}
 
 		err := wd.client.Rm(backupDir)
 		if err != nil {
@@ -244,6 +335,9 @@ func (wd *WebDav) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart
 
 		dirs, err := wd.client.Ls(backupDir)
 		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
 			logCh <- logger.Log(jobName, wd.name).Errorf("Failed to get access to directory '%s' with next error: %v", backupDir, err)
 			return err
 		}
@@ -254,6 +348,13 @@ func (wd *WebDav) deleteIncBackup(logCh chan logger.LogRecord, jobName, ofsPart
 				dirParts := strings.Split(dirName, "_")
 				dirMonth, _ := strconv.Atoi(dirParts[1])
 				if dirMonth < lastMonth {
+					if pins.Holds(path.Join(backupDir, dirName)) {
+						logCh <- logger.Log(jobName, wd.name).Infof("Backup '%s' in directory '%s' contains pinned backups. Skipping delete.", dirName, backupDir)
+						continue
+					}
+					if wd.Planned(RotationAction{Job: jobName, Storage: wd.name, Target: ofsPart, Path: path.Join(backupDir, dirName), RotationRule: IncRule(year, lastMonth)}) {
+						continue
+					}
 					if err = wd.client.Rm(path.Join(backupDir, dirName)); err != nil {
 						logCh <- logger.Log(jobName, wd.name).Errorf("Failed to delete '%s' in dir '%s' with next error: %s",
 							dirName, backupDir, err)
@@ -316,23 +417,57 @@ func (wd *WebDav) getInfo(dstPath string) (os.FileInfo, error) {
 	return nil, fs.ErrNotExist
 }
 
-func (wd *WebDav) GetFileReader(ofsPath string) (io.Reader, error) {
+func (wd *WebDav) GetFileReader(ofsPath string) (io.ReadCloser, error) {
 	f, err := wd.client.Read(path.Join(wd.backupPath, ofsPath))
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = f.Close() }()
 
-	var buf []byte
-	buf, err = io.ReadAll(f)
+	return wd.cipher.DecryptReadCloser(f)
+}
+
+// PutLink makes the copy of the backup synced from another storage as the server side copy of the one already synced
+func (wd *WebDav) PutLink(logCh chan logger.LogRecord, jobName, _, _, ofsPath, targetOfsPath string) error {
+	dst := path.Join(wd.backupPath, ofsPath)
+	if err := wd.mkDir(path.Dir(dst)); err != nil {
+		logCh <- logger.Log(jobName, wd.name).Errorf("Unable to create remote directory '%s': '%s'", path.Dir(dst), err)
+		return err
+	}
+	if err := wd.client.Copy(path.Join(wd.backupPath, targetOfsPath), dst); err != nil {
+		logCh <- logger.Log(jobName, wd.name).Errorf("Unable to make copy: %s", err)
+		return err
+	}
+	logCh <- logger.Log(jobName, wd.name).Infof("Successfully copied file to %s", dst)
+
+	return nil
+}
+
+// PutFile uploads the file copied from another storage as is
+func (wd *WebDav) PutFile(logCh chan logger.LogRecord, jobName, _, _, ofsPath string, src io.Reader) error {
+	return wd.upload(logCh, jobName, files.GetLimitedReader(src, wd.rateLimit), path.Join(wd.backupPath, ofsPath))
+}
+
+func (wd *WebDav) DeleteFile(ofsPath string) error {
+	return wd.client.Rm(path.Join(wd.backupPath, ofsPath))
+}
+
+// DeleteDir removes the dir, WebDAV removes the collection with its content
+func (wd *WebDav) DeleteDir(ofsPath string) error {
+	return wd.client.Rm(path.Join(wd.backupPath, ofsPath))
+}
+
+func (wd *WebDav) ListBackups(ofsPath string) ([]string, error) {
+	paths, err := wd.listAll(ofsPath)
 	if err != nil {
 		return nil, err
 	}
 
-	return bytes.NewReader(buf), err
+	paths, _ = SplitPartFiles(paths, func(p string) string { return p })
+	return paths, nil
 }
 
-func (wd *WebDav) ListBackups(ofsPath string) ([]string, error) {
+// listAll returns all files under the path including incomplete uploads
+func (wd *WebDav) listAll(ofsPath string) ([]string, error) {
 	bPath := path.Join(wd.backupPath, ofsPath)
 
 	fl, err := wd.client.Ls(bPath)